@@ -1,8 +1,12 @@
 package api
 
 import (
+	"sync"
+
 	"github.com/EggsyOnCode/velho-exchange/api/handlers"
+	"github.com/EggsyOnCode/velho-exchange/auth"
 	"github.com/EggsyOnCode/velho-exchange/core"
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/labstack/echo"
 	"github.com/labstack/echo/middleware"
 )
@@ -10,6 +14,13 @@ import (
 type Server struct {
 	echo     *echo.Echo
 	exchange *core.Exchange
+	// checks signed requests, see auth.SignRequest
+	verifier *auth.Verifier
+	// request budgets of users and IPs, see ratelimit.go
+	limiter *rateLimiter
+	// addresses of the keys that can sign /admin requests
+	admins   map[common.Address]bool
+	adminsMu sync.RWMutex
 }
 
 func NewServer(exchange *core.Exchange) *Server {
@@ -19,12 +30,16 @@ func NewServer(exchange *core.Exchange) *Server {
 	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
 		AllowOrigins:     []string{"http://localhost:3001", "http://localhost:5173", "http://127.0.0.1:5173", "*"},
 		AllowMethods:     []string{echo.GET, echo.PUT, echo.POST, echo.DELETE},
-		AllowHeaders:     []string{echo.HeaderOrigin, echo.HeaderContentType, echo.HeaderAccept},
+		AllowHeaders:     []string{echo.HeaderOrigin, echo.HeaderContentType, echo.HeaderAccept, auth.HeaderSignature, auth.HeaderNonce, auth.HeaderTimestamp, auth.HeaderAPIKey},
+		ExposeHeaders:    []string{HeaderRateLimitLimit, HeaderRateLimitRemaining, HeaderRateLimitReset, HeaderRetryAfter},
 		AllowCredentials: true,
 	}))
 	server := &Server{
 		echo:     e,
 		exchange: exchange,
+		verifier: auth.NewVerifier(auth.DefaultSignatureWindow),
+		limiter:  newRateLimiter(DefaultRateLimits),
+		admins:   make(map[common.Address]bool),
 	}
 
 	server.registerRoutes()
@@ -32,42 +47,188 @@ func NewServer(exchange *core.Exchange) *Server {
 }
 
 func (s *Server) registerRoutes() {
+	// the routes acting for a user take them from the request's signature, an
+	// API key needs the route's scope
+	read := handlers.Authenticate(s.exchange, s.verifier, core.ScopeRead)
+	trade := handlers.Authenticate(s.exchange, s.verifier, core.ScopeTrade)
+	withdraw := handlers.Authenticate(s.exchange, s.verifier, core.ScopeWithdraw)
+	wallet := handlers.AuthenticateWallet(s.exchange, s.verifier)
+	// every /admin route has to be signed by an admin's key, see SetAdmins
+	admin := s.echo.Group("/admin", handlers.AuthenticateAdmin(s.verifier, s.isAdmin))
+	// budgets are counted once a request's user is known
+	orders := s.limit(RateOrders)
+	cancels := s.limit(RateCancels)
+	marketData := s.limit(RateMarketData)
+	registration := s.limit(RateRegistration)
+
 	s.echo.POST("/order", func(ctx echo.Context) error {
 		return handlers.HandlePlaceOrder(ctx, s.exchange)
-	})
+	}, trade, orders)
 	s.echo.GET("/orderbook", func(ctx echo.Context) error {
 		return handlers.HandleGetOrderBook(ctx, s.exchange)
-	})
+	}, marketData)
+	// WebSocket feed of trades, depth and tickers
+	s.echo.GET("/ws/marketdata", func(ctx echo.Context) error {
+		return handlers.HandleMarketData(ctx, s.exchange)
+	}, marketData)
 	s.echo.DELETE("/order", func(ctx echo.Context) error {
 		return handlers.HandleDeleteOrder(ctx, s.exchange)
-	})
+	}, trade, cancels)
+	s.echo.PUT("/order/:id", func(ctx echo.Context) error {
+		return handlers.HandleAmendOrder(ctx, s.exchange)
+	}, trade, orders)
 	s.echo.POST("/user", func(ctx echo.Context) error {
 		return handlers.HandleUserRegistration(ctx, s.exchange)
-	})
+	}, registration)
 
 	s.echo.GET("/user/:id", func(ctx echo.Context) error {
 		return handlers.HandleGetUser(ctx, s.exchange)
-	})
+	}, read, handlers.RequireSelf)
+
+	// only the user's own key can hand out API keys
+	s.echo.POST("/user/:id/api-keys", func(ctx echo.Context) error {
+		return handlers.HandleCreateAPIKey(ctx, s.exchange)
+	}, wallet, handlers.RequireSelf)
+
+	s.echo.GET("/user/:id/api-keys", func(ctx echo.Context) error {
+		return handlers.HandleGetAPIKeys(ctx, s.exchange)
+	}, wallet, handlers.RequireSelf)
+
+	s.echo.DELETE("/user/:id/api-keys/:key", func(ctx echo.Context) error {
+		return handlers.HandleRevokeAPIKey(ctx, s.exchange)
+	}, wallet, handlers.RequireSelf)
+
+	s.echo.GET("/user/:id/trades", func(ctx echo.Context) error {
+		return handlers.HandleGetUserTrades(ctx, s.exchange)
+	}, read, handlers.RequireSelf)
 
 	s.echo.GET("/book/bid", func(ctx echo.Context) error {
 		return handlers.HandleGetBestBidPrice(ctx, s.exchange)
-	})
+	}, marketData)
 
 	s.echo.GET("/book/ask", func(ctx echo.Context) error {
 		return handlers.HandleGetBestAskPrice(ctx, s.exchange)
-	})
+	}, marketData)
 
 	s.echo.GET("/order", func(ctx echo.Context) error {
 		return handlers.HandleGetOrders(ctx, s.exchange)
-	})
+	}, read)
 
 	s.echo.GET("/trade", func(ctx echo.Context) error {
 		return handlers.HandleGetTrades(ctx, s.exchange)
-	})
+	}, marketData)
 
 	s.echo.GET("/marketPrice/:id", func(ctx echo.Context) error {
 		return handlers.HandleGetMarketPrice(ctx, s.exchange)
+	}, marketData)
+
+	s.echo.GET("/markets", func(ctx echo.Context) error {
+		return handlers.HandleGetMarkets(ctx, s.exchange)
+	}, marketData)
+
+	// market administration
+	admin.POST("/markets", func(ctx echo.Context) error {
+		return handlers.HandleCreateMarket(ctx, s.exchange)
+	})
+
+	admin.PUT("/markets/:market/status", func(ctx echo.Context) error {
+		return handlers.HandleSetMarketStatus(ctx, s.exchange)
+	})
+
+	admin.PUT("/markets/:market/fees", func(ctx echo.Context) error {
+		return handlers.HandleSetFeeSchedule(ctx, s.exchange)
+	})
+
+	admin.PUT("/markets/:market/risk", func(ctx echo.Context) error {
+		return handlers.HandleSetRiskLimits(ctx, s.exchange)
+	})
+
+	admin.GET("/fees", func(ctx echo.Context) error {
+		return handlers.HandleGetFeeRevenue(ctx, s.exchange)
+	})
+
+	admin.PUT("/limits/open-orders", func(ctx echo.Context) error {
+		return handlers.HandleSetMaxOpenOrders(ctx, s.exchange)
+	})
+
+	admin.GET("/ledger/check", func(ctx echo.Context) error {
+		return handlers.HandleCheckLedger(ctx, s.exchange)
+	})
+
+	admin.GET("/snapshot/verify", func(ctx echo.Context) error {
+		return handlers.HandleVerifySnapshot(ctx, s.exchange)
+	})
+
+	s.echo.GET("/user/:id/deposit-address", func(ctx echo.Context) error {
+		return handlers.HandleGetDepositAddress(ctx, s.exchange)
+	}, read, handlers.RequireSelf)
+
+	s.echo.GET("/deposits", func(ctx echo.Context) error {
+		return handlers.HandleGetDeposits(ctx, s.exchange)
+	}, read)
+
+	s.echo.POST("/withdrawals", func(ctx echo.Context) error {
+		return handlers.HandleRequestWithdrawal(ctx, s.exchange)
+	}, withdraw)
+
+	s.echo.GET("/withdrawals", func(ctx echo.Context) error {
+		return handlers.HandleGetWithdrawals(ctx, s.exchange)
+	}, read)
+
+	// everyone's deposits, withdrawals and transfers, or those of ?user=
+	admin.GET("/deposits", func(ctx echo.Context) error {
+		return handlers.HandleGetDeposits(ctx, s.exchange)
+	})
+
+	// credits a deposit that didn't come from a watched chain
+	admin.POST("/deposits", func(ctx echo.Context) error {
+		return handlers.HandleCreditDeposit(ctx, s.exchange)
+	})
+
+	admin.GET("/withdrawals", func(ctx echo.Context) error {
+		return handlers.HandleGetWithdrawals(ctx, s.exchange)
+	})
+
+	admin.GET("/settlement/transfers", func(ctx echo.Context) error {
+		return handlers.HandleGetTransfers(ctx, s.exchange)
+	})
+
+	admin.POST("/withdrawals/:id/approve", func(ctx echo.Context) error {
+		return handlers.HandleApproveWithdrawal(ctx, s.exchange)
+	})
+
+	admin.POST("/withdrawals/:id/reject", func(ctx echo.Context) error {
+		return handlers.HandleRejectWithdrawal(ctx, s.exchange)
+	})
+
+	admin.PUT("/withdrawals/limits/:asset", func(ctx echo.Context) error {
+		return handlers.HandleSetWithdrawalLimits(ctx, s.exchange)
 	})
+
+	s.echo.GET("/settlement/transfers", func(ctx echo.Context) error {
+		return handlers.HandleGetTransfers(ctx, s.exchange)
+	}, read)
+
+	s.echo.GET("/settlement/transfers/:id", func(ctx echo.Context) error {
+		return handlers.HandleGetTransfer(ctx, s.exchange)
+	}, read)
+}
+
+// SetAdmins replaces the addresses whose keys can sign /admin requests, without
+// any every admin request is refused
+func (s *Server) SetAdmins(addresses ...common.Address) {
+	s.adminsMu.Lock()
+	defer s.adminsMu.Unlock()
+	s.admins = make(map[common.Address]bool, len(addresses))
+	for _, address := range addresses {
+		s.admins[address] = true
+	}
+}
+
+func (s *Server) isAdmin(address common.Address) bool {
+	s.adminsMu.RLock()
+	defer s.adminsMu.RUnlock()
+	return s.admins[address]
 }
 
 func (s *Server) Start(addr string) {
@@ -0,0 +1,60 @@
+package api
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/EggsyOnCode/velho-exchange/auth"
+	"github.com/EggsyOnCode/velho-exchange/core"
+	"github.com/EggsyOnCode/velho-exchange/decimal"
+	"github.com/EggsyOnCode/velho-exchange/internals"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdminRoutesNeedAnAdminsSignature(t *testing.T) {
+	ex := core.NewExchange()
+	user := auth.NewUser(internals.GenerateNewPrivateKey(), decimal.FromInt(1_000))
+	require.NoError(t, ex.AddUser(user))
+	server := NewServer(ex)
+	adminKey := internals.GenerateNewPrivateKey()
+
+	nonce := 0
+	send := func(method, path string, body []byte, signer func(r *http.Request)) int {
+		r := httptest.NewRequest(method, path, bytes.NewReader(body))
+		if signer != nil {
+			signer(r)
+		}
+		w := httptest.NewRecorder()
+		server.echo.ServeHTTP(w, r)
+		return w.Code
+	}
+	signedBy := func(key *ecdsa.PrivateKey) func(r *http.Request) {
+		return func(r *http.Request) {
+			nonce++
+			require.NoError(t, auth.SignRequest(r, key, strconv.Itoa(nonce)))
+		}
+	}
+
+	// nobody is an admin until they're set
+	assert.Equal(t, http.StatusUnauthorized, send(http.MethodGet, "/admin/ledger/check", nil, nil))
+	assert.Equal(t, http.StatusForbidden, send(http.MethodGet, "/admin/ledger/check", nil, signedBy(adminKey)))
+
+	server.SetAdmins(internals.GetAddress(adminKey))
+	assert.Equal(t, http.StatusOK, send(http.MethodGet, "/admin/ledger/check", nil, signedBy(adminKey)))
+	assert.Equal(t, http.StatusNotFound, send(http.MethodPost, "/admin/withdrawals/99/approve", []byte(`{}`), signedBy(adminKey)))
+
+	// a user's own key doesn't do, neither does an API key
+	assert.Equal(t, http.StatusForbidden, send(http.MethodPost, "/admin/withdrawals/99/approve", []byte(`{}`), signedBy(user.PrivateKey)))
+	assert.Equal(t, http.StatusUnauthorized, send(http.MethodPut, "/admin/markets/ETH/status", []byte(`{"status":"HALTED"}`), nil))
+	key, secret, err := ex.CreateAPIKey(user.ID.String(), core.APIKey{Scopes: []core.APIScope{core.ScopeRead}})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, send(http.MethodGet, "/admin/fees", nil, func(r *http.Request) {
+		require.NoError(t, auth.SignRequestWithAPIKey(r, key.ID, secret, "api-key"))
+	}))
+	assert.Equal(t, core.MarketOpen, ex.OrderBook[core.ETH].Spec.Status)
+}
@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/EggsyOnCode/velho-exchange/core"
+	"github.com/labstack/echo"
+)
+
+type CreateAPIKeyRequest struct {
+	Label  string          `json:"label"`
+	Scopes []core.APIScope `json:"scopes"`
+	// IPs and CIDR ranges the key can be used from, any when it's empty
+	AllowedIPs []string `json:"allowed_ips"`
+	// unix nanos, zero for a key that doesn't expire
+	ExpiresAt int64 `json:"expires_at"`
+}
+
+// creates an API key for the user, the response is the only time its secret is given out
+func HandleCreateAPIKey(ctx echo.Context, e *core.Exchange) error {
+	userId := AuthenticatedUser(ctx)
+
+	var req CreateAPIKeyRequest
+	if err := json.NewDecoder(ctx.Request().Body).Decode(&req); err != nil {
+		return ctx.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request payload"})
+	}
+
+	key, secret, err := e.CreateAPIKey(userId, core.APIKey{
+		Label:      req.Label,
+		Scopes:     req.Scopes,
+		AllowedIPs: req.AllowedIPs,
+		ExpiresAt:  req.ExpiresAt,
+	})
+	if err != nil {
+		return ctx.JSON(http.StatusBadRequest, map[string]string{"status": "false", "error": err.Error()})
+	}
+
+	return ctx.JSON(http.StatusOK, map[string]any{"status": "success", "key": key, "secret": secret})
+}
+
+// lists the user's API keys, without their secrets
+func HandleGetAPIKeys(ctx echo.Context, e *core.Exchange) error {
+	return ctx.JSON(http.StatusOK, map[string]any{"status": "success", "keys": e.APIKeys(AuthenticatedUser(ctx))})
+}
+
+func HandleRevokeAPIKey(ctx echo.Context, e *core.Exchange) error {
+	err := e.RevokeAPIKey(AuthenticatedUser(ctx), ctx.Param("key"))
+	if errors.Is(err, core.ErrAPIKeyNotFound) {
+		return ctx.JSON(http.StatusNotFound, map[string]string{"status": "false", "error": err.Error()})
+	} else if err != nil {
+		return ctx.JSON(http.StatusInternalServerError, map[string]string{"status": "false", "error": err.Error()})
+	}
+
+	return ctx.JSON(http.StatusOK, map[string]string{"status": "success"})
+}
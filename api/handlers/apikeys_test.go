@@ -0,0 +1,116 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/EggsyOnCode/velho-exchange/auth"
+	"github.com/EggsyOnCode/velho-exchange/core"
+	"github.com/EggsyOnCode/velho-exchange/decimal"
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAPIKeyRoutes(t *testing.T) {
+	e := core.NewExchange()
+	user := auth.NewUser(nil, decimal.FromInt(100_000))
+	require.NoError(t, e.AddUser(user))
+	userId := user.ID.String()
+
+	v := auth.NewVerifier(auth.DefaultSignatureWindow)
+	router := echo.New()
+	wallet := AuthenticateWallet(e, v)
+	router.POST("/user/:id/api-keys", func(ctx echo.Context) error { return HandleCreateAPIKey(ctx, e) }, wallet, RequireSelf)
+	router.GET("/user/:id/api-keys", func(ctx echo.Context) error { return HandleGetAPIKeys(ctx, e) }, wallet, RequireSelf)
+	router.DELETE("/user/:id/api-keys/:key", func(ctx echo.Context) error { return HandleRevokeAPIKey(ctx, e) }, wallet, RequireSelf)
+	router.GET("/deposits", func(ctx echo.Context) error { return HandleGetDeposits(ctx, e) }, Authenticate(e, v, core.ScopeRead))
+	router.POST("/order", func(ctx echo.Context) error { return HandlePlaceOrder(ctx, e) }, Authenticate(e, v, core.ScopeTrade))
+
+	nonce := 0
+	send := func(r *http.Request, sign func(r *http.Request, nonce string) error) *httptest.ResponseRecorder {
+		nonce++
+		require.NoError(t, sign(r, string(rune('a'+nonce))))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+	byWallet := func(r *http.Request, nonce string) error { return auth.SignRequest(r, user.PrivateKey, nonce) }
+	createKey := func(req CreateAPIKeyRequest) (core.APIKey, string) {
+		r := httptest.NewRequest(http.MethodPost, "/user/"+userId+"/api-keys", bytes.NewReader(toJson(req)))
+		r.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		w := send(r, byWallet)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var res struct {
+			Key    core.APIKey `json:"key"`
+			Secret string      `json:"secret"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+		return res.Key, res.Secret
+	}
+	byKey := func(key core.APIKey, secret string) func(r *http.Request, nonce string) error {
+		return func(r *http.Request, nonce string) error { return auth.SignRequestWithAPIKey(r, key.ID, secret, nonce) }
+	}
+	placeOrder := func() *http.Request {
+		body := toJson(PlaceOrderRequest{OrderType: LimitOrder, Price: decimal.FromInt(10_000), Size: decimal.FromInt(1), Bid: true, Market: core.BTC})
+		r := httptest.NewRequest(http.MethodPost, "/order", bytes.NewReader(body))
+		r.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		return r
+	}
+
+	readKey, readSecret := createKey(CreateAPIKeyRequest{Label: "reader", Scopes: []core.APIScope{core.ScopeRead}})
+	assert.Equal(t, userId, readKey.UserID)
+	assert.NotEmpty(t, readSecret)
+
+	// a key only gets through the routes of its scopes
+	assert.Equal(t, http.StatusOK, send(httptest.NewRequest(http.MethodGet, "/deposits", nil), byKey(readKey, readSecret)).Code)
+	w := send(placeOrder(), byKey(readKey, readSecret))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), ErrCodeForbidden)
+	assert.Equal(t, http.StatusUnauthorized, send(httptest.NewRequest(http.MethodGet, "/deposits", nil), byKey(readKey, "not the secret")).Code)
+
+	// what the exchange stores of the secret doesn't sign for it, nor does its hash
+	stored := e.Snapshot().APIKeys[0]
+	require.Equal(t, readKey.ID, stored.ID)
+	assert.Equal(t, http.StatusUnauthorized, send(httptest.NewRequest(http.MethodGet, "/deposits", nil), byKey(readKey, stored.Secret.CipherText)).Code)
+	hash := sha256.Sum256([]byte(readSecret))
+	assert.Equal(t, http.StatusUnauthorized, send(httptest.NewRequest(http.MethodGet, "/deposits", nil), byKey(readKey, string(hash[:]))).Code)
+	assert.Equal(t, http.StatusUnauthorized, send(httptest.NewRequest(http.MethodGet, "/deposits", nil), byKey(readKey, hex.EncodeToString(hash[:]))).Code)
+
+	// and can't manage keys
+	assert.Equal(t, http.StatusForbidden, send(httptest.NewRequest(http.MethodGet, "/user/"+userId+"/api-keys", nil), byKey(readKey, readSecret)).Code)
+
+	tradeKey, tradeSecret := createKey(CreateAPIKeyRequest{Scopes: []core.APIScope{core.ScopeTrade}})
+	assert.Equal(t, http.StatusOK, send(placeOrder(), byKey(tradeKey, tradeSecret)).Code)
+	orders, _ := e.GetOrders(userId)
+	assert.Len(t, orders, 1)
+
+	// httptest requests come from 192.0.2.1
+	pinned, pinnedSecret := createKey(CreateAPIKeyRequest{Scopes: []core.APIScope{core.ScopeRead}, AllowedIPs: []string{"10.0.0.0/8"}})
+	assert.Equal(t, http.StatusForbidden, send(httptest.NewRequest(http.MethodGet, "/deposits", nil), byKey(pinned, pinnedSecret)).Code)
+	local, localSecret := createKey(CreateAPIKeyRequest{Scopes: []core.APIScope{core.ScopeRead}, AllowedIPs: []string{"192.0.2.0/24"}})
+	assert.Equal(t, http.StatusOK, send(httptest.NewRequest(http.MethodGet, "/deposits", nil), byKey(local, localSecret)).Code)
+
+	r := httptest.NewRequest(http.MethodPost, "/user/"+userId+"/api-keys", bytes.NewReader(toJson(CreateAPIKeyRequest{Scopes: []core.APIScope{"admin"}})))
+	r.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	assert.Equal(t, http.StatusBadRequest, send(r, byWallet).Code)
+
+	w = send(httptest.NewRequest(http.MethodGet, "/user/"+userId+"/api-keys", nil), byWallet)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), readSecret)
+	var listed struct {
+		Keys []core.APIKey `json:"keys"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &listed))
+	assert.Len(t, listed.Keys, 4)
+
+	// a revoked key is refused
+	assert.Equal(t, http.StatusOK, send(httptest.NewRequest(http.MethodDelete, "/user/"+userId+"/api-keys/"+readKey.ID, nil), byWallet).Code)
+	assert.Equal(t, http.StatusNotFound, send(httptest.NewRequest(http.MethodDelete, "/user/"+userId+"/api-keys/"+readKey.ID, nil), byWallet).Code)
+	assert.Equal(t, http.StatusUnauthorized, send(httptest.NewRequest(http.MethodGet, "/deposits", nil), byKey(readKey, readSecret)).Code)
+}
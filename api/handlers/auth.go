@@ -0,0 +1,161 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/EggsyOnCode/velho-exchange/auth"
+	"github.com/EggsyOnCode/velho-exchange/core"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/labstack/echo"
+)
+
+// where Authenticate keeps the ID of the user who signed the request, and of the
+// API key it was signed with
+const (
+	userContextKey   = "user"
+	apiKeyContextKey = "api_key"
+)
+
+// Authenticate lets a request through only if it's signed by a registered user,
+// who the handlers then act for. It can be signed with the user's key (see
+// auth.SignRequest), which can do anything, or with one of their API keys (see
+// auth.SignRequestWithAPIKey) that has scope, hasn't expired and allows the IP
+// the request comes from.
+func Authenticate(e *core.Exchange, v *auth.Verifier, scope core.APIScope) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) error {
+			r := ctx.Request()
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				return ctx.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request payload"})
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+
+			if keyID := r.Header.Get(auth.HeaderAPIKey); keyID != "" {
+				return authenticateAPIKey(ctx, e, v, scope, keyID, body, next)
+			}
+
+			address, err := v.Verify(r, body)
+			if err != nil {
+				return ctx.JSON(http.StatusUnauthorized, map[string]string{"status": "false", "error": err.Error(), "code": ErrCodeUnauthorized})
+			}
+			userId, ok := e.UserByAddress(address)
+			if !ok {
+				return ctx.JSON(http.StatusUnauthorized, map[string]string{"status": "false", "error": "no user is registered with the signing key", "code": ErrCodeUnauthorized})
+			}
+
+			setAuthenticatedUser(ctx, userId)
+			return next(ctx)
+		}
+	}
+}
+
+// AuthenticateWallet is Authenticate for the routes only the user's own key can
+// sign for, like managing their API keys
+func AuthenticateWallet(e *core.Exchange, v *auth.Verifier) echo.MiddlewareFunc {
+	return Authenticate(e, v, "")
+}
+
+// AuthenticateAdmin lets a request through only if it's signed with the user's
+// key scheme (see auth.SignRequest) by a key isAdmin accepts. API keys can't be
+// used. Admin requests don't act for a user, so none is set.
+func AuthenticateAdmin(v *auth.Verifier, isAdmin func(common.Address) bool) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) error {
+			r := ctx.Request()
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				return ctx.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request payload"})
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+
+			if r.Header.Get(auth.HeaderAPIKey) != "" {
+				return ctx.JSON(http.StatusForbidden, map[string]string{"status": "false", "error": "API keys can't be used here, sign with an admin key", "code": ErrCodeForbidden})
+			}
+			address, err := v.Verify(r, body)
+			if err != nil {
+				return ctx.JSON(http.StatusUnauthorized, map[string]string{"status": "false", "error": err.Error(), "code": ErrCodeUnauthorized})
+			}
+			if !isAdmin(address) {
+				return ctx.JSON(http.StatusForbidden, map[string]string{"status": "false", "error": "the signing key isn't an admin's", "code": ErrCodeForbidden})
+			}
+
+			return next(ctx)
+		}
+	}
+}
+
+// an empty scope refuses API keys
+func authenticateAPIKey(ctx echo.Context, e *core.Exchange, v *auth.Verifier, scope core.APIScope, keyID string, body []byte, next echo.HandlerFunc) error {
+	key, secretHash, ok := e.LookupAPIKey(keyID)
+	if !ok {
+		return ctx.JSON(http.StatusUnauthorized, map[string]string{"status": "false", "error": core.ErrAPIKeyNotFound.Error(), "code": ErrCodeUnauthorized})
+	}
+	if err := v.VerifyAPIKey(ctx.Request(), body, secretHash); err != nil {
+		return ctx.JSON(http.StatusUnauthorized, map[string]string{"status": "false", "error": err.Error(), "code": ErrCodeUnauthorized})
+	}
+	if key.Expired(time.Now()) {
+		return ctx.JSON(http.StatusUnauthorized, map[string]string{"status": "false", "error": "API key has expired", "code": ErrCodeUnauthorized})
+	}
+
+	if scope == "" {
+		return ctx.JSON(http.StatusForbidden, map[string]string{"status": "false", "error": "API keys can't be used here, sign with the user's key", "code": ErrCodeForbidden})
+	}
+	if !key.HasScope(scope) {
+		return ctx.JSON(http.StatusForbidden, map[string]string{"status": "false", "error": fmt.Sprintf("API key lacks the %s scope", scope), "code": ErrCodeForbidden})
+	}
+	host := ClientIP(ctx)
+	if !key.AllowsIP(net.ParseIP(host)) {
+		return ctx.JSON(http.StatusForbidden, map[string]string{"status": "false", "error": fmt.Sprintf("API key can't be used from %s", host), "code": ErrCodeForbidden})
+	}
+
+	setAuthenticatedUser(ctx, key.UserID)
+	ctx.Set(apiKeyContextKey, key.ID)
+	return next(ctx)
+}
+
+// RequireSelf only lets a request for the user in the :id path parameter through
+// if it's that user who signed it
+func RequireSelf(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		if ctx.Param("id") != AuthenticatedUser(ctx) {
+			return ctx.JSON(http.StatusForbidden, map[string]string{"status": "false", "error": "requests can only be made for the signing user", "code": ErrCodeForbidden})
+		}
+		return next(ctx)
+	}
+}
+
+// ClientIP is the address of the connection the request came over, forwarding
+// headers aren't trusted since anyone can set them
+func ClientIP(ctx echo.Context) string {
+	host, _, err := net.SplitHostPort(ctx.Request().RemoteAddr)
+	if err != nil {
+		return ctx.Request().RemoteAddr
+	}
+	return host
+}
+
+// AuthenticatedUser is the ID of the user who signed the request, empty on routes
+// that aren't authenticated
+func AuthenticatedUser(ctx echo.Context) string {
+	userId, _ := ctx.Get(userContextKey).(string)
+	return userId
+}
+
+func setAuthenticatedUser(ctx echo.Context, userId string) {
+	ctx.Set(userContextKey, userId)
+}
+
+// the user a listing is for: the signing user on authenticated routes, the
+// optional ?user= filter on the admin ones
+func listedUser(ctx echo.Context) string {
+	if userId := AuthenticatedUser(ctx); userId != "" {
+		return userId
+	}
+	return ctx.QueryParam("user")
+}
@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/EggsyOnCode/velho-exchange/auth"
+	"github.com/EggsyOnCode/velho-exchange/core"
+	"github.com/EggsyOnCode/velho-exchange/decimal"
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// a context of a request signed by userId, past Authenticate
+func asUser(r *http.Request, w http.ResponseWriter, userId string) echo.Context {
+	ctx := echo.New().NewContext(r, w)
+	setAuthenticatedUser(ctx, userId)
+	return ctx
+}
+
+func TestAuthenticatedRoutes(t *testing.T) {
+	e := core.NewExchange()
+	owner := auth.NewUser(nil, decimal.FromInt(100_000))
+	other := auth.NewUser(nil, decimal.FromInt(100_000))
+	require.NoError(t, e.AddUser(owner))
+	require.NoError(t, e.AddUser(other))
+
+	router := echo.New()
+	signed := Authenticate(e, auth.NewVerifier(auth.DefaultSignatureWindow), core.ScopeTrade)
+	router.POST("/order", func(ctx echo.Context) error { return HandlePlaceOrder(ctx, e) }, signed)
+	router.DELETE("/order", func(ctx echo.Context) error { return HandleDeleteOrder(ctx, e) }, signed)
+	router.GET("/user/:id", func(ctx echo.Context) error { return HandleGetUser(ctx, e) }, signed, RequireSelf)
+
+	send := func(r *http.Request, signer *auth.User, nonce string) *httptest.ResponseRecorder {
+		if signer != nil {
+			require.NoError(t, auth.SignRequest(r, signer.PrivateKey, nonce))
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+	placeOrder := func() *http.Request {
+		body := toJson(PlaceOrderRequest{OrderType: LimitOrder, Price: decimal.FromInt(10_000), Size: decimal.FromInt(1), Bid: true, Market: core.BTC})
+		r := httptest.NewRequest(http.MethodPost, "/order", bytes.NewReader(body))
+		r.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		return r
+	}
+
+	w := send(placeOrder(), nil, "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Body.String(), ErrCodeUnauthorized)
+
+	// the order is the signer's
+	w = send(placeOrder(), owner, "1")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	orders, _ := e.GetOrders(owner.ID.String())
+	require.Len(t, orders, 1)
+
+	// a nonce can't be used twice
+	assert.Equal(t, http.StatusUnauthorized, send(placeOrder(), owner, "1").Code)
+
+	// a key that isn't registered
+	stranger := auth.NewUser(nil, decimal.Zero)
+	assert.Equal(t, http.StatusUnauthorized, send(placeOrder(), stranger, "1").Code)
+
+	// a body that isn't the one signed
+	r := placeOrder()
+	require.NoError(t, auth.SignRequest(r, owner.PrivateKey, "2"))
+	r.Body = io.NopCloser(bytes.NewReader(toJson(PlaceOrderRequest{OrderType: LimitOrder, Price: decimal.FromInt(10_000), Size: decimal.FromInt(5), Bid: true, Market: core.BTC})))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// only the order's user can cancel it
+	cancel := func() *http.Request {
+		return httptest.NewRequest(http.MethodDelete, "/order?id="+orders[0].ID+"&market=BTC", nil)
+	}
+	assert.Equal(t, http.StatusNotFound, send(cancel(), other, "1").Code)
+	assert.Equal(t, http.StatusOK, send(cancel(), owner, "3").Code)
+
+	assert.Equal(t, http.StatusForbidden, send(httptest.NewRequest(http.MethodGet, "/user/"+owner.ID.String(), nil), other, "2").Code)
+	assert.Equal(t, http.StatusOK, send(httptest.NewRequest(http.MethodGet, "/user/"+owner.ID.String(), nil), owner, "4").Code)
+}
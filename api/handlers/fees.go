@@ -0,0 +1,44 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/EggsyOnCode/velho-exchange/core"
+	"github.com/EggsyOnCode/velho-exchange/ledger"
+	"github.com/labstack/echo"
+)
+
+// the user's fills with the fees they paid, oldest first
+func HandleGetUserTrades(ctx echo.Context, e *core.Exchange) error {
+	userId := ctx.Param("id")
+	if _, ok := e.User(userId); !ok {
+		return ctx.JSON(http.StatusNotFound, map[string]string{"status": "false", "error": "user not found"})
+	}
+
+	return ctx.JSON(http.StatusOK, map[string]any{"status": "success", "trades": e.UserTrades(userId)})
+}
+
+// replaces a market's fee tiers, the body is the list of tiers
+func HandleSetFeeSchedule(ctx echo.Context, e *core.Exchange) error {
+	var schedule core.FeeSchedule
+	if err := json.NewDecoder(ctx.Request().Body).Decode(&schedule); err != nil {
+		return ctx.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request payload"})
+	}
+
+	market := core.Market(ctx.Param("market"))
+	err := e.SetFeeSchedule(market, schedule)
+	if errors.Is(err, core.ErrMarketNotFound) {
+		return ctx.JSON(http.StatusNotFound, map[string]string{"status": "false", "error": err.Error()})
+	} else if err != nil {
+		return ctx.JSON(http.StatusBadRequest, map[string]string{"status": "false", "error": err.Error()})
+	}
+
+	return ctx.JSON(http.StatusOK, map[string]any{"status": "success", "market": market, "fees": schedule})
+}
+
+// what the fee account holds of every asset, net of rebates
+func HandleGetFeeRevenue(ctx echo.Context, e *core.Exchange) error {
+	return ctx.JSON(http.StatusOK, map[string]any{"status": "success", "balances": e.Ledger.Balances(ledger.Fees)})
+}
@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/EggsyOnCode/velho-exchange/auth"
+	"github.com/EggsyOnCode/velho-exchange/core"
+	"github.com/EggsyOnCode/velho-exchange/decimal"
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleFeeScheduleAndUserTrades(t *testing.T) {
+	e := core.NewExchange()
+	seller := auth.NewUser(nil, decimal.Zero)
+	buyer := auth.NewUser(nil, decimal.FromInt(10_000))
+	e.AddUser(seller)
+	e.AddUser(buyer)
+	require.NoError(t, e.Ledger.Deposit(seller.ID.String(), core.AssetETH, decimal.FromInt(1), "deposit"))
+
+	setFees := func(market string, schedule core.FeeSchedule) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPut, "/admin/markets/"+market+"/fees", bytes.NewReader(toJson(schedule)))
+		ctx := echo.New().NewContext(r, w)
+		ctx.SetPath("/admin/markets/:market/fees")
+		ctx.SetParamNames("market")
+		ctx.SetParamValues(market)
+		require.NoError(t, HandleSetFeeSchedule(ctx, e))
+		return w.Code
+	}
+	assert.Equal(t, http.StatusOK, setFees("ETH", core.DefaultFeeSchedule))
+	assert.Equal(t, http.StatusNotFound, setFees("DOGE", core.DefaultFeeSchedule))
+	assert.Equal(t, http.StatusBadRequest, setFees("ETH", core.FeeSchedule{{MinVolume: decimal.FromInt(1)}}))
+
+	ob := e.OrderBook[core.ETH]
+	ob.PlaceLimitOrder(decimal.FromInt(1_000), core.NewOrder(decimal.FromInt(1), false, decimal.FromInt(1_000), seller.ID.String()))
+	ob.PlaceLimitOrder(decimal.FromInt(1_000), core.NewOrder(decimal.FromInt(1), true, decimal.FromInt(1_000), buyer.ID.String()))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/user/"+seller.ID.String()+"/trades", nil)
+	ctx := echo.New().NewContext(r, w)
+	ctx.SetPath("/user/:id/trades")
+	ctx.SetParamNames("id")
+	ctx.SetParamValues(seller.ID.String())
+	require.NoError(t, HandleGetUserTrades(ctx, e))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var resp struct {
+		Trades []core.UserTrade `json:"trades"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Len(t, resp.Trades, 1)
+	assert.True(t, resp.Trades[0].Maker)
+	assert.Equal(t, decimal.FromInt(1), resp.Trades[0].Fee)
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/admin/fees", nil)
+	require.NoError(t, HandleGetFeeRevenue(echo.New().NewContext(r, w), e))
+	assert.Contains(t, w.Body.String(), `"USD":{"available":"1"`)
+}
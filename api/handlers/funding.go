@@ -0,0 +1,150 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/EggsyOnCode/velho-exchange/core"
+	"github.com/EggsyOnCode/velho-exchange/decimal"
+	"github.com/labstack/echo"
+)
+
+// address is optional, withdrawals go to the user's own wallet without it
+type WithdrawalRequest struct {
+	Asset   core.Asset      `json:"asset"`
+	Amount  decimal.Decimal `json:"amount"`
+	Address string          `json:"address,omitempty"`
+}
+
+// a deposit credited by an admin, tx_id identifies it so it's only credited once
+type CreditDepositRequest struct {
+	UserID string          `json:"user_id"`
+	Asset  core.Asset      `json:"asset"`
+	Amount decimal.Decimal `json:"amount"`
+	TxID   string          `json:"tx_id"`
+}
+
+type RejectWithdrawalRequest struct {
+	Reason string `json:"reason"`
+}
+
+func HandleGetDepositAddress(ctx echo.Context, e *core.Exchange) error {
+	address, err := e.DepositAddress(ctx.Param("id"))
+	if err != nil {
+		return ctx.JSON(http.StatusNotFound, map[string]string{"status": "false", "error": err.Error()})
+	}
+
+	return ctx.JSON(http.StatusOK, map[string]any{"status": "success", "address": address})
+}
+
+// lists the signing user's deposits, or on the admin route those of ?user= or
+// everyone's, oldest first
+func HandleGetDeposits(ctx echo.Context, e *core.Exchange) error {
+	userId := listedUser(ctx)
+
+	return ctx.JSON(http.StatusOK, map[string]any{"status": "success", "deposits": e.Deposits(userId)})
+}
+
+func HandleCreditDeposit(ctx echo.Context, e *core.Exchange) error {
+	var req CreditDepositRequest
+	if err := json.NewDecoder(ctx.Request().Body).Decode(&req); err != nil {
+		return ctx.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request payload"})
+	}
+	if req.TxID == "" {
+		return ctx.JSON(http.StatusBadRequest, map[string]string{"status": "false", "error": "tx_id is required"})
+	}
+
+	if err := e.CreditDeposit(req.UserID, req.Asset, req.Amount, req.TxID); err != nil {
+		return ctx.JSON(http.StatusBadRequest, map[string]string{"status": "false", "error": err.Error()})
+	}
+
+	for _, d := range e.Deposits(req.UserID) {
+		if d.Asset == req.Asset && d.TxID == req.TxID {
+			return ctx.JSON(http.StatusOK, map[string]any{"status": "success", "deposit": d})
+		}
+	}
+	return ctx.JSON(http.StatusOK, map[string]any{"status": "success"})
+}
+
+func HandleRequestWithdrawal(ctx echo.Context, e *core.Exchange) error {
+	userId := AuthenticatedUser(ctx)
+
+	var req WithdrawalRequest
+	if err := json.NewDecoder(ctx.Request().Body).Decode(&req); err != nil {
+		return ctx.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request payload"})
+	}
+
+	w, err := e.RequestWithdrawal(userId, req.Asset, req.Amount, req.Address)
+	if errors.Is(err, core.ErrInsufficientFunds) {
+		return ctx.JSON(http.StatusConflict, map[string]string{"status": "false", "error": err.Error(), "code": ErrCodeInsufficientFunds})
+	} else if errors.Is(err, core.ErrWithdrawalLimit) {
+		return ctx.JSON(http.StatusConflict, map[string]string{"status": "false", "error": err.Error(), "code": ErrCodeWithdrawalLimit})
+	} else if errors.Is(err, core.ErrAccountFrozen) {
+		return ctx.JSON(http.StatusForbidden, map[string]string{"status": "false", "error": err.Error(), "code": ErrCodeAccountFrozen})
+	} else if err != nil {
+		return ctx.JSON(http.StatusBadRequest, map[string]string{"status": "false", "error": err.Error()})
+	}
+
+	return ctx.JSON(http.StatusOK, map[string]any{"status": "success", "withdrawal": w})
+}
+
+// lists the signing user's withdrawals, or on the admin route those of ?user= or
+// everyone's, with ?status=, or any, oldest first
+func HandleGetWithdrawals(ctx echo.Context, e *core.Exchange) error {
+	userId := listedUser(ctx)
+	status := core.WithdrawalStatus(ctx.QueryParam("status"))
+
+	return ctx.JSON(http.StatusOK, map[string]any{"status": "success", "withdrawals": e.Withdrawals(userId, status)})
+}
+
+func HandleApproveWithdrawal(ctx echo.Context, e *core.Exchange) error {
+	id, err := strconv.ParseUint(ctx.Param("id"), 10, 64)
+	if err != nil {
+		return ctx.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid withdrawal ID"})
+	}
+
+	w, err := e.ApproveWithdrawal(id)
+	return withdrawalDecision(ctx, w, err)
+}
+
+func HandleRejectWithdrawal(ctx echo.Context, e *core.Exchange) error {
+	id, err := strconv.ParseUint(ctx.Param("id"), 10, 64)
+	if err != nil {
+		return ctx.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid withdrawal ID"})
+	}
+
+	// the reason is optional
+	var req RejectWithdrawalRequest
+	json.NewDecoder(ctx.Request().Body).Decode(&req)
+
+	w, err := e.RejectWithdrawal(id, req.Reason)
+	return withdrawalDecision(ctx, w, err)
+}
+
+func withdrawalDecision(ctx echo.Context, w core.Withdrawal, err error) error {
+	if errors.Is(err, core.ErrWithdrawalNotFound) {
+		return ctx.JSON(http.StatusNotFound, map[string]string{"status": "false", "error": err.Error()})
+	} else if errors.Is(err, core.ErrWithdrawalState) {
+		return ctx.JSON(http.StatusConflict, map[string]string{"status": "false", "error": err.Error()})
+	} else if err != nil {
+		return ctx.JSON(http.StatusInternalServerError, map[string]string{"status": "false", "error": err.Error()})
+	}
+
+	return ctx.JSON(http.StatusOK, map[string]any{"status": "success", "withdrawal": w})
+}
+
+func HandleSetWithdrawalLimits(ctx echo.Context, e *core.Exchange) error {
+	var limits core.WithdrawalLimits
+	if err := json.NewDecoder(ctx.Request().Body).Decode(&limits); err != nil {
+		return ctx.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request payload"})
+	}
+
+	asset := core.Asset(ctx.Param("asset"))
+	if err := e.SetWithdrawalLimits(asset, limits); err != nil {
+		return ctx.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+
+	return ctx.JSON(http.StatusOK, map[string]any{"status": "success", "asset": asset, "limits": limits})
+}
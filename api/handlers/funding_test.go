@@ -0,0 +1,91 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/EggsyOnCode/velho-exchange/auth"
+	"github.com/EggsyOnCode/velho-exchange/core"
+	"github.com/EggsyOnCode/velho-exchange/decimal"
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleWithdrawalFlow(t *testing.T) {
+	e := core.NewExchange()
+	e.SetWithdrawalLimits(core.AssetUSD, core.WithdrawalLimits{MaxAmount: decimal.FromInt(500)})
+	user := auth.NewUser(nil, decimal.FromInt(1_000))
+	e.AddUser(user)
+
+	request := func(amount int64) *httptest.ResponseRecorder {
+		req := WithdrawalRequest{Asset: core.AssetUSD, Amount: decimal.FromInt(amount)}
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/withdrawals", bytes.NewReader(toJson(req)))
+		require.NoError(t, HandleRequestWithdrawal(asUser(r, w, user.ID.String()), e))
+		return w
+	}
+
+	w := request(600)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Contains(t, w.Body.String(), ErrCodeWithdrawalLimit)
+
+	w = request(300)
+	require.Equal(t, http.StatusOK, w.Code)
+	var resp struct {
+		Withdrawal core.Withdrawal `json:"withdrawal"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, core.WithdrawalRequested, resp.Withdrawal.Status)
+
+	decide := func(handler func(echo.Context, *core.Exchange) error, id string) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/admin/withdrawals/"+id+"/approve", nil)
+		ctx := echo.New().NewContext(r, w)
+		ctx.SetPath("/admin/withdrawals/:id/approve")
+		ctx.SetParamNames("id")
+		ctx.SetParamValues(id)
+		require.NoError(t, handler(ctx, e))
+		return w.Code
+	}
+	id := strconv.FormatUint(resp.Withdrawal.ID, 10)
+	assert.Equal(t, http.StatusOK, decide(HandleApproveWithdrawal, id))
+	assert.Equal(t, http.StatusConflict, decide(HandleRejectWithdrawal, id))
+	assert.Equal(t, http.StatusNotFound, decide(HandleApproveWithdrawal, "99"))
+	e.WaitSettled()
+
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/withdrawals?status=CONFIRMED", nil)
+	require.NoError(t, HandleGetWithdrawals(asUser(r, w, user.ID.String()), e))
+	assert.Contains(t, w.Body.String(), `"status":"CONFIRMED"`)
+	assert.Equal(t, decimal.FromInt(700), user.USD)
+}
+
+func TestHandleCreditDeposit(t *testing.T) {
+	e := core.NewExchange()
+	user := auth.NewUser(nil, decimal.Zero)
+	e.AddUser(user)
+
+	credit := func(req CreditDepositRequest) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/admin/deposits", bytes.NewReader(toJson(req)))
+		require.NoError(t, HandleCreditDeposit(echo.New().NewContext(r, w), e))
+		return w
+	}
+
+	req := CreditDepositRequest{UserID: user.ID.String(), Asset: core.AssetUSD, Amount: decimal.FromInt(250), TxID: "wire-1"}
+	w := credit(req)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"tx_id":"wire-1"`)
+	// the same transaction isn't credited twice
+	assert.Equal(t, http.StatusOK, credit(req).Code)
+	assert.Equal(t, decimal.FromInt(250), user.USD)
+
+	assert.Equal(t, http.StatusBadRequest, credit(CreditDepositRequest{UserID: "nobody", Asset: core.AssetUSD, Amount: decimal.FromInt(1), TxID: "wire-2"}).Code)
+	assert.Equal(t, http.StatusBadRequest, credit(CreditDepositRequest{UserID: user.ID.String(), Asset: core.AssetUSD, Amount: decimal.FromInt(1)}).Code)
+	assert.Equal(t, http.StatusBadRequest, credit(CreditDepositRequest{UserID: user.ID.String(), Asset: core.AssetUSD, Amount: decimal.FromInt(-1), TxID: "wire-3"}).Code)
+}
@@ -0,0 +1,17 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/EggsyOnCode/velho-exchange/core"
+	"github.com/labstack/echo"
+)
+
+// replays the ledger's journal and verifies every asset is conserved
+func HandleCheckLedger(ctx echo.Context, e *core.Exchange) error {
+	if err := e.Ledger.Check(); err != nil {
+		return ctx.JSON(http.StatusInternalServerError, map[string]string{"status": "false", "error": err.Error()})
+	}
+
+	return ctx.JSON(http.StatusOK, map[string]any{"status": "success", "transactions": len(e.Ledger.Journal())})
+}
@@ -0,0 +1,28 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/EggsyOnCode/velho-exchange/core"
+	"github.com/labstack/echo"
+)
+
+type OpenOrderLimitRequest struct {
+	// 0 lifts the limit
+	MaxOpenOrders int `json:"max_open_orders"`
+}
+
+// sets how many orders a user can have open across markets
+func HandleSetMaxOpenOrders(ctx echo.Context, e *core.Exchange) error {
+	var req OpenOrderLimitRequest
+	if err := json.NewDecoder(ctx.Request().Body).Decode(&req); err != nil {
+		return ctx.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request payload"})
+	}
+
+	if err := e.SetMaxOpenOrders(req.MaxOpenOrders); err != nil {
+		return ctx.JSON(http.StatusBadRequest, map[string]string{"status": "false", "error": err.Error()})
+	}
+
+	return ctx.JSON(http.StatusOK, map[string]any{"status": "success", "max_open_orders": req.MaxOpenOrders})
+}
@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/EggsyOnCode/velho-exchange/core"
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo"
+)
+
+const (
+	// messages a market data connection can fall behind by before it's dropped
+	feedBuffer = 1024
+	// how long writing a message to a client may take
+	feedWriteTimeout = 10 * time.Second
+)
+
+// what a market data client sends, e.g.
+// {"op": "subscribe", "market": "ETH", "channel": "depth"}
+type FeedRequest struct {
+	// subscribe or unsubscribe
+	Op      string           `json:"op"`
+	Market  core.Market      `json:"market"`
+	Channel core.FeedChannel `json:"channel"`
+}
+
+// sent back for a request that couldn't be handled
+type FeedError struct {
+	Type    string      `json:"type"`
+	Error   string      `json:"error"`
+	Request FeedRequest `json:"request"`
+}
+
+var feedUpgrader = websocket.Upgrader{
+	// the feed is public, like the rest of the market data endpoints
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// HandleMarketData upgrades the request to a WebSocket that streams the market data
+// channels the client subscribes to. A client that can't keep up is disconnected
+// with close code 1013 (try again later) and has to resubscribe.
+func HandleMarketData(ctx echo.Context, e *core.Exchange) error {
+	conn, err := feedUpgrader.Upgrade(ctx.Response(), ctx.Request(), nil)
+	if err != nil {
+		// the upgrader has answered the request already
+		return nil
+	}
+	defer conn.Close()
+
+	sub := core.NewSubscriber(feedBuffer)
+	defer sub.Close()
+
+	var writeMu sync.Mutex
+	write := func(v any) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		conn.SetWriteDeadline(time.Now().Add(feedWriteTimeout))
+		return conn.WriteJSON(v)
+	}
+
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		for msg := range sub.Messages() {
+			if err := write(msg); err != nil {
+				break
+			}
+		}
+		if err := sub.Err(); err != nil {
+			writeMu.Lock()
+			conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, err.Error()), time.Now().Add(feedWriteTimeout))
+			writeMu.Unlock()
+		}
+		// stops the reader below
+		conn.Close()
+	}()
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			break
+		}
+
+		var req FeedRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			write(FeedError{Type: "error", Error: "malformed request"})
+			continue
+		}
+		switch req.Op {
+		case "subscribe":
+			err = e.Subscribe(sub, req.Market, req.Channel)
+		case "unsubscribe":
+			err = e.Unsubscribe(sub, req.Market, req.Channel)
+		default:
+			err = fmt.Errorf("unknown op %q", req.Op)
+		}
+		if err != nil {
+			write(FeedError{Type: "error", Error: err.Error(), Request: req})
+		}
+	}
+
+	sub.Close()
+	<-written
+	return nil
+}
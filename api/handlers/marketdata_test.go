@@ -0,0 +1,55 @@
+package handlers
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/EggsyOnCode/velho-exchange/auth"
+	"github.com/EggsyOnCode/velho-exchange/core"
+	"github.com/EggsyOnCode/velho-exchange/decimal"
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleMarketData(t *testing.T) {
+	e := core.NewExchange()
+	user := auth.NewUser(nil, decimal.FromInt(10_000))
+	require.NoError(t, e.AddUser(user))
+
+	router := echo.New()
+	router.GET("/ws/marketdata", func(ctx echo.Context) error {
+		return HandleMarketData(ctx, e)
+	})
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws/marketdata", nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	require.NoError(t, conn.WriteJSON(FeedRequest{Op: "subscribe", Market: core.ETH, Channel: core.FeedTicker}))
+	var msg core.FeedMessage
+	require.NoError(t, conn.ReadJSON(&msg))
+	assert.Equal(t, core.FeedSubscribed, msg.Type)
+	require.NoError(t, conn.ReadJSON(&msg))
+	assert.Equal(t, core.FeedTickerUpdate, msg.Type)
+	assert.True(t, msg.Ticker.BestBid.IsZero())
+
+	_, err = e.PlaceOrder(core.ETH, core.NewOrder(decimal.FromInt(1), true, decimal.FromInt(1_000), user.ID.String()))
+	require.NoError(t, err)
+	require.NoError(t, conn.ReadJSON(&msg))
+	assert.Equal(t, core.FeedTickerUpdate, msg.Type)
+	assert.Equal(t, core.ETH, msg.Market)
+	assert.Equal(t, decimal.FromInt(1_000), msg.Ticker.BestBid)
+
+	require.NoError(t, conn.WriteJSON(FeedRequest{Op: "subscribe", Market: core.ETH, Channel: "candles"}))
+	var feedErr FeedError
+	require.NoError(t, conn.ReadJSON(&feedErr))
+	assert.Equal(t, "error", feedErr.Type)
+	assert.Contains(t, feedErr.Error, "unknown market data channel")
+}
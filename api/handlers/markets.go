@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/EggsyOnCode/velho-exchange/core"
+	"github.com/labstack/echo"
+)
+
+type MarketResponse struct {
+	Market core.Market `json:"market"`
+	core.MarketSpec
+}
+
+// the spec's status defaults to PRE_OPEN
+type CreateMarketRequest struct {
+	Market core.Market `json:"market"`
+	core.MarketSpec
+}
+
+type MarketStatusRequest struct {
+	Status core.MarketStatus `json:"status"`
+}
+
+func HandleGetMarkets(ctx echo.Context, e *core.Exchange) error {
+	markets := make([]MarketResponse, 0)
+	for _, ob := range e.Markets() {
+		spec, err := e.MarketSpec(ob.TokenId)
+		if err != nil {
+			continue
+		}
+		markets = append(markets, MarketResponse{Market: ob.TokenId, MarketSpec: spec})
+	}
+
+	return ctx.JSON(http.StatusOK, map[string]any{"status": "success", "markets": markets})
+}
+
+func HandleCreateMarket(ctx echo.Context, e *core.Exchange) error {
+	var req CreateMarketRequest
+	if err := json.NewDecoder(ctx.Request().Body).Decode(&req); err != nil {
+		return ctx.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request payload"})
+	}
+
+	ob, err := e.CreateMarket(req.Market, req.MarketSpec)
+	if errors.Is(err, core.ErrMarketExists) {
+		return ctx.JSON(http.StatusConflict, map[string]string{"status": "false", "error": err.Error()})
+	} else if err != nil {
+		return ctx.JSON(http.StatusBadRequest, map[string]string{"status": "false", "error": err.Error()})
+	}
+	spec, err := e.MarketSpec(ob.TokenId)
+	if err != nil {
+		return ctx.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+
+	return ctx.JSON(http.StatusOK, map[string]any{"status": "success", "market": MarketResponse{Market: ob.TokenId, MarketSpec: spec}})
+}
+
+// replaces a market's pre-trade risk limits
+func HandleSetRiskLimits(ctx echo.Context, e *core.Exchange) error {
+	var limits core.RiskLimits
+	if err := json.NewDecoder(ctx.Request().Body).Decode(&limits); err != nil {
+		return ctx.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request payload"})
+	}
+
+	market := core.Market(ctx.Param("market"))
+	err := e.SetRiskLimits(market, limits)
+	if errors.Is(err, core.ErrMarketNotFound) {
+		return ctx.JSON(http.StatusNotFound, map[string]string{"status": "false", "error": err.Error()})
+	} else if err != nil {
+		return ctx.JSON(http.StatusBadRequest, map[string]string{"status": "false", "error": err.Error()})
+	}
+
+	return ctx.JSON(http.StatusOK, map[string]any{"status": "success", "market": market, "risk": limits})
+}
+
+// opens, halts or closes a market; closing cancels all of its orders and is final
+func HandleSetMarketStatus(ctx echo.Context, e *core.Exchange) error {
+	var req MarketStatusRequest
+	if err := json.NewDecoder(ctx.Request().Body).Decode(&req); err != nil {
+		return ctx.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request payload"})
+	}
+
+	market := core.Market(ctx.Param("market"))
+	err := e.SetMarketStatus(market, req.Status)
+	if errors.Is(err, core.ErrMarketNotFound) {
+		return ctx.JSON(http.StatusNotFound, map[string]string{"status": "false", "error": err.Error()})
+	} else if err != nil {
+		return ctx.JSON(http.StatusBadRequest, map[string]string{"status": "false", "error": err.Error()})
+	}
+
+	return ctx.JSON(http.StatusOK, map[string]any{"status": "success", "market": market, "market_status": req.Status})
+}
@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/EggsyOnCode/velho-exchange/auth"
+	"github.com/EggsyOnCode/velho-exchange/core"
+	"github.com/EggsyOnCode/velho-exchange/decimal"
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleCreateAndHaltMarket(t *testing.T) {
+	e := core.NewExchange()
+	user := auth.NewUser(nil, decimal.FromInt(10_000))
+	e.AddUser(user)
+
+	create := CreateMarketRequest{
+		Market: "SOL",
+		MarketSpec: core.MarketSpec{
+			Base:     "SOL",
+			Quote:    core.AssetUSD,
+			TickSize: decimal.RequireFromString("0.01"),
+			LotSize:  decimal.RequireFromString("0.1"),
+			MaxSize:  decimal.FromInt(100),
+		},
+	}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/admin/markets", bytes.NewReader(toJson(create)))
+	r.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	require.NoError(t, HandleCreateMarket(echo.New().NewContext(r, w), e))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodPost, "/admin/markets", bytes.NewReader(toJson(create)))
+	require.NoError(t, HandleCreateMarket(echo.New().NewContext(r, w), e))
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	placeOrder := func() *httptest.ResponseRecorder {
+		req := PlaceOrderRequest{OrderType: LimitOrder, Price: decimal.FromInt(20), Size: decimal.FromInt(1), Bid: true, Market: "SOL"}
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/order", bytes.NewReader(toJson(req)))
+		require.NoError(t, HandlePlaceOrder(asUser(r, w, user.ID.String()), e))
+		return w
+	}
+	setStatus := func(market string, status core.MarketStatus) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPut, "/admin/markets/"+market+"/status", bytes.NewReader(toJson(MarketStatusRequest{Status: status})))
+		ctx := echo.New().NewContext(r, w)
+		ctx.SetPath("/admin/markets/:market/status")
+		ctx.SetParamNames("market")
+		ctx.SetParamValues(market)
+		require.NoError(t, HandleSetMarketStatus(ctx, e))
+		return w.Code
+	}
+
+	// listed markets start pre-open
+	assert.Equal(t, http.StatusConflict, placeOrder().Code)
+	assert.Equal(t, http.StatusOK, setStatus("SOL", core.MarketOpen))
+	assert.Equal(t, http.StatusOK, placeOrder().Code)
+
+	assert.Equal(t, http.StatusOK, setStatus("SOL", core.MarketHalted))
+	assert.Equal(t, http.StatusConflict, placeOrder().Code)
+	assert.Equal(t, http.StatusNotFound, setStatus("DOGE", core.MarketHalted))
+
+	// closing cancels what's resting and can't be undone
+	assert.Equal(t, http.StatusOK, setStatus("SOL", core.MarketClosed))
+	ob, err := e.Market("SOL")
+	require.NoError(t, err)
+	assert.Empty(t, ob.OrdersMap)
+	assert.Equal(t, http.StatusBadRequest, setStatus("SOL", core.MarketOpen))
+}
+
+func TestHandlersReturnNotFoundForUnknownMarket(t *testing.T) {
+	e := core.NewExchange()
+
+	for _, handle := range []func(echo.Context, *core.Exchange) error{
+		HandleGetOrderBook,
+		HandleDeleteOrder,
+		HandleGetTrades,
+		HandleGetMarketPrice,
+		HandleGetBestAskPrice,
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/?market=DOGE", nil)
+		require.NoError(t, handle(echo.New().NewContext(r, w), e))
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	}
+
+	req := PlaceOrderRequest{OrderType: LimitOrder, Price: decimal.FromInt(20), Size: decimal.FromInt(1), Market: "DOGE"}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/order", bytes.NewReader(toJson(req)))
+	require.NoError(t, HandlePlaceOrder(echo.New().NewContext(r, w), e))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
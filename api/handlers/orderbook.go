@@ -1,12 +1,16 @@
 package handlers
 
 import (
+	"context"
 	"crypto/ecdsa"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 
-	"github.com/EggsyOnCode/velho-exchange/auth"
+	"github.com/EggsyOnCode/velho-exchange/avl"
 	"github.com/EggsyOnCode/velho-exchange/core"
+	"github.com/EggsyOnCode/velho-exchange/decimal"
 	"github.com/EggsyOnCode/velho-exchange/internals"
 	"github.com/google/uuid"
 	"github.com/labstack/echo"
@@ -15,21 +19,59 @@ import (
 type OrderType string
 
 const (
-	LimitOrder  OrderType = "LIMIT"
-	MarketOrder OrderType = "MARKET"
+	LimitOrder      OrderType = "LIMIT"
+	MarketOrder     OrderType = "MARKET"
+	StopMarketOrder OrderType = "STOP_MARKET"
+	StopLimitOrder  OrderType = "STOP_LIMIT"
 )
 
+// prices and sizes are decimal strings on the wire, e.g. "1000.25"
 type PlaceOrderRequest struct {
-	OrderType OrderType   `json:"order_type"`
-	Price     float64     `json:"price"`
-	Size      int64       `json:"size"`
-	Bid       bool        `json:"bid"`
-	Market    core.Market `json:"market"`
+	OrderType OrderType       `json:"order_type"`
+	Price     decimal.Decimal `json:"price"`
+	Size      decimal.Decimal `json:"size"`
+	Bid       bool            `json:"bid"`
+	Market    core.Market     `json:"market"`
+	// GTC (default), IOC, FOK or GTD; only used by limit orders
+	TimeInForce core.TimeInForce `json:"time_in_force,omitempty"`
+	// unix nanoseconds, required for GTD orders
+	ExpiresAt int64 `json:"expires_at,omitempty"`
+	// reject the limit order if it would match on arrival, or reprice it
+	// one tick behind the opposite best price if PostOnlyReprice is set
+	PostOnly        bool `json:"post_only,omitempty"`
+	PostOnlyReprice bool `json:"post_only_reprice,omitempty"`
+	// trigger price of STOP_MARKET and STOP_LIMIT orders
+	StopPrice decimal.Decimal `json:"stop_price,omitempty"`
+	// makes a limit order an iceberg: only display_size of it is shown on the book at a time
+	DisplaySize decimal.Decimal `json:"display_size,omitempty"`
+	// CANCEL_NEWEST, CANCEL_OLDEST, CANCEL_BOTH or DECREMENT_AND_CANCEL, overrides
+	// the user's default for what happens when the order would match the user's own orders
+	SelfTradePrevention core.SelfTradePrevention `json:"self_trade_prevention,omitempty"`
+	// protection of MARKET and STOP_MARKET orders: don't execute past worst_price or
+	// max_slippage_bps away from the best price on arrival, and don't exchange more than
+	// max_notional in quote (size may be omitted to spend / receive the whole budget)
+	WorstPrice     decimal.Decimal `json:"worst_price,omitempty"`
+	MaxSlippageBps int64           `json:"max_slippage_bps,omitempty"`
+	MaxNotional    decimal.Decimal `json:"max_notional,omitempty"`
 }
 
+// machine readable codes for rejections clients are expected to handle
+const (
+	ErrCodePostOnlyWouldCross = "POST_ONLY_WOULD_CROSS"
+	ErrCodeMarketNotOpen      = "MARKET_NOT_OPEN"
+	ErrCodeInsufficientFunds  = "INSUFFICIENT_FUNDS"
+	ErrCodeWithdrawalLimit    = "WITHDRAWAL_LIMIT"
+	ErrCodeUnauthorized       = "UNAUTHORIZED"
+	ErrCodeForbidden          = "FORBIDDEN"
+	ErrCodeKeyInUse           = "KEY_IN_USE"
+	ErrCodeTooManyOpenOrders  = "TOO_MANY_OPEN_ORDERS"
+	ErrCodeRateLimited        = "RATE_LIMITED"
+	ErrCodeRiskRejected       = "RISK_REJECTED"
+	ErrCodeAccountFrozen      = "ACCOUNT_FROZEN"
+)
+
 type User struct {
-	PrivateKey string  `json:"private_key"`
-	Usd        float64 `json:"usd"`
+	PrivateKey string `json:"private_key"`
 }
 
 type ExOrdersResponse struct {
@@ -38,84 +80,231 @@ type ExOrdersResponse struct {
 }
 
 type OrderBookResponse struct {
-	TotalAskVolume float64         `json:"total_ask_volume"`
-	TotalBidVolume float64         `json:"total_bid_volume"`
+	TotalAskVolume decimal.Decimal `json:"total_ask_volume"`
+	TotalBidVolume decimal.Decimal `json:"total_bid_volume"`
 	Asks           []*core.ExOrder `json:"asks"`
 	Bids           []*core.ExOrder `json:"bids"`
 }
 
 func HandlePlaceOrder(ctx echo.Context, e *core.Exchange) error {
 	var placeOrder PlaceOrderRequest
-	userId := ctx.QueryParam("user")
+	userId := AuthenticatedUser(ctx)
 
 	if err := json.NewDecoder(ctx.Request().Body).Decode(&placeOrder); err != nil {
 		return ctx.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request payload"})
 	}
 
-	// add order to exchange
-	ob := e.OrderBook[placeOrder.Market]
-	order := core.NewOrder(placeOrder.Size, placeOrder.Bid, placeOrder.Price, userId)
+	// the market as its sequencer has it before the order
+	var spec core.MarketSpec
+	var notOpen error
+	var bidVolume, askVolume decimal.Decimal
+	err := e.ReadBook(placeOrder.Market, func(ob *core.OrderBook) {
+		spec, notOpen = ob.Spec, ob.CheckOpen()
+		bidVolume, askVolume = ob.FillableBidVolume(), ob.FillableAskVolume()
+	})
+	if err != nil {
+		return ctx.JSON(http.StatusNotFound, map[string]string{"error": err.Error()})
+	}
+	if notOpen != nil {
+		return ctx.JSON(http.StatusConflict, map[string]string{"status": "false", "error": notOpen.Error(), "code": ErrCodeMarketNotOpen})
+	}
+
+	price := placeOrder.Price
+	size := placeOrder.Size
+	if placeOrder.OrderType == MarketOrder || placeOrder.OrderType == StopMarketOrder {
+		// price doesn't matter in market orders
+		price = decimal.Zero
+
+		if placeOrder.WorstPrice.IsNegative() || placeOrder.MaxSlippageBps < 0 || placeOrder.MaxNotional.IsNegative() {
+			return ctx.JSON(http.StatusBadRequest, map[string]string{"error": "worst_price, max_slippage_bps and max_notional can't be negative"})
+		}
+		if placeOrder.MaxSlippageBps > core.MaxSlippageBps {
+			return ctx.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("max_slippage_bps can't be more than %d", core.MaxSlippageBps)})
+		}
+		if size.IsZero() && placeOrder.MaxNotional.IsPositive() {
+			// sized by the budget, only the price is checked
+			size = spec.LotSize
+		}
+	}
+	if err := spec.CheckIncrements(price, size); err != nil {
+		return riskRejected(ctx, err)
+	}
+	if err := placeOrder.SelfTradePrevention.Validate(); err != nil {
+		return ctx.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
 
-	o := &core.ExOrder{
-		Size:      order.Size,
-		Price:     order.Price,
-		ID:        order.ID.String(),
-		UserID:    userId,
-		Bid:       order.Bid,
-		Timestamp: order.Timestamp,
-		OrderType: core.OrderType(placeOrder.OrderType),
-		Market:    placeOrder.Market,
+	if placeOrder.OrderType == StopMarketOrder || placeOrder.OrderType == StopLimitOrder {
+		return handlePlaceStopOrder(ctx, e, placeOrder, price, userId)
 	}
 
-	e.AddOrder(o)
+	order := core.NewOrder(placeOrder.Size, placeOrder.Bid, price, userId)
+	order.SelfTradePrevention = placeOrder.SelfTradePrevention
+	if placeOrder.OrderType == MarketOrder {
+		order.TimeInForce = core.ImmediateOrCancel
+		order.WorstPrice = placeOrder.WorstPrice
+		order.MaxSlippageBps = placeOrder.MaxSlippageBps
+		order.MaxNotional = placeOrder.MaxNotional
+	} else {
+		if placeOrder.TimeInForce != "" {
+			order.TimeInForce = placeOrder.TimeInForce
+			order.ExpiresAt = placeOrder.ExpiresAt
+		}
+		order.PostOnly = placeOrder.PostOnly
+		order.PostOnlyReprice = placeOrder.PostOnlyReprice
+
+		if !placeOrder.DisplaySize.IsZero() {
+			if err := spec.CheckIncrements(decimal.Zero, placeOrder.DisplaySize); err != nil {
+				return ctx.JSON(http.StatusBadRequest, map[string]string{"error": "display size: " + err.Error()})
+			}
+			order.DisplaySize = placeOrder.DisplaySize
+		}
+	}
 
 	if placeOrder.OrderType == LimitOrder {
-		ob.PlaceLimitOrder(placeOrder.Price, order)
-		return ctx.JSON(http.StatusOK, map[string]string{"status": "success", "id": order.ID.String()})
+		result, err := e.SubmitOrder(placeOrder.Market, order).WaitContext(ctx.Request().Context())
+		if requestGone(err) {
+			return ctx.JSON(http.StatusServiceUnavailable, map[string]string{"status": "false", "error": err.Error()})
+		} else if errors.Is(err, core.ErrPostOnlyWouldCross) {
+			return ctx.JSON(http.StatusConflict, map[string]string{"status": "false", "error": err.Error(), "code": ErrCodePostOnlyWouldCross})
+		} else if errors.Is(err, core.ErrInsufficientFunds) {
+			return ctx.JSON(http.StatusConflict, map[string]string{"status": "false", "error": err.Error(), "code": ErrCodeInsufficientFunds})
+		} else if errors.Is(err, core.ErrAccountFrozen) {
+			return ctx.JSON(http.StatusForbidden, map[string]string{"status": "false", "error": err.Error(), "code": ErrCodeAccountFrozen})
+		} else if errors.Is(err, core.ErrRiskCheck) {
+			return riskRejected(ctx, err)
+		} else if errors.Is(err, core.ErrTooManyOpenOrders) {
+			return ctx.JSON(http.StatusConflict, map[string]string{"status": "false", "error": err.Error(), "code": ErrCodeTooManyOpenOrders})
+		} else if errors.Is(err, core.ErrFillOrKill) {
+			return ctx.JSON(http.StatusExpectationFailed, map[string]string{"status": "false", "error": err.Error()})
+		} else if err != nil {
+			return ctx.JSON(http.StatusBadRequest, map[string]string{"status": "false", "error": err.Error()})
+		}
+		// price is echoed back since post only orders may have been repriced
+		return ctx.JSON(http.StatusOK, map[string]any{"status": "success", "id": order.ID.String(), "price": result.Order.Price, "matches": result.Matches, "self_trade_prevented": result.Order.SelfTradePrevented})
 	} else if placeOrder.OrderType == MarketOrder {
-		currentBidVol := ob.TotalBidVolume()
-		currentAskVol := ob.TotalAskVolume()
-
-		if o.Bid && float64(o.Size) > currentAskVol {
-			return ctx.JSON(http.StatusExpectationFailed, map[string]string{"status": "false", "error": "insufficient volume"})
-		} else if !o.Bid && float64(o.Size) > currentBidVol {
-			return ctx.JSON(http.StatusExpectationFailed, map[string]string{"status": "false", "error": "insufficient volume"})
+		// protected orders fill what they can within their bounds and report the rest as cancelled
+		if !order.IsProtected() {
+			if order.Bid && order.Size.Cmp(askVolume) > 0 {
+				return ctx.JSON(http.StatusExpectationFailed, map[string]string{"status": "false", "error": "insufficient volume"})
+			} else if !order.Bid && order.Size.Cmp(bidVolume) > 0 {
+				return ctx.JSON(http.StatusExpectationFailed, map[string]string{"status": "false", "error": "insufficient volume"})
+			}
 		}
 
-		matches := ob.PlaceMarketOrder(order)
-		if len(matches) == 0 {
+		result, err := e.SubmitOrder(placeOrder.Market, order).WaitContext(ctx.Request().Context())
+		matches := result.Matches
+		if requestGone(err) {
+			return ctx.JSON(http.StatusServiceUnavailable, map[string]string{"status": "false", "error": err.Error()})
+		} else if errors.Is(err, core.ErrInsufficientFunds) {
+			return ctx.JSON(http.StatusConflict, map[string]string{"status": "false", "error": err.Error(), "code": ErrCodeInsufficientFunds})
+		} else if errors.Is(err, core.ErrAccountFrozen) {
+			return ctx.JSON(http.StatusForbidden, map[string]string{"status": "false", "error": err.Error(), "code": ErrCodeAccountFrozen})
+		} else if errors.Is(err, core.ErrRiskCheck) {
+			return riskRejected(ctx, err)
+		} else if errors.Is(err, core.ErrInsufficientVolume) {
+			return ctx.JSON(http.StatusExpectationFailed, map[string]string{"status": "false", "error": err.Error()})
+		} else if err != nil {
+			return ctx.JSON(http.StatusBadRequest, map[string]string{"status": "false", "error": err.Error()})
+		}
+		if len(matches) == 0 && !result.Order.SelfTradePrevented.IsPositive() {
 			return ctx.JSON(http.StatusExpectationFailed, map[string]string{"status": "false", "matches": "no matches"})
 		}
-		return ctx.JSON(http.StatusOK, map[string]any{"status": "success", "matches": matches})
+
+		filled, notional := decimal.Zero, decimal.Zero
+		for _, m := range matches {
+			filled = filled.Add(m.SizeFilled)
+			notional = notional.Add(m.Notional)
+		}
+
+		return ctx.JSON(http.StatusOK, map[string]any{
+			"status":               "success",
+			"matches":              matches,
+			"filled":               filled,
+			"notional":             notional,
+			"cancelled":            result.Order.Size,
+			"worst_price":          result.Order.WorstPrice,
+			"self_trade_prevented": result.Order.SelfTradePrevented,
+		})
 	}
 
 	return nil
 }
 
-func HandleGetOrderBook(ctx echo.Context, e *core.Exchange) error {
-	market := ctx.QueryParam("market")
-	ob := e.OrderBook[core.Market(market)]
+// stop orders are accepted into the order book's trigger book, they only
+// match once the last traded price reaches their stop price
+func handlePlaceStopOrder(ctx echo.Context, e *core.Exchange, placeOrder PlaceOrderRequest, price decimal.Decimal, userId string) error {
+	order := core.NewStopOrder(core.OrderType(placeOrder.OrderType), placeOrder.Size, placeOrder.Bid, placeOrder.StopPrice, price, userId)
+	order.SelfTradePrevention = placeOrder.SelfTradePrevention
+	if order.OrderType == core.StopMarketOrder {
+		// the slippage bound is taken around the best price when the order triggers
+		order.WorstPrice = placeOrder.WorstPrice
+		order.MaxSlippageBps = placeOrder.MaxSlippageBps
+		order.MaxNotional = placeOrder.MaxNotional
+	}
 
-	asks := make([]*core.ExOrder, 0)
-	bids := make([]*core.ExOrder, 0)
+	result, err := e.SubmitOrder(placeOrder.Market, order).WaitContext(ctx.Request().Context())
+	if requestGone(err) {
+		return ctx.JSON(http.StatusServiceUnavailable, map[string]string{"status": "false", "error": err.Error()})
+	} else if errors.Is(err, core.ErrInsufficientFunds) {
+		return ctx.JSON(http.StatusConflict, map[string]string{"status": "false", "error": err.Error(), "code": ErrCodeInsufficientFunds})
+	} else if errors.Is(err, core.ErrAccountFrozen) {
+		return ctx.JSON(http.StatusForbidden, map[string]string{"status": "false", "error": err.Error(), "code": ErrCodeAccountFrozen})
+	} else if errors.Is(err, core.ErrRiskCheck) {
+		return riskRejected(ctx, err)
+	} else if errors.Is(err, core.ErrTooManyOpenOrders) {
+		return ctx.JSON(http.StatusConflict, map[string]string{"status": "false", "error": err.Error(), "code": ErrCodeTooManyOpenOrders})
+	} else if err != nil {
+		return ctx.JSON(http.StatusBadRequest, map[string]string{"status": "false", "error": err.Error()})
+	}
 
-	ob.Asks.Each(func(key float64, val *core.Limit) {
-		val.Orders.Each(func(key int64, val *core.Order) {
-			order := &core.ExOrder{
-				Size:      val.Size,
-				Timestamp: val.Timestamp,
-				Price:     val.Price,
-				Bid:       val.Bid,
-				ID:        val.ID.String(),
-				UserID:    val.UserID,
-				Market:    core.Market(market),
-				OrderType: core.LimitOrder,
-			}
-			asks = append(asks, order)
-		})
+	return ctx.JSON(http.StatusOK, map[string]any{"status": "success", "id": order.ID.String(), "triggered": result.Order.Triggered})
+}
+
+// 400 with the pre-trade check the order failed, see core.RiskError
+func riskRejected(ctx echo.Context, err error) error {
+	var risk *core.RiskError
+	if !errors.As(err, &risk) {
+		return ctx.JSON(http.StatusBadRequest, map[string]string{"status": "false", "error": err.Error()})
+	}
+	return ctx.JSON(http.StatusBadRequest, map[string]any{
+		"status": "false",
+		"error":  risk.Error(),
+		"code":   ErrCodeRiskRejected,
+		"reason": risk.Reason,
+		"limit":  risk.Limit,
+		"value":  risk.Value,
+	})
+}
+
+// the client went away before the market's sequencer got to its order, which
+// is applied all the same
+func requestGone(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+func HandleGetOrderBook(ctx echo.Context, e *core.Exchange) error {
+	market := core.Market(ctx.QueryParam("market"))
+
+	var res OrderBookResponse
+	err := e.ReadBook(market, func(ob *core.OrderBook) {
+		res = OrderBookResponse{
+			Asks:           levelOrders(ob.Asks, market),
+			Bids:           levelOrders(ob.Bids, market),
+			TotalAskVolume: ob.TotalAskVolume(),
+			TotalBidVolume: ob.TotalBidVolume(),
+		}
 	})
+	if err != nil {
+		return ctx.JSON(http.StatusNotFound, map[string]string{"error": err.Error()})
+	}
 
-	ob.Bids.Each(func(key float64, val *core.Limit) {
+	return ctx.JSON(http.StatusOK, res)
+}
+
+// the orders resting on one side of a book, best level first
+func levelOrders(side *avl.Tree[decimal.Decimal, *core.Limit], market core.Market) []*core.ExOrder {
+	orders := make([]*core.ExOrder, 0)
+	side.Each(func(key decimal.Decimal, val *core.Limit) {
 		val.Orders.Each(func(key int64, val *core.Order) {
 			order := &core.ExOrder{
 				Size:      val.Size,
@@ -124,33 +313,111 @@ func HandleGetOrderBook(ctx echo.Context, e *core.Exchange) error {
 				Bid:       val.Bid,
 				ID:        val.ID.String(),
 				UserID:    val.UserID,
-				Market:    core.Market(market),
+				Market:    market,
 				OrderType: core.LimitOrder,
 			}
-			bids = append(bids, order)
+			orders = append(orders, order)
 		})
 	})
-
-	return ctx.JSON(http.StatusOK, OrderBookResponse{Asks: asks, Bids: bids, TotalAskVolume: ob.TotalAskVolume(), TotalBidVolume: ob.TotalBidVolume()})
+	return orders
 }
 
 func HandleDeleteOrder(ctx echo.Context, e *core.Exchange) error {
 	idStr := ctx.QueryParam("id")
 	market := ctx.QueryParam("market")
-	ob := e.OrderBook[core.Market(market)]
+	if _, err := e.Market(core.Market(market)); err != nil {
+		return ctx.JSON(http.StatusNotFound, map[string]string{"error": err.Error()})
+	}
 
 	id, err := uuid.Parse(idStr) // Parse the ID here
 	if err != nil {
 		return ctx.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid order ID"})
 	}
 
-	ob.CancelOrderById(id.String())
+	// resting or waiting for its trigger, only its user can cancel it
+	var owned bool
+	e.ReadBook(core.Market(market), func(ob *core.OrderBook) {
+		order, ok := ob.OrdersMap[id]
+		if !ok {
+			order, ok = ob.StopOrders[id]
+		}
+		owned = ok && order.UserID == AuthenticatedUser(ctx)
+	})
+	if !owned {
+		return ctx.JSON(http.StatusNotFound, map[string]string{"status": "false", "error": core.ErrOrderNotFound.Error()})
+	}
+
+	// it may have been filled since
+	if err := e.CancelOrder(core.Market(market), id.String()); errors.Is(err, core.ErrOrderNotFound) {
+		return ctx.JSON(http.StatusNotFound, map[string]string{"status": "false", "error": err.Error()})
+	} else if err != nil {
+		return ctx.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
 	return ctx.JSON(http.StatusOK, map[string]string{"status": "success"})
 }
 
+// new price and remaining size of a resting limit order
+type AmendOrderRequest struct {
+	Price decimal.Decimal `json:"price"`
+	Size  decimal.Decimal `json:"size"`
+}
+
+// reducing the size at the same price keeps the order's time priority, any other
+// change replaces it (same ID, new priority) and may match right away
+func HandleAmendOrder(ctx echo.Context, e *core.Exchange) error {
+	var req AmendOrderRequest
+	userId := AuthenticatedUser(ctx)
+	market := ctx.QueryParam("market")
+
+	id, err := uuid.Parse(ctx.Param("id"))
+	if err != nil {
+		return ctx.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid order ID"})
+	}
+	if err := json.NewDecoder(ctx.Request().Body).Decode(&req); err != nil {
+		return ctx.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request payload"})
+	}
+
+	var owned bool
+	err = e.ReadBook(core.Market(market), func(ob *core.OrderBook) {
+		order, ok := ob.OrdersMap[id]
+		owned = ok && order.UserID == userId
+	})
+	if err != nil {
+		return ctx.JSON(http.StatusNotFound, map[string]string{"error": err.Error()})
+	}
+	if !owned {
+		return ctx.JSON(http.StatusNotFound, map[string]string{"status": "false", "error": core.ErrOrderNotFound.Error()})
+	}
+
+	result, err := e.SubmitAmend(core.Market(market), userId, id.String(), req.Price, req.Size).WaitContext(ctx.Request().Context())
+	if requestGone(err) {
+		return ctx.JSON(http.StatusServiceUnavailable, map[string]string{"status": "false", "error": err.Error()})
+	} else if errors.Is(err, core.ErrOrderNotFound) {
+		return ctx.JSON(http.StatusNotFound, map[string]string{"status": "false", "error": err.Error()})
+	} else if errors.Is(err, core.ErrMarketNotOpen) {
+		return ctx.JSON(http.StatusConflict, map[string]string{"status": "false", "error": err.Error(), "code": ErrCodeMarketNotOpen})
+	} else if errors.Is(err, core.ErrRiskCheck) {
+		return riskRejected(ctx, err)
+	} else if errors.Is(err, core.ErrPostOnlyWouldCross) {
+		return ctx.JSON(http.StatusConflict, map[string]string{"status": "false", "error": err.Error(), "code": ErrCodePostOnlyWouldCross})
+	} else if errors.Is(err, core.ErrInsufficientFunds) {
+		return ctx.JSON(http.StatusConflict, map[string]string{"status": "false", "error": err.Error(), "code": ErrCodeInsufficientFunds})
+	} else if errors.Is(err, core.ErrAccountFrozen) {
+		return ctx.JSON(http.StatusForbidden, map[string]string{"status": "false", "error": err.Error(), "code": ErrCodeAccountFrozen})
+	} else if err != nil {
+		return ctx.JSON(http.StatusBadRequest, map[string]string{"status": "false", "error": err.Error()})
+	}
+
+	return ctx.JSON(http.StatusOK, map[string]any{"status": "success", "id": id.String(), "price": result.Order.Price, "matches": result.Matches, "self_trade_prevented": result.Order.SelfTradePrevented})
+}
+
+// users start without balances, funds come from deposits
 type UserRegistrationRequest struct {
-	PrivateKey string  `json:"private_key"`
-	Usd        float64 `json:"usd"`
+	PrivateKey string `json:"private_key"`
+	// default self-trade prevention mode for the user's orders, self trades are allowed if empty
+	SelfTradePrevention core.SelfTradePrevention `json:"self_trade_prevention,omitempty"`
+	// what the user pays fees in, what they receive from a fill if empty
+	FeeCurrency core.FeeCurrency `json:"fee_currency,omitempty"`
 }
 
 func HandleUserRegistration(ctx echo.Context, e *core.Exchange) error {
@@ -159,14 +426,18 @@ func HandleUserRegistration(ctx echo.Context, e *core.Exchange) error {
 		return ctx.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request payload"})
 	}
 
-	balance := req.Usd
+	if err := req.SelfTradePrevention.Validate(); err != nil {
+		return ctx.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	if err := req.FeeCurrency.Validate(); err != nil {
+		return ctx.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
 
-	// Note : DB will handle if teh private key is already registered
 	var pk *ecdsa.PrivateKey
 	var err error
 
 	if req.PrivateKey == "" {
-		pk = nil
+		pk = internals.GenerateNewPrivateKey()
 	} else {
 		pk, err = internals.GetPrivKeyFromHexString(req.PrivateKey)
 		if err != nil {
@@ -174,11 +445,23 @@ func HandleUserRegistration(ctx echo.Context, e *core.Exchange) error {
 		}
 	}
 
-	user := auth.NewUser(pk, balance)
-
-	e.AddUser(user)
+	// the exchange only keeps the key in its keystore
+	userId, err := e.RegisterUser(pk)
+	// whoever sent the key holds it, they're told which user it belongs to
+	if errors.Is(err, core.ErrKeyInUse) {
+		userId, _ := e.UserByAddress(internals.GetAddress(pk))
+		return ctx.JSON(http.StatusConflict, map[string]string{"status": "false", "error": err.Error(), "code": ErrCodeKeyInUse, "user": userId})
+	} else if err != nil {
+		return ctx.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	if err := e.SetSelfTradePrevention(userId, req.SelfTradePrevention); err != nil {
+		return ctx.JSON(http.StatusBadRequest, map[string]string{"status": "false", "error": err.Error(), "user": userId})
+	}
+	if err := e.SetFeeCurrency(userId, req.FeeCurrency); err != nil {
+		return ctx.JSON(http.StatusBadRequest, map[string]string{"status": "false", "error": err.Error(), "user": userId})
+	}
 
-	return ctx.JSON(http.StatusOK, map[string]any{"status": "success", "user": user.ID.String()})
+	return ctx.JSON(http.StatusOK, map[string]any{"status": "success", "user": userId})
 }
 
 func HandleGetUser(ctx echo.Context, e *core.Exchange) error {
@@ -188,63 +471,66 @@ func HandleGetUser(ctx echo.Context, e *core.Exchange) error {
 		return ctx.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid user id"})
 	}
 
-	user := e.Users[userPk]
+	account, ok := e.Account(userPk)
+	if !ok {
+		return ctx.JSON(http.StatusNotFound, map[string]string{"status": "false", "error": "User not found"})
+	}
 
-	return ctx.JSON(http.StatusOK, map[string]any{"status": "success", "user": user})
+	return ctx.JSON(http.StatusOK, map[string]any{"status": "success", "account": account})
 }
 
 func HandleGetBestBidPrice(ctx echo.Context, e *core.Exchange) error {
 	marketStr := ctx.QueryParam("market")
 	market := core.Market(marketStr)
 
-	ob, ok := e.OrderBook[market] // Check if the orderbook exists
-	if !ok {
-		return ctx.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid market"})
-	}
-
-	if ob.Bids.Size() == 0 {
-		return ctx.JSON(http.StatusOK, map[string]float64{"price": 0}) // Or return a specific "no bids" value
+	// zero when there are no bids
+	var price decimal.Decimal
+	err := e.ReadBook(market, func(ob *core.OrderBook) { price = ob.GetBestBidPrice() })
+	if err != nil {
+		return ctx.JSON(http.StatusNotFound, map[string]string{"error": err.Error()})
 	}
 
-	price := ob.GetBestBidPrice()
-	return ctx.JSON(http.StatusOK, map[string]float64{"price": price})
+	return ctx.JSON(http.StatusOK, map[string]decimal.Decimal{"price": price})
 }
 
 func HandleGetBestAskPrice(ctx echo.Context, e *core.Exchange) error {
 	marketStr := ctx.QueryParam("market")
 	market := core.Market(marketStr)
 
-	ob, ok := e.OrderBook[market] // Check if the orderbook exists
-	if !ok {
-		return ctx.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid market"})
-	}
-
-	if ob.Asks.Size() == 0 {
-		return ctx.JSON(http.StatusOK, map[string]float64{"price": 0}) // Or return a specific "no asks" value
+	// zero when there are no asks
+	var price decimal.Decimal
+	err := e.ReadBook(market, func(ob *core.OrderBook) { price = ob.GetBestAskPrice() })
+	if err != nil {
+		return ctx.JSON(http.StatusNotFound, map[string]string{"error": err.Error()})
 	}
 
-	price := ob.GetBestAskPrice()
-	return ctx.JSON(http.StatusOK, map[string]float64{"price": price})
+	return ctx.JSON(http.StatusOK, map[string]decimal.Decimal{"price": price})
 }
 
 func HandleGetTrades(ctx echo.Context, e *core.Exchange) error {
 	market := ctx.QueryParam("market")
-	ob := e.OrderBook[core.Market(market)]
-	trades := ob.GetTrades()
+	var trades []*core.Trade
+	err := e.ReadBook(core.Market(market), func(ob *core.OrderBook) { trades = ob.GetTrades() })
+	if err != nil {
+		return ctx.JSON(http.StatusNotFound, map[string]string{"error": err.Error()})
+	}
 
 	return ctx.JSON(http.StatusOK, map[string]any{"status": "success", "trades": trades})
 }
 
 func HandleGetMarketPrice(ctx echo.Context, e *core.Exchange) error {
 	market := ctx.QueryParam("market")
-	ob := e.OrderBook[core.Market(market)]
-	price := ob.GetMarketPrice()
+	var price decimal.Decimal
+	err := e.ReadBook(core.Market(market), func(ob *core.OrderBook) { price = ob.GetMarketPrice() })
+	if err != nil {
+		return ctx.JSON(http.StatusNotFound, map[string]string{"error": err.Error()})
+	}
 
 	return ctx.JSON(http.StatusOK, map[string]any{"status": "success", "price": price})
 }
 
 func HandleGetOrders(ctx echo.Context, e *core.Exchange) error {
-	id := ctx.QueryParam("userID")
+	id := AuthenticatedUser(ctx)
 
 	orders, exists := e.GetOrders(id)
 	if !exists {
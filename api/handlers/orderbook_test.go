@@ -8,10 +8,12 @@ import (
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"sync"
 	"testing"
 
 	"github.com/EggsyOnCode/velho-exchange/auth"
 	"github.com/EggsyOnCode/velho-exchange/core"
+	"github.com/EggsyOnCode/velho-exchange/decimal"
 	"github.com/EggsyOnCode/velho-exchange/internals"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/labstack/echo"
@@ -21,23 +23,24 @@ import (
 
 func TestHandlePlaceOrderLimitOrder(t *testing.T) {
 	e := core.NewExchange()
-	user := auth.NewUser(nil, 100)
+	user := auth.NewUser(nil, decimal.FromInt(100))
 	e.AddUser(user)
 	userId := user.ID.String()
+	require.NoError(t, e.Ledger.Deposit(userId, core.AssetBTC, decimal.FromInt(1), "deposit"))
 
 	req := PlaceOrderRequest{
 		OrderType: LimitOrder,
-		Price:     10000.0,
-		Size:      1,
+		Price:     decimal.FromInt(10000),
+		Size:      decimal.FromInt(1),
 		Bid:       false,
 		Market:    core.BTC,
 	}
 
 	w := httptest.NewRecorder()
-	r := httptest.NewRequest(http.MethodPost, "/orders?user="+userId, bytes.NewReader(toJson(req)))
+	r := httptest.NewRequest(http.MethodPost, "/orders", bytes.NewReader(toJson(req)))
 	r.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
 
-	ctx := echo.New().NewContext(r, w)
+	ctx := asUser(r, w, userId)
 
 	err := HandlePlaceOrder(ctx, e)
 
@@ -54,31 +57,31 @@ func TestHandlePlaceOrderLimitOrder(t *testing.T) {
 	assert.Equal(t, orders[0].Price, req.Price)
 
 	ob := e.OrderBook[core.BTC]
-	assert.Equal(t, ob.TotalAskVolume(), float64(req.Size))
+	assert.Equal(t, ob.TotalAskVolume(), req.Size)
 
 }
 
 func TestHandlePlaceOrderMarketOrderInsufficientVolume(t *testing.T) {
 	e := core.NewExchange()
-	user := auth.NewUser(nil, 100)
+	user := auth.NewUser(nil, decimal.FromInt(100))
 	e.AddUser(user)
 	userId := user.ID.String()
 
 	ob := e.OrderBook[core.BTC]
-	ob.PlaceLimitOrder(10000.0, core.NewOrder(1, false, 10000.0, "otherUser")) // Add an ask
+	ob.PlaceLimitOrder(decimal.FromInt(10000), core.NewOrder(decimal.FromInt(1), false, decimal.FromInt(10000), "otherUser")) // Add an ask
 
 	req := PlaceOrderRequest{
 		OrderType: MarketOrder,
-		Size:      10,
+		Size:      decimal.FromInt(10),
 		Bid:       true,
 		Market:    core.BTC,
 	}
 
 	w := httptest.NewRecorder()
-	r := httptest.NewRequest(http.MethodPost, "/orders?user="+userId, bytes.NewReader(toJson(req)))
+	r := httptest.NewRequest(http.MethodPost, "/orders", bytes.NewReader(toJson(req)))
 	r.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
 
-	ctx := echo.New().NewContext(r, w)
+	ctx := asUser(r, w, userId)
 
 	err := HandlePlaceOrder(ctx, e)
 
@@ -96,14 +99,15 @@ func TestHandleGetOrderBook(t *testing.T) {
 
 	// Create a user with sufficient USD (important!)
 	pk := internals.GenerateNewPrivateKey()
-	user := auth.NewUser(pk, 10000.0) // High initial balance
+	user := auth.NewUser(pk, decimal.FromInt(10000)) // High initial balance
 	e.AddUser(user)
 	userId := user.ID.String()
+	require.NoError(t, e.Ledger.Deposit(userId, core.AssetBTC, decimal.FromInt(2), "deposit"))
 
 	// Add orders to the order book, using the user ID
 	ob := e.OrderBook[core.BTC]
-	ob.PlaceLimitOrder(10000.0, core.NewOrder(1, true, 10000.0, userId))  // Bid order
-	ob.PlaceLimitOrder(10001.0, core.NewOrder(2, false, 10001.0, userId)) // Ask order
+	ob.PlaceLimitOrder(decimal.FromInt(10000), core.NewOrder(decimal.FromInt(1), true, decimal.FromInt(10000), userId))  // Bid order
+	ob.PlaceLimitOrder(decimal.FromInt(10001), core.NewOrder(decimal.FromInt(2), false, decimal.FromInt(10001), userId)) // Ask order
 
 	w := httptest.NewRecorder()
 	r := httptest.NewRequest(http.MethodGet, "/orderbook?market=BTC", nil)
@@ -121,14 +125,14 @@ func TestHandleGetOrderBook(t *testing.T) {
 	require.Len(t, response.Bids, 1)
 	require.Len(t, response.Asks, 1)
 
-	assert.Equal(t, float64(1), response.TotalBidVolume)
-	assert.Equal(t, float64(2), response.TotalAskVolume)
+	assert.Equal(t, decimal.FromInt(1), response.TotalBidVolume)
+	assert.Equal(t, decimal.FromInt(2), response.TotalAskVolume)
 
 	// Verify the order data in the response
-	assert.Equal(t, float64(10000), response.Bids[0].Price)
-	assert.Equal(t, float64(10001), response.Asks[0].Price)
-	assert.Equal(t, int64(1), response.Bids[0].Size)
-	assert.Equal(t, int64(2), response.Asks[0].Size)
+	assert.Equal(t, decimal.FromInt(10000), response.Bids[0].Price)
+	assert.Equal(t, decimal.FromInt(10001), response.Asks[0].Price)
+	assert.Equal(t, decimal.FromInt(1), response.Bids[0].Size)
+	assert.Equal(t, decimal.FromInt(2), response.Asks[0].Size)
 	assert.Equal(t, userId, response.Bids[0].UserID)
 	assert.Equal(t, userId, response.Asks[0].UserID)
 
@@ -148,13 +152,11 @@ func TestHandleUserRegistration(t *testing.T) {
 	pk := internals.GenerateNewPrivateKey()
 	privateKeyHex := internals.EncodeHexString(pk) // Correct conversion
 
-	req := UserRegistrationRequest{
-		PrivateKey: privateKeyHex, // Use the hex string
-		Usd:        100.0,
-	}
+	// the public route doesn't take an opening balance
+	body := `{"private_key":"` + privateKeyHex + `","usd":"100"}`
 
 	w := httptest.NewRecorder()
-	r := httptest.NewRequest(http.MethodPost, "/users", bytes.NewReader(toJson(req)))
+	r := httptest.NewRequest(http.MethodPost, "/users", bytes.NewReader([]byte(body)))
 	r.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON) // Important
 
 	ctx := echo.New().NewContext(r, w)
@@ -169,6 +171,24 @@ func TestHandleUserRegistration(t *testing.T) {
 	require.NoError(t, err)
 
 	assert.NotEmpty(t, response["user"])
+	assert.True(t, e.Ledger.Balance(response["user"], core.AssetUSD).Available.IsZero())
+}
+
+func TestHandleUserRegistrationRejectsInvalidSettings(t *testing.T) {
+	e := core.NewExchange()
+
+	for _, body := range []string{
+		`{"private_key":"","self_trade_prevention":"NOPE"}`,
+		`{"private_key":"","fee_currency":"NOPE"}`,
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/users", bytes.NewReader([]byte(body)))
+		r.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+
+		require.NoError(t, HandleUserRegistration(echo.New().NewContext(r, w), e))
+		assert.Equal(t, http.StatusBadRequest, w.Code, body)
+	}
+	assert.Empty(t, e.Users)
 }
 
 // Ensure you have this function in your internals package
@@ -180,12 +200,12 @@ func EncodeHexString(pk *ecdsa.PrivateKey) string {
 // 	e := core.NewExchange()
 
 // 	pk := internals.GenerateNewPrivateKey()
-// 	user := auth.NewUser(pk, 100)
+// 	user := auth.NewUser(pk, decimal.FromInt(100))
 // 	e.AddUser(user)
 // 	userId := user.ID.String()
 
 // 	ob := e.OrderBook[core.BTC]
-// 	order, err := ob.PlaceMarketOrder(10000.0, core.NewOrder(1, true, 10000.0, userId))
+// 	order, err := ob.PlaceMarketOrder(10000.0, core.NewOrder(decimal.FromInt(1), true, decimal.FromInt(10000), userId))
 // 	require.NoError(t, err, "Failed to place order")
 
 // 	orderId := order.ID.String()
@@ -246,7 +266,7 @@ func TestHandleGetUser(t *testing.T) {
 
 	// Create a user
 	pk := internals.GenerateNewPrivateKey()
-	user := auth.NewUser(pk, 100.0)
+	user := auth.NewUser(pk, decimal.FromInt(100))
 	e.AddUser(user)
 	userId := user.ID.String()
 
@@ -261,6 +281,16 @@ func TestHandleGetUser(t *testing.T) {
 	err := HandleGetUser(ctx, e)
 	require.NoError(t, err)
 	assert.Equal(t, http.StatusOK, w.Code)
+
+	// the account doesn't carry the user's key
+	assert.NotContains(t, w.Body.String(), EncodeHexString(pk))
+	var response struct {
+		Account core.Account `json:"account"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, userId, response.Account.ID)
+	assert.Equal(t, internals.GetAddress(pk), response.Account.Address)
+	assert.Equal(t, decimal.FromInt(100), response.Account.Balances[core.AssetUSD].Available)
 }
 
 func TestHandleGetBestBidPrice(t *testing.T) {
@@ -271,16 +301,16 @@ func TestHandleGetBestBidPrice(t *testing.T) {
 
 	// Create users with USD
 	pk1 := internals.GenerateNewPrivateKey()
-	user1 := auth.NewUser(pk1, 10000)
+	user1 := auth.NewUser(pk1, decimal.FromInt(10000))
 	e.AddUser(user1)
 
 	pk2 := internals.GenerateNewPrivateKey()
-	user2 := auth.NewUser(pk2, 9500)
+	user2 := auth.NewUser(pk2, decimal.FromInt(9500))
 	e.AddUser(user2)
 
 	// Place some orders for testing, using user IDs
-	ob.PlaceLimitOrder(10000.0, core.NewOrder(1, true, 10000.0, user1.ID.String()))
-	ob.PlaceLimitOrder(9500.0, core.NewOrder(2, true, 9500.0, user2.ID.String()))
+	ob.PlaceLimitOrder(decimal.FromInt(10000), core.NewOrder(decimal.FromInt(1), true, decimal.FromInt(10000), user1.ID.String()))
+	ob.PlaceLimitOrder(decimal.FromInt(9500), core.NewOrder(decimal.FromInt(2), true, decimal.FromInt(9500), user2.ID.String()))
 
 	// Test successful retrieval
 	w := httptest.NewRecorder()
@@ -308,12 +338,12 @@ func TestHandleGetBestBidPrice(t *testing.T) {
 
 	err = HandleGetBestBidPrice(ctx, e)
 	require.NoError(t, err)
-	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, http.StatusNotFound, w.Code)
 
 	var errorResponse map[string]string // Use map[string]string for error response
 	err = json.Unmarshal(w.Body.Bytes(), &errorResponse)
 	require.NoError(t, err)
-	assert.Equal(t, "Invalid market", errorResponse["error"])
+	assert.Contains(t, errorResponse["error"], "market not found")
 }
 
 func TestHandleGetOrders(t *testing.T) {
@@ -321,18 +351,16 @@ func TestHandleGetOrders(t *testing.T) {
 	e := core.NewExchange()
 
 	// Simulate user creation and orders
-	user := auth.NewUser(internals.GenerateNewPrivateKey(), 10000)
+	user := auth.NewUser(internals.GenerateNewPrivateKey(), decimal.FromInt(10000))
 	userID := user.ID.String()
 	e.AddUser(user)
-	e.OrderBook["BTC"].PlaceLimitOrder(10000, core.NewOrder(1, true, 10000, userID))
-	e.OrderBook["BTC"].PlaceLimitOrder(9500, core.NewOrder(2, false, 9500, userID))
+	e.OrderBook["BTC"].PlaceLimitOrder(decimal.FromInt(10000), core.NewOrder(decimal.FromInt(1), true, decimal.FromInt(10000), userID))
+	e.OrderBook["BTC"].PlaceLimitOrder(decimal.FromInt(9500), core.NewOrder(decimal.FromInt(2), false, decimal.FromInt(9500), userID))
 
 	// Test case 1: Existing user with orders
 	r := httptest.NewRequest(http.MethodGet, "/users/"+userID+"/orders", nil)
 	w := httptest.NewRecorder()
-	ctx := echo.New().NewContext(r, w)
-	ctx.SetParamNames("userID")
-	ctx.SetParamValues(userID)
+	ctx := asUser(r, w, userID)
 
 	err := HandleGetOrders(ctx, e)
 	require.NoError(t, err)
@@ -344,9 +372,7 @@ func TestHandleGetOrders(t *testing.T) {
 	userID = "non-existent-user"
 	r = httptest.NewRequest(http.MethodGet, "/users/"+userID+"/orders", nil)
 	w = httptest.NewRecorder()
-	ctx = echo.New().NewContext(r, w)
-	ctx.SetParamNames("userID")
-	ctx.SetParamValues(userID)
+	ctx = asUser(r, w, userID)
 
 	err = HandleGetOrders(ctx, e)
 	require.NoError(t, err)
@@ -354,3 +380,199 @@ func TestHandleGetOrders(t *testing.T) {
 	assert.Equal(t, http.StatusNotFound, w.Code)
 
 }
+
+func TestHandlePlaceOrderRejectsOffTickPrice(t *testing.T) {
+	e := core.NewExchange()
+	user := auth.NewUser(nil, decimal.FromInt(100))
+	e.AddUser(user)
+
+	w := httptest.NewRecorder()
+	body := []byte(`{"order_type":"LIMIT","price":"10000.001","size":"1","bid":true,"market":"BTC"}`)
+	r := httptest.NewRequest(http.MethodPost, "/orders", bytes.NewReader(body))
+	r.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+
+	ctx := asUser(r, w, user.ID.String())
+
+	err := HandlePlaceOrder(ctx, e)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, 0, e.OrderBook[core.BTC].Bids.Size())
+
+	var response map[string]string
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, ErrCodeRiskRejected, response["code"])
+	assert.Equal(t, string(core.RiskPriceOffTick), response["reason"])
+}
+
+func TestHandlePlaceOrderRejectsOrderOverNotionalLimit(t *testing.T) {
+	e := core.NewExchange()
+	require.NoError(t, e.SetRiskLimits(core.BTC, core.RiskLimits{MaxOrderNotional: decimal.FromInt(1000)}))
+	user := auth.NewUser(nil, decimal.FromInt(100_000))
+	e.AddUser(user)
+
+	w := httptest.NewRecorder()
+	body := []byte(`{"order_type":"LIMIT","price":"100","size":"20","bid":true,"market":"BTC"}`)
+	r := httptest.NewRequest(http.MethodPost, "/orders", bytes.NewReader(body))
+	r.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+
+	err := HandlePlaceOrder(asUser(r, w, user.ID.String()), e)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	var response map[string]string
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, ErrCodeRiskRejected, response["code"])
+	assert.Equal(t, string(core.RiskMaxOrderNotional), response["reason"])
+	assert.Equal(t, "1000", response["limit"])
+	assert.Equal(t, "2000", response["value"])
+}
+
+func TestHandlePlaceOrderPostOnlyWouldCross(t *testing.T) {
+	e := core.NewExchange()
+	user := auth.NewUser(nil, decimal.FromInt(100_000))
+	e.AddUser(user)
+	require.NoError(t, e.Ledger.Deposit(user.ID.String(), core.AssetBTC, decimal.FromInt(1), "deposit"))
+
+	ob := e.OrderBook[core.BTC]
+	ob.PlaceLimitOrder(decimal.FromInt(10000), core.NewOrder(decimal.FromInt(1), false, decimal.FromInt(10000), user.ID.String()))
+
+	req := PlaceOrderRequest{
+		OrderType: LimitOrder,
+		Price:     decimal.FromInt(10000),
+		Size:      decimal.FromInt(1),
+		Bid:       true,
+		Market:    core.BTC,
+		PostOnly:  true,
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/orders", bytes.NewReader(toJson(req)))
+	r.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+
+	ctx := asUser(r, w, user.ID.String())
+
+	err := HandlePlaceOrder(ctx, e)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	var response map[string]string
+	err = json.Unmarshal(w.Body.Bytes(), &response)
+	require.NoError(t, err)
+	assert.Equal(t, ErrCodePostOnlyWouldCross, response["code"])
+	assert.Equal(t, decimal.FromInt(1), ob.TotalAskVolume())
+}
+
+func TestHandlePlaceOrderInsufficientFunds(t *testing.T) {
+	e := core.NewExchange()
+	user := auth.NewUser(nil, decimal.FromInt(500))
+	e.AddUser(user)
+
+	ob := e.OrderBook[core.BTC]
+	req := PlaceOrderRequest{
+		OrderType: LimitOrder,
+		Price:     decimal.FromInt(100),
+		Size:      decimal.FromInt(6),
+		Bid:       true,
+		Market:    core.BTC,
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/orders", bytes.NewReader(toJson(req)))
+	r.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+
+	err := HandlePlaceOrder(asUser(r, w, user.ID.String()), e)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	var response map[string]string
+	err = json.Unmarshal(w.Body.Bytes(), &response)
+	require.NoError(t, err)
+	assert.Equal(t, ErrCodeInsufficientFunds, response["code"])
+	assert.Equal(t, 0, ob.Bids.Size())
+	assert.Equal(t, decimal.FromInt(500), user.USD)
+}
+
+func TestHandleAmendOrder(t *testing.T) {
+	e := core.NewExchange()
+	owner := auth.NewUser(nil, decimal.FromInt(10_000))
+	other := auth.NewUser(nil, decimal.FromInt(10_000))
+	e.AddUser(owner)
+	e.AddUser(other)
+
+	ob := e.OrderBook[core.BTC]
+	order := core.NewOrder(decimal.FromInt(2), true, decimal.FromInt(100), owner.ID.String())
+	ob.PlaceLimitOrder(decimal.FromInt(100), order)
+
+	amend := func(userId string) *httptest.ResponseRecorder {
+		req := AmendOrderRequest{Price: decimal.FromInt(101), Size: decimal.FromInt(1)}
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPut, "/order/"+order.ID.String()+"?market=BTC", bytes.NewReader(toJson(req)))
+		r.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+
+		ctx := asUser(r, w, userId)
+		ctx.SetPath("/order/:id")
+		ctx.SetParamNames("id")
+		ctx.SetParamValues(order.ID.String())
+
+		require.NoError(t, HandleAmendOrder(ctx, e))
+		return w
+	}
+
+	// someone else's order looks like it doesn't exist
+	assert.Equal(t, http.StatusNotFound, amend(other.ID.String()).Code)
+	assert.Equal(t, decimal.FromInt(100), order.Price)
+
+	w := amend(owner.ID.String())
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, decimal.FromInt(101), ob.GetBestBidPrice())
+	assert.Equal(t, decimal.FromInt(1), ob.TotalBidVolume())
+}
+
+// run with -race: orders and reads of the same market from many requests at once
+func TestHandlersConcurrently(t *testing.T) {
+	e := core.NewExchange()
+	var users []string
+	for i := 0; i < 4; i++ {
+		user := auth.NewUser(nil, decimal.FromInt(1_000_000))
+		require.NoError(t, e.AddUser(user))
+		require.NoError(t, e.Ledger.Deposit(user.ID.String(), core.AssetBTC, decimal.FromInt(25), "deposit"))
+		users = append(users, user.ID.String())
+	}
+
+	var wg sync.WaitGroup
+	for i, userId := range users {
+		wg.Add(1)
+		go func(userId string, bid bool) {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				req := PlaceOrderRequest{OrderType: LimitOrder, Price: decimal.FromInt(int64(100 + j%5)), Size: decimal.FromInt(1), Bid: bid, Market: core.BTC}
+				w := httptest.NewRecorder()
+				r := httptest.NewRequest(http.MethodPost, "/order", bytes.NewReader(toJson(req)))
+				assert.NoError(t, HandlePlaceOrder(asUser(r, w, userId), e))
+				assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+			}
+		}(userId, i%2 == 0)
+	}
+
+	reads := []func(ctx echo.Context) error{
+		func(ctx echo.Context) error { return HandleGetOrderBook(ctx, e) },
+		func(ctx echo.Context) error { return HandleGetTrades(ctx, e) },
+		func(ctx echo.Context) error { return HandleGetBestBidPrice(ctx, e) },
+		func(ctx echo.Context) error { return HandleGetMarkets(ctx, e) },
+	}
+	for _, read := range reads {
+		wg.Add(1)
+		go func(read func(ctx echo.Context) error) {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				w := httptest.NewRecorder()
+				r := httptest.NewRequest(http.MethodGet, "/?market=BTC", nil)
+				assert.NoError(t, read(echo.New().NewContext(r, w)))
+				assert.Equal(t, http.StatusOK, w.Code)
+			}
+		}(read)
+	}
+	wg.Wait()
+
+	assert.NoError(t, e.Ledger.Check())
+}
@@ -0,0 +1,35 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/EggsyOnCode/velho-exchange/core"
+	"github.com/labstack/echo"
+)
+
+// lists the signing user's settlement transfers, or on the admin route those of
+// ?user= or everyone's, oldest first
+func HandleGetTransfers(ctx echo.Context, e *core.Exchange) error {
+	userId := listedUser(ctx)
+
+	return ctx.JSON(http.StatusOK, map[string]any{"status": "success", "transfers": e.Transfers(userId)})
+}
+
+func HandleGetTransfer(ctx echo.Context, e *core.Exchange) error {
+	id, err := strconv.ParseUint(ctx.Param("id"), 10, 64)
+	if err != nil {
+		return ctx.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid transfer ID"})
+	}
+
+	// a user only sees their own transfers
+	transfer, ok := e.Transfer(id)
+	if userId := AuthenticatedUser(ctx); userId != "" && transfer.UserID != userId {
+		ok = false
+	}
+	if !ok {
+		return ctx.JSON(http.StatusNotFound, map[string]string{"status": "false", "error": "transfer not found"})
+	}
+
+	return ctx.JSON(http.StatusOK, map[string]any{"status": "success", "transfer": transfer})
+}
@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/EggsyOnCode/velho-exchange/auth"
+	"github.com/EggsyOnCode/velho-exchange/core"
+	"github.com/EggsyOnCode/velho-exchange/decimal"
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleGetTransfers(t *testing.T) {
+	e := core.NewExchange()
+	seller := auth.NewUser(nil, decimal.Zero)
+	buyer := auth.NewUser(nil, decimal.FromInt(10_000))
+	e.AddUser(seller)
+	e.AddUser(buyer)
+	require.NoError(t, e.Ledger.Deposit(seller.ID.String(), core.AssetETH, decimal.FromInt(2), "deposit"))
+
+	ob := e.OrderBook[core.ETH]
+	ob.PlaceLimitOrder(decimal.FromInt(1_000), core.NewOrder(decimal.FromInt(2), false, decimal.FromInt(1_000), seller.ID.String()))
+	ob.PlaceLimitOrder(decimal.FromInt(1_000), core.NewOrder(decimal.FromInt(1), true, decimal.FromInt(1_000), buyer.ID.String()))
+	e.WaitSettled()
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/settlement/transfers", nil)
+	require.NoError(t, HandleGetTransfers(asUser(r, w, buyer.ID.String()), e))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var resp struct {
+		Transfers []core.Transfer `json:"transfers"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Len(t, resp.Transfers, 1)
+	assert.Equal(t, decimal.FromInt(1), resp.Transfers[0].Amount)
+	assert.Equal(t, core.TransferConfirmed, resp.Transfers[0].Status)
+
+	getTransfer := func(id string) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/settlement/transfers/"+id, nil)
+		ctx := echo.New().NewContext(r, w)
+		ctx.SetPath("/settlement/transfers/:id")
+		ctx.SetParamNames("id")
+		ctx.SetParamValues(id)
+		require.NoError(t, HandleGetTransfer(ctx, e))
+		return w.Code
+	}
+	assert.Equal(t, http.StatusOK, getTransfer("1"))
+	assert.Equal(t, http.StatusNotFound, getTransfer("99"))
+	assert.Equal(t, http.StatusBadRequest, getTransfer("abc"))
+}
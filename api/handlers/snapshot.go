@@ -0,0 +1,22 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/EggsyOnCode/velho-exchange/core"
+	"github.com/labstack/echo"
+)
+
+// restores the latest snapshot, replays the log tail onto it and compares the
+// result with the live exchange
+func HandleVerifySnapshot(ctx echo.Context, e *core.Exchange) error {
+	err := e.VerifySnapshot()
+	if errors.Is(err, core.ErrSnapshotMismatch) {
+		return ctx.JSON(http.StatusConflict, map[string]string{"status": "false", "error": err.Error()})
+	} else if err != nil {
+		return ctx.JSON(http.StatusInternalServerError, map[string]string{"status": "false", "error": err.Error()})
+	}
+
+	return ctx.JSON(http.StatusOK, map[string]any{"status": "success", "seq": e.Seq()})
+}
@@ -0,0 +1,301 @@
+package api
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/EggsyOnCode/velho-exchange/api/handlers"
+	"github.com/labstack/echo"
+)
+
+// Requests are rate limited with token buckets. Every IP and every user has a
+// bucket per RateClass, holding up to Burst requests and refilled at PerSecond.
+// A request takes a token from its IP's bucket and, if it's signed, from its
+// user's, and is refused with 429 if either is empty. Users' budgets come from
+// their tier, an IP's budget is shared by everyone behind it.
+
+// RateClass is a budget requests are counted against, each limited route has one
+type RateClass string
+
+const (
+	// placing and amending orders
+	RateOrders RateClass = "orders"
+	// cancelling orders
+	RateCancels RateClass = "cancels"
+	// public reads of books, trades and prices, and market data subscriptions
+	RateMarketData RateClass = "market_data"
+	// registering users, the only write that isn't signed, so it only has a
+	// budget per IP
+	RateRegistration RateClass = "registration"
+)
+
+// headers of the most constrained bucket a request was counted against
+const (
+	HeaderRateLimitLimit     = "X-RateLimit-Limit"
+	HeaderRateLimitRemaining = "X-RateLimit-Remaining"
+	// seconds until the bucket is full again
+	HeaderRateLimitReset = "X-RateLimit-Reset"
+	// seconds until the refused request can be retried
+	HeaderRetryAfter = "Retry-After"
+)
+
+// Rate is a token bucket: Burst requests at once, refilled at PerSecond
+type Rate struct {
+	Burst     int     `json:"burst"`
+	PerSecond float64 `json:"per_second"`
+}
+
+// RateBudgets holds a rate per class, classes without one aren't limited
+type RateBudgets map[RateClass]Rate
+
+const (
+	TierStandard    = "standard"
+	TierMarketMaker = "market_maker"
+)
+
+type RateLimitConfig struct {
+	// users' budgets by tier
+	Tiers map[string]RateBudgets
+	// tier of the users UserTiers doesn't name
+	DefaultTier string
+	// tiers by user ID
+	UserTiers map[string]string
+	// budgets of each IP, across every request from it, signed or not
+	PerIP RateBudgets
+}
+
+// DefaultRateLimits is what a server starts with, see Server.ConfigureRateLimits
+var DefaultRateLimits = RateLimitConfig{
+	Tiers: map[string]RateBudgets{
+		TierStandard: {
+			RateOrders:     {Burst: 20, PerSecond: 10},
+			RateCancels:    {Burst: 40, PerSecond: 20},
+			RateMarketData: {Burst: 40, PerSecond: 20},
+		},
+		TierMarketMaker: {
+			RateOrders:     {Burst: 200, PerSecond: 100},
+			RateCancels:    {Burst: 400, PerSecond: 200},
+			RateMarketData: {Burst: 200, PerSecond: 100},
+		},
+	},
+	DefaultTier: TierStandard,
+	PerIP: RateBudgets{
+		RateOrders:     {Burst: 400, PerSecond: 200},
+		RateCancels:    {Burst: 800, PerSecond: 400},
+		RateMarketData: {Burst: 100, PerSecond: 50},
+		// a few users at once, then one a minute
+		RateRegistration: {Burst: 5, PerSecond: 1.0 / 60},
+	},
+}
+
+func (c RateLimitConfig) Validate() error {
+	if _, ok := c.Tiers[c.DefaultTier]; !ok {
+		return fmt.Errorf("default rate limit tier %q doesn't exist", c.DefaultTier)
+	}
+	for userID, tier := range c.UserTiers {
+		if _, ok := c.Tiers[tier]; !ok {
+			return fmt.Errorf("user %s is in rate limit tier %q, which doesn't exist", userID, tier)
+		}
+	}
+	for tier, budgets := range c.Tiers {
+		if err := budgets.validate(); err != nil {
+			return fmt.Errorf("rate limit tier %q: %w", tier, err)
+		}
+	}
+	if err := c.PerIP.validate(); err != nil {
+		return fmt.Errorf("per IP rate limits: %w", err)
+	}
+	return nil
+}
+
+func (b RateBudgets) validate() error {
+	for class, rate := range b {
+		if rate.Burst < 1 || rate.PerSecond <= 0 {
+			return fmt.Errorf("%s needs a burst of at least 1 and a positive rate", class)
+		}
+	}
+	return nil
+}
+
+// the budgets of userID
+func (c RateLimitConfig) userBudgets(userID string) RateBudgets {
+	if tier, ok := c.UserTiers[userID]; ok {
+		return c.Tiers[tier]
+	}
+	return c.Tiers[c.DefaultTier]
+}
+
+type bucketKey struct {
+	class RateClass
+	// "ip:" or "user:" and who
+	owner string
+}
+
+type bucket struct {
+	rate   Rate
+	tokens float64
+	// when tokens was last refilled
+	last time.Time
+}
+
+func newBucket(rate Rate, now time.Time) *bucket {
+	return &bucket{rate: rate, tokens: float64(rate.Burst), last: now}
+}
+
+func (b *bucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(float64(b.rate.Burst), b.tokens+elapsed*b.rate.PerSecond)
+	}
+	b.last = now
+}
+
+func (b *bucket) full() bool {
+	return b.tokens >= float64(b.rate.Burst)
+}
+
+// how long until the bucket holds n tokens
+func (b *bucket) until(n float64) time.Duration {
+	if b.tokens >= n {
+		return 0
+	}
+	return time.Duration((n - b.tokens) / b.rate.PerSecond * float64(time.Second))
+}
+
+// what the limiter decided about a request, for its most constrained bucket
+type rateDecision struct {
+	allowed bool
+	// zero if the request wasn't counted against any bucket
+	limit      int
+	remaining  int
+	reset      time.Duration
+	retryAfter time.Duration
+}
+
+type rateLimiter struct {
+	mu      sync.Mutex
+	config  RateLimitConfig
+	buckets map[bucketKey]*bucket
+	// buckets that filled up are dropped every so often, a new one is full too
+	lastPrune time.Time
+	now       func() time.Time
+}
+
+// how often full buckets are dropped
+const bucketPruneInterval = time.Minute
+
+func newRateLimiter(config RateLimitConfig) *rateLimiter {
+	return &rateLimiter{config: config, buckets: make(map[bucketKey]*bucket), now: time.Now}
+}
+
+func (l *rateLimiter) configure(config RateLimitConfig) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// budgets may have shrunk, everyone starts over with full buckets
+	l.config = config
+	l.buckets = make(map[bucketKey]*bucket)
+}
+
+// allow counts a request of class from ip against the buckets of ip and, on
+// signed requests, of userID. A request is only counted if every bucket has a token.
+func (l *rateLimiter) allow(class RateClass, ip, userID string) rateDecision {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.prune(now)
+
+	var buckets []*bucket
+	if rate, ok := l.config.PerIP[class]; ok {
+		buckets = append(buckets, l.bucket(bucketKey{class, "ip:" + ip}, rate, now))
+	}
+	if userID != "" {
+		if rate, ok := l.config.userBudgets(userID)[class]; ok {
+			buckets = append(buckets, l.bucket(bucketKey{class, "user:" + userID}, rate, now))
+		}
+	}
+	if len(buckets) == 0 {
+		return rateDecision{allowed: true}
+	}
+
+	// the emptiest bucket is the one reported
+	tightest := buckets[0]
+	for _, b := range buckets[1:] {
+		if b.tokens < tightest.tokens {
+			tightest = b
+		}
+	}
+	d := rateDecision{allowed: tightest.tokens >= 1, limit: tightest.rate.Burst}
+	for _, b := range buckets {
+		d.retryAfter = max(d.retryAfter, b.until(1))
+	}
+	if d.allowed {
+		for _, b := range buckets {
+			b.tokens--
+		}
+	}
+	d.remaining = int(math.Max(0, math.Floor(tightest.tokens)))
+	d.reset = tightest.until(float64(tightest.rate.Burst))
+	return d
+}
+
+// the bucket under key refilled to now, a new one if there's none or its rate changed
+func (l *rateLimiter) bucket(key bucketKey, rate Rate, now time.Time) *bucket {
+	b, ok := l.buckets[key]
+	if !ok || b.rate != rate {
+		b = newBucket(rate, now)
+		l.buckets[key] = b
+	}
+	b.refill(now)
+	return b
+}
+
+func (l *rateLimiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < bucketPruneInterval {
+		return
+	}
+	for key, b := range l.buckets {
+		if b.refill(now); b.full() {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastPrune = now
+}
+
+// ConfigureRateLimits replaces the server's rate limits, every bucket starts
+// over full
+func (s *Server) ConfigureRateLimits(config RateLimitConfig) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	s.limiter.configure(config)
+	return nil
+}
+
+// limit counts requests against class. It goes after the route's
+// authentication, so signed requests count against their user too.
+func (s *Server) limit(class RateClass) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) error {
+			d := s.limiter.allow(class, handlers.ClientIP(ctx), handlers.AuthenticatedUser(ctx))
+			if d.limit > 0 {
+				header := ctx.Response().Header()
+				header.Set(HeaderRateLimitLimit, strconv.Itoa(d.limit))
+				header.Set(HeaderRateLimitRemaining, strconv.Itoa(d.remaining))
+				header.Set(HeaderRateLimitReset, strconv.Itoa(ceilSeconds(d.reset)))
+			}
+			if !d.allowed {
+				ctx.Response().Header().Set(HeaderRetryAfter, strconv.Itoa(max(1, ceilSeconds(d.retryAfter))))
+				return ctx.JSON(http.StatusTooManyRequests, map[string]string{"status": "false", "error": fmt.Sprintf("too many %s requests, slow down", class), "code": handlers.ErrCodeRateLimited})
+			}
+			return next(ctx)
+		}
+	}
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
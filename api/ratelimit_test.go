@@ -0,0 +1,127 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/EggsyOnCode/velho-exchange/core"
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiterBuckets(t *testing.T) {
+	config := RateLimitConfig{
+		Tiers: map[string]RateBudgets{
+			TierStandard:    {RateOrders: {Burst: 2, PerSecond: 1}},
+			TierMarketMaker: {RateOrders: {Burst: 4, PerSecond: 1}},
+		},
+		DefaultTier: TierStandard,
+		UserTiers:   map[string]string{"mm": TierMarketMaker},
+		PerIP:       RateBudgets{RateOrders: {Burst: 5, PerSecond: 1}},
+	}
+	require.NoError(t, config.Validate())
+
+	now := time.Unix(1_700_000_000, 0)
+	l := newRateLimiter(config)
+	l.now = func() time.Time { return now }
+
+	d := l.allow(RateOrders, "10.0.0.1", "alice")
+	assert.True(t, d.allowed)
+	assert.Equal(t, 2, d.limit)
+	assert.Equal(t, 1, d.remaining)
+	assert.True(t, l.allow(RateOrders, "10.0.0.1", "alice").allowed)
+
+	d = l.allow(RateOrders, "10.0.0.1", "alice")
+	assert.False(t, d.allowed)
+	assert.Equal(t, 0, d.remaining)
+	assert.Equal(t, time.Second, d.retryAfter)
+	assert.Equal(t, 2*time.Second, d.reset)
+
+	// classes without a budget aren't limited
+	assert.Equal(t, rateDecision{allowed: true}, l.allow(RateCancels, "10.0.0.1", "alice"))
+
+	// a market maker's tier has a bigger budget, but the IP's is shared
+	for i := 0; i < 3; i++ {
+		assert.True(t, l.allow(RateOrders, "10.0.0.1", "mm").allowed)
+	}
+	d = l.allow(RateOrders, "10.0.0.1", "mm")
+	assert.False(t, d.allowed)
+	assert.Equal(t, 5, d.limit)
+	assert.True(t, l.allow(RateOrders, "10.0.0.2", "mm").allowed)
+
+	// refused requests don't take a token from the other buckets
+	now = now.Add(time.Second)
+	assert.True(t, l.allow(RateOrders, "10.0.0.1", "alice").allowed)
+	assert.False(t, l.allow(RateOrders, "10.0.0.1", "bob").allowed)
+
+	// full buckets are dropped
+	now = now.Add(time.Hour)
+	l.allow(RateOrders, "10.0.0.3", "")
+	assert.Len(t, l.buckets, 1)
+
+	config.UserTiers["bob"] = "vip"
+	assert.Error(t, config.Validate())
+}
+
+func TestRateLimitedRoutes(t *testing.T) {
+	server := NewServer(core.NewExchange())
+	require.NoError(t, server.ConfigureRateLimits(RateLimitConfig{
+		Tiers:       map[string]RateBudgets{TierStandard: {}},
+		DefaultTier: TierStandard,
+		PerIP:       RateBudgets{RateMarketData: {Burst: 2, PerSecond: 0.5}},
+	}))
+
+	get := func(path, remoteAddr string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		server.echo.ServeHTTP(w, r)
+		return w
+	}
+
+	w := get("/markets", "192.0.2.1:1000")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "2", w.Header().Get(HeaderRateLimitLimit))
+	assert.Equal(t, "1", w.Header().Get(HeaderRateLimitRemaining))
+	assert.Equal(t, http.StatusOK, get("/markets", "192.0.2.1:1001").Code)
+
+	w = get("/markets", "192.0.2.1:1002")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "2", w.Header().Get(HeaderRetryAfter))
+	assert.Equal(t, "0", w.Header().Get(HeaderRateLimitRemaining))
+	assert.Contains(t, w.Body.String(), "RATE_LIMITED")
+
+	// another IP has its own budget, and routes outside the class aren't limited
+	assert.Equal(t, http.StatusOK, get("/markets", "192.0.2.2:1000").Code)
+	w = get("/admin/fees", "192.0.2.1:1003")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Empty(t, w.Header().Get(HeaderRateLimitLimit))
+}
+
+func TestRegistrationIsLimitedPerIP(t *testing.T) {
+	server := NewServer(core.NewExchange())
+	require.NoError(t, server.ConfigureRateLimits(RateLimitConfig{
+		Tiers:       map[string]RateBudgets{TierStandard: {}},
+		DefaultTier: TierStandard,
+		PerIP:       RateBudgets{RateRegistration: {Burst: 2, PerSecond: 1.0 / 60}},
+	}))
+
+	register := func(remoteAddr string) int {
+		r := httptest.NewRequest(http.MethodPost, "/user", strings.NewReader(`{"private_key":""}`))
+		r.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		server.echo.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, register("192.0.2.1:1000"))
+	assert.Equal(t, http.StatusOK, register("192.0.2.1:1001"))
+	assert.Equal(t, http.StatusTooManyRequests, register("192.0.2.1:1002"))
+	assert.Equal(t, http.StatusOK, register("192.0.2.2:1000"))
+	assert.Len(t, server.exchange.Users, 3)
+}
@@ -0,0 +1,48 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyAPIKeySignature(t *testing.T) {
+	id, secret, err := NewAPIKeyCredentials()
+	require.NoError(t, err)
+	v := NewVerifier(DefaultSignatureWindow)
+	body := []byte(`{"size":"1"}`)
+
+	signed := func(secret, nonce string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/order?market=ETH", bytes.NewReader(body))
+		require.NoError(t, SignRequestWithAPIKey(r, id, secret, nonce))
+		return r
+	}
+
+	r := signed(secret, "a")
+	assert.Equal(t, id, r.Header.Get(HeaderAPIKey))
+	require.NoError(t, v.VerifyAPIKey(r, body, []byte(secret)))
+	assert.ErrorIs(t, v.VerifyAPIKey(signed(secret, "a"), body, []byte(secret)), ErrReplayedNonce)
+
+	assert.ErrorIs(t, v.VerifyAPIKey(signed("not the secret", "b"), body, []byte(secret)), ErrBadSignature)
+	assert.ErrorIs(t, v.VerifyAPIKey(signed(secret, "c"), []byte(`{"size":"2"}`), []byte(secret)), ErrBadSignature)
+
+	// a signature by the key without its header isn't an API key's
+	r = signed(secret, "d")
+	r.Header.Del(HeaderAPIKey)
+	assert.ErrorIs(t, v.VerifyAPIKey(r, body, []byte(secret)), ErrUnsigned)
+
+	// a hash of the secret doesn't sign for it
+	sum := sha256.Sum256([]byte(secret))
+	r = signed(secret, "e")
+	timestamp, err := strconv.ParseInt(r.Header.Get(HeaderTimestamp), 10, 64)
+	require.NoError(t, err)
+	r.Header.Set(HeaderSignature, hex.EncodeToString(apiKeyMAC(sum[:], CanonicalRequest(r.Method, r.URL.RequestURI(), body, "e", timestamp))))
+	assert.ErrorIs(t, v.VerifyAPIKey(r, body, []byte(secret)), ErrBadSignature)
+}
@@ -0,0 +1,176 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// A signed request carries three headers: a nonce the client never uses twice, the
+// unix nanosecond timestamp it was signed at and the signature of its canonical
+// form (see CanonicalRequest) by the user's key. The signature is an Ethereum
+// signed message (EIP-191), so a wallet can sign requests too, and the address it
+// recovers to identifies the user. Requests can be signed with an API key
+// instead, see apikey.go.
+const (
+	HeaderSignature = "X-Velho-Signature"
+	HeaderNonce     = "X-Velho-Nonce"
+	HeaderTimestamp = "X-Velho-Timestamp"
+)
+
+// how far a request's timestamp may be from the server's clock
+const DefaultSignatureWindow = 30 * time.Second
+
+// longest nonce accepted
+const maxNonceLength = 64
+
+var (
+	ErrUnsigned       = errors.New("request isn't signed")
+	ErrBadSignature   = errors.New("invalid request signature")
+	ErrStaleRequest   = errors.New("request timestamp is outside the accepted window")
+	ErrReplayedNonce  = errors.New("request nonce was already used")
+	ErrMalformedNonce = errors.New("request nonce must be 1 to 64 characters")
+)
+
+// CanonicalRequest is what's signed: the method, the path with its query string,
+// the hex SHA-256 of the body, the nonce and the timestamp, one per line
+func CanonicalRequest(method, uri string, body []byte, nonce string, timestamp int64) []byte {
+	sum := sha256.Sum256(body)
+	return []byte(fmt.Sprintf("%s\n%s\n%s\n%s\n%d", method, uri, hex.EncodeToString(sum[:]), nonce, timestamp))
+}
+
+// the hash an Ethereum wallet signs for message
+func messageHash(message []byte) []byte {
+	return crypto.Keccak256([]byte(fmt.Sprintf("\x19Ethereum Signed Message:\n%d", len(message))), message)
+}
+
+// SignRequest signs r with key, with nonce and the current time. The body is read
+// and put back, so it can be sent afterwards.
+func SignRequest(r *http.Request, key *ecdsa.PrivateKey, nonce string) error {
+	var body []byte
+	if r.Body != nil {
+		var err error
+		if body, err = io.ReadAll(r.Body); err != nil {
+			return err
+		}
+		r.Body.Close()
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	timestamp := time.Now().UnixNano()
+	sig, err := crypto.Sign(messageHash(CanonicalRequest(r.Method, r.URL.RequestURI(), body, nonce, timestamp)), key)
+	if err != nil {
+		return err
+	}
+
+	r.Header.Set(HeaderSignature, hex.EncodeToString(sig))
+	r.Header.Set(HeaderNonce, nonce)
+	r.Header.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+	return nil
+}
+
+// Verifier checks signed requests and remembers their nonces for as long as their
+// timestamps are accepted, so none of them can be replayed
+type Verifier struct {
+	window time.Duration
+
+	mu sync.Mutex
+	// nonces seen per signer (an address or an API key), with the timestamps
+	// they were signed at
+	seen      map[string]map[string]int64
+	lastPrune int64
+}
+
+func NewVerifier(window time.Duration) *Verifier {
+	return &Verifier{window: window, seen: make(map[string]map[string]int64)}
+}
+
+// the signature, nonce and timestamp of r, if its timestamp is within the window
+func (v *Verifier) signed(r *http.Request) (sig []byte, nonce string, timestamp, now int64, err error) {
+	sigHex, nonce, tsHeader := r.Header.Get(HeaderSignature), r.Header.Get(HeaderNonce), r.Header.Get(HeaderTimestamp)
+	if sigHex == "" || nonce == "" || tsHeader == "" {
+		return nil, "", 0, 0, ErrUnsigned
+	}
+	if len(nonce) > maxNonceLength {
+		return nil, "", 0, 0, ErrMalformedNonce
+	}
+	timestamp, err = strconv.ParseInt(tsHeader, 10, 64)
+	if err != nil {
+		return nil, "", 0, 0, ErrStaleRequest
+	}
+	now = time.Now().UnixNano()
+	if skew := now - timestamp; skew > int64(v.window) || skew < -int64(v.window) {
+		return nil, "", 0, 0, ErrStaleRequest
+	}
+	if sig, err = hex.DecodeString(sigHex); err != nil {
+		return nil, "", 0, 0, ErrBadSignature
+	}
+	return sig, nonce, timestamp, now, nil
+}
+
+// Verify returns the address r was signed by, body is r's body
+func (v *Verifier) Verify(r *http.Request, body []byte) (common.Address, error) {
+	sig, nonce, timestamp, now, err := v.signed(r)
+	if err != nil {
+		return common.Address{}, err
+	}
+	if len(sig) != crypto.SignatureLength {
+		return common.Address{}, ErrBadSignature
+	}
+	// wallets put 27 / 28 in the recovery ID
+	if sig[crypto.RecoveryIDOffset] >= 27 {
+		sig[crypto.RecoveryIDOffset] -= 27
+	}
+	pub, err := crypto.SigToPub(messageHash(CanonicalRequest(r.Method, r.URL.RequestURI(), body, nonce, timestamp)), sig)
+	if err != nil {
+		return common.Address{}, ErrBadSignature
+	}
+	address := crypto.PubkeyToAddress(*pub)
+
+	if err := v.useNonce(address.Hex(), nonce, timestamp, now); err != nil {
+		return common.Address{}, err
+	}
+	return address, nil
+}
+
+func (v *Verifier) useNonce(signer string, nonce string, timestamp, now int64) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	// a nonce older than the window can't come back, its timestamp would be stale
+	if now-v.lastPrune > int64(v.window) {
+		for signer, nonces := range v.seen {
+			for n, ts := range nonces {
+				if now-ts > int64(v.window) {
+					delete(nonces, n)
+				}
+			}
+			if len(nonces) == 0 {
+				delete(v.seen, signer)
+			}
+		}
+		v.lastPrune = now
+	}
+
+	nonces := v.seen[signer]
+	if nonces == nil {
+		nonces = make(map[string]int64)
+		v.seen[signer] = nonces
+	}
+	if _, ok := nonces[nonce]; ok {
+		return ErrReplayedNonce
+	}
+	nonces[nonce] = timestamp
+	return nil
+}
@@ -0,0 +1,72 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/EggsyOnCode/velho-exchange/internals"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifySignedRequest(t *testing.T) {
+	key := internals.GenerateNewPrivateKey()
+	v := NewVerifier(DefaultSignatureWindow)
+	body := []byte(`{"size":"1"}`)
+
+	signed := func(nonce string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/order?market=ETH", bytes.NewReader(body))
+		require.NoError(t, SignRequest(r, key, nonce))
+		return r
+	}
+
+	address, err := v.Verify(signed("a"), body)
+	require.NoError(t, err)
+	assert.Equal(t, internals.GetAddress(key), address)
+
+	_, err = v.Verify(signed("a"), body)
+	assert.ErrorIs(t, err, ErrReplayedNonce)
+
+	// the query and the body are signed too, changing either recovers another address
+	r := signed("b")
+	r.URL.RawQuery = "market=BTC"
+	if address, err := v.Verify(r, body); err == nil {
+		assert.NotEqual(t, internals.GetAddress(key), address)
+	}
+	if address, err := v.Verify(signed("c"), []byte(`{"size":"2"}`)); err == nil {
+		assert.NotEqual(t, internals.GetAddress(key), address)
+	}
+
+	_, err = v.Verify(httptest.NewRequest(http.MethodGet, "/order", nil), nil)
+	assert.ErrorIs(t, err, ErrUnsigned)
+
+	r = signed("d")
+	r.Header.Set(HeaderTimestamp, strconv.FormatInt(time.Now().Add(-time.Minute).UnixNano(), 10))
+	_, err = v.Verify(r, body)
+	assert.ErrorIs(t, err, ErrStaleRequest)
+}
+
+func TestVerifyWalletSignature(t *testing.T) {
+	key := internals.GenerateNewPrivateKey()
+	v := NewVerifier(DefaultSignatureWindow)
+
+	// a wallet's personal_sign puts 27 / 28 in the recovery ID
+	r := httptest.NewRequest(http.MethodGet, "/order", nil)
+	timestamp := time.Now().UnixNano()
+	sig, err := crypto.Sign(messageHash(CanonicalRequest(http.MethodGet, "/order", nil, "n", timestamp)), key)
+	require.NoError(t, err)
+	sig[crypto.RecoveryIDOffset] += 27
+	r.Header.Set(HeaderSignature, hex.EncodeToString(sig))
+	r.Header.Set(HeaderNonce, "n")
+	r.Header.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+
+	address, err := v.Verify(r, nil)
+	require.NoError(t, err)
+	assert.Equal(t, internals.GetAddress(key), address)
+}
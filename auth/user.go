@@ -5,7 +5,9 @@ import (
 	"crypto/ecdsa"
 	"fmt"
 
+	"github.com/EggsyOnCode/velho-exchange/decimal"
 	"github.com/EggsyOnCode/velho-exchange/internals"
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/google/uuid"
@@ -13,19 +15,23 @@ import (
 )
 
 type User struct {
-	ID         uuid.UUID
-	PrivateKey *ecdsa.PrivateKey
-	USD        float64
+	ID uuid.UUID
+	// of the user's wallet, requests they sign recover to it
+	Address common.Address
+	// only whoever created the user holds it, the exchange keeps it encrypted
+	// (see core.Keystore) and it's never encoded
+	PrivateKey *ecdsa.PrivateKey `json:"-"`
+	USD        decimal.Decimal
 }
 
-func NewUser(pk *ecdsa.PrivateKey, usd float64) *User {
+func NewUser(pk *ecdsa.PrivateKey, usd decimal.Decimal) *User {
 	if pk == nil {
 		pk = internals.GenerateNewPrivateKey()
 	}
 
-
 	user := &User{
 		ID:         uuid.New(),
+		Address:    internals.GetAddress(pk),
 		USD:        usd,
 		PrivateKey: pk,
 	}
@@ -33,8 +39,8 @@ func NewUser(pk *ecdsa.PrivateKey, usd float64) *User {
 	logrus.WithFields(
 		logrus.Fields{
 			"id":      user.ID,
-			"address": internals.GetAddress(user.PrivateKey),
-			"balance": usd,
+			"address": user.Address,
+			"balance": usd.String(),
 		}).Info("New user created")
 
 	return user
@@ -59,7 +65,7 @@ func GenerateUsers() []*User {
 	users := make([]*User, 0)
 
 	for i := 0; i < 3; i++ {
-		user := NewUser(privKeys[i], 0)
+		user := NewUser(privKeys[i], decimal.Zero)
 		users = append(users, user)
 
 	}
@@ -87,7 +93,7 @@ func GenerateMM() ([]*User, []string) {
 	users := make([]*User, 0)
 
 	for i := 0; i < 3; i++ {
-		user := NewUser(privKeys[i], 0)
+		user := NewUser(privKeys[i], decimal.Zero)
 		users = append(users, user)
 
 	}
@@ -96,8 +102,7 @@ func GenerateMM() ([]*User, []string) {
 }
 
 func GetBalance(user *User, client *ethclient.Client) float64 {
-	addr := internals.GetAddress(user.PrivateKey)
-	bal, _ := client.BalanceAt(context.Background(), addr, nil)
+	bal, _ := client.BalanceAt(context.Background(), user.Address, nil)
 
 	ans, _ := internals.WeiToEther(bal).Float64()
 	return ans
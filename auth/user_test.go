@@ -3,23 +3,24 @@ package auth
 import (
 	"testing"
 
+	"github.com/EggsyOnCode/velho-exchange/decimal"
 	"github.com/EggsyOnCode/velho-exchange/internals"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestNewUser(t *testing.T) {
 	// Test with a new private key
-	user := NewUser(nil, 100.0)
+	user := NewUser(nil, decimal.FromInt(100))
 	assert.NotNil(t, user, "New user should not be nil")
 	assert.NotNil(t, user.PrivateKey, "Private key should not be nil")
-	assert.Equal(t, 100.0, user.USD, "User USD balance should be initialized correctly")
+	assert.Equal(t, decimal.FromInt(100), user.USD, "User USD balance should be initialized correctly")
 
 	// Test with an existing private key
 	privKey := internals.GenerateNewPrivateKey()
-	user2 := NewUser(privKey, 50.0)
+	user2 := NewUser(privKey, decimal.FromInt(50))
 	assert.NotNil(t, user2, "New user should not be nil")
 	assert.Equal(t, privKey, user2.PrivateKey, "Private keys should match")
-	assert.Equal(t, 50.0, user2.USD, "User USD balance should be initialized correctly")
+	assert.Equal(t, decimal.FromInt(50), user2.USD, "User USD balance should be initialized correctly")
 }
 
 func TestGenerateUsers(t *testing.T) {
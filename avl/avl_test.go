@@ -0,0 +1,63 @@
+package avl
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	g "github.com/zyedidia/generic"
+)
+
+func TestTreeMatchesAMap(t *testing.T) {
+	tree := New[int, int](g.Less[int])
+	m := make(map[int]int)
+
+	_, _, ok := tree.Min()
+	assert.False(t, ok)
+	_, _, ok = tree.Max()
+	assert.False(t, ok)
+
+	for i := 0; i < 1000; i++ {
+		key := rand.Intn(100)
+		if rand.Intn(2) == 0 {
+			m[key] = i
+			tree.Put(key, i)
+		} else {
+			delete(m, key)
+			tree.Remove(key)
+		}
+
+		assert.Equal(t, len(m), tree.Size())
+		var keys []int
+		tree.Each(func(k, v int) {
+			keys = append(keys, k)
+			assert.Equal(t, m[k], v)
+		})
+		assert.Len(t, keys, len(m))
+		if len(keys) == 0 {
+			continue
+		}
+
+		k, v, ok := tree.Min()
+		assert.True(t, ok)
+		assert.Equal(t, keys[0], k)
+		assert.Equal(t, m[k], v)
+		k, v, ok = tree.Max()
+		assert.True(t, ok)
+		assert.Equal(t, keys[len(keys)-1], k)
+		assert.Equal(t, m[k], v)
+	}
+}
+
+func TestMinFollowsTheOrdering(t *testing.T) {
+	tree := New[int, string](g.Greater[int])
+	tree.Put(10, "ten")
+	tree.Put(30, "thirty")
+	tree.Put(20, "twenty")
+
+	k, v, _ := tree.Min()
+	assert.Equal(t, 30, k)
+	assert.Equal(t, "thirty", v)
+	k, _, _ = tree.Max()
+	assert.Equal(t, 10, k)
+}
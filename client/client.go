@@ -2,14 +2,21 @@ package client
 
 import (
 	"bytes"
+	"crypto/ecdsa"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"strconv"
+	"sync"
 
 	"github.com/EggsyOnCode/velho-exchange/api/handlers"
+	"github.com/EggsyOnCode/velho-exchange/auth"
 	"github.com/EggsyOnCode/velho-exchange/core"
+	"github.com/EggsyOnCode/velho-exchange/decimal"
+	"github.com/EggsyOnCode/velho-exchange/internals"
+	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
 )
 
@@ -19,16 +26,61 @@ const (
 
 type Client struct {
 	client *http.Client
+
+	// keys of the users requests are signed for, by user ID
+	mu   sync.Mutex
+	keys map[string]*ecdsa.PrivateKey
+	// API keys, which are used rather than the user's key when there's one
+	apiKeys map[string]apiKey
+}
+
+type apiKey struct {
+	id, secret string
 }
 
 func NewClient() *Client {
 	c := http.DefaultClient
 	return &Client{
-		client: c,
+		client:  c,
+		keys:    make(map[string]*ecdsa.PrivateKey),
+		apiKeys: make(map[string]apiKey),
 	}
 }
 
-func (c *Client) PlaceOrder(orderType string, price float64, size int64, bid bool, market string, user string) string {
+// AddKey makes the client sign requests for userID with key, users registered
+// with RegisterUser are added already
+func (c *Client) AddKey(userID string, key *ecdsa.PrivateKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.keys[userID] = key
+}
+
+// UseAPIKey makes the client sign requests for userID with the API key keyID,
+// so a bot doesn't need the user's key. Only the routes in the key's scopes
+// can be called.
+func (c *Client) UseAPIKey(userID, keyID, secret string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.apiKeys[userID] = apiKey{id: keyID, secret: secret}
+}
+
+// signs req for user, see auth.SignRequest and auth.SignRequestWithAPIKey
+func (c *Client) sign(req *http.Request, user string) error {
+	c.mu.Lock()
+	key, ok := c.keys[user]
+	apiKey, hasAPIKey := c.apiKeys[user]
+	c.mu.Unlock()
+	if hasAPIKey {
+		return auth.SignRequestWithAPIKey(req, apiKey.id, apiKey.secret, uuid.New().String())
+	}
+	if !ok {
+		return fmt.Errorf("client: no key to sign requests of user %s with", user)
+	}
+
+	return auth.SignRequest(req, key, uuid.New().String())
+}
+
+func (c *Client) PlaceOrder(orderType string, price decimal.Decimal, size decimal.Decimal, bid bool, market string, user string) string {
 	var t handlers.OrderType
 	if orderType == "LIMIT" {
 		t = handlers.LimitOrder
@@ -42,6 +94,27 @@ func (c *Client) PlaceOrder(orderType string, price float64, size int64, bid boo
 		Bid:       bid,
 		Market:    core.Market(market),
 	}
+
+	id, _ := c.SubmitOrder(order, user)
+	return id
+}
+
+// APIError is returned when the exchange rejects a request
+type APIError struct {
+	StatusCode int
+	// machine readable reason, e.g. handlers.ErrCodePostOnlyWouldCross (may be empty)
+	Code    string
+	Message string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("client: request failed with status %d: %s", e.StatusCode, e.Message)
+}
+
+// SubmitOrder places a fully specified order (time in force, post only etc.) on behalf of user,
+// it returns the order ID for limit and stop orders and the number of matches for market orders.
+// Rejections by the exchange are returned as an *APIError.
+func (c *Client) SubmitOrder(order *handlers.PlaceOrderRequest, user string) (string, error) {
 	body, err := json.Marshal(order)
 	if err != nil {
 		log.Fatalf("client: error marshaling request body: %s\n", err)
@@ -49,17 +122,14 @@ func (c *Client) PlaceOrder(orderType string, price float64, size int64, bid boo
 
 	endpoint := Endpoint + "/order"
 	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
-
-	// Add the user ID as a query parameter
-	q := req.URL.Query()
-	q.Add("user", user)
-	req.URL.RawQuery = q.Encode()
-
 	if err != nil {
 		log.Fatalf("client: error creating http request: %s\n", err)
 	}
 
 	req.Header.Set("Content-Type", "application/json")
+	if err := c.sign(req, user); err != nil {
+		return "", err
+	}
 
 	res, err := c.client.Do(req)
 	if err != nil {
@@ -80,30 +150,100 @@ func (c *Client) PlaceOrder(orderType string, price float64, size int64, bid boo
 			log.Fatalf("client: error unmarshaling response body: %s\n", err)
 		}
 
-		if orderType == "LIMIT" {
+		if order.OrderType != handlers.MarketOrder {
 			if orderId, ok := response["id"].(string); ok {
-				return orderId
+				return orderId, nil
 			}
 		} else {
 			if matches, ok := response["matches"].([]interface{}); ok {
 
-				return strconv.Itoa(len(matches))
+				return strconv.Itoa(len(matches)), nil
 			}
 		}
 
-	} else {
-		logrus.WithFields(logrus.Fields{
-			"error": "not enough volume for market order ",
-		}).Info("market order failed")
+		return "", nil
 	}
 
-	return ""
+	var response map[string]string
+	bodyBytes, _ := ioutil.ReadAll(res.Body)
+	json.Unmarshal(bodyBytes, &response)
+
+	apiErr := &APIError{
+		StatusCode: res.StatusCode,
+		Code:       response["code"],
+		Message:    response["error"],
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"orderType": order.OrderType,
+		"status":    res.StatusCode,
+		"code":      apiErr.Code,
+		"error":     apiErr.Message,
+	}).Info("order failed")
+
+	return "", apiErr
 }
 
-func (c *Client) RegisterUser(privKey string, usd float64) string {
+// AmendOrder changes the price and remaining size of user's resting limit order in one request,
+// rejections by the exchange (e.g. the order was already filled) are returned as an *APIError
+func (c *Client) AmendOrder(orderID string, market string, price, size decimal.Decimal, user string) error {
+	body, err := json.Marshal(&handlers.AmendOrderRequest{
+		Price: price,
+		Size:  size,
+	})
+	if err != nil {
+		log.Fatalf("client: error marshaling request body: %s\n", err)
+	}
+
+	endpoint := Endpoint + "/order/" + orderID
+	req, err := http.NewRequest(http.MethodPut, endpoint, bytes.NewReader(body))
+	if err != nil {
+		log.Fatalf("client: error creating http request: %s\n", err)
+	}
+
+	q := req.URL.Query()
+	q.Add("market", market)
+	req.URL.RawQuery = q.Encode()
+
+	req.Header.Set("Content-Type", "application/json")
+	if err := c.sign(req, user); err != nil {
+		return err
+	}
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		log.Fatalf("client: error making http request: %s\n", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	var response map[string]string
+	bodyBytes, _ := ioutil.ReadAll(res.Body)
+	json.Unmarshal(bodyBytes, &response)
+
+	return &APIError{
+		StatusCode: res.StatusCode,
+		Code:       response["code"],
+		Message:    response["error"],
+	}
+}
+
+// RegisterUser registers a user with the hex private key, or a new one if it's
+// empty, and signs the user's requests with it from then on
+func (c *Client) RegisterUser(privKey string) string {
+	if privKey == "" {
+		privKey = internals.EncodeHexString(internals.GenerateNewPrivateKey())
+	}
+	key, err := internals.GetPrivKeyFromHexString(privKey)
+	if err != nil {
+		log.Fatalf("client: invalid private key: %s\n", err)
+	}
+
 	user := &handlers.User{
 		PrivateKey: privKey,
-		Usd:        usd,
 	}
 
 	body, err := json.Marshal(user)
@@ -140,10 +280,20 @@ func (c *Client) RegisterUser(privKey string, usd float64) string {
 
 		// Extract user ID from response
 		if userID, ok := response["user"].(string); ok {
+			c.AddKey(userID, key)
 			return userID
 		}
 
 		log.Println("client: user ID not found in response")
+	} else if res.StatusCode == http.StatusConflict {
+		// the key was registered before, e.g. by an earlier run
+		var response map[string]string
+		bodyBytes, _ := ioutil.ReadAll(res.Body)
+		json.Unmarshal(bodyBytes, &response)
+		if userID := response["user"]; userID != "" {
+			c.AddKey(userID, key)
+			return userID
+		}
 	} else {
 		log.Printf("client: failed to register user, status code: %d\n", res.StatusCode)
 	}
@@ -151,7 +301,7 @@ func (c *Client) RegisterUser(privKey string, usd float64) string {
 	return ""
 }
 
-func (c *Client) GetBestAskPrice(market string) float64 {
+func (c *Client) GetBestAskPrice(market string) decimal.Decimal {
 	endpoint := Endpoint + "/book/ask?market=" + market
 	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
 	if err != nil {
@@ -165,7 +315,7 @@ func (c *Client) GetBestAskPrice(market string) float64 {
 
 	if res.StatusCode == http.StatusOK {
 		// Decode response body
-		var response map[string]float64
+		var response map[string]decimal.Decimal
 		bodyBytes, err := ioutil.ReadAll(res.Body)
 		if err != nil {
 			log.Fatalf("client: error reading response body: %s\n", err)
@@ -185,10 +335,10 @@ func (c *Client) GetBestAskPrice(market string) float64 {
 		log.Printf("client: failed to get best ask price, status code: %d\n", res.StatusCode)
 	}
 
-	return 0
+	return decimal.Zero
 }
 
-func (c *Client) GetBestBidPrice(market string) float64 {
+func (c *Client) GetBestBidPrice(market string) decimal.Decimal {
 	endpoint := Endpoint + "/book/bid?market=" + market
 	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
 	if err != nil {
@@ -202,7 +352,7 @@ func (c *Client) GetBestBidPrice(market string) float64 {
 
 	if res.StatusCode == http.StatusOK {
 		// Decode response body
-		var response map[string]float64
+		var response map[string]decimal.Decimal
 		bodyBytes, err := ioutil.ReadAll(res.Body)
 		if err != nil {
 			log.Fatalf("client: error reading response body: %s\n", err)
@@ -222,7 +372,7 @@ func (c *Client) GetBestBidPrice(market string) float64 {
 		log.Printf("client: failed to get best ask price, status code: %d\n", res.StatusCode)
 	}
 
-	return 0
+	return decimal.Zero
 }
 
 type Orders struct {
@@ -237,11 +387,15 @@ type Response struct {
 }
 
 func (c *Client) GetOrders(userId string) Response {
-	endpoint := Endpoint + "/order?userID=" + userId
+	endpoint := Endpoint + "/order"
 	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
 	if err != nil {
 		log.Fatalf("client: error creating http request: %s\n", err)
 	}
+	if err := c.sign(req, userId); err != nil {
+		log.Printf("client: %s\n", err)
+		return Response{}
+	}
 
 	res, err := c.client.Do(req)
 	if err != nil {
@@ -308,11 +462,6 @@ func (c *Client) GetTrades(market string) []*core.Trade {
 	return nil
 }
 
-func calculateAvgMarketOrderPrice(matches []interface{}) float64 {
-	var total float64
-	for _, m := range matches {
-		match := m.(map[string]interface{})
-		total += match["Price"].(float64) / match["SizeFilled"].(float64)
-	}
-	return total / float64(len(matches))
+func calculateAvgMarketOrderPrice(matches []core.Match) decimal.Decimal {
+	return core.CalculateAvgMarketOrderPrice(matches)
 }
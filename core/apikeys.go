@@ -0,0 +1,267 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/EggsyOnCode/velho-exchange/auth"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/sirupsen/logrus"
+)
+
+// APIScope is what requests signed with an API key may do
+type APIScope string
+
+const (
+	// look at orders, balances, trades and transfers
+	ScopeRead APIScope = "read"
+	// place, amend and cancel orders
+	ScopeTrade APIScope = "trade"
+	// request withdrawals
+	ScopeWithdraw APIScope = "withdraw"
+)
+
+var (
+	ErrAPIKeyNotFound = errors.New("API key not found")
+	ErrInvalidAPIKey  = errors.New("invalid API key")
+)
+
+func (s APIScope) valid() bool {
+	return s == ScopeRead || s == ScopeTrade || s == ScopeWithdraw
+}
+
+// APIKey lets a user's bots sign requests without the user's wallet key, see
+// auth.SignRequestWithAPIKey. Its secret is only handed out when it's created.
+type APIKey struct {
+	ID     string     `json:"id"`
+	UserID string     `json:"user_id"`
+	Label  string     `json:"label,omitempty"`
+	Scopes []APIScope `json:"scopes"`
+	// IPs and CIDR ranges the key can be used from, any when it's empty
+	AllowedIPs []string `json:"allowed_ips,omitempty"`
+	// unix nanos, zero if it doesn't expire
+	ExpiresAt int64 `json:"expires_at,omitempty"`
+	CreatedAt int64 `json:"created_at"`
+}
+
+func (k APIKey) HasScope(scope APIScope) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func (k APIKey) Expired(now time.Time) bool {
+	return k.ExpiresAt != 0 && now.UnixNano() >= k.ExpiresAt
+}
+
+// AllowsIP reports whether the key can be used from ip
+func (k APIKey) AllowsIP(ip net.IP) bool {
+	if len(k.AllowedIPs) == 0 {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+	for _, allowed := range k.AllowedIPs {
+		if _, ipNet, err := net.ParseCIDR(allowed); err == nil {
+			if ipNet.Contains(ip) {
+				return true
+			}
+		} else if ip.Equal(net.ParseIP(allowed)) {
+			return true
+		}
+	}
+	return false
+}
+
+// keyring keeps users' API keys, by ID, with their secrets, which requests are
+// HMAC'd with. The secrets are only logged and snapshotted sealed by the keystore.
+type keyring struct {
+	mu      sync.Mutex
+	keys    map[string]APIKey
+	secrets map[string][]byte
+	sealed  map[string]keystore.CryptoJSON
+}
+
+func newKeyring() *keyring {
+	return &keyring{
+		keys:    make(map[string]APIKey),
+		secrets: make(map[string][]byte),
+		sealed:  make(map[string]keystore.CryptoJSON),
+	}
+}
+
+// CreateAPIKey gives userID a new API key with spec's label, scopes, allowed IPs
+// and expiry. The secret returned is only handed out this once, the exchange
+// keeps it encrypted with the keystore's passphrase.
+func (ex *Exchange) CreateAPIKey(userID string, spec APIKey) (APIKey, string, error) {
+	id, secret, err := auth.NewAPIKeyCredentials()
+	if err != nil {
+		return APIKey{}, "", err
+	}
+	sealed, err := ex.keystore.seal([]byte(secret))
+	if err != nil {
+		return APIKey{}, "", err
+	}
+	spec.ID, spec.UserID = id, userID
+	cmd := &createAPIKeyCommand{Key: spec, Secret: sealed}
+	if err := ex.execute(CmdCreateAPIKey, cmd); err != nil {
+		return APIKey{}, "", err
+	}
+	return cmd.key, secret, nil
+}
+
+func (ex *Exchange) createAPIKey(key APIKey, sealed keystore.CryptoJSON) (APIKey, error) {
+	if _, ok := ex.Users[key.UserID]; !ok {
+		return APIKey{}, fmt.Errorf("user %s not found", key.UserID)
+	}
+	if len(key.Scopes) == 0 {
+		return APIKey{}, fmt.Errorf("%w: it needs at least one scope", ErrInvalidAPIKey)
+	}
+	for _, scope := range key.Scopes {
+		if !scope.valid() {
+			return APIKey{}, fmt.Errorf("%w: unknown scope %q", ErrInvalidAPIKey, scope)
+		}
+	}
+	for _, allowed := range key.AllowedIPs {
+		if _, _, err := net.ParseCIDR(allowed); err != nil && net.ParseIP(allowed) == nil {
+			return APIKey{}, fmt.Errorf("%w: %q is neither an IP nor a CIDR range", ErrInvalidAPIKey, allowed)
+		}
+	}
+	now := ex.now()
+	if key.ExpiresAt != 0 && key.ExpiresAt <= now {
+		return APIKey{}, fmt.Errorf("%w: it expires in the past", ErrInvalidAPIKey)
+	}
+	key.Scopes = append([]APIScope(nil), key.Scopes...)
+	key.AllowedIPs = append([]string(nil), key.AllowedIPs...)
+	key.CreatedAt = now
+
+	k := ex.apiKeys
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if _, ok := k.keys[key.ID]; ok {
+		return APIKey{}, fmt.Errorf("%w: key %s already exists", ErrInvalidAPIKey, key.ID)
+	}
+	secret, err := ex.keystore.open(sealed)
+	if err != nil {
+		return APIKey{}, fmt.Errorf("API key %s: %w", key.ID, err)
+	}
+	k.keys[key.ID] = key
+	k.secrets[key.ID] = secret
+	k.sealed[key.ID] = sealed
+
+	logrus.WithFields(logrus.Fields{
+		"id":     key.ID,
+		"userId": key.UserID,
+		"scopes": key.Scopes,
+	}).Info("API key created")
+
+	return key, nil
+}
+
+// APIKeys returns userID's API keys, oldest first
+func (ex *Exchange) APIKeys(userID string) []APIKey {
+	k := ex.apiKeys
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	keys := make([]APIKey, 0)
+	for _, key := range k.keys {
+		if key.UserID == userID {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].CreatedAt != keys[j].CreatedAt {
+			return keys[i].CreatedAt < keys[j].CreatedAt
+		}
+		return keys[i].ID < keys[j].ID
+	})
+	return keys
+}
+
+// LookupAPIKey returns the API key id and its secret, which requests signed with
+// it are checked against
+func (ex *Exchange) LookupAPIKey(id string) (APIKey, []byte, bool) {
+	k := ex.apiKeys
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	key, ok := k.keys[id]
+	return key, k.secrets[id], ok
+}
+
+// RevokeAPIKey deletes userID's API key id, requests signed with it are refused from then on
+func (ex *Exchange) RevokeAPIKey(userID, id string) error {
+	return ex.execute(CmdRevokeAPIKey, &revokeAPIKeyCommand{UserID: userID, ID: id})
+}
+
+func (ex *Exchange) revokeAPIKey(userID, id string) error {
+	k := ex.apiKeys
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	// someone else's key is as good as missing
+	if key, ok := k.keys[id]; !ok || key.UserID != userID {
+		return ErrAPIKeyNotFound
+	}
+	delete(k.keys, id)
+	delete(k.secrets, id)
+	delete(k.sealed, id)
+
+	logrus.WithFields(logrus.Fields{
+		"id":     id,
+		"userId": userID,
+	}).Info("API key revoked")
+
+	return nil
+}
+
+// what snapshots keep of an API key
+type APIKeySnapshot struct {
+	APIKey
+	// encrypted with the keystore's passphrase
+	Secret keystore.CryptoJSON `json:"secret"`
+}
+
+func (k *keyring) snapshot() []APIKeySnapshot {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	keys := make([]APIKeySnapshot, 0, len(k.keys))
+	for id, key := range k.keys {
+		keys = append(keys, APIKeySnapshot{APIKey: key, Secret: k.sealed[id]})
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ID < keys[j].ID })
+	return keys
+}
+
+// ks opens the secrets, it has to be restored first
+func (k *keyring) restore(keys []APIKeySnapshot, ks *Keystore) error {
+	secrets := make(map[string][]byte, len(keys))
+	for _, key := range keys {
+		secret, err := ks.open(key.Secret)
+		if err != nil {
+			return fmt.Errorf("API key %s: %w", key.ID, err)
+		}
+		secrets[key.ID] = secret
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys = make(map[string]APIKey, len(keys))
+	k.secrets = secrets
+	k.sealed = make(map[string]keystore.CryptoJSON, len(keys))
+	for _, key := range keys {
+		k.keys[key.ID] = key.APIKey
+		k.sealed[key.ID] = key.Secret
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package core
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/EggsyOnCode/velho-exchange/auth"
+	"github.com/EggsyOnCode/velho-exchange/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAPIKeys(t *testing.T) {
+	ex := NewExchange()
+	user := auth.NewUser(nil, decimal.FromInt(1_000))
+	other := auth.NewUser(nil, decimal.FromInt(1_000))
+	require.NoError(t, ex.AddUser(user))
+	require.NoError(t, ex.AddUser(other))
+	userID := user.ID.String()
+
+	expiry := time.Now().Add(time.Hour).UnixNano()
+	key, secret, err := ex.CreateAPIKey(userID, APIKey{
+		Label:      "bot",
+		Scopes:     []APIScope{ScopeRead, ScopeTrade},
+		AllowedIPs: []string{"10.0.0.0/8", "192.168.1.7"},
+		ExpiresAt:  expiry,
+	})
+	require.NoError(t, err)
+	assert.NotEmpty(t, key.ID)
+	assert.Equal(t, userID, key.UserID)
+	assert.NotZero(t, key.CreatedAt)
+
+	// requests are checked against the secret, which is only kept encrypted at rest
+	found, foundSecret, ok := ex.LookupAPIKey(key.ID)
+	require.True(t, ok)
+	assert.Equal(t, key, found)
+	assert.Equal(t, []byte(secret), foundSecret)
+	snapshot, err := json.Marshal(ex.Snapshot())
+	require.NoError(t, err)
+	assert.NotContains(t, string(snapshot), secret)
+
+	assert.True(t, key.HasScope(ScopeTrade))
+	assert.False(t, key.HasScope(ScopeWithdraw))
+	assert.True(t, key.AllowsIP(net.ParseIP("10.1.2.3")))
+	assert.True(t, key.AllowsIP(net.ParseIP("192.168.1.7")))
+	assert.False(t, key.AllowsIP(net.ParseIP("192.168.1.8")))
+	assert.False(t, key.Expired(time.Now()))
+	assert.True(t, key.Expired(time.Unix(0, expiry)))
+
+	_, _, err = ex.CreateAPIKey(userID, APIKey{})
+	assert.ErrorIs(t, err, ErrInvalidAPIKey)
+	_, _, err = ex.CreateAPIKey(userID, APIKey{Scopes: []APIScope{"admin"}})
+	assert.ErrorIs(t, err, ErrInvalidAPIKey)
+	_, _, err = ex.CreateAPIKey(userID, APIKey{Scopes: []APIScope{ScopeRead}, AllowedIPs: []string{"somewhere"}})
+	assert.ErrorIs(t, err, ErrInvalidAPIKey)
+	_, _, err = ex.CreateAPIKey(userID, APIKey{Scopes: []APIScope{ScopeRead}, ExpiresAt: time.Now().Add(-time.Hour).UnixNano()})
+	assert.ErrorIs(t, err, ErrInvalidAPIKey)
+	_, _, err = ex.CreateAPIKey("nobody", APIKey{Scopes: []APIScope{ScopeRead}})
+	assert.Error(t, err)
+
+	second, _, err := ex.CreateAPIKey(userID, APIKey{Scopes: []APIScope{ScopeRead}})
+	require.NoError(t, err)
+	assert.Equal(t, []APIKey{key, second}, ex.APIKeys(userID))
+	assert.Empty(t, ex.APIKeys(other.ID.String()))
+
+	// a key can only be revoked by its user
+	assert.ErrorIs(t, ex.RevokeAPIKey(other.ID.String(), key.ID), ErrAPIKeyNotFound)
+	require.NoError(t, ex.RevokeAPIKey(userID, key.ID))
+	_, _, ok = ex.LookupAPIKey(key.ID)
+	assert.False(t, ok)
+	assert.Equal(t, []APIKey{second}, ex.APIKeys(userID))
+	assert.ErrorIs(t, ex.RevokeAPIKey(userID, key.ID), ErrAPIKeyNotFound)
+}
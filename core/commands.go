@@ -0,0 +1,656 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/EggsyOnCode/velho-exchange/auth"
+	"github.com/EggsyOnCode/velho-exchange/decimal"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// Everything that changes the exchange's state goes through execute as a
+// command: it's appended to the write-ahead log, if one is open, and applied
+// under the command lock, so the log holds the commands in the order they were
+// applied. While a command is applied the engine's clock reads the time it was
+// logged with, which makes replaying it give the same books, balances and trades.
+//
+// A command is applied the same way whether it's live or replayed, its results
+// are kept in unexported fields for the live caller. Commands that change a
+// market's book are handed to the market's sequencer, see sequencer.go.
+//
+// A command that can check up front whether it applies (a validator) is only
+// logged if it does, what it rejects never reaches the log. A command that
+// panics while it's applied fails with ErrRequestPanicked, live and replayed
+// alike, so the log replays to what was applied and doesn't take the exchange
+// down on every boot.
+
+const (
+	CmdRegisterUser           CommandType = "REGISTER_USER"
+	CmdSetSelfTradePrevention CommandType = "SET_SELF_TRADE_PREVENTION"
+	CmdSetFeeCurrency         CommandType = "SET_FEE_CURRENCY"
+	CmdCreateMarket           CommandType = "CREATE_MARKET"
+	CmdSetMarketStatus        CommandType = "SET_MARKET_STATUS"
+	CmdSetFeeSchedule         CommandType = "SET_FEE_SCHEDULE"
+	CmdPlaceOrder             CommandType = "PLACE_ORDER"
+	CmdCancelOrder            CommandType = "CANCEL_ORDER"
+	CmdAmendOrder             CommandType = "AMEND_ORDER"
+	CmdExpireOrders           CommandType = "EXPIRE_ORDERS"
+	CmdDepositAddress         CommandType = "DEPOSIT_ADDRESS"
+	CmdCreditDeposit          CommandType = "CREDIT_DEPOSIT"
+	CmdSetWithdrawalLimits    CommandType = "SET_WITHDRAWAL_LIMITS"
+	CmdRequestWithdrawal      CommandType = "REQUEST_WITHDRAWAL"
+	CmdApproveWithdrawal      CommandType = "APPROVE_WITHDRAWAL"
+	CmdRejectWithdrawal       CommandType = "REJECT_WITHDRAWAL"
+	CmdFailWithdrawal         CommandType = "FAIL_WITHDRAWAL"
+	CmdCreateAPIKey           CommandType = "CREATE_API_KEY"
+	CmdRevokeAPIKey           CommandType = "REVOKE_API_KEY"
+	CmdSetMaxOpenOrders       CommandType = "SET_MAX_OPEN_ORDERS"
+	CmdSetRiskLimits          CommandType = "SET_RISK_LIMITS"
+	CmdReverseTransfer        CommandType = "REVERSE_TRANSFER"
+)
+
+type command interface {
+	apply(ex *Exchange) error
+}
+
+// a command that checks it can be applied before it's logged, ex.cmdMu is held
+type validator interface {
+	command
+	validate(ex *Exchange) error
+}
+
+// a command that changes the book of one market, its sequencer applies it
+type marketCommand interface {
+	command
+	market() Market
+}
+
+// an empty command of each type, to decode logged ones into
+var commandTypes = map[CommandType]func() command{
+	CmdRegisterUser:           func() command { return &registerUserCommand{} },
+	CmdSetSelfTradePrevention: func() command { return &selfTradePreventionCommand{} },
+	CmdSetFeeCurrency:         func() command { return &feeCurrencyCommand{} },
+	CmdCreateMarket:           func() command { return &createMarketCommand{} },
+	CmdSetMarketStatus:        func() command { return &marketStatusCommand{} },
+	CmdSetFeeSchedule:         func() command { return &feeScheduleCommand{} },
+	CmdPlaceOrder:             func() command { return &placeOrderCommand{} },
+	CmdCancelOrder:            func() command { return &cancelOrderCommand{} },
+	CmdAmendOrder:             func() command { return &amendOrderCommand{} },
+	CmdExpireOrders:           func() command { return &expireOrdersCommand{} },
+	CmdDepositAddress:         func() command { return &depositAddressCommand{} },
+	CmdCreditDeposit:          func() command { return &creditDepositCommand{} },
+	CmdSetWithdrawalLimits:    func() command { return &withdrawalLimitsCommand{} },
+	CmdRequestWithdrawal:      func() command { return &requestWithdrawalCommand{} },
+	CmdApproveWithdrawal:      func() command { return &approveWithdrawalCommand{} },
+	CmdRejectWithdrawal:       func() command { return &rejectWithdrawalCommand{} },
+	CmdFailWithdrawal:         func() command { return &failWithdrawalCommand{} },
+	CmdCreateAPIKey:           func() command { return &createAPIKeyCommand{} },
+	CmdRevokeAPIKey:           func() command { return &revokeAPIKeyCommand{} },
+	CmdSetMaxOpenOrders:       func() command { return &maxOpenOrdersCommand{} },
+	CmdSetRiskLimits:          func() command { return &riskLimitsCommand{} },
+	CmdReverseTransfer:        func() command { return &reverseTransferCommand{} },
+}
+
+// execute logs cmd and applies it, on the market's sequencer if it's a market's command.
+// Either way it's logged and applied holding ex.cmdMu, so commands are applied one
+// at a time across every market: they move balances all markets share and the
+// log replays them in a single order. A market's sequencer orders its requests
+// and runs reads of its book without the lock, it doesn't apply commands in
+// parallel with other markets'.
+func (ex *Exchange) execute(typ CommandType, cmd command) error {
+	if cmd, ok := cmd.(marketCommand); ok {
+		req := newRequest()
+		req.typ, req.cmd = typ, cmd
+		req = ex.submit(cmd.market(), req)
+		<-req.done
+		return req.err
+	}
+	return ex.logAndApply(typ, cmd)
+}
+
+func (ex *Exchange) logAndApply(typ CommandType, cmd command) error {
+	ex.cmdMu.Lock()
+	defer ex.cmdMu.Unlock()
+
+	if v, ok := cmd.(validator); ok {
+		if err := v.validate(ex); err != nil {
+			return err
+		}
+	}
+
+	c := Command{Type: typ, Time: max(time.Now().UnixNano(), ex.clock)}
+	if ex.wal != nil {
+		data, err := json.Marshal(cmd)
+		if err != nil {
+			return err
+		}
+		c.Data = data
+		if err := ex.wal.Append(&c); err != nil {
+			return fmt.Errorf("logging %s: %w", typ, err)
+		}
+		ex.seq = c.Seq
+	}
+
+	return ex.applyAt(c.Time, cmd)
+}
+
+// applies cmd with the engine's clock starting at t, ex.cmdMu is held. A panic
+// fails the command, what it changed before it stays as it does on replay.
+func (ex *Exchange) applyAt(t int64, cmd command) (err error) {
+	ex.clock = t
+	ex.applying = true
+	defer func() {
+		ex.applying = false
+		// the next command is logged after this one
+		ex.clock = max(ex.clock, t+1)
+
+		if r := recover(); r != nil {
+			logrus.WithFields(logrus.Fields{
+				"command": fmt.Sprintf("%T", cmd),
+				"panic":   r,
+				"stack":   string(debug.Stack()),
+			}).Error("command panicked")
+			err = fmt.Errorf("%w: %v", ErrRequestPanicked, r)
+		}
+	}()
+
+	return cmd.apply(ex)
+}
+
+// now is the time state changes are stamped with. While a command is applied
+// it's the command's time, moved on by a nanosecond every time it's read so
+// what's stamped stays unique, otherwise it's the wall clock.
+func (ex *Exchange) now() int64 {
+	if !ex.applying {
+		return time.Now().UnixNano()
+	}
+	ex.clock++
+	return ex.clock - 1
+}
+
+// OpenWAL replays the write-ahead log at path onto the exchange and logs every
+// command from then on. The exchange has to be as it was when the log was
+// started, or restored from a snapshot of it (see Recover): only configured,
+// with the same settlement backends and journal, so the transfers replayed
+// commands queue are matched with the journaled ones rather than sent again.
+// Commands a restored snapshot already holds are skipped.
+func (ex *Exchange) OpenWAL(path string, config WALConfig) error {
+	wal, commands, err := OpenWAL(path, config)
+	if err != nil {
+		return err
+	}
+
+	if err := wal.resume(ex.seq, commands); err != nil {
+		wal.Close()
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if err := ex.replay(commands); err != nil {
+		wal.Close()
+		return err
+	}
+
+	ex.cmdMu.Lock()
+	ex.wal = wal
+	ex.cmdMu.Unlock()
+
+	// a withdrawal whose transfer failed before that was logged is credited back
+	// now, a failed transfer into custody is reversed
+	ex.followWithdrawals()
+	ex.followPulls()
+
+	logrus.WithFields(logrus.Fields{
+		"path":     path,
+		"commands": len(commands),
+		"sync":     config.Sync,
+	}).Info("write-ahead log replayed")
+
+	return nil
+}
+
+// CloseWAL syncs and closes the write-ahead log, commands aren't logged afterwards
+func (ex *Exchange) CloseWAL() error {
+	ex.cmdMu.Lock()
+	defer ex.cmdMu.Unlock()
+
+	if ex.wal == nil {
+		return nil
+	}
+	err := ex.wal.Close()
+	ex.wal = nil
+	return err
+}
+
+// applies commands in order. Commands that were rejected when they were logged
+// are rejected again, only one that can't be read stops the replay.
+func (ex *Exchange) replay(commands []Command) error {
+	ex.cmdMu.Lock()
+	defer ex.cmdMu.Unlock()
+
+	ex.settler.startReplay(ex.restoredTransferID)
+	defer ex.settler.endReplay()
+
+	for _, c := range commands {
+		if c.Seq <= ex.seq {
+			continue
+		}
+		newCommand, ok := commandTypes[c.Type]
+		if !ok {
+			return fmt.Errorf("command %d: unknown type %q", c.Seq, c.Type)
+		}
+		cmd := newCommand()
+		if err := json.Unmarshal(c.Data, cmd); err != nil {
+			return fmt.Errorf("command %d: %w", c.Seq, err)
+		}
+
+		if err := ex.applyAt(c.Time, cmd); err != nil {
+			logrus.WithError(err).WithFields(logrus.Fields{
+				"seq":  c.Seq,
+				"type": c.Type,
+			}).Debug("replayed command rejected")
+		}
+		ex.seq = c.Seq
+	}
+
+	return nil
+}
+
+type registerUserCommand struct {
+	ID      uuid.UUID      `json:"id"`
+	Address common.Address `json:"address"`
+	// the user's key, encrypted by the keystore
+	Key json.RawMessage `json:"key"`
+	USD decimal.Decimal `json:"usd"`
+
+	user *auth.User
+}
+
+func (c *registerUserCommand) apply(ex *Exchange) error {
+	if len(c.Key) == 0 {
+		return fmt.Errorf("user %s has no encrypted key", c.ID)
+	}
+	if c.user == nil {
+		c.user = &auth.User{ID: c.ID, Address: c.Address, USD: c.USD}
+	}
+	if _, ok := ex.addresses[c.Address]; ok {
+		return ErrKeyInUse
+	}
+	if address, err := ex.keystore.add(c.Key); err != nil {
+		return err
+	} else if address != c.Address {
+		return fmt.Errorf("user %s: key is for %s, not %s", c.ID, address, c.Address)
+	}
+
+	ex.addUser(c.user)
+	return nil
+}
+
+type selfTradePreventionCommand struct {
+	UserID string              `json:"user_id"`
+	Mode   SelfTradePrevention `json:"mode"`
+}
+
+func (c *selfTradePreventionCommand) apply(ex *Exchange) error {
+	return ex.setSelfTradePrevention(c.UserID, c.Mode)
+}
+
+type feeCurrencyCommand struct {
+	UserID   string      `json:"user_id"`
+	Currency FeeCurrency `json:"currency"`
+}
+
+func (c *feeCurrencyCommand) apply(ex *Exchange) error {
+	return ex.setFeeCurrency(c.UserID, c.Currency)
+}
+
+type createMarketCommand struct {
+	Market Market     `json:"market"`
+	Spec   MarketSpec `json:"spec"`
+
+	ob *OrderBook
+}
+
+func (c *createMarketCommand) apply(ex *Exchange) (err error) {
+	c.ob, err = ex.createMarket(c.Market, c.Spec)
+	return err
+}
+
+type marketStatusCommand struct {
+	Market Market       `json:"market"`
+	Status MarketStatus `json:"status"`
+}
+
+func (c *marketStatusCommand) market() Market { return c.Market }
+
+func (c *marketStatusCommand) apply(ex *Exchange) error {
+	return ex.setMarketStatus(c.Market, c.Status)
+}
+
+type feeScheduleCommand struct {
+	Market   Market      `json:"market"`
+	Schedule FeeSchedule `json:"schedule"`
+}
+
+func (c *feeScheduleCommand) market() Market { return c.Market }
+
+func (c *feeScheduleCommand) apply(ex *Exchange) error {
+	return ex.setFeeSchedule(c.Market, c.Schedule)
+}
+
+type riskLimitsCommand struct {
+	Market Market     `json:"market"`
+	Limits RiskLimits `json:"limits"`
+}
+
+func (c *riskLimitsCommand) market() Market { return c.Market }
+
+func (c *riskLimitsCommand) apply(ex *Exchange) error {
+	return ex.setRiskLimits(c.Market, c.Limits)
+}
+
+// an order as it was placed, before anything matched
+type placeOrderCommand struct {
+	Market              Market              `json:"market"`
+	ID                  uuid.UUID           `json:"id"`
+	UserID              string              `json:"user_id"`
+	OrderType           OrderType           `json:"order_type"`
+	Bid                 bool                `json:"bid"`
+	Size                decimal.Decimal     `json:"size"`
+	Price               decimal.Decimal     `json:"price"`
+	Timestamp           int64               `json:"timestamp"`
+	TimeInForce         TimeInForce         `json:"time_in_force"`
+	ExpiresAt           int64               `json:"expires_at,omitempty"`
+	PostOnly            bool                `json:"post_only,omitempty"`
+	PostOnlyReprice     bool                `json:"post_only_reprice,omitempty"`
+	StopPrice           decimal.Decimal     `json:"stop_price,omitempty"`
+	DisplaySize         decimal.Decimal     `json:"display_size,omitempty"`
+	SelfTradePrevention SelfTradePrevention `json:"self_trade_prevention,omitempty"`
+	WorstPrice          decimal.Decimal     `json:"worst_price,omitempty"`
+	MaxSlippageBps      int64               `json:"max_slippage_bps,omitempty"`
+	MaxNotional         decimal.Decimal     `json:"max_notional,omitempty"`
+
+	order   *Order
+	placed  Order
+	matches []Match
+}
+
+func newPlaceOrderCommand(market Market, o *Order) *placeOrderCommand {
+	return &placeOrderCommand{
+		Market:              market,
+		ID:                  o.ID,
+		UserID:              o.UserID,
+		OrderType:           o.OrderType,
+		Bid:                 o.Bid,
+		Size:                o.Size,
+		Price:               o.Price,
+		Timestamp:           o.Timestamp,
+		TimeInForce:         o.TimeInForce,
+		ExpiresAt:           o.ExpiresAt,
+		PostOnly:            o.PostOnly,
+		PostOnlyReprice:     o.PostOnlyReprice,
+		StopPrice:           o.StopPrice,
+		DisplaySize:         o.DisplaySize,
+		SelfTradePrevention: o.SelfTradePrevention,
+		WorstPrice:          o.WorstPrice,
+		MaxSlippageBps:      o.MaxSlippageBps,
+		MaxNotional:         o.MaxNotional,
+		order:               o,
+	}
+}
+
+func (c *placeOrderCommand) market() Market { return c.Market }
+
+func (c *placeOrderCommand) validate(ex *Exchange) error {
+	ob, err := ex.Market(c.Market)
+	if err != nil {
+		return err
+	}
+	return ex.checkOrder(ob, c.build())
+}
+
+func (c *placeOrderCommand) apply(ex *Exchange) (err error) {
+	c.matches, err = ex.placeOrder(c.Market, c.build())
+	c.placed = *c.order
+	return err
+}
+
+// the order c places, a replayed command makes it from what was logged
+func (c *placeOrderCommand) build() *Order {
+	if c.order == nil {
+		c.order = &Order{
+			ID:                  c.ID,
+			UserID:              c.UserID,
+			OrderType:           c.OrderType,
+			Bid:                 c.Bid,
+			Size:                c.Size,
+			Price:               c.Price,
+			Timestamp:           c.Timestamp,
+			TimeInForce:         c.TimeInForce,
+			ExpiresAt:           c.ExpiresAt,
+			PostOnly:            c.PostOnly,
+			PostOnlyReprice:     c.PostOnlyReprice,
+			StopPrice:           c.StopPrice,
+			DisplaySize:         c.DisplaySize,
+			SelfTradePrevention: c.SelfTradePrevention,
+			WorstPrice:          c.WorstPrice,
+			MaxSlippageBps:      c.MaxSlippageBps,
+			MaxNotional:         c.MaxNotional,
+		}
+	}
+	return c.order
+}
+
+type cancelOrderCommand struct {
+	Market  Market `json:"market"`
+	OrderID string `json:"order_id"`
+}
+
+func (c *cancelOrderCommand) market() Market { return c.Market }
+
+func (c *cancelOrderCommand) apply(ex *Exchange) error {
+	ob, err := ex.Market(c.Market)
+	if err != nil {
+		return err
+	}
+	return ob.CancelOrderById(c.OrderID)
+}
+
+type amendOrderCommand struct {
+	Market  Market          `json:"market"`
+	UserID  string          `json:"user_id"`
+	OrderID string          `json:"order_id"`
+	Price   decimal.Decimal `json:"price"`
+	Size    decimal.Decimal `json:"size"`
+
+	amended Order
+	matches []Match
+}
+
+func (c *amendOrderCommand) market() Market { return c.Market }
+
+func (c *amendOrderCommand) apply(ex *Exchange) error {
+	o, matches, err := ex.amendOrder(c.Market, c.UserID, c.OrderID, c.Price, c.Size)
+	if err != nil {
+		return err
+	}
+	c.amended, c.matches = *o, matches
+	return nil
+}
+
+type expireOrdersCommand struct {
+	Market Market `json:"market"`
+
+	expired []*Order
+}
+
+func (c *expireOrdersCommand) market() Market { return c.Market }
+
+func (c *expireOrdersCommand) apply(ex *Exchange) error {
+	ob, err := ex.Market(c.Market)
+	if err != nil {
+		return err
+	}
+	c.expired = ob.ExpireOrders(ex.now())
+	return nil
+}
+
+type depositAddressCommand struct {
+	UserID string `json:"user_id"`
+	// the deposit address's key, encrypted by the keystore
+	Key json.RawMessage `json:"key"`
+}
+
+func (c *depositAddressCommand) apply(ex *Exchange) error {
+	// when two requests race the first key applied is kept
+	if _, ok := ex.deposits.address(c.UserID); ok {
+		return nil
+	}
+	if len(c.Key) == 0 {
+		return fmt.Errorf("deposit address of %s has no encrypted key", c.UserID)
+	}
+	address, err := ex.keystore.add(c.Key)
+	if err != nil {
+		return err
+	}
+	ex.deposits.setAddress(c.UserID, address)
+	return nil
+}
+
+type creditDepositCommand struct {
+	UserID  string          `json:"user_id"`
+	Asset   Asset           `json:"asset"`
+	Amount  decimal.Decimal `json:"amount"`
+	Address string          `json:"address"`
+	TxID    string          `json:"tx_id"`
+	Block   uint64          `json:"block"`
+}
+
+// only credits of a positive amount to a known user are logged
+func (c *creditDepositCommand) validate(ex *Exchange) error {
+	if _, ok := ex.Users[c.UserID]; !ok {
+		return fmt.Errorf("user %s not found", c.UserID)
+	}
+	if !c.Amount.IsPositive() {
+		return fmt.Errorf("amount %s must be positive", c.Amount)
+	}
+	return nil
+}
+
+func (c *creditDepositCommand) apply(ex *Exchange) error {
+	return ex.creditDeposit(c)
+}
+
+type withdrawalLimitsCommand struct {
+	Asset  Asset            `json:"asset"`
+	Limits WithdrawalLimits `json:"limits"`
+}
+
+func (c *withdrawalLimitsCommand) apply(ex *Exchange) error {
+	ex.withdrawals.mu.Lock()
+	defer ex.withdrawals.mu.Unlock()
+	ex.withdrawals.limits[c.Asset] = c.Limits
+	return nil
+}
+
+type requestWithdrawalCommand struct {
+	UserID  string          `json:"user_id"`
+	Asset   Asset           `json:"asset"`
+	Amount  decimal.Decimal `json:"amount"`
+	Address string          `json:"address,omitempty"`
+
+	withdrawal Withdrawal
+}
+
+func (c *requestWithdrawalCommand) apply(ex *Exchange) (err error) {
+	c.withdrawal, err = ex.requestWithdrawal(c.UserID, c.Asset, c.Amount, c.Address)
+	return err
+}
+
+type approveWithdrawalCommand struct {
+	ID uint64 `json:"id"`
+
+	withdrawal Withdrawal
+}
+
+func (c *approveWithdrawalCommand) apply(ex *Exchange) (err error) {
+	c.withdrawal, err = ex.approveWithdrawalByID(c.ID)
+	return err
+}
+
+type rejectWithdrawalCommand struct {
+	ID     uint64 `json:"id"`
+	Reason string `json:"reason,omitempty"`
+
+	withdrawal Withdrawal
+}
+
+func (c *rejectWithdrawalCommand) apply(ex *Exchange) (err error) {
+	c.withdrawal, err = ex.rejectWithdrawal(c.ID, c.Reason)
+	return err
+}
+
+type failWithdrawalCommand struct {
+	ID     uint64 `json:"id"`
+	Reason string `json:"reason,omitempty"`
+}
+
+func (c *failWithdrawalCommand) apply(ex *Exchange) error {
+	return ex.failWithdrawal(c.ID, c.Reason)
+}
+
+type reverseTransferCommand struct {
+	TransferID uint64          `json:"transfer_id"`
+	UserID     string          `json:"user_id"`
+	Asset      Asset           `json:"asset"`
+	Amount     decimal.Decimal `json:"amount"`
+}
+
+func (c *reverseTransferCommand) validate(ex *Exchange) error {
+	if ex.shortfalls.reversed[c.TransferID] {
+		return errTransferReversed
+	}
+	return nil
+}
+
+func (c *reverseTransferCommand) apply(ex *Exchange) error {
+	return ex.reverseTransfer(c)
+}
+
+type createAPIKeyCommand struct {
+	Key APIKey `json:"key"`
+	// encrypted with the keystore's passphrase, the secret is never logged in the clear
+	Secret keystore.CryptoJSON `json:"secret"`
+
+	key APIKey
+}
+
+func (c *createAPIKeyCommand) apply(ex *Exchange) (err error) {
+	c.key, err = ex.createAPIKey(c.Key, c.Secret)
+	return err
+}
+
+type revokeAPIKeyCommand struct {
+	UserID string `json:"user_id"`
+	ID     string `json:"id"`
+}
+
+func (c *revokeAPIKeyCommand) apply(ex *Exchange) error {
+	return ex.revokeAPIKey(c.UserID, c.ID)
+}
+
+type maxOpenOrdersCommand struct {
+	Max int `json:"max"`
+}
+
+func (c *maxOpenOrdersCommand) apply(ex *Exchange) error {
+	if c.Max < 0 {
+		return fmt.Errorf("max open orders can't be negative")
+	}
+	ex.maxOpenOrders = c.Max
+	return nil
+}
@@ -0,0 +1,342 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/EggsyOnCode/velho-exchange/decimal"
+	"github.com/EggsyOnCode/velho-exchange/internals"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/sirupsen/logrus"
+)
+
+type DepositStatus string
+
+const (
+	// seen on chain, waiting for enough confirmations
+	DepositPending DepositStatus = "PENDING"
+	// added to the user's available balance
+	DepositCredited DepositStatus = "CREDITED"
+)
+
+// ChainDeposit is a transfer to an address, as seen by a DepositSource
+type ChainDeposit struct {
+	TxID    string
+	Address string
+	Amount  decimal.Decimal
+	Block   uint64
+}
+
+// DepositSource reads an asset's chain for the deposit watcher
+type DepositSource interface {
+	// Head returns the number of the latest block
+	Head() (uint64, error)
+	// Transfers returns every transfer of the asset in the given block
+	Transfers(block uint64) ([]ChainDeposit, error)
+}
+
+type Deposit struct {
+	ID      uint64          `json:"id"`
+	UserID  string          `json:"user_id"`
+	Asset   Asset           `json:"asset"`
+	Amount  decimal.Decimal `json:"amount"`
+	Address string          `json:"address"`
+	TxID    string          `json:"tx_id"`
+	Block   uint64          `json:"block"`
+	// blocks on top of and including Block when it was last looked at
+	Confirmations uint64        `json:"confirmations"`
+	Status        DepositStatus `json:"status"`
+	// unix nanos
+	CreatedAt int64 `json:"created_at"`
+	UpdatedAt int64 `json:"updated_at"`
+}
+
+// a chain the watcher follows
+type watchedChain struct {
+	source DepositSource
+	// confirmations a deposit needs before it's credited
+	confirmations uint64
+	// next block to read
+	next uint64
+}
+
+// depositWatcher gives every user a deposit address the exchange holds the key
+// of, follows the chains registered with WatchDeposits and credits what's sent to
+// those addresses once it's buried deep enough.
+type depositWatcher struct {
+	mu sync.Mutex
+	// deposit address of each user, whose key is in the keystore, stored
+	// against user ID
+	addresses map[string]common.Address
+	// user ID of each deposit address, lowercase hex
+	owners   map[string]string
+	chains   map[Asset]*watchedChain
+	deposits map[uint64]*Deposit
+	// deposits already seen, against asset and transaction ID
+	seen   map[string]uint64
+	nextID uint64
+}
+
+func newDepositWatcher() *depositWatcher {
+	return &depositWatcher{
+		addresses: make(map[string]common.Address),
+		owners:    make(map[string]string),
+		chains:    make(map[Asset]*watchedChain),
+		deposits:  make(map[uint64]*Deposit),
+		seen:      make(map[string]uint64),
+	}
+}
+
+// DepositAddress returns the address userID deposits to, created the first time it's asked for
+func (ex *Exchange) DepositAddress(userID string) (string, error) {
+	if _, ok := ex.User(userID); !ok {
+		return "", fmt.Errorf("user %s not found", userID)
+	}
+	if address, ok := ex.deposits.address(userID); ok {
+		return address, nil
+	}
+
+	// the key is logged, encrypted, so the address outlives a restart
+	key, err := ex.keystore.encrypt(internals.GenerateNewPrivateKey())
+	if err != nil {
+		return "", err
+	}
+	if err := ex.execute(CmdDepositAddress, &depositAddressCommand{UserID: userID, Key: key}); err != nil {
+		return "", err
+	}
+
+	address, _ := ex.deposits.address(userID)
+	return address, nil
+}
+
+func (w *depositWatcher) address(userID string) (string, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	address, ok := w.addresses[userID]
+	if !ok {
+		return "", false
+	}
+	return address.Hex(), true
+}
+
+func (w *depositWatcher) setAddress(userID string, address common.Address) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.addresses[userID] = address
+	w.owners[strings.ToLower(address.Hex())] = userID
+}
+
+// WatchDeposits follows source from its current head on and credits deposits of
+// asset once they have the given number of confirmations (at least one)
+func (ex *Exchange) WatchDeposits(asset Asset, source DepositSource, confirmations uint64) error {
+	head, err := source.Head()
+	if err != nil {
+		return err
+	}
+
+	w := ex.deposits
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.chains[asset] = &watchedChain{
+		source:        source,
+		confirmations: max(confirmations, 1),
+		next:          head,
+	}
+
+	return nil
+}
+
+// ScanDeposits reads every watched chain up to its head once, records new
+// deposits and credits the ones that are confirmed
+func (ex *Exchange) ScanDeposits() error {
+	w := ex.deposits
+	w.mu.Lock()
+	var errs []error
+	var confirmed []Deposit
+	for asset, chain := range w.chains {
+		deposits, err := w.scanChain(asset, chain)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", asset, err))
+		}
+		confirmed = append(confirmed, deposits...)
+	}
+	w.mu.Unlock()
+
+	// crediting changes balances, so it's a command
+	sort.Slice(confirmed, func(i, j int) bool { return confirmed[i].ID < confirmed[j].ID })
+	for _, d := range confirmed {
+		err := ex.execute(CmdCreditDeposit, &creditDepositCommand{
+			UserID:  d.UserID,
+			Asset:   d.Asset,
+			Amount:  d.Amount,
+			Address: d.Address,
+			TxID:    d.TxID,
+			Block:   d.Block,
+		})
+		if err != nil {
+			logrus.WithError(err).WithField("id", d.ID).Error("deposit not credited")
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("scanning deposits: %v", errs)
+	}
+
+	return nil
+}
+
+// CreditDeposit credits amount of asset to userID for a deposit that didn't come
+// from a watched chain. txID identifies it, a deposit is only credited once.
+func (ex *Exchange) CreditDeposit(userID string, asset Asset, amount decimal.Decimal, txID string) error {
+	return ex.execute(CmdCreditDeposit, &creditDepositCommand{UserID: userID, Asset: asset, Amount: amount, TxID: txID})
+}
+
+// StartDepositWatcher scans the watched chains at the given interval
+func (ex *Exchange) StartDepositWatcher(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if err := ex.ScanDeposits(); err != nil {
+				logrus.WithError(err).Error("deposit scan failed")
+			}
+		}
+	}()
+}
+
+// Deposits returns the deposits of userID, or everyone's when it's empty, oldest first
+func (ex *Exchange) Deposits(userID string) []Deposit {
+	w := ex.deposits
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	deposits := make([]Deposit, 0)
+	for _, d := range w.deposits {
+		if userID == "" || d.UserID == userID {
+			deposits = append(deposits, *d)
+		}
+	}
+	sort.Slice(deposits, func(i, j int) bool { return deposits[i].ID < deposits[j].ID })
+
+	return deposits
+}
+
+// reads chain's new blocks and returns the pending deposits that are
+// confirmed, w.mu is held
+func (w *depositWatcher) scanChain(asset Asset, chain *watchedChain) ([]Deposit, error) {
+	head, err := chain.source.Head()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UnixNano()
+	for ; chain.next <= head; chain.next++ {
+		transfers, err := chain.source.Transfers(chain.next)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, t := range transfers {
+			userID, ok := w.owners[strings.ToLower(t.Address)]
+			key := depositKey(asset, t.TxID)
+			if _, seen := w.seen[key]; !ok || seen || !t.Amount.IsPositive() {
+				continue
+			}
+
+			d := w.add(userID, asset, t, now)
+
+			logrus.WithFields(logrus.Fields{
+				"id":     d.ID,
+				"userId": userID,
+				"asset":  asset,
+				"amount": t.Amount,
+				"tx":     t.TxID,
+			}).Info("deposit seen")
+		}
+	}
+
+	var confirmed []Deposit
+	for _, d := range w.deposits {
+		if d.Asset != asset || d.Status != DepositPending || d.Block > head {
+			continue
+		}
+
+		d.Confirmations = head - d.Block + 1
+		d.UpdatedAt = now
+		if d.Confirmations >= chain.confirmations {
+			confirmed = append(confirmed, *d)
+		}
+	}
+
+	return confirmed, nil
+}
+
+func depositKey(asset Asset, txID string) string {
+	return string(asset) + "/" + txID
+}
+
+// records a pending deposit of t to userID, w.mu is held
+func (w *depositWatcher) add(userID string, asset Asset, t ChainDeposit, now int64) *Deposit {
+	w.nextID++
+	d := &Deposit{
+		ID:        w.nextID,
+		UserID:    userID,
+		Asset:     asset,
+		Amount:    t.Amount,
+		Address:   t.Address,
+		TxID:      t.TxID,
+		Block:     t.Block,
+		Status:    DepositPending,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	w.deposits[d.ID] = d
+	w.seen[depositKey(asset, t.TxID)] = d.ID
+	return d
+}
+
+// adds a confirmed deposit to its user's balance, once. When it's replayed the
+// watcher hasn't seen it yet, it's recorded as it's credited.
+func (ex *Exchange) creditDeposit(c *creditDepositCommand) error {
+	w := ex.deposits
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := ex.now()
+	var d *Deposit
+	if id, ok := w.seen[depositKey(c.Asset, c.TxID)]; ok {
+		d = w.deposits[id]
+	} else {
+		d = w.add(c.UserID, c.Asset, ChainDeposit{TxID: c.TxID, Address: c.Address, Amount: c.Amount, Block: c.Block}, now)
+	}
+	if d.Status == DepositCredited {
+		return nil
+	}
+
+	if err := ex.Ledger.Deposit(d.UserID, d.Asset, d.Amount, fmt.Sprintf("deposit %s", d.TxID)); err != nil {
+		return err
+	}
+	// what the user owes for a failed transfer into custody comes out first
+	if err := ex.repayShortfall(d.UserID, d.Asset); err != nil {
+		return err
+	}
+	d.Status = DepositCredited
+	d.UpdatedAt = now
+
+	logrus.WithFields(logrus.Fields{
+		"id":            d.ID,
+		"userId":        d.UserID,
+		"asset":         d.Asset,
+		"amount":        d.Amount,
+		"confirmations": d.Confirmations,
+	}).Info("deposit credited")
+
+	return nil
+}
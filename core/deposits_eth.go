@@ -0,0 +1,64 @@
+package core
+
+import (
+	"context"
+	"math/big"
+
+	"github.com/EggsyOnCode/velho-exchange/decimal"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// EthBlockClient is the part of a JSON-RPC client EthDeposits uses, satisfied
+// by *ethclient.Client as well as go-ethereum's simulated backend client
+type EthBlockClient interface {
+	BlockNumber(ctx context.Context) (uint64, error)
+	BlockByNumber(ctx context.Context, number *big.Int) (*types.Block, error)
+}
+
+// EthDeposits reads plain ETH transfers out of blocks. Transfers made by
+// contracts (internal transactions) aren't seen.
+type EthDeposits struct {
+	client EthBlockClient
+}
+
+func NewEthDeposits(client EthBlockClient) *EthDeposits {
+	return &EthDeposits{client: client}
+}
+
+func (s *EthDeposits) Head() (uint64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), ethCallTimeout)
+	defer cancel()
+
+	return s.client.BlockNumber(ctx)
+}
+
+func (s *EthDeposits) Transfers(number uint64) ([]ChainDeposit, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), ethCallTimeout)
+	defer cancel()
+
+	block, err := s.client.BlockByNumber(ctx, new(big.Int).SetUint64(number))
+	if err != nil {
+		return nil, err
+	}
+
+	var transfers []ChainDeposit
+	for _, tx := range block.Transactions() {
+		if tx.To() == nil || tx.Value().Sign() <= 0 {
+			continue
+		}
+
+		// anything below decimal.Decimal's smallest step is dropped
+		units := new(big.Int).Quo(tx.Value(), weiPerUnit)
+		if !units.IsInt64() {
+			continue
+		}
+		transfers = append(transfers, ChainDeposit{
+			TxID:    tx.Hash().Hex(),
+			Address: tx.To().Hex(),
+			Amount:  decimal.Decimal(units.Int64()),
+			Block:   number,
+		})
+	}
+
+	return transfers, nil
+}
@@ -0,0 +1,151 @@
+package core
+
+import (
+	"context"
+	"math/big"
+	"sync"
+	"testing"
+
+	"github.com/EggsyOnCode/velho-exchange/auth"
+	"github.com/EggsyOnCode/velho-exchange/decimal"
+	"github.com/EggsyOnCode/velho-exchange/internals"
+	"github.com/EggsyOnCode/velho-exchange/ledger"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// a chain whose blocks are mined by the test
+type fakeChain struct {
+	mu     sync.Mutex
+	blocks []*types.Block
+}
+
+func newFakeChain() *fakeChain {
+	c := &fakeChain{}
+	c.mine()
+	return c
+}
+
+// appends a block holding txs
+func (c *fakeChain) mine(txs ...*types.Transaction) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	header := &types.Header{Number: big.NewInt(int64(len(c.blocks)))}
+	c.blocks = append(c.blocks, types.NewBlockWithHeader(header).WithBody(types.Body{Transactions: txs}))
+}
+
+func (c *fakeChain) BlockNumber(ctx context.Context) (uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return uint64(len(c.blocks) - 1), nil
+}
+
+func (c *fakeChain) BlockByNumber(ctx context.Context, number *big.Int) (*types.Block, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !number.IsUint64() || number.Uint64() >= uint64(len(c.blocks)) {
+		return nil, ethereum.NotFound
+	}
+	return c.blocks[number.Uint64()], nil
+}
+
+func ethTransfer(nonce uint64, to string, eth string) *types.Transaction {
+	wei := new(big.Int).Mul(big.NewInt(int64(decimal.RequireFromString(eth))), weiPerUnit)
+	return types.NewTransaction(nonce, common.HexToAddress(to), wei, ethTransferGas, big.NewInt(1), nil)
+}
+
+func TestDepositsCreditedAfterConfirmations(t *testing.T) {
+	ex := NewExchange()
+	chain := newFakeChain()
+	require.NoError(t, ex.WatchDeposits(AssetETH, NewEthDeposits(chain), 3))
+
+	user := auth.NewUser(nil, decimal.Zero)
+	ex.AddUser(user)
+	address, err := ex.DepositAddress(user.ID.String())
+	require.NoError(t, err)
+	again, _ := ex.DepositAddress(user.ID.String())
+	assert.Equal(t, address, again)
+
+	_, err = ex.DepositAddress("nobody")
+	assert.Error(t, err)
+
+	// transfers to other addresses are ignored
+	chain.mine(
+		ethTransfer(0, address, "1.5"),
+		ethTransfer(1, internals.GetAddress(ex.PrivateKey).Hex(), "7"),
+	)
+	chain.mine()
+	require.NoError(t, ex.ScanDeposits())
+
+	deposits := ex.Deposits(user.ID.String())
+	require.Len(t, deposits, 1)
+	assert.Equal(t, DepositPending, deposits[0].Status)
+	assert.Equal(t, uint64(2), deposits[0].Confirmations)
+	assert.Equal(t, ledger.Balance{}, ex.Ledger.Balance(user.ID.String(), AssetETH))
+
+	chain.mine()
+	require.NoError(t, ex.ScanDeposits())
+	// scanning again doesn't credit it twice
+	require.NoError(t, ex.ScanDeposits())
+
+	deposits = ex.Deposits("")
+	require.Len(t, deposits, 1)
+	assert.Equal(t, DepositCredited, deposits[0].Status)
+	assert.Equal(t, decimal.RequireFromString("1.5"), deposits[0].Amount)
+	assert.Equal(t, ledger.Balance{Available: decimal.RequireFromString("1.5")}, ex.Ledger.Balance(user.ID.String(), AssetETH))
+	assert.NoError(t, ex.Ledger.Check())
+}
+
+func TestAskNeedsDepositedTokens(t *testing.T) {
+	ex := NewExchange()
+	ob := ex.OrderBook[BTC]
+	seller := auth.NewUser(nil, decimal.Zero)
+	ex.AddUser(seller)
+	sellerID := seller.ID.String()
+	require.NoError(t, ex.Ledger.Deposit(sellerID, AssetBTC, decimal.FromInt(2), "deposit"))
+
+	// one token short, nothing is taken from the wallet
+	_, err := ob.PlaceLimitOrder(decimal.FromInt(100), NewOrder(decimal.FromInt(3), false, decimal.FromInt(100), sellerID))
+	assert.ErrorIs(t, err, ErrInsufficientFunds)
+	assert.Equal(t, ledger.Balance{Available: decimal.FromInt(2)}, ex.Ledger.Balance(sellerID, AssetBTC))
+	assert.Empty(t, ex.Transfers(sellerID))
+	assert.Equal(t, 0, ob.Asks.Size())
+
+	ask := NewOrder(decimal.FromInt(2), false, decimal.FromInt(100), sellerID)
+	_, err = ob.PlaceLimitOrder(ask.Price, ask)
+	require.NoError(t, err)
+	assert.Equal(t, ledger.Balance{Locked: decimal.FromInt(2)}, ex.Ledger.Balance(sellerID, AssetBTC))
+
+	ob.CancelOrderById(ask.ID.String())
+	assert.Equal(t, ledger.Balance{Available: decimal.FromInt(2)}, ex.Ledger.Balance(sellerID, AssetBTC))
+	assert.NoError(t, ex.Ledger.Check())
+}
+
+func TestCreditDepositOnlyOnce(t *testing.T) {
+	ex := NewExchange()
+	user := auth.NewUser(nil, decimal.Zero)
+	ex.AddUser(user)
+	userID := user.ID.String()
+
+	require.NoError(t, ex.CreditDeposit(userID, AssetETH, decimal.FromInt(5), "seed"))
+	require.NoError(t, ex.CreditDeposit(userID, AssetETH, decimal.FromInt(5), "seed"))
+	assert.Equal(t, ledger.Balance{Available: decimal.FromInt(5)}, ex.Ledger.Balance(userID, AssetETH))
+	if assert.Len(t, ex.Deposits(userID), 1) {
+		assert.Equal(t, DepositCredited, ex.Deposits(userID)[0].Status)
+	}
+
+	assert.Error(t, ex.CreditDeposit(userID, AssetETH, decimal.Zero, "nothing"))
+	assert.Error(t, ex.CreditDeposit(uuid.NewString(), AssetETH, decimal.FromInt(5), "nobody"))
+	assert.Len(t, ex.Deposits(""), 1)
+}
+
+// credits a confirmed deposit of amount of asset to userID, asks can only sell
+// what's on the exchange. It's logged like the watcher's, so it's replayed too.
+func deposit(t *testing.T, ex *Exchange, userID string, asset Asset, amount int64) {
+	t.Helper()
+	require.NoError(t, ex.CreditDeposit(userID, asset, decimal.FromInt(amount), uuid.NewString()))
+}
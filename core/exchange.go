@@ -2,72 +2,427 @@ package core
 
 import (
 	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
 
 	"github.com/EggsyOnCode/velho-exchange/auth"
+	"github.com/EggsyOnCode/velho-exchange/avl"
+	"github.com/EggsyOnCode/velho-exchange/decimal"
+	"github.com/EggsyOnCode/velho-exchange/internals"
+	"github.com/EggsyOnCode/velho-exchange/ledger"
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
 	g "github.com/zyedidia/generic"
-	"github.com/zyedidia/generic/avl"
 )
 
 type (
-	OrderType string
-	Market    string
-	ExOrder   struct {
-		ID        string
-		Size      int64
-		Timestamp int64
-		Price     float64
-		Bid       bool
-		UserID    string
-		Market    Market
-		OrderType OrderType
+	OrderType   string
+	TimeInForce string
+	Market      string
+	ExOrder     struct {
+		ID          string
+		Size        decimal.Decimal
+		Timestamp   int64
+		Price       decimal.Decimal
+		Bid         bool
+		UserID      string
+		Market      Market
+		OrderType   OrderType
+		TimeInForce TimeInForce
+		ExpiresAt   int64
+		StopPrice   decimal.Decimal
+		// whether a stop order has been triggered and moved to the book
+		Triggered bool
+		// visible slice size of an iceberg order
+		DisplaySize decimal.Decimal
 	}
 )
 
 const (
-	BTC         Market    = "BTC"
-	ETH         Market    = "ETH"
-	LimitOrder  OrderType = "LIMIT"
-	MarketOrder OrderType = "MARKET"
+	BTC             Market    = "BTC"
+	ETH             Market    = "ETH"
+	LimitOrder      OrderType = "LIMIT"
+	MarketOrder     OrderType = "MARKET"
+	StopMarketOrder OrderType = "STOP_MARKET"
+	StopLimitOrder  OrderType = "STOP_LIMIT"
 )
 
+const (
+	// rests until it's filled or cancelled (default)
+	GoodTillCancel TimeInForce = "GTC"
+	// fills whatever crosses right away, the rest is cancelled
+	ImmediateOrCancel TimeInForce = "IOC"
+	// fills entirely right away or not at all
+	FillOrKill TimeInForce = "FOK"
+	// rests like GTC until its expiry, after which the expirer cancels it
+	GoodTillDate TimeInForce = "GTD"
+)
+
+// whether the unfilled part of an order with this time in force goes on the book
+func (tif TimeInForce) Rests() bool {
+	return tif == GoodTillCancel || tif == GoodTillDate
+}
+
+// a key identifies its user, it can't be registered twice
+var ErrKeyInUse = errors.New("key is already registered to another user")
+
 const DUMMY_PV = "ac0974bec39a17e36ba4a6b4d238ff944bacb478cbed5efcae784d7bf4f2ff80"
 
 type Exchange struct {
 	PrivateKey *ecdsa.PrivateKey
-	OrderBook  map[Market]*OrderBook
-	Users      map[string]*auth.User
-	UsdPool    float64
+	// markets can be listed at runtime, use Market / Markets to look them up
+	OrderBook map[Market]*OrderBook
+	Users     map[string]*auth.User
+	// user IDs by the address of their key, which signed requests recover
+	addresses map[common.Address]string
+	// every balance the exchange keeps for its users, see the ledger package
+	Ledger *ledger.Ledger
+	// moves assets between users' wallets and the exchange's, see settlement.go
+	settler *settler
+	// credits what users send to their deposit addresses, see deposits.go
+	deposits *depositWatcher
+	// users' requests to take funds off the exchange, see withdrawals.go
+	withdrawals *withdrawalDesk
+	// failed transfers into custody and what users owe for them, see shortfalls.go
+	shortfalls *shortfalls
+	// users' keys, encrypted, see keystore.go
+	keystore *Keystore
+	// keys users' bots sign requests with, see apikeys.go
+	apiKeys *keyring
+	// users' fee currency and trade history, see fees.go
+	fees *feeBook
 	// stored against user ID
 	orders map[string]*avl.Tree[string, *ExOrder]
+	// default self-trade prevention mode of each user, stored against user ID
+	selfTradePrevention map[string]SelfTradePrevention
+	// how many orders a user can have open, see open_orders.go
+	maxOpenOrders int
+	// the goroutine each market's book belongs to, see sequencer.go
+	sequencers map[Market]*sequencer
+	// guards OrderBook and sequencers
+	marketsMu sync.RWMutex
+	// commands are logged here before they're applied, see commands.go
+	wal *WAL
+	// held while a command is logged and applied, and while account state is
+	// read. One lock for every market: commands are applied one at a time.
+	cmdMu sync.Mutex
+	// the engine's clock and whether it's running, see now
+	clock    int64
+	applying bool
+	// sequence number of the last command applied from the log
+	seq uint64
+	// where snapshots are written, see snapshot.go
+	snapshotPath string
+	// ID of the last settlement transfer a command queued before the snapshot
+	// the exchange was restored from
+	restoredTransferID uint64
 }
 
 func NewExchange() *Exchange {
-	orderbooks := make(map[Market]*OrderBook)
-	orderbooks[BTC] = NewOrderBook(BTC)
-	orderbooks[ETH] = NewOrderBook(ETH)
-
 	// priv
 
 	pv, _ := crypto.HexToECDSA(DUMMY_PV)
 
 	ex := &Exchange{
-		PrivateKey: pv,
-		OrderBook:  orderbooks,
-		UsdPool:    0,
-		Users:      make(map[string]*auth.User),
-		orders:     make(map[string]*avl.Tree[string, *ExOrder]),
+		PrivateKey:  pv,
+		OrderBook:   make(map[Market]*OrderBook),
+		Ledger:      ledger.New(),
+		deposits:    newDepositWatcher(),
+		withdrawals: newWithdrawalDesk(),
+		shortfalls:  newShortfalls(),
+		apiKeys:     newKeyring(),
+		keystore:    NewKeystore(unconfiguredKeystore),
+		fees:        newFeeBook(),
+		Users:       make(map[string]*auth.User),
+		addresses:   make(map[common.Address]string),
+		orders:      make(map[string]*avl.Tree[string, *ExOrder]),
+		sequencers:  make(map[Market]*sequencer),
+
+		selfTradePrevention: make(map[string]SelfTradePrevention),
+		maxOpenOrders:       DefaultMaxOpenOrders,
 	}
+	ex.settler = newSettler(ex.transferUpdated)
+	// journal entries are stamped like the rest of a command's changes
+	ex.Ledger.SetClock(ex.now)
 
-	orderbooks[BTC].SetExchange(ex)
-	orderbooks[ETH].SetExchange(ex)
+	// users' USD mirrors their available USD in the ledger
+	ex.Ledger.OnChange(func(owner string, asset Asset, balance ledger.Balance) {
+		if user, ok := ex.Users[owner]; ok && asset == AssetUSD {
+			user.USD = balance.Available
+		}
+	})
+
+	// the default markets, more can be listed at runtime
+	for market, spec := range DefaultMarketSpecs {
+		ex.CreateMarket(market, spec)
+	}
 
 	return ex
 
 }
 
-func (ex *Exchange) AddUser(user *auth.User) {
-	ex.Users[user.ID.String()] = user
+// StartExpirer sweeps every order book for expired GTD orders at the given interval
+func (ex *Exchange) StartExpirer(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			now := time.Now().UnixNano()
+			for _, ob := range ex.Markets() {
+				// only sweeps that expire something are logged
+				var expired bool
+				ex.ReadBook(ob.TokenId, func(ob *OrderBook) { expired = ob.HasExpired(now) })
+				if !expired {
+					continue
+				}
+				if _, err := ex.ExpireOrders(ob.TokenId); err != nil {
+					logrus.WithError(err).WithField("market", ob.TokenId).Error("orders not expired")
+				}
+			}
+		}
+	}()
+}
+
+// ExpireOrders cancels the GTD orders of market that expired, see OrderBook.ExpireOrders
+func (ex *Exchange) ExpireOrders(market Market) ([]*Order, error) {
+	cmd := &expireOrdersCommand{Market: market}
+	err := ex.execute(CmdExpireOrders, cmd)
+	return cmd.expired, err
+}
+
+// AddUser registers user, the USD it comes with is deposited into the ledger as
+// its opening balance. The exchange keeps its key encrypted in the keystore,
+// user is kept as it is.
+func (ex *Exchange) AddUser(user *auth.User) error {
+	if user.PrivateKey == nil {
+		return fmt.Errorf("user %s has no key", user.ID)
+	}
+	user.Address = internals.GetAddress(user.PrivateKey)
+	return ex.registerUser(user, user.PrivateKey)
+}
+
+// RegisterUser registers a new user with key and no balance and returns their
+// ID. The exchange only keeps key in its keystore, the user it registers doesn't
+// carry it.
+func (ex *Exchange) RegisterUser(key *ecdsa.PrivateKey) (string, error) {
+	user := &auth.User{ID: uuid.New(), Address: internals.GetAddress(key)}
+	if err := ex.registerUser(user, key); err != nil {
+		return "", err
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"id":      user.ID,
+		"address": user.Address,
+	}).Info("New user created")
+
+	return user.ID.String(), nil
+}
+
+func (ex *Exchange) registerUser(user *auth.User, key *ecdsa.PrivateKey) error {
+	// encrypting takes a while, it's done before the command
+	encrypted, err := ex.keystore.encrypt(key)
+	if err != nil {
+		return err
+	}
+	return ex.execute(CmdRegisterUser, &registerUserCommand{
+		ID:      user.ID,
+		Address: user.Address,
+		Key:     encrypted,
+		USD:     user.USD,
+		user:    user,
+	})
+}
+
+// User returns a copy of the user registered with id
+func (ex *Exchange) User(id string) (auth.User, bool) {
+	ex.cmdMu.Lock()
+	defer ex.cmdMu.Unlock()
+
+	user, ok := ex.Users[id]
+	if !ok {
+		return auth.User{}, false
+	}
+	return *user, true
+}
+
+// Account is what's shown of a user, unlike auth.User it's safe to hand out
+type Account struct {
+	ID      string         `json:"id"`
+	Address common.Address `json:"address"`
+	// available and locked balance of every asset the user holds
+	Balances map[Asset]ledger.Balance `json:"balances"`
+	// orders resting on a book or waiting for their trigger
+	OpenOrders int `json:"open_orders"`
+}
+
+// Account returns the public view of the user registered with id
+func (ex *Exchange) Account(id string) (Account, bool) {
+	user, ok := ex.User(id)
+	if !ok {
+		return Account{}, false
+	}
+	orders, _ := ex.GetOrders(id)
+
+	return Account{
+		ID:         id,
+		Address:    user.Address,
+		Balances:   ex.Ledger.Balances(id),
+		OpenOrders: len(orders),
+	}, true
+}
+
+// UserByAddress returns the ID of the user whose key has address
+func (ex *Exchange) UserByAddress(address common.Address) (string, bool) {
+	ex.cmdMu.Lock()
+	defer ex.cmdMu.Unlock()
+
+	id, ok := ex.addresses[address]
+	return id, ok
+}
+
+func (ex *Exchange) addUser(user *auth.User) {
+	id := user.ID.String()
+	ex.Users[id] = user
+	ex.addresses[user.Address] = id
+	ex.settler.addUser(user)
+
+	if !ex.Ledger.HasAccount(id) && user.USD.IsPositive() {
+		ex.Ledger.Deposit(id, AssetUSD, user.USD, "opening balance")
+	}
+}
+
+// SetSelfTradePrevention sets the mode used for the user's orders that don't specify one
+func (ex *Exchange) SetSelfTradePrevention(userID string, mode SelfTradePrevention) error {
+	if err := mode.Validate(); err != nil {
+		return err
+	}
+	return ex.execute(CmdSetSelfTradePrevention, &selfTradePreventionCommand{UserID: userID, Mode: mode})
+}
+
+func (ex *Exchange) setSelfTradePrevention(userID string, mode SelfTradePrevention) error {
+	if err := mode.Validate(); err != nil {
+		return err
+	}
+
+	if mode == STPNone {
+		delete(ex.selfTradePrevention, userID)
+	} else {
+		ex.selfTradePrevention[userID] = mode
+	}
+	return nil
+}
+
+func (ex *Exchange) SelfTradePrevention(userID string) SelfTradePrevention {
+	return ex.selfTradePrevention[userID]
+}
+
+// PlaceOrder places o on market by its type: a limit order goes to the book, a
+// market order fills what it can and a stop order waits in the trigger book.
+// The order's user index is updated too.
+func (ex *Exchange) PlaceOrder(market Market, o *Order) ([]Match, error) {
+	result, err := ex.SubmitOrder(market, o).Wait()
+	return result.Matches, err
+}
+
+func (ex *Exchange) placeOrder(market Market, o *Order) ([]Match, error) {
+	ob, err := ex.Market(market)
+	if err != nil {
+		return nil, err
+	}
+	if err := ex.checkOrder(ob, o); err != nil {
+		return nil, err
+	}
+
+	ex.AddOrder(&ExOrder{
+		ID:          o.ID.String(),
+		Size:        o.Size,
+		Timestamp:   o.Timestamp,
+		Price:       o.Price,
+		Bid:         o.Bid,
+		UserID:      o.UserID,
+		Market:      market,
+		OrderType:   o.OrderType,
+		TimeInForce: o.TimeInForce,
+		ExpiresAt:   o.ExpiresAt,
+		StopPrice:   o.StopPrice,
+		DisplaySize: o.DisplaySize,
+	})
+
+	switch {
+	case o.IsStop():
+		return nil, ob.PlaceStopOrder(o)
+	case o.OrderType == MarketOrder:
+		return ob.PlaceMarketOrder(o)
+	default:
+		return ob.PlaceLimitOrder(o.Price, o)
+	}
+}
+
+// checkOrder runs the checks an order has to pass before it's placed, they're
+// run before the order is logged and again as it's applied. ex.cmdMu is held.
+func (ex *Exchange) checkOrder(ob *OrderBook, o *Order) error {
+	if err := ob.CheckOpen(); err != nil {
+		return err
+	}
+	if ex.frozen(o.UserID) {
+		return ErrAccountFrozen
+	}
+	if err := ex.checkRisk(ob, o, ""); err != nil {
+		return err
+	}
+	return ex.checkOpenOrders(o)
+}
+
+// CancelOrder cancels the order with the given ID on market, resting or waiting
+// for its trigger. The cancel is applied after whatever was queued on the market
+// before it, an order that was filled meanwhile gives ErrOrderNotFound.
+func (ex *Exchange) CancelOrder(market Market, orderID string) error {
+	return ex.execute(CmdCancelOrder, &cancelOrderCommand{Market: market, OrderID: orderID})
+}
+
+// AmendOrder changes the price and size of userID's resting order on market, see
+// OrderBook.AmendOrder. The user's order index is updated too.
+func (ex *Exchange) AmendOrder(market Market, userID, orderID string, price, size decimal.Decimal) ([]Match, error) {
+	result, err := ex.SubmitAmend(market, userID, orderID, price, size).Wait()
+	return result.Matches, err
+}
+
+func (ex *Exchange) amendOrder(market Market, userID, orderID string, price, size decimal.Decimal) (*Order, []Match, error) {
+	ob, err := ex.Market(market)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := uuid.Parse(orderID); err != nil {
+		return nil, nil, ErrOrderNotFound
+	}
+	o := ob.GetOrderById(orderID)
+	if o == nil || o.UserID != userID {
+		return nil, nil, ErrOrderNotFound
+	}
+	// reducing an order in place only takes risk off
+	if price.Cmp(o.Price) != 0 || size.Cmp(o.Remaining()) > 0 {
+		if ex.frozen(userID) {
+			return nil, nil, ErrAccountFrozen
+		}
+		amended := *o
+		amended.Price, amended.Size, amended.Hidden = price, size, decimal.Zero
+		if err := ex.checkRisk(ob, &amended, orderID); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	matches, err := ob.AmendOrder(orderID, price, size)
+	if err != nil {
+		return nil, nil, err
+	}
+	ex.UpdateOrder(userID, orderID, o.Price, size)
+
+	return o, matches, nil
 }
 
 func (ex *Exchange) AddOrder(order *ExOrder) {
@@ -81,20 +436,50 @@ func (ex *Exchange) AddOrder(order *ExOrder) {
 
 }
 
+// UpdateOrder records the new price and size of an amended order in the user's order index
+func (ex *Exchange) UpdateOrder(userID, orderID string, price, size decimal.Decimal) {
+	if orders, ok := ex.orders[userID]; ok {
+		if o, ok := orders.Get(orderID); ok {
+			o.Price = price
+			o.Size = size
+		}
+	}
+}
+
+// GetOrders returns copies of userId's orders still on a book or waiting for their
+// trigger, the rest are dropped from the index
 func (ex *Exchange) GetOrders(userId string) ([]*ExOrder, bool) {
+	// books only change under the command lock, so they can be read across markets here
+	ex.cmdMu.Lock()
+	defer ex.cmdMu.Unlock()
+	return ex.openOrders(userId)
+}
+
+// GetOrders, ex.cmdMu is held
+func (ex *Exchange) openOrders(userId string) ([]*ExOrder, bool) {
 	var orders []*ExOrder
+	var gone []string
 	_, exists := ex.orders[userId]
 	if exists {
 		ex.orders[userId].Each(func(k string, v *ExOrder) {
-			ob := ex.OrderBook[v.Market]
-			if ob.GetOrderById(v.ID) == nil {
-				ex.orders[userId].Remove(k)
+			ob, err := ex.Market(v.Market)
+			var o *Order
+			if err == nil {
+				o = ob.GetOrderById(v.ID)
+			}
+			if o == nil {
+				gone = append(gone, k)
 				return
 			}
-			orders = append(orders, v)
+			v.Triggered = o.Triggered
+			order := *v
+			orders = append(orders, &order)
 		})
+		// the tree can't change while it's walked
+		for _, k := range gone {
+			ex.orders[userId].Remove(k)
+		}
 	}
 
 	return orders, exists
 }
-
@@ -5,43 +5,51 @@ import (
 	"testing"
 
 	"github.com/EggsyOnCode/velho-exchange/auth"
+	"github.com/EggsyOnCode/velho-exchange/decimal"
 	"github.com/EggsyOnCode/velho-exchange/internals"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestExchange(t *testing.T) {
 	ex := NewExchange()
+	// ETH balances are checked on the dev chain
+	client, _ := internals.NewEthClient()
+	ex.RegisterSettlement(AssetETH, NewEthSettlement(client, ex.PrivateKey, ex.Keystore()))
 	ob := ex.OrderBook[ETH]
 
 	users := auth.GenerateUsers()
 
 	for _, user := range users {
-		user.USD = 100_000
+		user.USD = decimal.FromInt(100_000)
 	}
 
 	ex.AddUser(users[0])
 	ex.AddUser(users[1])
 	ex.AddUser(users[2])
+	// the seller's ETH is in the exchange's custody already
+	deposit(t, ex, users[2].ID.String(), AssetETH, 5)
 
 	// buying ETH and selling USD
-	buyOrder := NewOrder(3, true, 400, users[0].ID.String())
+	buyOrder := NewOrder(decimal.FromInt(3), true, decimal.FromInt(400), users[0].ID.String())
 	ob.PlaceLimitOrder(buyOrder.Price, buyOrder)
 
-	buyOrder1 := NewOrder(3, true, 800, users[1].ID.String())
+	buyOrder1 := NewOrder(decimal.FromInt(3), true, decimal.FromInt(800), users[1].ID.String())
 	ob.PlaceLimitOrder(buyOrder1.Price, buyOrder1)
 
 	assert.NotNil(t, 1)
 
 	// selling ETH and buying USD
-	sellOrder := NewMarketOrder(5, false, users[2].ID.String())
-	matches := ob.PlaceMarketOrder(sellOrder)
+	sellOrder := NewMarketOrder(decimal.FromInt(5), false, users[2].ID.String())
+	matches, err := ob.PlaceMarketOrder(sellOrder)
+	assert.NoError(t, err)
 	fmt.Printf("Matches: %v\n", matches)
 
 	assert.Equal(t, len(matches), 2)
-	assert.Equal(t, users[2].USD, float64(100_000+400*2+800*3))
-	assert.Equal(t, users[0].USD, float64(100_000-400*3))
-	assert.Equal(t, users[1].USD, float64(100_000-800*3))
+	assert.Equal(t, users[2].USD, decimal.FromInt(100_000+400*2+800*3))
+	assert.Equal(t, users[0].USD, decimal.FromInt(100_000-400*3))
+	assert.Equal(t, users[1].USD, decimal.FromInt(100_000-800*3))
 
+	ex.WaitSettled()
 	user0Bal := internals.GetBalance(internals.GetAddress(users[0].PrivateKey))
 	assert.Equal(t, user0Bal, float64(10002))
 
@@ -56,19 +64,22 @@ func TestExchange(t *testing.T) {
 
 	tolerance := 0.0000005
 
-	assert.InEpsilon(t, 9995.0-gasPrice, user2Bal, tolerance, "User balance should match expected value within tolerance")
-	assert.InEpsilon(t, 10000.0-gasPrice, exBal, tolerance, "Exchange balance should match expected value within tolerance")
+	assert.InEpsilon(t, 10000.0, user2Bal, tolerance, "User balance should match expected value within tolerance")
+	assert.InEpsilon(t, 9995.0-gasPrice, exBal, tolerance, "Exchange balance should match expected value within tolerance")
 
 }
 
 func TestExchangeSellLimitBuyMarket(t *testing.T) {
 	ex := NewExchange()
+	// ETH balances are checked on the dev chain
+	client, _ := internals.NewEthClient()
+	ex.RegisterSettlement(AssetETH, NewEthSettlement(client, ex.PrivateKey, ex.Keystore()))
 	ob := ex.OrderBook[ETH]
 
 	users := auth.GenerateUsers()
 
 	for _, user := range users {
-		user.USD = 100_000 // Initial USD balance
+		user.USD = decimal.FromInt(100_000) // Initial USD balance
 	}
 
 	ex.AddUser(users[0])
@@ -77,17 +88,21 @@ func TestExchangeSellLimitBuyMarket(t *testing.T) {
 	fmt.Println("user id of seller 0", users[0].ID.String())
 	fmt.Println("user id of seller 1", users[1].ID.String())
 	fmt.Println("user id of buyer 2", users[2].ID.String())
+	// the sellers' ETH is in the exchange's custody already
+	deposit(t, ex, users[0].ID.String(), AssetETH, 3)
+	deposit(t, ex, users[1].ID.String(), AssetETH, 3)
 
 	// selling ETH and buying USD
-	sellOrder := NewOrder(3, false, 400, users[0].ID.String()) // Sell order from user 0
+	sellOrder := NewOrder(decimal.FromInt(3), false, decimal.FromInt(400), users[0].ID.String()) // Sell order from user 0
 	ob.PlaceLimitOrder(sellOrder.Price, sellOrder)
 
-	sellOrder1 := NewOrder(3, false, 800, users[1].ID.String()) // Sell order from user 1
+	sellOrder1 := NewOrder(decimal.FromInt(3), false, decimal.FromInt(800), users[1].ID.String()) // Sell order from user 1
 	ob.PlaceLimitOrder(sellOrder1.Price, sellOrder1)
 
 	// buying ETH and selling USD
-	buyOrder := NewMarketOrder(5, true, users[2].ID.String()) // Buy market order from user 2
-	matches := ob.PlaceMarketOrder(buyOrder)
+	buyOrder := NewMarketOrder(decimal.FromInt(5), true, users[2].ID.String()) // Buy market order from user 2
+	matches, err := ob.PlaceMarketOrder(buyOrder)
+	assert.NoError(t, err)
 	fmt.Printf("Matches: %v\n", matches)
 
 	// Check that we have two matches
@@ -97,17 +112,18 @@ func TestExchangeSellLimitBuyMarket(t *testing.T) {
 
 	// Calculate expected balances after the transactions
 	expectedUser0USD := 100_000 + 400*3
-	expectedUser0ETH := float64(10000-3) - gasPrice
+	// sellers were paid from their deposits, their wallets don't move
+	expectedUser0ETH := float64(10000)
 	expectedUser1USD := 100_000 + 800*2
-	// it will be 10000 - 3 because when submitting a limit order, the users's entire order size is tranferred to exchange (here 3)
-	expectedUser1ETH := float64(10000-3) - gasPrice
+	expectedUser1ETH := float64(10000)
 	expectedUser2USD := 100_000 - (400*3 + 800*2)
 
-	assert.Equal(t, users[0].USD, float64(expectedUser0USD))
-	assert.Equal(t, users[1].USD, float64(expectedUser1USD))
-	assert.Equal(t, users[2].USD, float64(expectedUser2USD))
+	assert.Equal(t, users[0].USD, decimal.FromInt(int64(expectedUser0USD)))
+	assert.Equal(t, users[1].USD, decimal.FromInt(int64(expectedUser1USD)))
+	assert.Equal(t, users[2].USD, decimal.FromInt(int64(expectedUser2USD)))
 
 	// Assuming internals.GetBalance() retrieves the current balance of the given address
+	ex.WaitSettled()
 	user0Bal := internals.GetBalance(internals.GetAddress(users[0].PrivateKey))
 
 	user1Bal := internals.GetBalance(internals.GetAddress(users[1].PrivateKey))
@@ -123,8 +139,25 @@ func TestExchangeSellLimitBuyMarket(t *testing.T) {
 
 	ob.CancelOrderById(sellOrder1.ID.String())
 
-	uptedUser1Eth := float64(10000-2) - gasPrice
+	// the unsold ETH goes back to user 1's balance on the exchange, not their wallet
+	uptedUser1Eth := float64(10000)
+	ex.WaitSettled()
 
 	user1BalUpdated := internals.GetBalance(internals.GetAddress(users[1].PrivateKey))
 	assert.InEpsilon(t, user1BalUpdated, uptedUser1Eth, tolerance, "User balance should match expected value within tolerance")
 }
+
+func TestUserByAddress(t *testing.T) {
+	ex := NewExchange()
+	user := auth.NewUser(nil, decimal.FromInt(100))
+	assert.NoError(t, ex.AddUser(user))
+
+	id, ok := ex.UserByAddress(internals.GetAddress(user.PrivateKey))
+	assert.True(t, ok)
+	assert.Equal(t, user.ID.String(), id)
+
+	// the key identifies the user, it can't be registered again
+	assert.ErrorIs(t, ex.AddUser(auth.NewUser(user.PrivateKey, decimal.Zero)), ErrKeyInUse)
+	_, ok = ex.UserByAddress(internals.GetAddress(internals.GenerateNewPrivateKey()))
+	assert.False(t, ok)
+}
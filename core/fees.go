@@ -0,0 +1,290 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/EggsyOnCode/velho-exchange/decimal"
+	"github.com/EggsyOnCode/velho-exchange/ledger"
+)
+
+// Every fill is charged in the FILL transaction that settles it: the user of the
+// resting order pays the maker rate and the user of the incoming order the taker
+// rate of the tier their traded volume puts them in on the market's schedule.
+// Fees go to the ledger's fee account, a negative maker rate is a rebate paid out
+// of it.
+
+// FeeCurrency is what a user pays fees in
+type FeeCurrency string
+
+const (
+	// out of what the fill pays them: the base asset when buying, the quote when selling (default)
+	FeeInReceived FeeCurrency = ""
+	// always the quote asset, out of their available balance when buying. When
+	// that can't cover it the fee is taken from the base asset they receive.
+	FeeInQuote FeeCurrency = "QUOTE"
+)
+
+// volume that decides a user's fee tier is what they traded over this window
+const FeeVolumeWindow = 30 * 24 * time.Hour
+
+// FeeTier applies to users who traded at least MinVolume (in quote, over every
+// market) within FeeVolumeWindow. Rates are in basis points of what's charged.
+type FeeTier struct {
+	MinVolume decimal.Decimal `json:"min_volume"`
+	// negative for a rebate
+	MakerBps decimal.Decimal `json:"maker_bps"`
+	TakerBps decimal.Decimal `json:"taker_bps"`
+}
+
+// FeeSchedule holds a market's tiers by ascending MinVolume, the first one from
+// zero. A market without one is traded for free.
+type FeeSchedule []FeeTier
+
+// the schedule main.go gives the demo markets
+var DefaultFeeSchedule = FeeSchedule{
+	{MinVolume: decimal.Zero, MakerBps: decimal.FromInt(10), TakerBps: decimal.FromInt(20)},
+	{MinVolume: decimal.FromInt(100_000), MakerBps: decimal.FromInt(5), TakerBps: decimal.FromInt(15)},
+	{MinVolume: decimal.FromInt(1_000_000), MakerBps: decimal.FromInt(-1), TakerBps: decimal.FromInt(10)},
+}
+
+func (c FeeCurrency) Validate() error {
+	switch c {
+	case FeeInReceived, FeeInQuote:
+		return nil
+	}
+	return fmt.Errorf("unknown fee currency %q", c)
+}
+
+func (s FeeSchedule) Validate() error {
+	maxBps := decimal.FromInt(bpsScale)
+	for i, tier := range s {
+		if i == 0 && !tier.MinVolume.IsZero() {
+			return fmt.Errorf("the first fee tier must start at a volume of 0")
+		}
+		if i > 0 && tier.MinVolume.Cmp(s[i-1].MinVolume) <= 0 {
+			return fmt.Errorf("fee tiers must be ordered by ascending volume")
+		}
+		if tier.TakerBps.IsNegative() || tier.TakerBps.Cmp(maxBps) >= 0 || tier.MakerBps.Cmp(maxBps) >= 0 {
+			return fmt.Errorf("fee rates must be below %d bps and taker rates non-negative", bpsScale)
+		}
+		// the taker's fee always pays for the maker's rebate
+		if tier.MakerBps.Add(tier.TakerBps).IsNegative() {
+			return fmt.Errorf("maker rebate of %s bps is larger than the taker fee of %s bps", tier.MakerBps.Neg(), tier.TakerBps)
+		}
+	}
+	return nil
+}
+
+// the tier a user who traded volume is in
+func (s FeeSchedule) Tier(volume decimal.Decimal) FeeTier {
+	var tier FeeTier
+	for _, t := range s {
+		if volume.Cmp(t.MinVolume) < 0 {
+			break
+		}
+		tier = t
+	}
+	return tier
+}
+
+// bps basis points of amount
+func feeOf(amount, bps decimal.Decimal) decimal.Decimal {
+	return amount.Mul(bps).Div(decimal.FromInt(bpsScale))
+}
+
+// UserTrade is one side of a fill, as seen by the user who traded it
+type UserTrade struct {
+	Market   Market          `json:"market"`
+	OrderID  string          `json:"order_id"`
+	Bid      bool            `json:"bid"`
+	Price    decimal.Decimal `json:"price"`
+	Size     decimal.Decimal `json:"size"`
+	Notional decimal.Decimal `json:"notional"`
+	// whether the user's order was resting on the book
+	Maker bool `json:"maker"`
+	// negative for a rebate
+	Fee       decimal.Decimal `json:"fee"`
+	FeeAsset  Asset           `json:"fee_asset"`
+	Timestamp int64           `json:"timestamp"`
+}
+
+// fee settings and trade history of every user
+type feeBook struct {
+	mu       sync.Mutex
+	currency map[string]FeeCurrency
+	// stored against user ID, oldest first
+	trades map[string][]UserTrade
+}
+
+func newFeeBook() *feeBook {
+	return &feeBook{
+		currency: make(map[string]FeeCurrency),
+		trades:   make(map[string][]UserTrade),
+	}
+}
+
+// SetFeeCurrency sets what the user pays fees in
+func (ex *Exchange) SetFeeCurrency(userID string, currency FeeCurrency) error {
+	if err := currency.Validate(); err != nil {
+		return err
+	}
+	return ex.execute(CmdSetFeeCurrency, &feeCurrencyCommand{UserID: userID, Currency: currency})
+}
+
+func (ex *Exchange) setFeeCurrency(userID string, currency FeeCurrency) error {
+	if err := currency.Validate(); err != nil {
+		return err
+	}
+
+	ex.fees.mu.Lock()
+	defer ex.fees.mu.Unlock()
+	if currency == FeeInReceived {
+		delete(ex.fees.currency, userID)
+	} else {
+		ex.fees.currency[userID] = currency
+	}
+	return nil
+}
+
+func (ex *Exchange) FeeCurrency(userID string) FeeCurrency {
+	ex.fees.mu.Lock()
+	defer ex.fees.mu.Unlock()
+	return ex.fees.currency[userID]
+}
+
+// SetFeeSchedule replaces the fee schedule of market, it applies from the next fill on
+func (ex *Exchange) SetFeeSchedule(market Market, schedule FeeSchedule) error {
+	return ex.execute(CmdSetFeeSchedule, &feeScheduleCommand{Market: market, Schedule: schedule})
+}
+
+func (ex *Exchange) setFeeSchedule(market Market, schedule FeeSchedule) error {
+	ob, err := ex.Market(market)
+	if err != nil {
+		return err
+	}
+	if err := schedule.Validate(); err != nil {
+		return err
+	}
+
+	ob.Spec.Fees = schedule
+	return nil
+}
+
+// UserTrades returns the fills of userID's orders, oldest first. Fills that left
+// the fee volume window are dropped when a snapshot is written.
+func (ex *Exchange) UserTrades(userID string) []UserTrade {
+	ex.fees.mu.Lock()
+	defer ex.fees.mu.Unlock()
+	return append(make([]UserTrade, 0), ex.fees.trades[userID]...)
+}
+
+// TradedVolume is the quote userID traded over every market since then
+func (ex *Exchange) TradedVolume(userID string, since time.Time) decimal.Decimal {
+	ex.fees.mu.Lock()
+	defer ex.fees.mu.Unlock()
+	return ex.fees.volumeSince(userID, since.UnixNano())
+}
+
+// FeeTier returns the tier userID trades market at
+func (ex *Exchange) FeeTier(market Market, userID string) (FeeTier, error) {
+	spec, err := ex.MarketSpec(market)
+	if err != nil {
+		return FeeTier{}, err
+	}
+	return spec.Fees.Tier(ex.TradedVolume(userID, time.Now().Add(-FeeVolumeWindow))), nil
+}
+
+func (b *feeBook) volumeSince(userID string, since int64) decimal.Decimal {
+	volume := decimal.Zero
+	trades := b.trades[userID]
+	for i := len(trades) - 1; i >= 0 && trades[i].Timestamp >= since; i-- {
+		volume = volume.Add(trades[i].Notional)
+	}
+	return volume
+}
+
+// trades of each user since since, the ones fee tiers still count, b.mu is held
+func (b *feeBook) tradesSince(since int64) map[string][]UserTrade {
+	trades := make(map[string][]UserTrade, len(b.trades))
+	for userID, all := range b.trades {
+		i := sort.Search(len(all), func(i int) bool { return all[i].Timestamp >= since })
+		if i < len(all) {
+			trades[userID] = append([]UserTrade(nil), all[i:]...)
+		}
+	}
+	return trades
+}
+
+func (b *feeBook) record(userID string, trade UserTrade) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trades[userID] = append(b.trades[userID], trade)
+}
+
+// works out the fees of both sides of m, the bid paying in bidCurrency, and
+// writes them into it
+func (ob *OrderBook) chargeFees(m *Match, bidCurrency FeeCurrency) {
+	fees := ob.Exchange.fees
+	since := ob.now() - int64(FeeVolumeWindow)
+
+	fees.mu.Lock()
+	askTier := ob.Spec.Fees.Tier(fees.volumeSince(m.Ask.UserID, since))
+	bidTier := ob.Spec.Fees.Tier(fees.volumeSince(m.Bid.UserID, since))
+	fees.mu.Unlock()
+
+	askBps, bidBps := askTier.TakerBps, bidTier.MakerBps
+	if m.TakerBid {
+		askBps, bidBps = askTier.MakerBps, bidTier.TakerBps
+	}
+
+	// a seller receives the quote either way
+	m.AskFee, m.AskFeeAsset = feeOf(m.Notional, askBps), ob.Spec.Quote
+	if bidCurrency == FeeInQuote {
+		m.BidFee, m.BidFeeAsset = feeOf(m.Notional, bidBps), ob.Spec.Quote
+	} else {
+		m.BidFee, m.BidFeeAsset = feeOf(m.SizeFilled, bidBps), ob.Spec.Base
+	}
+}
+
+// the postings moving a fee from owner's available balance to the fee account
+func feePostings(owner string, asset Asset, fee decimal.Decimal) []ledger.Posting {
+	if fee.IsZero() {
+		return nil
+	}
+	return []ledger.Posting{
+		{Account: ledger.AvailableOf(owner, asset), Amount: fee.Neg()},
+		{Account: ledger.AvailableOf(ledger.Fees, asset), Amount: fee},
+	}
+}
+
+// adds both sides of a settled match to their users' trade history
+func (ob *OrderBook) recordUserTrades(m Match, ts int64) {
+	fees := ob.Exchange.fees
+	fees.record(m.Ask.UserID, UserTrade{
+		Market:    ob.TokenId,
+		OrderID:   m.Ask.ID.String(),
+		Bid:       false,
+		Price:     m.Price,
+		Size:      m.SizeFilled,
+		Notional:  m.Notional,
+		Maker:     m.TakerBid,
+		Fee:       m.AskFee,
+		FeeAsset:  m.AskFeeAsset,
+		Timestamp: ts,
+	})
+	fees.record(m.Bid.UserID, UserTrade{
+		Market:    ob.TokenId,
+		OrderID:   m.Bid.ID.String(),
+		Bid:       true,
+		Price:     m.Price,
+		Size:      m.SizeFilled,
+		Notional:  m.Notional,
+		Maker:     !m.TakerBid,
+		Fee:       m.BidFee,
+		FeeAsset:  m.BidFeeAsset,
+		Timestamp: ts,
+	})
+}
@@ -0,0 +1,160 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/EggsyOnCode/velho-exchange/auth"
+	"github.com/EggsyOnCode/velho-exchange/decimal"
+	"github.com/EggsyOnCode/velho-exchange/ledger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMakerAndTakerFees(t *testing.T) {
+	ex := NewExchange()
+	require.NoError(t, ex.SetFeeSchedule(BTC, FeeSchedule{
+		{MinVolume: decimal.Zero, MakerBps: decimal.FromInt(10), TakerBps: decimal.FromInt(20)},
+	}))
+	ob := ex.OrderBook[BTC]
+
+	seller := auth.NewUser(nil, decimal.Zero)
+	buyer := auth.NewUser(nil, decimal.FromInt(1_000))
+	ex.AddUser(seller)
+	ex.AddUser(buyer)
+	sellerID, buyerID := seller.ID.String(), buyer.ID.String()
+	deposit(t, ex, sellerID, AssetBTC, 5)
+
+	// the seller rests and makes, the buyer takes
+	ob.PlaceLimitOrder(decimal.FromInt(100), NewOrder(decimal.FromInt(5), false, decimal.FromInt(100), sellerID))
+	matches, err := ob.PlaceLimitOrder(decimal.FromInt(100), NewOrder(decimal.FromInt(5), true, decimal.FromInt(100), buyerID))
+	require.NoError(t, err)
+	require.Len(t, matches, 1)
+
+	m := matches[0]
+	assert.True(t, m.TakerBid)
+	// 10 bps of the 500 USD the seller receives, 20 bps of the 5 BTC the buyer receives
+	assert.Equal(t, decimal.RequireFromString("0.5"), m.AskFee)
+	assert.Equal(t, AssetUSD, m.AskFeeAsset)
+	assert.Equal(t, decimal.RequireFromString("0.01"), m.BidFee)
+	assert.Equal(t, AssetBTC, m.BidFeeAsset)
+
+	assert.Equal(t, decimal.RequireFromString("499.5"), seller.USD)
+	assert.Equal(t, decimal.RequireFromString("0.5"), ex.Ledger.Balance(ledger.Fees, AssetUSD).Available)
+	assert.Equal(t, decimal.RequireFromString("0.01"), ex.Ledger.Balance(ledger.Fees, AssetBTC).Available)
+	ex.WaitSettled()
+	assert.Equal(t, decimal.RequireFromString("4.99"), ex.Settlement(AssetBTC).(*MemorySettlement).Wallet(buyerID))
+
+	trades := ob.GetTrades()
+	require.Len(t, trades, 1)
+	assert.Equal(t, m.AskFee, trades[0].AskFee)
+	assert.Equal(t, m.BidFee, trades[0].BidFee)
+
+	history := ex.UserTrades(buyerID)
+	require.Len(t, history, 1)
+	assert.False(t, history[0].Maker)
+	assert.Equal(t, decimal.RequireFromString("0.01"), history[0].Fee)
+	assert.True(t, ex.UserTrades(sellerID)[0].Maker)
+	assert.NoError(t, ex.Ledger.Check())
+}
+
+func TestFeeTiersAndMakerRebate(t *testing.T) {
+	ex := NewExchange()
+	require.NoError(t, ex.SetFeeSchedule(BTC, FeeSchedule{
+		{MinVolume: decimal.Zero, MakerBps: decimal.FromInt(10), TakerBps: decimal.FromInt(20)},
+		{MinVolume: decimal.FromInt(1_000), MakerBps: decimal.FromInt(-5), TakerBps: decimal.FromInt(10)},
+	}))
+	ob := ex.OrderBook[BTC]
+
+	maker := auth.NewUser(nil, decimal.FromInt(10_000))
+	taker := auth.NewUser(nil, decimal.Zero)
+	ex.AddUser(maker)
+	ex.AddUser(taker)
+	makerID, takerID := maker.ID.String(), taker.ID.String()
+	deposit(t, ex, takerID, AssetBTC, 20)
+
+	sell := func() Match {
+		ob.PlaceLimitOrder(decimal.FromInt(100), NewOrder(decimal.FromInt(10), true, decimal.FromInt(100), makerID))
+		matches, err := ob.PlaceMarketOrder(NewMarketOrder(decimal.FromInt(10), false, takerID))
+		require.NoError(t, err)
+		require.Len(t, matches, 1)
+		return matches[0]
+	}
+
+	first := sell()
+	assert.Equal(t, decimal.RequireFromString("0.01"), first.BidFee)
+	assert.Equal(t, decimal.FromInt(2), first.AskFee)
+
+	// both traded 1,000 USD, the maker is paid a rebate now
+	assert.Equal(t, decimal.FromInt(1_000), ex.TradedVolume(makerID, time.Now().Add(-FeeVolumeWindow)))
+	tier, err := ex.FeeTier(BTC, makerID)
+	require.NoError(t, err)
+	assert.Equal(t, decimal.FromInt(-5), tier.MakerBps)
+
+	second := sell()
+	assert.Equal(t, decimal.RequireFromString("-0.005"), second.BidFee)
+	assert.Equal(t, decimal.FromInt(1), second.AskFee)
+	assert.Equal(t, decimal.FromInt(3), ex.Ledger.Balance(ledger.Fees, AssetUSD).Available)
+	assert.Equal(t, decimal.RequireFromString("0.005"), ex.Ledger.Balance(ledger.Fees, AssetBTC).Available)
+
+	// volume older than the window doesn't count
+	assert.Equal(t, decimal.Zero, ex.TradedVolume(makerID, time.Now().Add(time.Minute)))
+	assert.NoError(t, ex.Ledger.Check())
+}
+
+func TestFeesInQuote(t *testing.T) {
+	ex := NewExchange()
+	require.NoError(t, ex.SetFeeSchedule(BTC, FeeSchedule{
+		{MinVolume: decimal.Zero, MakerBps: decimal.FromInt(10), TakerBps: decimal.FromInt(20)},
+	}))
+	ob := ex.OrderBook[BTC]
+
+	seller := auth.NewUser(nil, decimal.Zero)
+	buyer := auth.NewUser(nil, decimal.FromInt(1_001))
+	ex.AddUser(seller)
+	ex.AddUser(buyer)
+	buyerID := buyer.ID.String()
+	deposit(t, ex, seller.ID.String(), AssetBTC, 20)
+	require.NoError(t, ex.SetFeeCurrency(buyerID, FeeInQuote))
+	assert.Error(t, ex.SetFeeCurrency(buyerID, "EUR"))
+
+	ob.PlaceLimitOrder(decimal.FromInt(100), NewOrder(decimal.FromInt(20), false, decimal.FromInt(100), seller.ID.String()))
+
+	// 1 USD is left to pay the 20 bps of 500 USD with
+	matches, err := ob.PlaceMarketOrder(NewMarketOrder(decimal.FromInt(5), true, buyerID))
+	require.NoError(t, err)
+	assert.Equal(t, AssetUSD, matches[0].BidFeeAsset)
+	assert.Equal(t, decimal.FromInt(1), matches[0].BidFee)
+	assert.Equal(t, decimal.FromInt(500), buyer.USD)
+
+	// now it can't, so the fee comes out of the BTC bought
+	matches, err = ob.PlaceMarketOrder(NewMarketOrder(decimal.FromInt(5), true, buyerID))
+	require.NoError(t, err)
+	assert.Equal(t, AssetBTC, matches[0].BidFeeAsset)
+	assert.Equal(t, decimal.RequireFromString("0.01"), matches[0].BidFee)
+	assert.Equal(t, decimal.Zero, buyer.USD)
+	assert.NoError(t, ex.Ledger.Check())
+}
+
+func TestFeeScheduleValidate(t *testing.T) {
+	tier := func(volume, maker, taker int64) FeeTier {
+		return FeeTier{MinVolume: decimal.FromInt(volume), MakerBps: decimal.FromInt(maker), TakerBps: decimal.FromInt(taker)}
+	}
+
+	assert.NoError(t, FeeSchedule(nil).Validate())
+	assert.NoError(t, DefaultFeeSchedule.Validate())
+	assert.Error(t, FeeSchedule{tier(10, 1, 2)}.Validate())
+	assert.Error(t, FeeSchedule{tier(0, 1, 2), tier(0, 1, 1)}.Validate())
+	assert.Error(t, FeeSchedule{tier(0, 1, -1)}.Validate())
+	assert.Error(t, FeeSchedule{tier(0, -3, 2)}.Validate())
+	assert.Error(t, FeeSchedule{tier(0, 1, bpsScale)}.Validate())
+
+	_, err := NewExchange().CreateMarket("SOL", MarketSpec{
+		Base:     "SOL",
+		Quote:    AssetUSD,
+		TickSize: decimal.RequireFromString("0.01"),
+		LotSize:  decimal.RequireFromString("0.1"),
+		Fees:     FeeSchedule{tier(0, -3, 2)},
+	})
+	assert.Error(t, err)
+}
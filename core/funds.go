@@ -0,0 +1,157 @@
+package core
+
+import (
+	"github.com/EggsyOnCode/velho-exchange/decimal"
+	"github.com/sirupsen/logrus"
+)
+
+// An order locks everything it can be settled with before it's matched, so an
+// order its user can't pay for is rejected before anything moves. A bid locks
+// USD: its size at its limit price, or the most a market order's size can cost
+// on the book. An ask locks the tokens its user deposited, tokens only come into
+// the exchange's custody through deposits (deposits.go).
+// Every fill is paid out of the lock, whatever the order no longer needs (price
+// improvement, a cancelled remainder) is released after matching and a cancelled
+// or expired order releases all of it.
+
+// the amount of its asset o locks for size of it
+func (o *Order) lockFor(size decimal.Decimal) decimal.Decimal {
+	if o.Bid {
+		return o.Price.Mul(size)
+	}
+	return size
+}
+
+// what a pending stop order locks: what it locks once it's triggered, and for a
+// buy STOP_MARKET its size at its worst price, or its stop price without one, up
+// to its max notional. A triggered order gives it back and locks afresh.
+func (o *Order) stopLock() decimal.Decimal {
+	switch {
+	case !o.Bid:
+		return o.Size
+	case o.OrderType == StopLimitOrder:
+		return o.lockFor(o.Size)
+	case o.Size.IsZero():
+		return o.MaxNotional
+	}
+
+	price := o.StopPrice
+	if o.WorstPrice.IsPositive() {
+		price = o.WorstPrice
+	}
+	cost := price.Mul(o.Size)
+	if o.MaxNotional.IsPositive() {
+		return decimal.Min(cost, o.MaxNotional)
+	}
+	return cost
+}
+
+// the most a market ask with only a quote budget sells within crosses: the best
+// bids' size, in whole lots at each level, until the budget runs out. As in
+// maxCost its user's own orders are left out when self-trade prevention is on.
+func (ob *OrderBook) budgetSize(o *Order, crosses func(price decimal.Decimal) bool) decimal.Decimal {
+	left, size := o.MaxNotional, decimal.Zero
+	ob.Bids.Each(func(price decimal.Decimal, l *Limit) {
+		if !left.IsPositive() || !crosses(price) {
+			return
+		}
+
+		volume := decimal.Zero
+		l.Orders.Each(func(_ int64, order *Order) {
+			if order.UserID != o.UserID || o.SelfTradePrevention == STPNone {
+				volume = volume.Add(order.Remaining())
+			}
+		})
+		sold := decimal.Min(volume, left.Div(price).TruncateTo(ob.Spec.LotSize))
+		size = size.Add(sold)
+		left = left.Sub(price.Mul(sold))
+	})
+
+	return size
+}
+
+func (ob *OrderBook) lockedAsset(o *Order) Asset {
+	if o.Bid {
+		return ob.Spec.Quote
+	}
+	return ob.Spec.Base
+}
+
+// locks amount for o, ErrInsufficientFunds if its user's available balance can't cover it
+func (ob *OrderBook) reserve(o *Order, amount decimal.Decimal) error {
+	if !amount.IsPositive() {
+		return nil
+	}
+	if ob.Exchange == nil {
+		return ErrNoExchange
+	}
+
+	asset := ob.lockedAsset(o)
+	if err := ob.Exchange.Ledger.Lock(o.UserID, asset, amount, o.ID.String()); err != nil {
+		return err
+	}
+	o.Locked = o.Locked.Add(amount)
+
+	return nil
+}
+
+// unlocks amount of what o has locked and hands it back to its user
+func (ob *OrderBook) release(o *Order, amount decimal.Decimal) {
+	if !amount.IsPositive() {
+		return
+	}
+
+	asset := ob.lockedAsset(o)
+	if err := ob.Exchange.Ledger.Unlock(o.UserID, asset, amount, o.ID.String()); err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"id":     o.ID,
+			"userId": o.UserID,
+			"asset":  asset,
+			"amount": amount,
+		}).Error("order funds not released")
+		return
+	}
+	o.Locked = o.Locked.Sub(amount)
+}
+
+// hands size of a resting order back to its owner: an ask's tokens, or the USD
+// a bid locked at its limit price
+func (ob *OrderBook) releaseCustody(o *Order, size decimal.Decimal) {
+	ob.release(o, o.lockFor(size))
+}
+
+// releases what o has locked beyond what its resting part needs, all of it if
+// it doesn't rest
+func (ob *OrderBook) releaseExcess(o *Order, rests bool) {
+	keep := decimal.Zero
+	if rests {
+		keep = o.lockFor(o.Remaining())
+	}
+	ob.release(o, o.Locked.Sub(keep))
+}
+
+// the most a market bid can pay for its size within crosses: the cheapest asks it
+// can trade with. Its user's own orders never cost it anything when self-trade
+// prevention is on, so they're left out.
+func (ob *OrderBook) maxCost(o *Order, crosses func(price decimal.Decimal) bool) decimal.Decimal {
+	left, cost := o.Size, decimal.Zero
+	ob.Asks.Each(func(price decimal.Decimal, l *Limit) {
+		if left.IsZero() || !crosses(price) {
+			return
+		}
+
+		l.Orders.Each(func(_ int64, order *Order) {
+			if left.IsZero() || (order.UserID == o.UserID && o.SelfTradePrevention != STPNone) {
+				return
+			}
+			size := decimal.Min(left, order.Remaining())
+			cost = cost.Add(price.Mul(size))
+			left = left.Sub(size)
+		})
+	})
+
+	if o.MaxNotional.IsPositive() {
+		return decimal.Min(cost, o.MaxNotional)
+	}
+	return cost
+}
@@ -0,0 +1,242 @@
+package core
+
+import (
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/EggsyOnCode/velho-exchange/internals"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/google/uuid"
+)
+
+var (
+	ErrKeyNotFound = errors.New("no key for the address in the keystore")
+	// the passphrase doesn't decrypt the keys stored
+	ErrKeystorePassphrase = errors.New("keystore passphrase doesn't decrypt its keys")
+)
+
+type KeystoreConfig struct {
+	// what keys are encrypted with
+	Passphrase string
+	// scrypt's cost parameters, see keystore.EncryptKey
+	ScryptN int
+	ScryptP int
+}
+
+// DefaultKeystoreConfig has go-ethereum's light scrypt cost, a key is decrypted
+// for every transaction it signs and the standard cost takes a second each time
+var DefaultKeystoreConfig = KeystoreConfig{ScryptN: keystore.LightScryptN, ScryptP: keystore.LightScryptP}
+
+// what an exchange starts with, keys are only obfuscated until ConfigureKeystore
+// gives it a passphrase
+var unconfiguredKeystore = KeystoreConfig{ScryptN: 2, ScryptP: 1}
+
+// Keystore holds the private keys of users' wallets and deposit addresses,
+// encrypted in go-ethereum's keystore format with a passphrase. They're logged
+// and snapshotted that way too. A key is only decrypted to sign a transaction,
+// see SignTx. API key secrets are logged and snapshotted encrypted with the same
+// passphrase (see seal).
+type Keystore struct {
+	mu     sync.Mutex
+	config KeystoreConfig
+	// encrypted key JSON by address
+	keys map[common.Address][]byte
+}
+
+func NewKeystore(config KeystoreConfig) *Keystore {
+	return &Keystore{config: config, keys: make(map[common.Address][]byte)}
+}
+
+// ConfigureKeystore sets what the exchange's keys are encrypted with. It has to
+// be done before any key is stored, so before the exchange is recovered.
+func (ex *Exchange) ConfigureKeystore(config KeystoreConfig) error {
+	ks := ex.keystore
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if len(ks.keys) > 0 {
+		return fmt.Errorf("keystore can't be configured once it holds keys")
+	}
+	ks.config = config
+	return nil
+}
+
+// Keystore is where the exchange keeps users' keys, settlement signs with it
+func (ex *Exchange) Keystore() *Keystore {
+	return ex.keystore
+}
+
+// Import encrypts key into the keystore and returns its address
+func (ks *Keystore) Import(key *ecdsa.PrivateKey) (common.Address, error) {
+	data, err := ks.encrypt(key)
+	if err != nil {
+		return common.Address{}, err
+	}
+	return ks.add(data)
+}
+
+// the keystore JSON of key, encrypting is slow so it's done outside of commands
+func (ks *Keystore) encrypt(key *ecdsa.PrivateKey) ([]byte, error) {
+	ks.mu.Lock()
+	config := ks.config
+	ks.mu.Unlock()
+
+	return keystore.EncryptKey(&keystore.Key{
+		Id:         uuid.New(),
+		Address:    internals.GetAddress(key),
+		PrivateKey: key,
+	}, config.Passphrase, config.ScryptN, config.ScryptP)
+}
+
+// stores the encrypted key data, as it was logged or snapshotted
+func (ks *Keystore) add(data []byte) (common.Address, error) {
+	address, err := keyAddress(data)
+	if err != nil {
+		return common.Address{}, err
+	}
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.keys[address] = append([]byte(nil), data...)
+	return address, nil
+}
+
+// the address encrypted key data is for, which it carries in the clear
+func keyAddress(data []byte) (common.Address, error) {
+	var header struct {
+		Address string `json:"address"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return common.Address{}, fmt.Errorf("encrypted key: %w", err)
+	}
+	if !common.IsHexAddress(header.Address) {
+		return common.Address{}, fmt.Errorf("encrypted key has an invalid address %q", header.Address)
+	}
+	return common.HexToAddress(header.Address), nil
+}
+
+func (ks *Keystore) Has(address common.Address) bool {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	_, ok := ks.keys[address]
+	return ok
+}
+
+// SignTx signs tx with the key of address, which is decrypted for it and wiped afterwards
+func (ks *Keystore) SignTx(address common.Address, tx *types.Transaction, signer types.Signer) (*types.Transaction, error) {
+	key, err := ks.unlock(address)
+	if err != nil {
+		return nil, err
+	}
+	defer wipeKey(key)
+
+	return types.SignTx(tx, signer, key)
+}
+
+func (ks *Keystore) unlock(address common.Address) (*ecdsa.PrivateKey, error) {
+	ks.mu.Lock()
+	data, ok := ks.keys[address]
+	passphrase := ks.config.Passphrase
+	ks.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("%w %s", ErrKeyNotFound, address)
+	}
+
+	key, err := keystore.DecryptKey(data, passphrase)
+	if errors.Is(err, keystore.ErrDecrypt) {
+		return nil, ErrKeystorePassphrase
+	} else if err != nil {
+		return nil, err
+	}
+	return key.PrivateKey, nil
+}
+
+// check makes sure the passphrase decrypts the keys, by decrypting one of them
+func (ks *Keystore) check() error {
+	ks.mu.Lock()
+	var address common.Address
+	found := false
+	for a := range ks.keys {
+		address, found = a, true
+		break
+	}
+	ks.mu.Unlock()
+	if !found {
+		return nil
+	}
+
+	key, err := ks.unlock(address)
+	if err != nil {
+		return err
+	}
+	wipeKey(key)
+	return nil
+}
+
+// secret encrypted with the keystore's passphrase, like a key. Encrypting is slow
+// so it's done outside of commands.
+func (ks *Keystore) seal(secret []byte) (keystore.CryptoJSON, error) {
+	ks.mu.Lock()
+	config := ks.config
+	ks.mu.Unlock()
+
+	return keystore.EncryptDataV3(secret, []byte(config.Passphrase), config.ScryptN, config.ScryptP)
+}
+
+// the secret sealed is of
+func (ks *Keystore) open(sealed keystore.CryptoJSON) ([]byte, error) {
+	ks.mu.Lock()
+	passphrase := ks.config.Passphrase
+	ks.mu.Unlock()
+
+	secret, err := keystore.DecryptDataV3(sealed, passphrase)
+	if errors.Is(err, keystore.ErrDecrypt) {
+		return nil, ErrKeystorePassphrase
+	}
+	return secret, err
+}
+
+func wipeKey(key *ecdsa.PrivateKey) {
+	b := key.D.Bits()
+	clear(b)
+}
+
+// the encrypted keys, by address
+func (ks *Keystore) snapshot() []json.RawMessage {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	addresses := make([]common.Address, 0, len(ks.keys))
+	for address := range ks.keys {
+		addresses = append(addresses, address)
+	}
+	sort.Slice(addresses, func(i, j int) bool { return addresses[i].Cmp(addresses[j]) < 0 })
+
+	keys := make([]json.RawMessage, 0, len(addresses))
+	for _, address := range addresses {
+		keys = append(keys, append(json.RawMessage(nil), ks.keys[address]...))
+	}
+	return keys
+}
+
+func (ks *Keystore) restore(keys []json.RawMessage) error {
+	restored := make(map[common.Address][]byte, len(keys))
+	for _, data := range keys {
+		address, err := keyAddress(data)
+		if err != nil {
+			return err
+		}
+		restored[address] = append([]byte(nil), data...)
+	}
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.keys = restored
+	return nil
+}
@@ -0,0 +1,114 @@
+package core
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/EggsyOnCode/velho-exchange/auth"
+	"github.com/EggsyOnCode/velho-exchange/decimal"
+	"github.com/EggsyOnCode/velho-exchange/internals"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeystoreSignsWithoutHandingOutKeys(t *testing.T) {
+	keys := NewKeystore(unconfiguredKeystore)
+	key := internals.GenerateNewPrivateKey()
+	address, err := keys.Import(key)
+	require.NoError(t, err)
+	assert.Equal(t, internals.GetAddress(key), address)
+	assert.True(t, keys.Has(address))
+
+	signer := types.LatestSignerForChainID(big.NewInt(1337))
+	tx, err := keys.SignTx(address, types.NewTransaction(0, common.Address{}, big.NewInt(1), ethTransferGas, big.NewInt(1), nil), signer)
+	require.NoError(t, err)
+	from, err := types.Sender(signer, tx)
+	require.NoError(t, err)
+	assert.Equal(t, address, from)
+
+	_, err = keys.SignTx(common.Address{1}, tx, signer)
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+
+	// the same keys under another passphrase can't be unlocked
+	other := NewKeystore(KeystoreConfig{Passphrase: "other", ScryptN: 2, ScryptP: 1})
+	require.NoError(t, other.restore(keys.snapshot()))
+	_, err = other.SignTx(address, tx, signer)
+	assert.ErrorIs(t, err, ErrKeystorePassphrase)
+}
+
+func TestKeysAreEncryptedAtRest(t *testing.T) {
+	dir := t.TempDir()
+	snapshotPath, walPath := filepath.Join(dir, "snapshot.json"), filepath.Join(dir, "commands.wal")
+	config := KeystoreConfig{Passphrase: "correct horse", ScryptN: 2, ScryptP: 1}
+	recover := func(config KeystoreConfig) (*Exchange, error) {
+		ex := NewExchange()
+		require.NoError(t, ex.ConfigureKeystore(config))
+		return ex, ex.Recover(snapshotPath, walPath, DefaultWALConfig)
+	}
+
+	ex, err := recover(config)
+	require.NoError(t, err)
+	user := auth.NewUser(nil, decimal.FromInt(1_000))
+	require.NoError(t, ex.AddUser(user))
+	assert.Error(t, ex.ConfigureKeystore(config), "keys are stored already")
+	_, err = ex.DepositAddress(user.ID.String())
+	require.NoError(t, err)
+	_, err = ex.WriteSnapshot(snapshotPath)
+	require.NoError(t, err)
+	other, err := ex.RegisterUser(internals.GenerateNewPrivateKey())
+	require.NoError(t, err)
+	registered, _ := ex.User(other)
+	assert.Nil(t, registered.PrivateKey)
+	require.NoError(t, ex.CloseWAL())
+
+	keyHex := hex.EncodeToString(crypto.FromECDSA(user.PrivateKey))
+	for _, path := range []string{snapshotPath, walPath} {
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.NotContains(t, string(data), keyHex, path)
+	}
+
+	_, err = recover(KeystoreConfig{Passphrase: "wrong", ScryptN: 2, ScryptP: 1})
+	assert.ErrorIs(t, err, ErrKeystorePassphrase)
+
+	// settlement unlocks the restored key to send from the user's wallet
+	restored, err := recover(config)
+	require.NoError(t, err)
+	client := newFakeEthClient()
+	backend := NewEthSettlement(client, restored.PrivateKey, restored.Keystore())
+	u, ok := restored.User(user.ID.String())
+	require.True(t, ok)
+	assert.Nil(t, u.PrivateKey)
+	_, err = backend.Send(Batch{Asset: AssetETH, User: &u, Amount: decimal.FromInt(1), ToExchange: true})
+	require.NoError(t, err)
+	from, err := types.Sender(types.LatestSignerForChainID(client.sent[0].ChainId()), client.sent[0])
+	require.NoError(t, err)
+	assert.Equal(t, user.Address, from)
+	require.NoError(t, restored.CloseWAL())
+}
+
+func TestRejectsKeysLoggedInHex(t *testing.T) {
+	ex := NewExchange()
+	key := internals.GenerateNewPrivateKey()
+
+	// a plaintext key isn't read from the log
+	var cmd registerUserCommand
+	require.NoError(t, json.Unmarshal([]byte(`{"id":"`+uuid.NewString()+`","address":"`+internals.GetAddress(key).Hex()+`","private_key":"`+hex.EncodeToString(crypto.FromECDSA(key))+`"}`), &cmd))
+	assert.Error(t, ex.logAndApply(CmdRegisterUser, &cmd))
+	_, ok := ex.UserByAddress(internals.GetAddress(key))
+	assert.False(t, ok)
+	assert.False(t, ex.Keystore().Has(internals.GetAddress(key)))
+
+	var deposit depositAddressCommand
+	require.NoError(t, json.Unmarshal([]byte(`{"user_id":"someone","private_key":"`+hex.EncodeToString(crypto.FromECDSA(key))+`"}`), &deposit))
+	assert.Error(t, ex.logAndApply(CmdDepositAddress, &deposit))
+	assert.False(t, ex.Keystore().Has(internals.GetAddress(key)))
+}
@@ -0,0 +1,345 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/EggsyOnCode/velho-exchange/decimal"
+)
+
+// The market data feed publishes what a market's commands changed once its
+// sequencer applied them: the trades they printed, the price levels (visible
+// volume only) they changed and the best bid and offer. Depth updates carry a
+// sequence number per market, and a depth subscriber starts from a full snapshot
+// tagged with the sequence number it's current as of, so updates with a higher
+// one apply on top of it and a gap means the client has to wait for the next
+// snapshot (see StartDepthSnapshots).
+//
+// Publishing never waits for a subscriber: messages go to a buffered channel and
+// a subscriber whose buffer is full is dropped with ErrSlowConsumer rather than
+// holding up matching.
+
+var (
+	ErrSlowConsumer   = errors.New("market data subscriber fell behind")
+	ErrUnknownChannel = errors.New("unknown market data channel")
+)
+
+type FeedChannel string
+
+const (
+	FeedTrades FeedChannel = "trades"
+	FeedDepth  FeedChannel = "depth"
+	FeedTicker FeedChannel = "ticker"
+)
+
+type FeedMessageType string
+
+const (
+	FeedSubscribed    FeedMessageType = "subscribed"
+	FeedUnsubscribed  FeedMessageType = "unsubscribed"
+	FeedTradePrints   FeedMessageType = "trades"
+	FeedDepthSnapshot FeedMessageType = "depth_snapshot"
+	FeedDepthUpdate   FeedMessageType = "depth_update"
+	FeedTickerUpdate  FeedMessageType = "ticker"
+)
+
+type FeedMessage struct {
+	Type    FeedMessageType `json:"type"`
+	Market  Market          `json:"market"`
+	Channel FeedChannel     `json:"channel"`
+	// depth messages: the update's sequence number, or the one a snapshot is current as of
+	Seq    uint64       `json:"seq"`
+	Trades []TradePrint `json:"trades,omitempty"`
+	// a snapshot's levels best price first, or the levels an update changed;
+	// a level with a zero size is gone
+	Bids   []PriceLevel `json:"bids,omitempty"`
+	Asks   []PriceLevel `json:"asks,omitempty"`
+	Ticker *Ticker      `json:"ticker,omitempty"`
+	// unix nanoseconds the message was published at
+	Time int64 `json:"time"`
+}
+
+// a trade as the public sees it, without what each side paid in fees
+type TradePrint struct {
+	Price decimal.Decimal `json:"price"`
+	Size  decimal.Decimal `json:"size"`
+	// whether the taker was buying
+	Bid       bool  `json:"bid"`
+	Timestamp int64 `json:"timestamp"`
+}
+
+type PriceLevel struct {
+	Price decimal.Decimal `json:"price"`
+	Size  decimal.Decimal `json:"size"`
+}
+
+// best bid and offer, zero on an empty side
+type Ticker struct {
+	BestBid     decimal.Decimal `json:"best_bid"`
+	BestBidSize decimal.Decimal `json:"best_bid_size"`
+	BestAsk     decimal.Decimal `json:"best_ask"`
+	BestAskSize decimal.Decimal `json:"best_ask_size"`
+	LastPrice   decimal.Decimal `json:"last_price"`
+}
+
+func (c FeedChannel) valid() bool {
+	switch c {
+	case FeedTrades, FeedDepth, FeedTicker:
+		return true
+	}
+	return false
+}
+
+// Subscriber receives the messages of the channels it's subscribed to, across
+// markets. It's closed by Close, or by the feed once its buffer overflows.
+type Subscriber struct {
+	mu       sync.Mutex
+	messages chan FeedMessage
+	closed   bool
+	err      error
+}
+
+func NewSubscriber(buffer int) *Subscriber {
+	return &Subscriber{messages: make(chan FeedMessage, buffer)}
+}
+
+// Messages is closed once the subscriber is
+func (s *Subscriber) Messages() <-chan FeedMessage {
+	return s.messages
+}
+
+// Err is why the feed closed the subscriber, nil if it was closed by Close
+func (s *Subscriber) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func (s *Subscriber) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closeLocked(nil)
+}
+
+func (s *Subscriber) closeLocked(err error) {
+	if s.closed {
+		return
+	}
+	s.closed, s.err = true, err
+	close(s.messages)
+}
+
+// hands m over without waiting, false if the subscriber is (now) closed
+func (s *Subscriber) send(m FeedMessage) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	select {
+	case s.messages <- m:
+		return true
+	default:
+		s.closeLocked(ErrSlowConsumer)
+		return false
+	}
+}
+
+type levelKey struct {
+	bid   bool
+	price decimal.Decimal
+}
+
+// a book's subscribers and what changed since it was last published. A book gets
+// one with its first subscriber, changes aren't tracked before that.
+type marketFeed struct {
+	subscribers map[FeedChannel]map[*Subscriber]struct{}
+	seq         uint64
+	ticker      Ticker
+
+	levels map[levelKey]struct{}
+	trades []TradePrint
+}
+
+func (ob *OrderBook) levelChanged(bid bool, price decimal.Decimal) {
+	if ob.feed != nil {
+		ob.feed.levels[levelKey{bid: bid, price: price}] = struct{}{}
+	}
+}
+
+func (ob *OrderBook) tradePrinted(t *Trade) {
+	if ob.feed != nil {
+		ob.feed.trades = append(ob.feed.trades, TradePrint{Price: t.Price, Size: t.Size, Bid: t.Bid, Timestamp: t.Timestamp})
+	}
+}
+
+// publishes to the subscribers of channel, dropping the ones that are closed
+func (ob *OrderBook) publish(channel FeedChannel, m FeedMessage) {
+	m.Market, m.Channel, m.Time = ob.TokenId, channel, time.Now().UnixNano()
+	for s := range ob.feed.subscribers[channel] {
+		if !s.send(m) {
+			delete(ob.feed.subscribers[channel], s)
+		}
+	}
+}
+
+// publishes what the commands since the last call changed, on the sequencer
+func (ob *OrderBook) publishMarketData() {
+	f := ob.feed
+	if f == nil {
+		return
+	}
+
+	if len(f.trades) > 0 {
+		ob.publish(FeedTrades, FeedMessage{Type: FeedTradePrints, Trades: f.trades})
+		f.trades = nil
+	}
+
+	if len(f.levels) > 0 {
+		f.seq++
+		m := FeedMessage{Type: FeedDepthUpdate, Seq: f.seq}
+		for key := range f.levels {
+			level := PriceLevel{Price: key.price, Size: decimal.Zero}
+			if l := ob.limitAt(key.bid, key.price); l != nil {
+				level.Size = l.TotalVolume
+			}
+			if key.bid {
+				m.Bids = append(m.Bids, level)
+			} else {
+				m.Asks = append(m.Asks, level)
+			}
+		}
+		sortLevels(m.Bids, true)
+		sortLevels(m.Asks, false)
+		ob.publish(FeedDepth, m)
+		f.levels = make(map[levelKey]struct{})
+	}
+
+	if t := ob.Ticker(); t != f.ticker {
+		f.ticker = t
+		ob.publish(FeedTicker, FeedMessage{Type: FeedTickerUpdate, Ticker: &t})
+	}
+}
+
+func (ob *OrderBook) limitAt(bid bool, price decimal.Decimal) *Limit {
+	if bid {
+		return ob.BidsMap[price]
+	}
+	return ob.AsksMap[price]
+}
+
+func sortLevels(levels []PriceLevel, bid bool) {
+	sort.Slice(levels, func(i, j int) bool {
+		if bid {
+			return levels[i].Price.Cmp(levels[j].Price) > 0
+		}
+		return levels[i].Price.Cmp(levels[j].Price) < 0
+	})
+}
+
+// Ticker is the book's best bid and offer and last traded price
+func (ob *OrderBook) Ticker() Ticker {
+	t := Ticker{LastPrice: ob.CurrentPrice}
+	if l := ob.bestLimit(ob.Bids); l != nil {
+		t.BestBid, t.BestBidSize = l.Price, l.TotalVolume
+	}
+	if l := ob.bestLimit(ob.Asks); l != nil {
+		t.BestAsk, t.BestAskSize = l.Price, l.TotalVolume
+	}
+	return t
+}
+
+func (ob *OrderBook) depthSnapshot() FeedMessage {
+	m := FeedMessage{Type: FeedDepthSnapshot, Seq: ob.feed.seq}
+	ob.Bids.Each(func(price decimal.Decimal, l *Limit) {
+		if !l.TotalVolume.IsZero() {
+			m.Bids = append(m.Bids, PriceLevel{Price: price, Size: l.TotalVolume})
+		}
+	})
+	ob.Asks.Each(func(price decimal.Decimal, l *Limit) {
+		if !l.TotalVolume.IsZero() {
+			m.Asks = append(m.Asks, PriceLevel{Price: price, Size: l.TotalVolume})
+		}
+	})
+	return m
+}
+
+// Subscribe adds s to channel of market. The subscription is acknowledged with a
+// "subscribed" message, followed by a depth snapshot or the current ticker; trade
+// prints start with the next trade.
+func (ex *Exchange) Subscribe(s *Subscriber, market Market, channel FeedChannel) error {
+	if !channel.valid() {
+		return fmt.Errorf("%w: %q", ErrUnknownChannel, channel)
+	}
+
+	return ex.ReadBook(market, func(ob *OrderBook) {
+		if ob.feed == nil {
+			ob.feed = &marketFeed{
+				subscribers: make(map[FeedChannel]map[*Subscriber]struct{}),
+				levels:      make(map[levelKey]struct{}),
+				ticker:      ob.Ticker(),
+			}
+		}
+		subscribers := ob.feed.subscribers[channel]
+		if subscribers == nil {
+			subscribers = make(map[*Subscriber]struct{})
+			ob.feed.subscribers[channel] = subscribers
+		}
+		subscribers[s] = struct{}{}
+
+		sendTo := func(m FeedMessage) {
+			m.Market, m.Channel, m.Time = market, channel, time.Now().UnixNano()
+			s.send(m)
+		}
+		sendTo(FeedMessage{Type: FeedSubscribed})
+		switch channel {
+		case FeedDepth:
+			sendTo(ob.depthSnapshot())
+		case FeedTicker:
+			t := ob.Ticker()
+			sendTo(FeedMessage{Type: FeedTickerUpdate, Ticker: &t})
+		}
+	})
+}
+
+// Unsubscribe takes s off channel of market, it's acknowledged with an
+// "unsubscribed" message
+func (ex *Exchange) Unsubscribe(s *Subscriber, market Market, channel FeedChannel) error {
+	if !channel.valid() {
+		return fmt.Errorf("%w: %q", ErrUnknownChannel, channel)
+	}
+
+	return ex.ReadBook(market, func(ob *OrderBook) {
+		if ob.feed != nil {
+			delete(ob.feed.subscribers[channel], s)
+		}
+		s.send(FeedMessage{Type: FeedUnsubscribed, Market: market, Channel: channel, Time: time.Now().UnixNano()})
+	})
+}
+
+// StartDepthSnapshots publishes a full depth snapshot of every market with depth
+// subscribers every interval, for clients that missed an update to resync from
+func (ex *Exchange) StartDepthSnapshots(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			ex.PublishDepthSnapshots()
+		}
+	}()
+}
+
+// PublishDepthSnapshots publishes a full depth snapshot of every market with depth subscribers
+func (ex *Exchange) PublishDepthSnapshots() {
+	for _, book := range ex.Markets() {
+		ex.ReadBook(book.TokenId, func(ob *OrderBook) {
+			if ob.feed != nil && len(ob.feed.subscribers[FeedDepth]) > 0 {
+				ob.publish(FeedDepth, ob.depthSnapshot())
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/EggsyOnCode/velho-exchange/auth"
+	"github.com/EggsyOnCode/velho-exchange/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// the messages published so far, they're sent before the command's submitter hears back
+func received(s *Subscriber) []FeedMessage {
+	var messages []FeedMessage
+	for {
+		select {
+		case m, ok := <-s.Messages():
+			if !ok {
+				return messages
+			}
+			messages = append(messages, m)
+		default:
+			return messages
+		}
+	}
+}
+
+func TestMarketDataFeed(t *testing.T) {
+	ex := NewExchange()
+	seller := auth.NewUser(nil, decimal.FromInt(1_000))
+	buyer := auth.NewUser(nil, decimal.FromInt(10_000))
+	require.NoError(t, ex.AddUser(seller))
+	require.NoError(t, ex.AddUser(buyer))
+	deposit(t, ex, seller.ID.String(), AssetETH, 2)
+
+	_, err := ex.PlaceOrder(ETH, NewOrder(decimal.FromInt(2), false, decimal.FromInt(1_000), seller.ID.String()))
+	require.NoError(t, err)
+
+	sub := NewSubscriber(64)
+	for _, channel := range []FeedChannel{FeedDepth, FeedTrades, FeedTicker} {
+		require.NoError(t, ex.Subscribe(sub, ETH, channel))
+	}
+	messages := received(sub)
+	require.Len(t, messages, 5)
+	snapshot := messages[1]
+	assert.Equal(t, FeedDepthSnapshot, snapshot.Type)
+	assert.Equal(t, []PriceLevel{{Price: decimal.FromInt(1_000), Size: decimal.FromInt(2)}}, snapshot.Asks)
+	assert.Equal(t, FeedSubscribed, messages[2].Type)
+	assert.Equal(t, FeedTickerUpdate, messages[4].Type)
+	assert.Equal(t, decimal.FromInt(1_000), messages[4].Ticker.BestAsk)
+
+	// fills half the ask and rests the rest of the bid
+	_, err = ex.PlaceOrder(ETH, NewOrder(decimal.FromInt(3), true, decimal.FromInt(1_000), buyer.ID.String()))
+	require.NoError(t, err)
+	_, err = ex.PlaceOrder(ETH, NewOrder(decimal.FromInt(1), true, decimal.FromInt(900), buyer.ID.String()))
+	require.NoError(t, err)
+
+	messages = received(sub)
+	require.Len(t, messages, 4)
+
+	trades := messages[0]
+	assert.Equal(t, FeedTradePrints, trades.Type)
+	require.Len(t, trades.Trades, 1)
+	assert.Equal(t, decimal.FromInt(2), trades.Trades[0].Size)
+	assert.True(t, trades.Trades[0].Bid)
+
+	update := messages[1]
+	assert.Equal(t, FeedDepthUpdate, update.Type)
+	assert.Equal(t, snapshot.Seq+1, update.Seq)
+	assert.Equal(t, []PriceLevel{{Price: decimal.FromInt(1_000), Size: decimal.Zero}}, update.Asks)
+	assert.Equal(t, []PriceLevel{{Price: decimal.FromInt(1_000), Size: decimal.FromInt(1)}}, update.Bids)
+
+	assert.Equal(t, FeedTickerUpdate, messages[2].Type)
+	assert.Equal(t, Ticker{BestBid: decimal.FromInt(1_000), BestBidSize: decimal.FromInt(1), LastPrice: decimal.FromInt(1_000)}, *messages[2].Ticker)
+
+	// the bid below the best one doesn't move the ticker
+	assert.Equal(t, FeedDepthUpdate, messages[3].Type)
+	assert.Equal(t, snapshot.Seq+2, messages[3].Seq)
+
+	// a periodic snapshot is what the updates add up to
+	ex.PublishDepthSnapshots()
+	messages = received(sub)
+	require.Len(t, messages, 1)
+	assert.Equal(t, snapshot.Seq+2, messages[0].Seq)
+	assert.Equal(t, []PriceLevel{
+		{Price: decimal.FromInt(1_000), Size: decimal.FromInt(1)},
+		{Price: decimal.FromInt(900), Size: decimal.FromInt(1)},
+	}, messages[0].Bids)
+	assert.Empty(t, messages[0].Asks)
+
+	require.NoError(t, ex.Unsubscribe(sub, ETH, FeedDepth))
+	_, err = ex.PlaceOrder(ETH, NewOrder(decimal.FromInt(1), true, decimal.FromInt(800), buyer.ID.String()))
+	require.NoError(t, err)
+	messages = received(sub)
+	require.Len(t, messages, 1)
+	assert.Equal(t, FeedUnsubscribed, messages[0].Type)
+}
+
+func TestSlowSubscriberIsDropped(t *testing.T) {
+	ex := NewExchange()
+	user := auth.NewUser(nil, decimal.FromInt(10_000))
+	require.NoError(t, ex.AddUser(user))
+
+	// room for the acknowledgement and the snapshot only
+	sub := NewSubscriber(2)
+	require.NoError(t, ex.Subscribe(sub, ETH, FeedDepth))
+
+	for i := 0; i < 3; i++ {
+		_, err := ex.PlaceOrder(ETH, NewOrder(decimal.FromInt(1), true, decimal.FromInt(int64(100+i)), user.ID.String()))
+		require.NoError(t, err)
+	}
+	assert.Len(t, received(sub), 2)
+	assert.ErrorIs(t, sub.Err(), ErrSlowConsumer)
+
+	assert.ErrorIs(t, ex.Subscribe(sub, ETH, "candles"), ErrUnknownChannel)
+	assert.ErrorIs(t, ex.Subscribe(sub, "DOGE", FeedTrades), ErrMarketNotFound)
+}
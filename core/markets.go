@@ -0,0 +1,257 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/EggsyOnCode/velho-exchange/decimal"
+	"github.com/EggsyOnCode/velho-exchange/ledger"
+)
+
+var (
+	ErrMarketNotFound = errors.New("market not found")
+	ErrMarketExists   = errors.New("market already exists")
+	ErrMarketNotOpen  = errors.New("market is not open for trading")
+)
+
+type (
+	Asset        = ledger.Asset
+	MarketStatus string
+)
+
+const (
+	AssetBTC Asset = "BTC"
+	AssetETH Asset = "ETH"
+	// every market is quoted in USD for now
+	AssetUSD Asset = "USD"
+)
+
+const (
+	// listed, orders aren't accepted yet
+	MarketPreOpen MarketStatus = "PRE_OPEN"
+	// continuous trading
+	MarketOpen MarketStatus = "OPEN"
+	// trading is suspended, resting orders stay on the book and can be cancelled
+	MarketHalted MarketStatus = "HALTED"
+	// delisted for good, every resting and pending order is cancelled
+	MarketClosed MarketStatus = "CLOSED"
+)
+
+// MarketSpec describes a market: its base and quote assets, its trading
+// increments (prices must be multiples of TickSize and sizes multiples of
+// LotSize), the bounds on the size of an order, its other pre-trade checks and
+// whether it's trading
+type MarketSpec struct {
+	Base     Asset           `json:"base"`
+	Quote    Asset           `json:"quote"`
+	TickSize decimal.Decimal `json:"tick_size"`
+	LotSize  decimal.Decimal `json:"lot_size"`
+	// zero means no bound
+	MinSize decimal.Decimal `json:"min_size"`
+	MaxSize decimal.Decimal `json:"max_size"`
+	Status  MarketStatus    `json:"status"`
+	// maker / taker fee tiers, none means the market is traded for free
+	Fees FeeSchedule `json:"fees,omitempty"`
+	// price band and notional limits, see risk.go
+	Risk RiskLimits `json:"risk"`
+}
+
+// DefaultRiskLimits, which main sets on the default markets, keep limit prices within 10% of the reference price and
+// orders under 1,000,000 USD, with at most 10,000,000 USD open per user
+var DefaultRiskLimits = RiskLimits{
+	PriceBandBps:     1_000,
+	PriceReference:   ReferenceMid,
+	MaxOrderNotional: decimal.FromInt(1_000_000),
+	MaxUserNotional:  decimal.FromInt(10_000_000),
+}
+
+var DefaultMarketSpecs = map[Market]MarketSpec{
+	BTC: {
+		Base:     AssetBTC,
+		Quote:    AssetUSD,
+		TickSize: decimal.RequireFromString("0.01"),
+		LotSize:  decimal.RequireFromString("0.0001"),
+		Status:   MarketOpen,
+	},
+	ETH: {
+		Base:     AssetETH,
+		Quote:    AssetUSD,
+		TickSize: decimal.RequireFromString("0.01"),
+		LotSize:  decimal.RequireFromString("0.001"),
+		Status:   MarketOpen,
+	},
+}
+
+func (s MarketStatus) Validate() error {
+	switch s {
+	case MarketPreOpen, MarketOpen, MarketHalted, MarketClosed:
+		return nil
+	}
+	return fmt.Errorf("unknown market status %q", s)
+}
+
+func (spec MarketSpec) Validate() error {
+	if spec.Base == "" {
+		return fmt.Errorf("market needs a base asset")
+	}
+	if spec.Quote != AssetUSD {
+		return fmt.Errorf("quote asset must be %s, got %q", AssetUSD, spec.Quote)
+	}
+	if !spec.TickSize.IsPositive() || !spec.LotSize.IsPositive() {
+		return fmt.Errorf("tick size and lot size must be positive")
+	}
+	if spec.MinSize.IsNegative() || !spec.MinSize.IsMultipleOf(spec.LotSize) {
+		return fmt.Errorf("min size %s is not a multiple of the lot size %s", spec.MinSize, spec.LotSize)
+	}
+	if spec.MaxSize.IsNegative() || !spec.MaxSize.IsMultipleOf(spec.LotSize) {
+		return fmt.Errorf("max size %s is not a multiple of the lot size %s", spec.MaxSize, spec.LotSize)
+	}
+	if spec.MaxSize.IsPositive() && spec.MaxSize.Cmp(spec.MinSize) < 0 {
+		return fmt.Errorf("max size %s is below the min size %s", spec.MaxSize, spec.MinSize)
+	}
+	if err := spec.Fees.Validate(); err != nil {
+		return err
+	}
+	if err := spec.Risk.Validate(); err != nil {
+		return err
+	}
+	return spec.Status.Validate()
+}
+
+// MarketSpec returns the spec market trades by
+func (ex *Exchange) MarketSpec(market Market) (spec MarketSpec, err error) {
+	err = ex.ReadBook(market, func(ob *OrderBook) { spec = ob.Spec })
+	return spec, err
+}
+
+// CheckIncrements makes sure price is a multiple of the market's tick size and
+// size is a positive multiple of its lot size within the market's min / max order
+// size. A zero price is accepted for market orders. It fails with a *RiskError.
+func (spec MarketSpec) CheckIncrements(price, size decimal.Decimal) error {
+	if err := spec.checkSize(size); err != nil {
+		return err
+	}
+	if price.IsNegative() || !price.IsMultipleOf(spec.TickSize) {
+		return riskError(RiskPriceOffTick, spec.TickSize, price, "price %s is not a multiple of the tick size %s", price, spec.TickSize)
+	}
+	return nil
+}
+
+func (spec MarketSpec) checkSize(size decimal.Decimal) error {
+	if !size.IsPositive() || !size.IsMultipleOf(spec.LotSize) {
+		return riskError(RiskInvalidSize, spec.LotSize, size, "size %s is not a positive multiple of the lot size %s", size, spec.LotSize)
+	}
+	if size.Cmp(spec.MinSize) < 0 {
+		return riskError(RiskSizeBelowMin, spec.MinSize, size, "size %s is below the min order size %s", size, spec.MinSize)
+	}
+	if spec.MaxSize.IsPositive() && size.Cmp(spec.MaxSize) > 0 {
+		return riskError(RiskSizeAboveMax, spec.MaxSize, size, "size %s is above the max order size %s", size, spec.MaxSize)
+	}
+	return nil
+}
+
+// a limit or stop price, which has to be positive, name says which
+func (spec MarketSpec) checkPrice(name string, price decimal.Decimal) error {
+	if !price.IsPositive() {
+		return riskError(RiskInvalidPrice, decimal.Zero, price, "%s %s must be positive", name, price)
+	}
+	if !price.IsMultipleOf(spec.TickSize) {
+		return riskError(RiskPriceOffTick, spec.TickSize, price, "%s %s is not a multiple of the tick size %s", name, price, spec.TickSize)
+	}
+	return nil
+}
+
+// CheckOpen returns ErrMarketNotOpen unless the market accepts orders
+func (ob *OrderBook) CheckOpen() error {
+	if ob.Spec.Status != MarketOpen {
+		return fmt.Errorf("%w: %s is %s", ErrMarketNotOpen, ob.TokenId, ob.Spec.Status)
+	}
+	return nil
+}
+
+// CreateMarket lists a new market, it starts out PRE_OPEN unless spec says otherwise
+func (ex *Exchange) CreateMarket(market Market, spec MarketSpec) (*OrderBook, error) {
+	cmd := &createMarketCommand{Market: market, Spec: spec}
+	err := ex.execute(CmdCreateMarket, cmd)
+	return cmd.ob, err
+}
+
+func (ex *Exchange) createMarket(market Market, spec MarketSpec) (*OrderBook, error) {
+	if market == "" {
+		return nil, fmt.Errorf("market needs a name")
+	}
+	if spec.Status == "" {
+		spec.Status = MarketPreOpen
+	}
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+
+	ex.marketsMu.Lock()
+	defer ex.marketsMu.Unlock()
+
+	if _, ok := ex.OrderBook[market]; ok {
+		return nil, ErrMarketExists
+	}
+
+	ob := NewOrderBook(market, spec)
+	ob.SetExchange(ex)
+	ex.OrderBook[market] = ob
+	ex.startSequencerLocked(market)
+
+	return ob, nil
+}
+
+// Market returns the order book of market, or ErrMarketNotFound
+func (ex *Exchange) Market(market Market) (*OrderBook, error) {
+	ex.marketsMu.RLock()
+	defer ex.marketsMu.RUnlock()
+
+	ob, ok := ex.OrderBook[market]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrMarketNotFound, market)
+	}
+	return ob, nil
+}
+
+// Markets returns every listed market's order book sorted by market name, only
+// its name is to be read outside of ReadBook
+func (ex *Exchange) Markets() []*OrderBook {
+	ex.marketsMu.RLock()
+	defer ex.marketsMu.RUnlock()
+
+	books := make([]*OrderBook, 0, len(ex.OrderBook))
+	for _, ob := range ex.OrderBook {
+		books = append(books, ob)
+	}
+	sort.Slice(books, func(i, j int) bool { return books[i].TokenId < books[j].TokenId })
+
+	return books
+}
+
+// SetMarketStatus moves a market to status, a CLOSED market can't be reopened
+// and closing one cancels all of its orders
+func (ex *Exchange) SetMarketStatus(market Market, status MarketStatus) error {
+	return ex.execute(CmdSetMarketStatus, &marketStatusCommand{Market: market, Status: status})
+}
+
+func (ex *Exchange) setMarketStatus(market Market, status MarketStatus) error {
+	ob, err := ex.Market(market)
+	if err != nil {
+		return err
+	}
+	if err := status.Validate(); err != nil {
+		return err
+	}
+	if ob.Spec.Status == MarketClosed && status != MarketClosed {
+		return fmt.Errorf("market %s is closed", market)
+	}
+
+	ob.Spec.Status = status
+	if status == MarketClosed {
+		ob.CancelAll()
+	}
+
+	return nil
+}
@@ -0,0 +1,46 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrTooManyOpenOrders is returned for an order that could rest when its user
+// already has the most open orders the exchange allows
+var ErrTooManyOpenOrders = errors.New("too many open orders")
+
+// DefaultMaxOpenOrders is how many orders a user can have resting on the books
+// or waiting for their trigger, across every market
+const DefaultMaxOpenOrders = 200
+
+// SetMaxOpenOrders sets how many open orders a user can have, 0 lifts the limit.
+// Users already past it keep their orders but can't add to them.
+func (ex *Exchange) SetMaxOpenOrders(max int) error {
+	if max < 0 {
+		return fmt.Errorf("max open orders can't be negative")
+	}
+	return ex.execute(CmdSetMaxOpenOrders, &maxOpenOrdersCommand{Max: max})
+}
+
+func (ex *Exchange) MaxOpenOrders() int {
+	ex.cmdMu.Lock()
+	defer ex.cmdMu.Unlock()
+	return ex.maxOpenOrders
+}
+
+// whether o can end up resting on the book or in the trigger book
+func (o *Order) canRest() bool {
+	return o.IsStop() || (o.OrderType != MarketOrder && o.TimeInForce.Rests())
+}
+
+// refuses o if it could rest and its user is at the limit, ex.cmdMu is held
+func (ex *Exchange) checkOpenOrders(o *Order) error {
+	if ex.maxOpenOrders == 0 || !o.canRest() {
+		return nil
+	}
+	orders, _ := ex.openOrders(o.UserID)
+	if len(orders) >= ex.maxOpenOrders {
+		return fmt.Errorf("%w: the limit is %d", ErrTooManyOpenOrders, ex.maxOpenOrders)
+	}
+	return nil
+}
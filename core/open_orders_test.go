@@ -0,0 +1,53 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/EggsyOnCode/velho-exchange/auth"
+	"github.com/EggsyOnCode/velho-exchange/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaxOpenOrders(t *testing.T) {
+	ex := NewExchange()
+	assert.Equal(t, DefaultMaxOpenOrders, ex.MaxOpenOrders())
+	require.NoError(t, ex.SetMaxOpenOrders(2))
+	assert.Error(t, ex.SetMaxOpenOrders(-1))
+
+	buyer := auth.NewUser(nil, decimal.FromInt(10_000))
+	seller := auth.NewUser(nil, decimal.Zero)
+	ex.AddUser(buyer)
+	ex.AddUser(seller)
+	ex.Ledger.Deposit(seller.ID.String(), AssetBTC, decimal.FromInt(10), "test")
+
+	bid := func(price int64) error {
+		_, err := ex.PlaceOrder(BTC, NewOrder(decimal.FromInt(1), true, decimal.FromInt(price), buyer.ID.String()))
+		return err
+	}
+	require.NoError(t, bid(90))
+	require.NoError(t, bid(91))
+	// the limit is across markets and counts stop orders too
+	assert.ErrorIs(t, bid(92), ErrTooManyOpenOrders)
+	_, err := ex.PlaceOrder(ETH, NewStopOrder(StopLimitOrder, decimal.FromInt(1), true, decimal.FromInt(200), decimal.FromInt(200), buyer.ID.String()))
+	assert.ErrorIs(t, err, ErrTooManyOpenOrders)
+
+	// orders that can't rest aren't refused
+	ioc := NewOrder(decimal.FromInt(1), true, decimal.FromInt(95), buyer.ID.String())
+	ioc.TimeInForce = ImmediateOrCancel
+	_, err = ex.PlaceOrder(BTC, ioc)
+	assert.NoError(t, err)
+
+	// a filled order no longer counts
+	_, err = ex.PlaceOrder(BTC, NewOrder(decimal.FromInt(1), false, decimal.FromInt(91), seller.ID.String()))
+	require.NoError(t, err)
+	assert.NoError(t, bid(92))
+	assert.ErrorIs(t, bid(93), ErrTooManyOpenOrders)
+
+	require.NoError(t, ex.SetMaxOpenOrders(0))
+	assert.NoError(t, bid(93))
+
+	restored := NewExchange()
+	require.NoError(t, restored.Restore(ex.Snapshot()))
+	assert.Equal(t, 0, restored.MaxOpenOrders())
+}
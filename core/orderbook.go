@@ -1,72 +1,149 @@
 package core
 
 import (
+	"errors"
 	"fmt"
+	"sort"
 	"time"
 
-	"github.com/EggsyOnCode/velho-exchange/internals"
+	"github.com/EggsyOnCode/velho-exchange/avl"
+	"github.com/EggsyOnCode/velho-exchange/decimal"
+	"github.com/EggsyOnCode/velho-exchange/ledger"
 	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
 	g "github.com/zyedidia/generic"
-	"github.com/zyedidia/generic/avl"
 )
 
+var (
+	ErrFillOrKill         = errors.New("fill or kill order can't be filled entirely")
+	ErrOrderExpired       = errors.New("good till date order needs an expiry in the future")
+	ErrPostOnlyWouldCross = errors.New("post only order would match immediately")
+	ErrOrderNotFound      = errors.New("order not found")
+	ErrInsufficientFunds  = ledger.ErrInsufficientFunds
+	ErrInsufficientVolume = errors.New("insufficient volume")
+	// a book that isn't part of an exchange has no ledger to lock funds on
+	ErrNoExchange = errors.New("order book has no exchange")
+)
+
+// MaxBookTrades is how many of its latest trades a book keeps
+const MaxBookTrades = 1000
+
 // these are to be used on the Front end for displaying recent trades
 // every match order is a trade
 // these trades are getting aggregated later on for analysis
 type Trade struct {
-	Price     float64
-	Size      float64
+	Price     decimal.Decimal
+	Size      decimal.Decimal
 	Bid       bool
 	Timestamp int64
+	// what each side paid in fees, see Match
+	AskFee      decimal.Decimal
+	AskFeeAsset Asset
+	BidFee      decimal.Decimal
+	BidFeeAsset Asset
 }
 
 type Match struct {
 	Ask        *Order
 	Bid        *Order
-	SizeFilled float64
-	Price      float64
+	SizeFilled decimal.Decimal
+	// execution price, i.e. the price of the resting (maker) order
+	Price decimal.Decimal
+	// exact quote amount exchanged: Price * SizeFilled
+	Notional decimal.Decimal
+	// whether the bid was the incoming order, taking liquidity from the ask
+	TakerBid bool
+	// fees charged to each side once the match is settled, negative for a maker
+	// rebate, and the asset they were paid in, see fees.go
+	AskFee      decimal.Decimal
+	AskFeeAsset Asset
+	BidFee      decimal.Decimal
+	BidFeeAsset Asset
 }
 
 type Order struct {
 	ID        uuid.UUID
 	UserID    string
-	Size      int64
+	Size      decimal.Decimal
 	Timestamp int64
-	Price     float64
+	Price     decimal.Decimal
 	// if the order is for sell then its false, otherwise its true (for buy)
-	Bid   bool
-	Limit *Limit
+	Bid         bool
+	TimeInForce TimeInForce
+	// unix nanos after which a GTD order is expired, unused otherwise
+	ExpiresAt int64
+	// a post only order only ever adds liquidity: if it would match on arrival
+	// it's rejected, or repriced one tick behind the opposite best price when
+	// PostOnlyReprice is set
+	PostOnly        bool
+	PostOnlyReprice bool
+	OrderType       OrderType
+	// trigger price of STOP_MARKET / STOP_LIMIT orders
+	StopPrice decimal.Decimal
+	// set once a stop order left the trigger book
+	Triggered bool
+	// iceberg orders only show DisplaySize on the book at a time: Size is the
+	// visible slice and Hidden the reserve it's replenished from
+	DisplaySize decimal.Decimal
+	Hidden      decimal.Decimal
+	// what happens when the order would match one of its user's resting orders,
+	// the user's default applies when it's empty
+	SelfTradePrevention SelfTradePrevention
+	// size that didn't trade because the counterparty was the same user
+	SelfTradePrevented decimal.Decimal
+	// market order protection, see protection.go
+	WorstPrice     decimal.Decimal
+	MaxSlippageBps int64
+	MaxNotional    decimal.Decimal
+	// what's locked in the ledger to settle the order with and not paid out yet:
+	// USD for a bid, tokens for an ask, see funds.go
+	Locked decimal.Decimal
+	Limit  *Limit `json:"-"`
 }
 
-func NewOrder(size int64, bid bool, price float64, userId string) *Order {
+func NewOrder(size decimal.Decimal, bid bool, price decimal.Decimal, userId string) *Order {
 	return &Order{
-		ID:        uuid.New(),
-		Size:      size,
-		Timestamp: time.Now().UnixNano(),
-		Bid:       bid,
-		Price:     price,
-		UserID:    userId,
+		ID:          uuid.New(),
+		Size:        size,
+		Timestamp:   time.Now().UnixNano(),
+		Bid:         bid,
+		Price:       price,
+		UserID:      userId,
+		OrderType:   LimitOrder,
+		TimeInForce: GoodTillCancel,
 	}
 }
 
-func NewMarketOrder(size int64, bid bool, userID string) *Order {
+// market orders never rest, whatever can't be filled is dropped
+func NewMarketOrder(size decimal.Decimal, bid bool, userID string) *Order {
 	return &Order{
-		Size:      size,
-		Timestamp: time.Now().UnixNano(),
-		Bid:       bid,
-		UserID:    userID,
+		Size:        size,
+		Timestamp:   time.Now().UnixNano(),
+		Bid:         bid,
+		UserID:      userID,
+		OrderType:   MarketOrder,
+		TimeInForce: ImmediateOrCancel,
 	}
 }
 
-func (o *Order) TotalPrice() float64 {
-	return float64(o.Size * int64(o.Price))
+// quote amount needed to cover the (remaining) order at its limit price
+func (o *Order) TotalPrice() decimal.Decimal {
+	return o.Price.Mul(o.Remaining())
+}
+
+// visible and hidden size left to fill
+func (o *Order) Remaining() decimal.Decimal {
+	return o.Size.Add(o.Hidden)
+}
+
+func (o *Order) IsIceberg() bool {
+	return o.DisplaySize.IsPositive()
 }
 
 func (o *Order) String() string {
 	t := time.Unix(o.Timestamp, 0)
 	format := t.Format("2006-01-02 15:04:05")
-	return fmt.Sprintf("Order{ID: %s, UserID: %s, Size: %d, Timestamp: %s, Price: %f, Bid: %v}", o.ID, o.UserID, o.Size, format, o.Price, o.Bid)
+	return fmt.Sprintf("Order{ID: %s, UserID: %s, Size: %s, Timestamp: %s, Price: %s, Bid: %v}", o.ID, o.UserID, o.Size, format, o.Price, o.Bid)
 }
 
 func (o *Order) Type() string {
@@ -77,118 +154,203 @@ func (o *Order) Type() string {
 }
 
 func (o *Order) IsFilled() bool {
-	return o.Size == 0
+	return o.Remaining().IsZero()
+}
+
+func (o *Order) checkTimeInForce(now int64) error {
+	switch o.TimeInForce {
+	case GoodTillCancel, ImmediateOrCancel, FillOrKill:
+		return nil
+	case GoodTillDate:
+		if o.ExpiresAt <= now {
+			return ErrOrderExpired
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unknown time in force %q", o.TimeInForce)
 }
 
 type Limit struct {
-	Price float64
-	// sorted by timestamps
+	Price decimal.Decimal
+	// sorted by timestamps, oldest first (time priority)
 	Orders *avl.Tree[int64, *Order]
 	// total volume of tokens available for trade (not tokenAmt * Price)
-	TotalVolume float64
+	TotalVolume decimal.Decimal
+	// reserve of the iceberg orders on this level, not shown on the book
+	HiddenVolume decimal.Decimal
 }
 
-func NewLimit(price float64) *Limit {
+func NewLimit(price decimal.Decimal) *Limit {
 	return &Limit{
 		Price:       price,
-		Orders:      avl.New[int64, *Order](g.Greater[int64]),
-		TotalVolume: 0,
+		Orders:      avl.New[int64, *Order](g.Less[int64]),
+		TotalVolume: decimal.Zero,
 	}
 }
 
 type OrderBook struct {
 	// they'll be sorted by price levels
-	Asks *avl.Tree[float64, *Limit]
-	Bids *avl.Tree[float64, *Limit]
+	Asks *avl.Tree[decimal.Decimal, *Limit]
+	Bids *avl.Tree[decimal.Decimal, *Limit]
 
 	// price levels to limit
-	AsksMap map[float64]*Limit
-	BidsMap map[float64]*Limit
+	AsksMap map[decimal.Decimal]*Limit
+	BidsMap map[decimal.Decimal]*Limit
 
+	// the latest MaxBookTrades trades, by timestamp
 	Trades *avl.Tree[int64, *Trade]
 
 	OrdersMap map[uuid.UUID]*Order
 
-	totalBidVolume float64
-	totalAskVolume float64
-	Exchange       *Exchange
-	TokenId        Market
-	CurrentPrice   float64
+	// trigger book of pending stop orders, keyed by stop price:
+	// buy stops lowest first, sell stops highest first
+	buyStops   *avl.Tree[decimal.Decimal, *Limit]
+	sellStops  *avl.Tree[decimal.Decimal, *Limit]
+	StopOrders map[uuid.UUID]*Order
+	triggering bool
+
+	// visible volume on each side, what's shown on the book
+	totalBidVolume decimal.Decimal
+	totalAskVolume decimal.Decimal
+	// iceberg reserves on each side
+	hiddenBidVolume decimal.Decimal
+	hiddenAskVolume decimal.Decimal
+	Exchange        *Exchange
+	TokenId         Market
+	Spec            MarketSpec
+	CurrentPrice    decimal.Decimal
+	lastTradeTs     int64
+
+	// market data subscribers and what changed since it was last published, only
+	// touched by the market's sequencer (see marketdata.go)
+	feed *marketFeed
 }
 
-func NewOrderBook(tokenID Market) *OrderBook {
+func NewOrderBook(tokenID Market, spec MarketSpec) *OrderBook {
 	return &OrderBook{
 		// asks are sorted in ascending order : lowest ask first
-		Asks: avl.New[float64, *Limit](g.Less[float64]),
+		Asks: avl.New[decimal.Decimal, *Limit](g.Less[decimal.Decimal]),
 		// bids are sorted in descending order : highest bid first
-		Bids:         avl.New[float64, *Limit](g.Greater[float64]),
-		AsksMap:      make(map[float64]*Limit),
-		BidsMap:      make(map[float64]*Limit),
+		Bids:         avl.New[decimal.Decimal, *Limit](g.Greater[decimal.Decimal]),
+		AsksMap:      make(map[decimal.Decimal]*Limit),
+		BidsMap:      make(map[decimal.Decimal]*Limit),
 		OrdersMap:    make(map[uuid.UUID]*Order),
+		buyStops:     avl.New[decimal.Decimal, *Limit](g.Less[decimal.Decimal]),
+		sellStops:    avl.New[decimal.Decimal, *Limit](g.Greater[decimal.Decimal]),
+		StopOrders:   make(map[uuid.UUID]*Order),
 		Trades:       avl.New[int64, *Trade](g.Greater[int64]),
 		TokenId:      tokenID,
-		CurrentPrice: 0,
+		Spec:         spec,
+		CurrentPrice: decimal.Zero,
 	}
 }
 
+// CheckIncrements checks price and size against the market's spec, see MarketSpec.CheckIncrements
+func (ob *OrderBook) CheckIncrements(price, size decimal.Decimal) error {
+	return ob.Spec.CheckIncrements(price, size)
+}
+
 func (ob *OrderBook) SetExchange(e *Exchange) {
 	ob.Exchange = e
 }
 
+// the exchange's clock, see Exchange.now
+func (ob *OrderBook) now() int64 {
+	if ob.Exchange == nil {
+		return time.Now().UnixNano()
+	}
+	return ob.Exchange.now()
+}
+
 func (l *Limit) AddOrder(o *Order) {
 	l.Orders.Put(o.Timestamp, o)
-	l.TotalVolume += float64(o.Size)
+	l.TotalVolume = l.TotalVolume.Add(o.Size)
+	l.HiddenVolume = l.HiddenVolume.Add(o.Hidden)
 }
 
 // cancel / clear order
 func (l *Limit) RemoveOrders(orders []*Order) bool {
 	for _, o := range orders {
 		l.Orders.Remove(o.Timestamp)
-		l.TotalVolume -= float64(o.Size)
+		l.TotalVolume = l.TotalVolume.Sub(o.Size)
+		l.HiddenVolume = l.HiddenVolume.Sub(o.Hidden)
 	}
 
 	return l.Orders.Size() == 0
 }
 
 // we fill a bid / buyOrder
-func (l *Limit) Fill(o *Order) ([]Match, []*Order, bool) {
-	var (
-		matches      []Match
-		filledOrders []*Order
-	)
-	stop := false
+// orders on the level are matched oldest first, an iceberg whose visible slice
+// runs out is replenished from its reserve and goes to the back of the queue.
+// Orders of o's own user are handled by o's self-trade prevention mode instead
+// of being matched. now is the time replenished slices queue up at.
+func (l *Limit) Fill(o *Order, now int64) (matches []Match, filledOrders []*Order, selfTrades []SelfTrade, empty bool) {
+	for !o.IsFilled() {
+		order := l.head()
+		if order == nil {
+			break
+		}
 
-	l.Orders.Each(func(key int64, order *Order) {
-		if stop {
-			return
+		if o.SelfTradePrevention != STPNone && order.UserID == o.UserID {
+			selfTrades = append(selfTrades, l.preventSelfTrade(o, order, now))
+			continue
 		}
 
 		match := l.fillOrder(o, order)
 		matches = append(matches, match)
 
-		l.TotalVolume -= match.SizeFilled
+		l.TotalVolume = l.TotalVolume.Sub(match.SizeFilled)
 
-		if order.IsFilled() {
-			filledOrders = append(filledOrders, order)
+		if !order.Size.IsZero() {
+			continue
 		}
 
-		if o.IsFilled() {
-			stop = true
+		if order.Hidden.IsPositive() {
+			l.replenish(order, now)
+			continue
 		}
-	})
 
-	flag := l.RemoveOrders(filledOrders)
-	if flag {
-		return matches, filledOrders, true
+		l.Orders.Remove(order.Timestamp)
+		filledOrders = append(filledOrders, order)
 	}
 
 	// if the limit is empty, then we'll remove it from the orderbook
-	return matches, filledOrders, false
+	return matches, filledOrders, selfTrades, l.Orders.Size() == 0
+}
+
+// oldest order on the level
+func (l *Limit) head() *Order {
+	_, first, _ := l.Orders.Min()
+	return first
+}
+
+// shows the next slice of an iceberg order whose visible part was filled,
+// the slice loses time priority
+func (l *Limit) replenish(o *Order, now int64) {
+	l.Orders.Remove(o.Timestamp)
+
+	slice := decimal.Min(o.DisplaySize, o.Hidden)
+	o.Hidden = o.Hidden.Sub(slice)
+	o.Size = slice
+	o.Timestamp = l.nextTimestamp(now)
+
+	l.Orders.Put(o.Timestamp, o)
+	l.TotalVolume = l.TotalVolume.Add(slice)
+	l.HiddenVolume = l.HiddenVolume.Sub(slice)
+}
+
+// a timestamp later than every order on the level, orders are keyed by it so it has to be unique
+func (l *Limit) nextTimestamp(ts int64) int64 {
+	if last, _, ok := l.Orders.Max(); ok && last >= ts {
+		return last + 1
+	}
+	return ts
 }
 
 func (l *Limit) fillOrder(o, order *Order) Match {
 	var (
-		sizeFilled float64
+		sizeFilled decimal.Decimal
 		ask        *Order
 		bid        *Order
 	)
@@ -203,15 +365,13 @@ func (l *Limit) fillOrder(o, order *Order) Match {
 		bid = order
 	}
 
-	if o.Size >= order.Size {
-		o.Size -= order.Size
-		sizeFilled = float64(order.Size)
-		order.Size = 0
-	} else {
-		order.Size -= o.Size
-		sizeFilled = float64(o.Size)
-		o.Size = 0
-	}
+	sizeFilled = decimal.Min(o.Size, order.Size)
+	notional := order.Price.Mul(sizeFilled)
+	o.Size = o.Size.Sub(sizeFilled)
+	order.Size = order.Size.Sub(sizeFilled)
+	// the fill is paid out of what both orders locked, settlement moves the funds
+	ask.Locked = ask.Locked.Sub(sizeFilled)
+	bid.Locked = bid.Locked.Sub(notional)
 
 	updated_ask := *ask
 	updated_bid := *bid
@@ -220,11 +380,13 @@ func (l *Limit) fillOrder(o, order *Order) Match {
 		Ask:        &updated_ask,
 		Bid:        &updated_bid,
 		SizeFilled: sizeFilled,
-		Price:      order.Price * sizeFilled,
+		Price:      order.Price,
+		Notional:   notional,
+		TakerBid:   o.Bid,
 	}
 }
 
-func (ob *OrderBook) DeleteLimit(price float64, bid bool) {
+func (ob *OrderBook) DeleteLimit(price decimal.Decimal, bid bool) {
 	if bid {
 		if l, ok := ob.BidsMap[price]; ok {
 			// Delete the limit from the BidsMap
@@ -233,7 +395,9 @@ func (ob *OrderBook) DeleteLimit(price float64, bid bool) {
 			ob.Bids.Remove(price)
 
 			// Update the total bid volume
-			ob.totalBidVolume -= l.TotalVolume
+			ob.levelChanged(true, price)
+			ob.totalBidVolume = ob.totalBidVolume.Sub(l.TotalVolume)
+			ob.hiddenBidVolume = ob.hiddenBidVolume.Sub(l.HiddenVolume)
 		}
 	} else {
 		if l, ok := ob.AsksMap[price]; ok {
@@ -243,88 +407,424 @@ func (ob *OrderBook) DeleteLimit(price float64, bid bool) {
 			ob.Asks.Remove(price)
 
 			// Update the total ask volume
-			ob.totalAskVolume -= l.TotalVolume
+			ob.levelChanged(false, price)
+			ob.totalAskVolume = ob.totalAskVolume.Sub(l.TotalVolume)
+			ob.hiddenAskVolume = ob.hiddenAskVolume.Sub(l.HiddenVolume)
 		}
 	}
 }
 
-func (ob *OrderBook) TotalAskVolume() float64 {
+func (ob *OrderBook) TotalAskVolume() decimal.Decimal {
 	return ob.totalAskVolume
 }
 
-func (ob *OrderBook) TotalBidVolume() float64 {
+func (ob *OrderBook) TotalBidVolume() decimal.Decimal {
 	return ob.totalBidVolume
 }
 
-// This is for placing limit orders only
+// visible plus hidden (iceberg) ask volume, i.e. what a buy order can actually fill against
+func (ob *OrderBook) FillableAskVolume() decimal.Decimal {
+	return ob.totalAskVolume.Add(ob.hiddenAskVolume)
+}
+
+// visible plus hidden (iceberg) bid volume, i.e. what a sell order can actually fill against
+func (ob *OrderBook) FillableBidVolume() decimal.Decimal {
+	return ob.totalBidVolume.Add(ob.hiddenBidVolume)
+}
+
+// applies a change in the visible / hidden volume of the price level at price
+func (ob *OrderBook) adjustVolume(bid bool, price, visible, hidden decimal.Decimal) {
+	if !visible.IsZero() {
+		ob.levelChanged(bid, price)
+	}
+	if bid {
+		ob.totalBidVolume = ob.totalBidVolume.Add(visible)
+		ob.hiddenBidVolume = ob.hiddenBidVolume.Add(hidden)
+	} else {
+		ob.totalAskVolume = ob.totalAskVolume.Add(visible)
+		ob.hiddenAskVolume = ob.hiddenAskVolume.Add(hidden)
+	}
+}
+
+// PlaceLimitOrder matches o against the opposite side of the book for as long as
+// the best opposite price crosses the limit price, then handles whatever is left
+// according to the order's time in force: GTC and GTD orders rest on the book,
+// IOC orders cancel the remainder and FOK orders are rejected up front unless
+// they can be filled entirely.
 // IMP : price level of an order could be different from o.size * o.price
-func (ob *OrderBook) PlaceLimitOrder(price float64, o *Order) {
-	var limit *Limit
+func (ob *OrderBook) PlaceLimitOrder(price decimal.Decimal, o *Order) ([]Match, error) {
+	matches, err := ob.placeLimitOrder(price, o)
+	if len(matches) > 0 {
+		ob.triggerStops()
+	}
+
+	return matches, err
+}
+
+func (ob *OrderBook) placeLimitOrder(price decimal.Decimal, o *Order) ([]Match, error) {
+	if err := ob.CheckOpen(); err != nil {
+		return nil, err
+	}
+	if err := o.checkTimeInForce(ob.now()); err != nil {
+		return nil, err
+	}
+
+	if o.PostOnly {
+		p, err := ob.postOnlyPrice(price, o)
+		if err != nil {
+			return nil, err
+		}
+		if p != price {
+			logrus.WithFields(logrus.Fields{
+				"id":       o.ID,
+				"price":    price,
+				"repriced": p,
+			}).Info("post only order repriced")
+		}
+		price = p
+		o.Price = p
+	}
+
+	crosses := func(limitPrice decimal.Decimal) bool {
+		if o.Bid {
+			return limitPrice.Cmp(price) <= 0
+		}
+		return limitPrice.Cmp(price) >= 0
+	}
+
+	o.SelfTradePrevention = ob.selfTradePrevention(o)
+	if err := o.SelfTradePrevention.Validate(); err != nil {
+		return nil, err
+	}
+
+	// FOK is checked before anything moves so it's all or nothing
+	if o.TimeInForce == FillOrKill && ob.crossingVolume(o, crosses).Cmp(o.Size) < 0 {
+		return nil, ErrFillOrKill
+	}
+
+	// the whole order is paid for at its limit price up front
+	if err := ob.reserve(o, o.lockFor(o.Size)); err != nil {
+		return nil, err
+	}
+
+	logrus.WithFields(
+		logrus.Fields{
+			"price":       price,
+			"size":        o.Size,
+			"type":        o.Type(),
+			"timeInForce": o.TimeInForce,
+			"userId":      o.UserID,
+			"timestamp":   o.Timestamp,
+		},
+	).Info("new limit Order")
+
+	matches := ob.matchOrder(o, crosses)
+	rests := !o.IsFilled() && o.TimeInForce.Rests()
+
+	if len(matches) > 0 {
+		ob.BalanceOrderBookForMarketOrder(o, matches)
+		ob.recordTrades(matches)
+
+		logrus.WithFields(logrus.Fields{
+			"matches":      len(matches),
+			"remaining":    o.Size,
+			"selfTrade":    o.SelfTradePrevented,
+			"currentPrice": ob.CurrentPrice,
+		}).Info("limit order matched")
+	}
+
+	// the resting part keeps its lock, better prices and a cancelled remainder are given back
+	ob.releaseExcess(o, rests)
+
+	if o.IsFilled() {
+		return matches, nil
+	}
+
+	if !rests {
+		logrus.WithFields(logrus.Fields{
+			"id":          o.ID,
+			"cancelled":   o.Size,
+			"timeInForce": o.TimeInForce,
+		}).Info("unfilled remainder of limit order cancelled")
+
+		return matches, nil
+	}
+
+	ob.restOrder(price, o)
+
+	return matches, nil
+}
+
+// returns the price a post only order can rest at without taking liquidity
+func (ob *OrderBook) postOnlyPrice(price decimal.Decimal, o *Order) (decimal.Decimal, error) {
+	if !o.TimeInForce.Rests() {
+		return price, fmt.Errorf("post only orders must be able to rest, got time in force %s", o.TimeInForce)
+	}
 
 	if o.Bid {
-		if l, ok := ob.BidsMap[price]; ok {
-			limit = l
-			l.AddOrder(o)
-			ob.OrdersMap[o.ID] = o
-			o.Limit = limit
-			ob.totalBidVolume += float64(o.Size)
-			// tranferring usd to the exchange
-			ob.TransferUSD(o.UserID, o.TotalPrice(), true)
+		bestAsk := ob.bestLimit(ob.Asks)
+		if bestAsk == nil || price.Cmp(bestAsk.Price) < 0 {
+			return price, nil
+		}
+		if !o.PostOnlyReprice {
+			return price, ErrPostOnlyWouldCross
+		}
 
-		} else {
-			limit = NewLimit(price)
-			ob.BidsMap[price] = limit
-			limit.AddOrder(o)
-			ob.OrdersMap[o.ID] = o
-			o.Limit = limit
-			ob.Bids.Put(price, limit)
-			ob.totalBidVolume += float64(o.Size)
+		repriced := bestAsk.Price.Sub(ob.Spec.TickSize)
+		if !repriced.IsPositive() {
+			return price, ErrPostOnlyWouldCross
+		}
+		return repriced, nil
+	}
 
-			// transfering usd to the exchange
-			ob.TransferUSD(o.UserID, o.TotalPrice(), true)
+	bestBid := ob.bestLimit(ob.Bids)
+	if bestBid == nil || price.Cmp(bestBid.Price) > 0 {
+		return price, nil
+	}
+	if !o.PostOnlyReprice {
+		return price, ErrPostOnlyWouldCross
+	}
+	return bestBid.Price.Add(ob.Spec.TickSize), nil
+}
 
+// volume resting on the opposite side of o at price levels that cross its limit
+// and that o can actually trade with: its user's own orders are skipped when
+// they'd be cancelled (CANCEL_OLDEST), and nothing past them counts when o itself
+// would lose size on reaching them
+func (ob *OrderBook) crossingVolume(o *Order, crosses func(price decimal.Decimal) bool) decimal.Decimal {
+	side := ob.Bids
+	if o.Bid {
+		side = ob.Asks
+	}
+
+	volume := decimal.Zero
+	blocked := false
+	side.Each(func(price decimal.Decimal, l *Limit) {
+		if blocked || !crosses(price) {
+			return
+		}
+		if o.SelfTradePrevention == STPNone {
+			volume = volume.Add(l.TotalVolume).Add(l.HiddenVolume)
+			return
 		}
 
-	} else {
-		if l, ok := ob.AsksMap[price]; ok {
-			limit = l
-			l.AddOrder(o)
-			ob.OrdersMap[o.ID] = o
-			o.Limit = limit
-			ob.totalAskVolume += float64(o.Size)
+		l.Orders.Each(func(_ int64, order *Order) {
+			switch {
+			case blocked:
+			case order.UserID != o.UserID:
+				volume = volume.Add(order.Remaining())
+			case o.SelfTradePrevention != STPCancelOldest:
+				blocked = true
+			}
+		})
+	})
 
-			// transfer tokens to the exchange
-			ob.TransferTokens(o.UserID, ob.TokenId, float64(o.Size), true)
+	return volume
+}
 
-		} else {
+// whether o is a GTD order whose expiry is at or before now
+func (o *Order) expired(now int64) bool {
+	return o.TimeInForce == GoodTillDate && o.ExpiresAt <= now
+}
+
+// HasExpired reports whether a resting or pending stop GTD order expired at or
+// before now
+func (ob *OrderBook) HasExpired(now int64) bool {
+	for _, o := range ob.OrdersMap {
+		if o.expired(now) {
+			return true
+		}
+	}
+	for _, o := range ob.StopOrders {
+		if o.expired(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// sorts orders oldest first
+func sortOrders(orders []*Order) {
+	sort.Slice(orders, func(i, j int) bool {
+		if orders[i].Timestamp != orders[j].Timestamp {
+			return orders[i].Timestamp < orders[j].Timestamp
+		}
+		return orders[i].ID.String() < orders[j].ID.String()
+	})
+}
+
+// ExpireOrders cancels every resting or pending stop GTD order whose expiry is at
+// or before now (unix nanoseconds) and returns them
+func (ob *OrderBook) ExpireOrders(now int64) []*Order {
+	var expired []*Order
+
+	for _, o := range ob.OrdersMap {
+		if o.expired(now) {
+			expired = append(expired, o)
+		}
+	}
+	for _, o := range ob.StopOrders {
+		if o.expired(now) {
+			expired = append(expired, o)
+		}
+	}
+	// in a fixed order so replaying the sweep releases funds the same way
+	sortOrders(expired)
+
+	for _, o := range expired {
+		ob.CancelOrderById(o.ID.String())
+
+		logrus.WithFields(logrus.Fields{
+			"id":        o.ID,
+			"userId":    o.UserID,
+			"expiresAt": o.ExpiresAt,
+		}).Info("GTD order expired")
+	}
+
+	return expired
+}
+
+// restOrder adds the (remaining) order to its price level on the book
+func (ob *OrderBook) restOrder(price decimal.Decimal, o *Order) {
+	var limit *Limit
+
+	if o.Bid {
+		limit = ob.BidsMap[price]
+		if limit == nil {
+			limit = NewLimit(price)
+			ob.BidsMap[price] = limit
+			ob.Bids.Put(price, limit)
+		}
+	} else {
+		limit = ob.AsksMap[price]
+		if limit == nil {
 			limit = NewLimit(price)
 			ob.AsksMap[price] = limit
-			limit.AddOrder(o)
-			ob.OrdersMap[o.ID] = o
-			o.Limit = limit
 			ob.Asks.Put(price, limit)
-			ob.totalAskVolume += float64(o.Size)
+		}
+	}
+
+	if o.IsIceberg() && o.Size.Cmp(o.DisplaySize) > 0 {
+		o.Hidden = o.Size.Sub(o.DisplaySize)
+		o.Size = o.DisplaySize
+	}
 
-			// transfer tokens to the exchange
-			ob.TransferTokens(o.UserID, ob.TokenId, float64(o.Size), true)
+	limit.AddOrder(o)
+	ob.adjustVolume(o.Bid, price, o.Size, o.Hidden)
+	ob.OrdersMap[o.ID] = o
+	o.Limit = limit
+}
+
+// matchOrder sweeps the opposite side of the book starting from the best price
+// level for as long as crosses(level price) holds and o isn't filled, nor out of
+// its quote budget if it has one
+func (ob *OrderBook) matchOrder(o *Order, crosses func(price decimal.Decimal) bool) []Match {
+	var matches []Match
+	spent := decimal.Zero
+
+	for !o.IsFilled() {
+		var l *Limit
+		if o.Bid {
+			l = ob.bestLimit(ob.Asks)
+		} else {
+			l = ob.bestLimit(ob.Bids)
+		}
+
+		if l == nil || !crosses(l.Price) {
+			break
+		}
+
+		held := decimal.Zero
+		if o.MaxNotional.IsPositive() {
+			var ok bool
+			if held, ok = ob.capToBudget(o, spent, l.Price); !ok {
+				break
+			}
+		}
+
+		visible, hidden := l.TotalVolume, l.HiddenVolume
+		limitMatches, filledOrders, selfTrades, flag := l.Fill(o, ob.now())
+		matches = append(matches, limitMatches...)
+		for _, m := range limitMatches {
+			spent = spent.Add(m.Notional)
+		}
+		ob.deleteOrders(filledOrders)
+		ob.settleSelfTrades(selfTrades)
+
+		// fills take visible volume, iceberg replenishment moves hidden volume to visible
+		ob.adjustVolume(!o.Bid, l.Price, l.TotalVolume.Sub(visible), l.HiddenVolume.Sub(hidden))
+
+		if flag {
+			ob.DeleteLimit(l.Price, !o.Bid)
+		}
+
+		if held.IsPositive() {
+			o.Size = o.Size.Add(held)
+			if len(selfTrades) > 0 && o.SelfTradePrevention.CancelsIncoming() {
+				break
+			}
 		}
 	}
 
-	logrus.WithFields(
-		logrus.Fields{
-			"price":     price,
-			"size":      o.Size,
-			"type":      o.Type(),
-			"userId":    o.UserID,
-			"timestamp": o.Timestamp,
-		},
-	).Info("new limit Order")
+	return matches
+}
+
+// total size exchanged by the matches
+func filledSize(matches []Match) decimal.Decimal {
+	size := decimal.Zero
+	for _, m := range matches {
+		size = size.Add(m.SizeFilled)
+	}
+	return size
+}
 
+// records a trade for every match and moves the current price to the last execution
+func (ob *OrderBook) recordTrades(matches []Match) {
+	for _, m := range matches {
+		// trades are keyed by their timestamp, so it has to be unique
+		ts := ob.now()
+		if ts <= ob.lastTradeTs {
+			ts = ob.lastTradeTs + 1
+		}
+		ob.lastTradeTs = ts
+
+		trade := &Trade{
+			Price:       m.Price,
+			Size:        m.SizeFilled,
+			Bid:         m.Bid.Bid,
+			Timestamp:   ts,
+			AskFee:      m.AskFee,
+			AskFeeAsset: m.AskFeeAsset,
+			BidFee:      m.BidFee,
+			BidFeeAsset: m.BidFeeAsset,
+		}
+		ob.Trades.Put(ts, trade)
+		// older trades are dropped, so snapshots of the book stay small
+		for ob.Trades.Size() > MaxBookTrades {
+			oldest, _, _ := ob.Trades.Min()
+			ob.Trades.Remove(oldest)
+		}
+		ob.tradePrinted(trade)
+	}
+
+	//INFO: the current price of an asset is the price it was latest traded on (doesn't matter buy or sell)
+	ob.CurrentPrice = matches[len(matches)-1].Price
 }
 
-func (ob *OrderBook) PlaceMarketOrder(o *Order) []Match {
+// PlaceMarketOrder fills o against the opposite side of the book, best price first.
+// Whatever isn't filled (e.g. because of the order's protection) is cancelled and
+// left in o.Size. It's rejected before anything moves if the market isn't open,
+// an unprotected order can't be filled entirely or its user can't pay for it.
+func (ob *OrderBook) PlaceMarketOrder(o *Order) ([]Match, error) {
 	var matches []Match
 
+	if err := ob.CheckOpen(); err != nil {
+		return nil, err
+	}
+	if err := o.checkProtection(); err != nil {
+		return nil, err
+	}
+
 	if o.Bid {
 		// buying tokens in return for USD (for now)
 
@@ -338,36 +838,12 @@ func (ob *OrderBook) PlaceMarketOrder(o *Order) []Match {
 			},
 		).Info("new Market Order")
 
-		if float64(o.Size) > ob.totalAskVolume {
+		// protected orders fill what they can within their bounds instead
+		if !o.IsProtected() && o.Size.Cmp(ob.FillableAskVolume()) > 0 {
 			// market order can't be filled
-			fmt.Errorf("market order can't be filled, not enough asks, current totalAskVolume: %f, order.TotalPrice: %f", ob.totalAskVolume, o.TotalPrice())
-			return nil
+			logrus.Errorf("market order can't be filled, not enough asks, current fillable ask volume: %s, order.Size: %s", ob.FillableAskVolume(), o.Size)
+			return nil, ErrInsufficientVolume
 		}
-
-		stop := false
-		ob.Asks.Each(func(key float64, l *Limit) {
-
-			if stop {
-				return
-			}
-			// we'll match the order with the asks ; incrementally starting from the lowest ask
-			limitMatches, filledOrders, flag := l.Fill(o)
-			matches = append(matches, limitMatches...)
-			ob.deleteOrders(filledOrders)
-
-			if flag {
-				ob.DeleteLimit(key, false)
-			}
-
-			for _, m := range limitMatches {
-				ob.totalAskVolume -= m.SizeFilled
-			}
-
-			if o.IsFilled() {
-				stop = true
-			}
-		})
-
 	} else {
 
 		// user is selling tokens in return for USD from exchange
@@ -382,73 +858,207 @@ func (ob *OrderBook) PlaceMarketOrder(o *Order) []Match {
 			},
 		).Info("new Market Order")
 
-		if float64(o.Size) > ob.totalBidVolume {
+		if !o.IsProtected() && o.Size.Cmp(ob.FillableBidVolume()) > 0 {
 			// market order can't be filled
-			fmt.Errorf("market order can't be consumed, not enough bids, current totalBidVolume: %f, order.TotalPrice: %f", ob.totalBidVolume, o.TotalPrice())
-			return nil
+			logrus.Errorf("market order can't be consumed, not enough bids, current fillable bid volume: %s, order.Size: %s", ob.FillableBidVolume(), o.Size)
+			return nil, ErrInsufficientVolume
 		}
+	}
 
-		ob.TransferTokens(o.UserID, ob.TokenId, float64(o.Size), true)
-
-		stop := false
-		ob.Bids.Each(func(key float64, l *Limit) {
-			if stop {
-				return
-			}
-			// we'll match the order with the bids ; incrementally starting from the highest ask
-			limitMatches, filledOrders, flag := l.Fill(o)
-			matches = append(matches, limitMatches...)
-			ob.deleteOrders(filledOrders)
+	o.SelfTradePrevention = ob.selfTradePrevention(o)
+	if err := o.SelfTradePrevention.Validate(); err != nil {
+		return nil, err
+	}
 
-			if o.IsFilled() {
-				stop = true
-			}
+	// an order with only a quote budget takes as much as the budget allows
+	budgetOnly := o.Size.IsZero() && o.MaxNotional.IsPositive()
+	if budgetOnly && o.Bid {
+		o.Size = ob.FillableAskVolume()
+	}
+	ob.applySlippageBound(o)
+	// an ask locks what its budget sells on the book, no more than its user has
+	if budgetOnly && !o.Bid {
+		o.Size = ob.budgetSize(o, o.withinWorstPrice)
+		if ob.Exchange != nil {
+			o.Size = decimal.Min(o.Size, ob.Exchange.Ledger.Balance(o.UserID, ob.Spec.Base).Available.TruncateTo(ob.Spec.LotSize))
+		}
+	}
 
-			if flag {
-				ob.DeleteLimit(key, true)
-			}
-			for _, m := range limitMatches {
-				ob.totalBidVolume -= m.SizeFilled
-			}
+	lock := o.Size
+	if o.Bid {
+		lock = ob.maxCost(o, o.withinWorstPrice)
+	}
+	if err := ob.reserve(o, lock); err != nil {
+		if budgetOnly {
+			o.Size = decimal.Zero
+		}
+		return nil, err
+	}
 
-		})
+	// a market order takes whatever price the book offers, up to its worst price if it has one
+	matches = ob.matchOrder(o, o.withinWorstPrice)
+
+	if budgetOnly {
+		o.Size = decimal.Zero
+	} else if o.Size.IsPositive() {
+		logrus.WithFields(logrus.Fields{
+			"cancelled":   o.Size,
+			"worstPrice":  o.WorstPrice,
+			"maxNotional": o.MaxNotional,
+			"userId":      o.UserID,
+		}).Info("unfilled remainder of market order cancelled")
 	}
 
-	for _, m := range matches {
-		ob.Trades.Put(m.Ask.Timestamp, &Trade{
-			Price:     m.Price / m.SizeFilled,
-			Size:      m.SizeFilled,
-			Bid:       m.Bid.Bid,
-			Timestamp: time.Now().UnixNano(),
-		})
+	if len(matches) == 0 {
+		ob.releaseExcess(o, false)
+		return nil, nil
 	}
 
 	ob.BalanceOrderBookForMarketOrder(o, matches)
-
-	//INFO: the current price of an asset is the price it was latest traded on (doesn't matter buy or sell)
-	latestTrade, _ := ob.Trades.Get(matches[len(matches)-1].Ask.Timestamp)
-	price := latestTrade.Price / latestTrade.Size
+	ob.recordTrades(matches)
+	// nothing of a market order rests, what it didn't pay is given back
+	ob.releaseExcess(o, false)
 
 	logrus.WithFields(logrus.Fields{
-		"currentPrice": price,
+		"currentPrice": ob.CurrentPrice,
 	}).Info("current price of the asset")
 
 	logrus.WithFields(logrus.Fields{
 		"matches":   len(matches),
-		"avg Price": price,
+		"avg Price": CalculateAvgMarketOrderPrice(matches),
 	}).Info("market order filled")
 
-	ob.CurrentPrice = price
+	ob.triggerStops()
 
-	return matches
+	return matches, nil
 }
 
+// CancelOrder takes a resting order off the book, custody isn't touched
 func (ob *OrderBook) CancelOrder(o *Order) {
 	limit := o.Limit
+	ob.adjustVolume(o.Bid, limit.Price, o.Size.Neg(), o.Hidden.Neg())
 	flag := limit.RemoveOrders([]*Order{o})
 	if flag {
 		ob.DeleteLimit(limit.Price, o.Bid)
 	}
+	delete(ob.OrdersMap, o.ID)
+}
+
+// AmendOrder changes the price and/or (remaining) size of a resting limit order.
+// Reducing the size at the same price happens in place and keeps the order's
+// time priority; any other change is an atomic cancel-replace: the order keeps
+// its ID but goes through matching again like a new order and loses its priority.
+// If the replacement is rejected the original order stays on the book untouched.
+func (ob *OrderBook) AmendOrder(orderId string, price, size decimal.Decimal) ([]Match, error) {
+	o, ok := ob.OrdersMap[uuid.MustParse(orderId)]
+	if !ok {
+		return nil, ErrOrderNotFound
+	}
+	if err := ob.CheckOpen(); err != nil {
+		return nil, err
+	}
+
+	if !price.IsPositive() {
+		return nil, fmt.Errorf("price %s must be positive", price)
+	}
+	if err := ob.CheckIncrements(price, size); err != nil {
+		return nil, err
+	}
+
+	remaining := o.Remaining()
+	if price == o.Price && size.Cmp(remaining) <= 0 {
+		if size.Cmp(remaining) < 0 {
+			ob.reduceOrder(o, remaining.Sub(size))
+		}
+		return nil, nil
+	}
+
+	// everything that could reject the replacement is checked while the original still rests
+	if err := o.checkTimeInForce(ob.now()); err != nil {
+		return nil, err
+	}
+	if o.PostOnly {
+		if _, err := ob.postOnlyPrice(price, o); err != nil {
+			return nil, err
+		}
+	}
+	if err := ob.selfTradePrevention(o).Validate(); err != nil {
+		return nil, err
+	}
+	// the replacement locks what it needs at its new price, the original's lock is given back
+	replacement := *o
+	replacement.Price = price
+	available := ob.Exchange.Ledger.Balance(o.UserID, ob.lockedAsset(o)).Available
+	if available.Add(o.Locked).Cmp(replacement.lockFor(size)) < 0 {
+		return nil, ErrInsufficientFunds
+	}
+
+	original := *o
+	ob.CancelOrder(o)
+	ob.release(o, o.Locked)
+
+	logrus.WithFields(logrus.Fields{
+		"id":        o.ID,
+		"oldPrice":  o.Price,
+		"oldSize":   remaining,
+		"price":     price,
+		"size":      size,
+		"userId":    o.UserID,
+		"timestamp": o.Timestamp,
+	}).Info("order replaced")
+
+	o.Price = price
+	o.Size = size
+	o.Hidden = decimal.Zero
+	o.SelfTradePrevented = decimal.Zero
+	o.Limit = nil
+	o.Timestamp = ob.now()
+
+	matches, err := ob.PlaceLimitOrder(price, o)
+	if err != nil {
+		// it was rejected before anything moved
+		ob.reinstate(o, original)
+		return nil, err
+	}
+	return matches, nil
+}
+
+// puts o back on the book as original was, with its lock and its place in the
+// queue, after its replacement was rejected
+func (ob *OrderBook) reinstate(o *Order, original Order) {
+	*o = original
+	o.Locked = decimal.Zero
+	if err := ob.reserve(o, original.Locked); err != nil {
+		// what the cancel gave back can't have gone anywhere
+		logrus.WithError(err).WithField("id", o.ID).Error("reinstated order not locked")
+	}
+	ob.restOrder(original.Price, o)
+
+	logrus.WithFields(logrus.Fields{
+		"id":    o.ID,
+		"price": o.Price,
+		"size":  o.Remaining(),
+	}).Info("order reinstated")
+}
+
+// takes delta off a resting order without touching its place in the queue,
+// an iceberg's reserve goes first
+func (ob *OrderBook) reduceOrder(o *Order, delta decimal.Decimal) {
+	hidden := decimal.Min(o.Hidden, delta)
+	visible := delta.Sub(hidden)
+
+	o.Hidden = o.Hidden.Sub(hidden)
+	o.Size = o.Size.Sub(visible)
+	o.Limit.TotalVolume = o.Limit.TotalVolume.Sub(visible)
+	o.Limit.HiddenVolume = o.Limit.HiddenVolume.Sub(hidden)
+	ob.adjustVolume(o.Bid, o.Limit.Price, visible.Neg(), hidden.Neg())
+	ob.releaseCustody(o, delta)
+
+	logrus.WithFields(logrus.Fields{
+		"id":        o.ID,
+		"reducedBy": delta,
+		"remaining": o.Remaining(),
+	}).Info("order reduced")
 }
 
 func (ob *OrderBook) deleteOrders(o []*Order) {
@@ -460,17 +1070,30 @@ func (ob *OrderBook) deleteOrders(o []*Order) {
 
 func (ob *OrderBook) GetOrderById(id string) *Order {
 	uuid := uuid.MustParse(id)
-	o := ob.OrdersMap[uuid]
+	if o, ok := ob.OrdersMap[uuid]; ok {
+		return o
+	}
 
-	return o
+	// pending stop orders aren't on the book yet
+	return ob.StopOrders[uuid]
 }
 
-func (ob *OrderBook) CancelOrderById(orderId string) {
-	orderID := uuid.MustParse(orderId)
+// CancelOrderById cancels a resting or pending stop order, ErrOrderNotFound if
+// the book has neither with orderId
+func (ob *OrderBook) CancelOrderById(orderId string) error {
+	orderID, err := uuid.Parse(orderId)
+	if err != nil {
+		return ErrOrderNotFound
+	}
+	if stop, ok := ob.StopOrders[orderID]; ok {
+		ob.removeStopOrder(stop)
+		ob.release(stop, stop.Locked)
+		return nil
+	}
+
 	order, exists := ob.OrdersMap[orderID]
 	if !exists {
-		fmt.Printf("Order with ID %s not found\n", orderID)
-		return
+		return ErrOrderNotFound
 	}
 
 	var limit *Limit
@@ -481,17 +1104,11 @@ func (ob *OrderBook) CancelOrderById(orderId string) {
 	}
 
 	if limit != nil {
+		// whatever the order still has locked goes back: a bid's USD, or an ask's
+		// tokens (including an iceberg's hidden reserve)
+		ob.release(order, order.Locked)
 
-		// we only trasnfer tokens if the limit order is an ask
-		// in case of a bid, the tokens are already in the user's custody
-		// and usd are transferred p2p during matching
-		if !order.Bid {
-			// if the order is an ask, then even if it has already been matched
-			// and has some tokens consumed, the remaining tokens will be left in teh CEX's custody
-			// we will trasnfer those tokens
-			ob.TransferTokens(order.UserID, ob.TokenId, float64(order.Size), false)
-		}
-
+		ob.adjustVolume(order.Bid, limit.Price, order.Size.Neg(), order.Hidden.Neg())
 		flag := limit.RemoveOrders([]*Order{order})
 		if flag {
 			ob.DeleteLimit(limit.Price, order.Bid)
@@ -499,120 +1116,130 @@ func (ob *OrderBook) CancelOrderById(orderId string) {
 	}
 
 	delete(ob.OrdersMap, orderID)
+	return nil
 }
 
-// userID: user who is transferring  the tokens or to whom the tokens are being transferred
-func (ob *OrderBook) TransferTokens(userId string, token Market, tokenCount float64, toExchange bool) {
-	// transfer tokens to/from the exchange
-	switch token {
-	case BTC:
-		// Add BTC transfer logic here if needed
-	case ETH:
-		pvUser := ob.Exchange.Users[userId]
-		exAddr := internals.GetAddress(ob.Exchange.PrivateKey)
-		if toExchange {
-			internals.TransferETH(pvUser.PrivateKey, exAddr, tokenCount)
-		} else {
-			pubKeyUser := internals.GetAddress(pvUser.PrivateKey)
-			internals.TransferETH(ob.Exchange.PrivateKey, pubKeyUser, tokenCount)
-		}
+// CancelAll cancels every resting and pending stop order of the book and returns them
+func (ob *OrderBook) CancelAll() []*Order {
+	var orders []*Order
+	for _, o := range ob.OrdersMap {
+		orders = append(orders, o)
 	}
-}
+	for _, o := range ob.StopOrders {
+		orders = append(orders, o)
+	}
+	sortOrders(orders)
 
-func (ob *OrderBook) TransferUSDBetweenUsers(from, to string, usd float64) {
-	fromUser := ob.Exchange.Users[from]
-	toUser := ob.Exchange.Users[to]
+	for _, o := range orders {
+		ob.CancelOrderById(o.ID.String())
+	}
 
-	fromUser.USD -= usd
-	toUser.USD += usd
+	return orders
 }
 
-func (ob *OrderBook) TransferUSD(userID string, usd float64, toExchange bool) error {
-	user, ok := ob.Exchange.Users[userID]
-	if !ok {
-		return fmt.Errorf("User %s not found", userID)
-	}
-
+// userID: user who is transferring  the tokens or to whom the tokens are being transferred,
+// the ledger records them as a deposit into / withdrawal out of the exchange and
+// the asset's settlement backend moves them
+func (ob *OrderBook) TransferTokens(userId string, asset Asset, tokenCount decimal.Decimal, toExchange bool) {
+	ref := fmt.Sprintf("%s transfer", ob.TokenId)
+	var err error
 	if toExchange {
-		if user.USD < usd {
-			return fmt.Errorf("Insufficient USD balance for user %s", userID)
-		}
-		user.USD -= usd
-		ob.Exchange.UsdPool += usd
+		err = ob.Exchange.Ledger.Deposit(userId, asset, tokenCount, ref)
 	} else {
-		// Allow negative balances (optional):
-		// user.USD += usd
-		// Disallow negative balances:
-		if user.USD+usd < 0 {
-			return fmt.Errorf("Transfer would result in negative USD balance for user %s", userID)
-		}
-		user.USD += usd
-		ob.Exchange.UsdPool -= usd
+		err = ob.Exchange.Ledger.Withdraw(userId, asset, tokenCount, ref)
+	}
+	if err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"userId":     userId,
+			"asset":      asset,
+			"amount":     tokenCount,
+			"toExchange": toExchange,
+		}).Error("token transfer not recorded")
+		return
 	}
 
-	return nil
+	// the asset itself moves later, settlement never holds up matching
+	if err := ob.Exchange.submitTransfer(userId, asset, tokenCount, toExchange); err != nil {
+		logrus.WithError(err).Error("token transfer not queued")
+	}
 }
 
-// iterates over matches and transfers tokens or/and USD depending on the type of market order
+// iterates over matches and settles each one as a single ledger transaction: the
+// seller's base asset goes to the buyer and the buyer's quote asset to the seller,
+// both paid out of what their orders locked, and both sides' fees go to the fee
+// account (see fees.go). The fees are written into matches. The buyer's tokens
+// are then paid out to them.
 func (ob *OrderBook) BalanceOrderBookForMarketOrder(o *Order, matches []Match) {
-	for _, m := range matches {
-		if o.Bid {
-			// buying tokens in return for USD (for now)
-			ob.TransferTokens(o.UserID, ob.TokenId, m.SizeFilled, false)
-			// the user who placed the ask (who wanna sell their ETH for USD) will receive the USD
-			// transferring USD from the buyer to the seller
-			ob.TransferUSDBetweenUsers(o.UserID, m.Ask.UserID, m.Price)
-		} else {
-			// user is selling tokens in return for USD from exchange
-			ob.TransferUSD(o.UserID, m.Price, false)
-			// the user who placed the bid will receive the tokens
-			userId := m.Bid.UserID
+	for i := range matches {
+		m := &matches[i]
+		buyer := m.Bid.UserID
+		ref := fmt.Sprintf("%s/%s", m.Ask.ID, m.Bid.ID)
+
+		currency := ob.Exchange.FeeCurrency(buyer)
+		ob.chargeFees(m, currency)
+		_, err := ob.Exchange.Ledger.Post(ledger.KindFill, ref, ob.fillPostings(m)...)
+		if errors.Is(err, ErrInsufficientFunds) && currency == FeeInQuote {
+			// the buyer's available quote can't cover the fee, it comes out of the base they get
+			ob.chargeFees(m, FeeInReceived)
+			_, err = ob.Exchange.Ledger.Post(ledger.KindFill, ref, ob.fillPostings(m)...)
+		}
+		if err != nil {
+			logrus.WithError(err).WithFields(logrus.Fields{
+				"ask":  m.Ask.ID,
+				"bid":  m.Bid.ID,
+				"size": m.SizeFilled,
+			}).Error("match not settled")
+			continue
+		}
+		ob.recordUserTrades(*m, ob.now())
 
-			// transfer tokens to the bid orders (who supplied ETH)
-			ob.TransferTokens(userId, ob.TokenId, m.SizeFilled, false)
+		// transfer tokens to the bid orders (who supplied USD)
+		received := m.SizeFilled
+		if m.BidFeeAsset == ob.Spec.Base {
+			received = received.Sub(m.BidFee)
+		}
+		if received.IsPositive() {
+			ob.TransferTokens(buyer, ob.Spec.Base, received, false)
 		}
 	}
 }
 
-// returns highest bid price
-func (ob *OrderBook) GetBestBidPrice() float64 {
-	if ob.Bids.Size() == 0 {
-		return 0
-	}
+// the postings of m's FILL transaction, fees included
+func (ob *OrderBook) fillPostings(m *Match) []ledger.Posting {
+	seller, buyer := m.Ask.UserID, m.Bid.UserID
 
-	counter := 0
-	var requiredLimit *Limit
+	postings := []ledger.Posting{
+		{Account: ledger.LockedOf(seller, ob.Spec.Base), Amount: m.SizeFilled.Neg()},
+		{Account: ledger.AvailableOf(buyer, ob.Spec.Base), Amount: m.SizeFilled},
+		{Account: ledger.LockedOf(buyer, ob.Spec.Quote), Amount: m.Notional.Neg()},
+		{Account: ledger.AvailableOf(seller, ob.Spec.Quote), Amount: m.Notional},
+	}
+	postings = append(postings, feePostings(seller, m.AskFeeAsset, m.AskFee)...)
+	postings = append(postings, feePostings(buyer, m.BidFeeAsset, m.BidFee)...)
 
-	ob.Bids.Each(func(key float64, val *Limit) {
-		if counter > 0 {
-			return
-		}
-		requiredLimit = val
-		counter++
-	})
+	return postings
+}
 
-	return requiredLimit.Price
+// returns the first price level of the given side of the book, or nil if it's empty
+func (ob *OrderBook) bestLimit(side *avl.Tree[decimal.Decimal, *Limit]) *Limit {
+	_, best, _ := side.Min()
+	return best
+}
 
+// returns highest bid price
+func (ob *OrderBook) GetBestBidPrice() decimal.Decimal {
+	if l := ob.bestLimit(ob.Bids); l != nil {
+		return l.Price
+	}
+	return decimal.Zero
 }
 
 // returns lowest ask price
-func (ob *OrderBook) GetBestAskPrice() float64 {
-	if ob.Asks.Size() == 0 {
-		return 0
+func (ob *OrderBook) GetBestAskPrice() decimal.Decimal {
+	if l := ob.bestLimit(ob.Asks); l != nil {
+		return l.Price
 	}
-
-	counter := 0
-	var requiredLimit *Limit
-
-	ob.Asks.Each(func(key float64, val *Limit) {
-		if counter > 0 {
-			return
-		}
-		requiredLimit = val
-		counter++
-	})
-
-	return requiredLimit.Price
+	return decimal.Zero
 }
 
 func (ob *OrderBook) GetTrades() []*Trade {
@@ -623,14 +1250,19 @@ func (ob *OrderBook) GetTrades() []*Trade {
 	return trades
 }
 
-func CalculateAvgMarketOrderPrice(matches []Match) float64 {
-	var total float64
+// volume weighted average execution price of the matches
+func CalculateAvgMarketOrderPrice(matches []Match) decimal.Decimal {
+	var notional, size decimal.Decimal
 	for _, m := range matches {
-		total += m.Price / m.SizeFilled
+		notional = notional.Add(m.Notional)
+		size = size.Add(m.SizeFilled)
+	}
+	if size.IsZero() {
+		return decimal.Zero
 	}
-	return total / float64(len(matches))
+	return notional.Div(size)
 }
 
-func (ob *OrderBook) GetMarketPrice() float64 {
+func (ob *OrderBook) GetMarketPrice() decimal.Decimal {
 	return ob.CurrentPrice
 }
@@ -2,9 +2,14 @@ package core
 
 import (
 	"testing"
+	"time"
 
 	"github.com/EggsyOnCode/velho-exchange/auth"
+	"github.com/EggsyOnCode/velho-exchange/decimal"
 	"github.com/EggsyOnCode/velho-exchange/internals"
+	"github.com/EggsyOnCode/velho-exchange/ledger"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
 )
 
 // import (
@@ -16,7 +21,7 @@ import (
 //
 // )
 func BenchmarkPlaceLimitOrder(b *testing.B) {
-	ob := NewOrderBook(Market("ETH"))
+	ob := NewOrderBook(ETH, DefaultMarketSpecs[ETH])
 	ex := NewExchange()
 	ob.SetExchange(ex)
 	b.ResetTimer()
@@ -24,10 +29,10 @@ func BenchmarkPlaceLimitOrder(b *testing.B) {
 	for n := 0; n < b.N; n++ {
 		// Create a user for each iteration (important for accurate benchmarking)
 		pk := internals.GenerateNewPrivateKey()
-		user := auth.NewUser(pk, 10000)
+		user := auth.NewUser(pk, decimal.FromInt(10000))
 		ex.AddUser(user)
-		order := NewOrder(100, true, 1000.0, user.ID.String())
-		ob.PlaceLimitOrder(1000.0, order)
+		order := NewOrder(decimal.FromInt(100), true, decimal.FromInt(1000), user.ID.String())
+		ob.PlaceLimitOrder(decimal.FromInt(1000), order)
 
 		// Clean up the order and user for the next iteration
 		ob.CancelOrder(order)
@@ -36,18 +41,18 @@ func BenchmarkPlaceLimitOrder(b *testing.B) {
 }
 
 func BenchmarkPlaceLimitOrderWithPreExistingUser(b *testing.B) {
-	ob := NewOrderBook(Market("ETH"))
+	ob := NewOrderBook(ETH, DefaultMarketSpecs[ETH])
 	ex := NewExchange()
 	ob.SetExchange(ex)
 
 	pk := internals.GenerateNewPrivateKey()
-	user := auth.NewUser(pk, 10000)
+	user := auth.NewUser(pk, decimal.FromInt(10000))
 	ex.AddUser(user)
 	b.ResetTimer()
 
 	for n := 0; n < b.N; n++ {
-		order := NewOrder(100, true, 1000.0, user.ID.String())
-		ob.PlaceLimitOrder(1000.0, order)
+		order := NewOrder(decimal.FromInt(100), true, decimal.FromInt(1000), user.ID.String())
+		ob.PlaceLimitOrder(decimal.FromInt(1000), order)
 
 		// Clean up the order for the next iteration
 		ob.CancelOrder(order)
@@ -56,12 +61,12 @@ func BenchmarkPlaceLimitOrderWithPreExistingUser(b *testing.B) {
 
 func FuzzGetBestAskPrice(f *testing.F) {
 	f.Fuzz(func(t *testing.T, data []byte) {
-		var asks []float64
+		var asks []decimal.Decimal
 		for _, v := range data {
-			asks = append(asks, float64(v))
+			asks = append(asks, decimal.FromInt(int64(v)))
 		}
 
-		ob := NewOrderBook(Market("ETH"))
+		ob := NewOrderBook(ETH, DefaultMarketSpecs[ETH])
 		for _, price := range asks {
 			ob.Asks.Put(price, NewLimit(price))
 		}
@@ -72,29 +77,826 @@ func FuzzGetBestAskPrice(f *testing.F) {
 
 func TestPlaceMarketOrder_InsufficientAskVolume(t *testing.T) {
   // Create order book
-  ob := NewOrderBook(Market("ETH"))
+  ex := NewExchange()
+  ob := ex.OrderBook[ETH]
+  seller := auth.NewUser(nil, decimal.Zero)
+  buyer := auth.NewUser(nil, decimal.FromInt(100_000))
+  ex.AddUser(seller)
+  ex.AddUser(buyer)
+  deposit(t, ex, seller.ID.String(), AssetETH, 10)
 
   // Create ask order
-  askOrder := NewOrder(10, false, 1000, "user1")
-  ob.PlaceLimitOrder(1000, askOrder)
+  askOrder := NewOrder(decimal.FromInt(10), false, decimal.FromInt(1000), seller.ID.String())
+  ob.PlaceLimitOrder(decimal.FromInt(1000), askOrder)
 
-  // Create market buy order for a larger size
-  marketOrder := NewMarketOrder(20, true, "user2")
+  // A market buy for a larger size is rejected as is
+  marketOrder := NewMarketOrder(decimal.FromInt(20), true, buyer.ID.String())
+  matches, err := ob.PlaceMarketOrder(marketOrder)
+  assert.ErrorIs(t, err, ErrInsufficientVolume)
+  assert.Empty(t, matches)
+  assert.Equal(t, decimal.FromInt(10), ob.TotalAskVolume())
 
-  // Place market order
-  matches := ob.PlaceMarketOrder(marketOrder)
+  // With a worst price it fills what there is and the rest is cancelled
+  marketOrder = NewMarketOrder(decimal.FromInt(20), true, buyer.ID.String())
+  marketOrder.WorstPrice = decimal.FromInt(1000)
+  matches, err = ob.PlaceMarketOrder(marketOrder)
+  assert.NoError(t, err)
 
   // Assertions
   if len(matches) != 1 {
     t.Errorf("Expected 1 match, got %d", len(matches))
   }
 
-  totalFilled := 0.0
+  totalFilled := decimal.Zero
   for _, m := range matches {
-    totalFilled += m.SizeFilled
+    totalFilled = totalFilled.Add(m.SizeFilled)
   }
 
-  if totalFilled != 10 {
-    t.Errorf("Expected order to be partially filled, filled %f", totalFilled)
+  if totalFilled != decimal.FromInt(10) {
+    t.Errorf("Expected order to be partially filled, filled %s", totalFilled)
   }
-}
\ No newline at end of file
+}
+func TestOrderBookWithoutExchangeRejectsOrders(t *testing.T) {
+	ob := NewOrderBook(ETH, DefaultMarketSpecs[ETH])
+
+	_, err := ob.PlaceLimitOrder(decimal.FromInt(1000), NewOrder(decimal.FromInt(1), false, decimal.FromInt(1000), "user"))
+	assert.ErrorIs(t, err, ErrNoExchange)
+	assert.Equal(t, decimal.Zero, ob.TotalAskVolume())
+}
+
+func TestPlaceLimitOrderCrossesBeforeResting(t *testing.T) {
+	ex := NewExchange()
+	ob := ex.OrderBook[BTC]
+
+	seller := auth.NewUser(nil, decimal.Zero)
+	buyer := auth.NewUser(nil, decimal.FromInt(10_000))
+	ex.AddUser(seller)
+	ex.AddUser(buyer)
+	deposit(t, ex, seller.ID.String(), AssetBTC, 6)
+
+	ob.PlaceLimitOrder(decimal.FromInt(100), NewOrder(decimal.FromInt(3), false, decimal.FromInt(100), seller.ID.String()))
+	ob.PlaceLimitOrder(decimal.FromInt(102), NewOrder(decimal.FromInt(3), false, decimal.FromInt(102), seller.ID.String()))
+
+	bid := NewOrder(decimal.FromInt(5), true, decimal.FromInt(101), buyer.ID.String())
+	matches, err := ob.PlaceLimitOrder(decimal.FromInt(101), bid)
+	assert.NoError(t, err)
+
+	assert.Len(t, matches, 1)
+	assert.Equal(t, decimal.FromInt(3), matches[0].SizeFilled)
+	assert.Equal(t, decimal.FromInt(100), ob.CurrentPrice)
+	assert.Len(t, ob.GetTrades(), 1)
+
+	// the unfilled remainder rests at its limit price
+	assert.Equal(t, decimal.FromInt(2), bid.Size)
+	assert.Equal(t, decimal.FromInt(101), ob.GetBestBidPrice())
+	assert.Equal(t, decimal.FromInt(102), ob.GetBestAskPrice())
+	assert.Equal(t, decimal.FromInt(2), ob.TotalBidVolume())
+	assert.Equal(t, decimal.FromInt(3), ob.TotalAskVolume())
+
+	assert.Equal(t, decimal.FromInt(300), seller.USD)
+	assert.Equal(t, decimal.FromInt(10_000-300-2*101), buyer.USD)
+}
+
+func TestPlaceLimitOrderTimePriority(t *testing.T) {
+	ex := NewExchange()
+	ob := ex.OrderBook[BTC]
+
+	first := auth.NewUser(nil, decimal.Zero)
+	second := auth.NewUser(nil, decimal.Zero)
+	taker := auth.NewUser(nil, decimal.FromInt(1_000))
+	ex.AddUser(first)
+	ex.AddUser(second)
+	ex.AddUser(taker)
+	deposit(t, ex, first.ID.String(), AssetBTC, 2)
+	deposit(t, ex, second.ID.String(), AssetBTC, 2)
+
+	firstAsk := NewOrder(decimal.FromInt(2), false, decimal.FromInt(100), first.ID.String())
+	ob.PlaceLimitOrder(decimal.FromInt(100), firstAsk)
+	secondAsk := NewOrder(decimal.FromInt(2), false, decimal.FromInt(100), second.ID.String())
+	ob.PlaceLimitOrder(decimal.FromInt(100), secondAsk)
+
+	matches, err := ob.PlaceLimitOrder(decimal.FromInt(100), NewOrder(decimal.FromInt(2), true, decimal.FromInt(100), taker.ID.String()))
+	assert.NoError(t, err)
+
+	assert.Len(t, matches, 1)
+	assert.Equal(t, firstAsk.ID, matches[0].Ask.ID)
+	assert.Nil(t, ob.GetOrderById(firstAsk.ID.String()))
+	assert.NotNil(t, ob.GetOrderById(secondAsk.ID.String()))
+}
+
+func TestPlaceLimitOrderFractionalPricesShareALevel(t *testing.T) {
+	ex := NewExchange()
+	ob := ex.OrderBook[BTC]
+
+	buyer := auth.NewUser(nil, decimal.FromInt(1_000))
+	ex.AddUser(buyer)
+
+	// 0.1 + 0.2 style float drift used to split these into two price levels
+	price := decimal.RequireFromString("0.1").Add(decimal.RequireFromString("0.2"))
+	size := decimal.RequireFromString("0.3")
+	ob.PlaceLimitOrder(price, NewOrder(size, true, price, buyer.ID.String()))
+	ob.PlaceLimitOrder(decimal.RequireFromString("0.3"), NewOrder(size, true, decimal.RequireFromString("0.3"), buyer.ID.String()))
+
+	assert.Len(t, ob.BidsMap, 1)
+	assert.Equal(t, decimal.RequireFromString("0.6"), ob.TotalBidVolume())
+	assert.Equal(t, decimal.RequireFromString("999.82"), buyer.USD)
+}
+
+func TestCheckIncrements(t *testing.T) {
+	ob := NewOrderBook(ETH, DefaultMarketSpecs[ETH])
+
+	assert.NoError(t, ob.CheckIncrements(decimal.RequireFromString("1000.01"), decimal.RequireFromString("0.001")))
+	assert.NoError(t, ob.CheckIncrements(decimal.Zero, decimal.FromInt(3)))
+	assert.Error(t, ob.CheckIncrements(decimal.RequireFromString("1000.001"), decimal.FromInt(1)))
+	assert.Error(t, ob.CheckIncrements(decimal.FromInt(1000), decimal.RequireFromString("0.0005")))
+	assert.Error(t, ob.CheckIncrements(decimal.FromInt(1000), decimal.Zero))
+	assert.Error(t, ob.CheckIncrements(decimal.FromInt(-1), decimal.FromInt(1)))
+}
+
+func TestCreateMarket(t *testing.T) {
+	ex := NewExchange()
+
+	spec := MarketSpec{
+		Base:     "SOL",
+		Quote:    AssetUSD,
+		TickSize: decimal.RequireFromString("0.01"),
+		LotSize:  decimal.RequireFromString("0.1"),
+		MinSize:  decimal.FromInt(1),
+		MaxSize:  decimal.FromInt(10),
+	}
+	ob, err := ex.CreateMarket("SOL", spec)
+	assert.NoError(t, err)
+	assert.Equal(t, MarketPreOpen, ob.Spec.Status)
+	assert.Len(t, ex.Markets(), 3)
+
+	_, err = ex.CreateMarket("SOL", spec)
+	assert.ErrorIs(t, err, ErrMarketExists)
+	_, err = ex.CreateMarket("XRP", MarketSpec{Base: "XRP", Quote: "EUR", TickSize: spec.TickSize, LotSize: spec.LotSize})
+	assert.Error(t, err)
+	_, err = ex.Market("XRP")
+	assert.ErrorIs(t, err, ErrMarketNotFound)
+
+	assert.Error(t, ob.CheckIncrements(decimal.FromInt(20), decimal.RequireFromString("0.5")))
+	assert.Error(t, ob.CheckIncrements(decimal.FromInt(20), decimal.RequireFromString("10.1")))
+	assert.NoError(t, ob.CheckIncrements(decimal.FromInt(20), decimal.FromInt(10)))
+
+	_, err = ob.PlaceLimitOrder(decimal.FromInt(20), NewOrder(decimal.FromInt(1), true, decimal.FromInt(20), "user"))
+	assert.ErrorIs(t, err, ErrMarketNotOpen)
+	assert.Empty(t, ob.OrdersMap)
+}
+
+func TestPlaceLimitOrderImmediateOrCancel(t *testing.T) {
+	ex := NewExchange()
+	ob := ex.OrderBook[BTC]
+
+	seller := auth.NewUser(nil, decimal.Zero)
+	buyer := auth.NewUser(nil, decimal.FromInt(10_000))
+	ex.AddUser(seller)
+	ex.AddUser(buyer)
+	deposit(t, ex, seller.ID.String(), AssetBTC, 3)
+
+	ob.PlaceLimitOrder(decimal.FromInt(100), NewOrder(decimal.FromInt(3), false, decimal.FromInt(100), seller.ID.String()))
+
+	bid := NewOrder(decimal.FromInt(5), true, decimal.FromInt(100), buyer.ID.String())
+	bid.TimeInForce = ImmediateOrCancel
+	matches, err := ob.PlaceLimitOrder(decimal.FromInt(100), bid)
+
+	assert.NoError(t, err)
+	assert.Len(t, matches, 1)
+	assert.Equal(t, decimal.FromInt(2), bid.Size)
+	// the remainder is cancelled, not rested
+	assert.Nil(t, ob.GetOrderById(bid.ID.String()))
+	assert.Equal(t, 0, ob.Bids.Size())
+	assert.Equal(t, decimal.FromInt(10_000-300), buyer.USD)
+}
+
+func TestPlaceLimitOrderFillOrKill(t *testing.T) {
+	ex := NewExchange()
+	ob := ex.OrderBook[BTC]
+
+	seller := auth.NewUser(nil, decimal.Zero)
+	buyer := auth.NewUser(nil, decimal.FromInt(10_000))
+	ex.AddUser(seller)
+	ex.AddUser(buyer)
+	deposit(t, ex, seller.ID.String(), AssetBTC, 6)
+
+	ob.PlaceLimitOrder(decimal.FromInt(100), NewOrder(decimal.FromInt(3), false, decimal.FromInt(100), seller.ID.String()))
+	ob.PlaceLimitOrder(decimal.FromInt(105), NewOrder(decimal.FromInt(3), false, decimal.FromInt(105), seller.ID.String()))
+
+	// only 3 are available at or below 101
+	bid := NewOrder(decimal.FromInt(4), true, decimal.FromInt(101), buyer.ID.String())
+	bid.TimeInForce = FillOrKill
+	matches, err := ob.PlaceLimitOrder(decimal.FromInt(101), bid)
+
+	assert.ErrorIs(t, err, ErrFillOrKill)
+	assert.Empty(t, matches)
+	assert.Equal(t, decimal.FromInt(6), ob.TotalAskVolume())
+	assert.Equal(t, decimal.FromInt(10_000), buyer.USD)
+
+	bid = NewOrder(decimal.FromInt(4), true, decimal.FromInt(105), buyer.ID.String())
+	bid.TimeInForce = FillOrKill
+	matches, err = ob.PlaceLimitOrder(decimal.FromInt(105), bid)
+
+	assert.NoError(t, err)
+	assert.Len(t, matches, 2)
+	assert.True(t, bid.IsFilled())
+	assert.Equal(t, decimal.FromInt(2), ob.TotalAskVolume())
+}
+
+func TestPlaceLimitOrderGoodTillDate(t *testing.T) {
+	ex := NewExchange()
+	ob := ex.OrderBook[BTC]
+
+	buyer := auth.NewUser(nil, decimal.FromInt(10_000))
+	ex.AddUser(buyer)
+
+	expired := NewOrder(decimal.FromInt(1), true, decimal.FromInt(100), buyer.ID.String())
+	expired.TimeInForce = GoodTillDate
+	expired.ExpiresAt = time.Now().Add(-time.Minute).UnixNano()
+	_, err := ob.PlaceLimitOrder(decimal.FromInt(100), expired)
+	assert.ErrorIs(t, err, ErrOrderExpired)
+
+	bid := NewOrder(decimal.FromInt(1), true, decimal.FromInt(100), buyer.ID.String())
+	bid.TimeInForce = GoodTillDate
+	bid.ExpiresAt = time.Now().Add(time.Minute).UnixNano()
+	_, err = ob.PlaceLimitOrder(decimal.FromInt(100), bid)
+	assert.NoError(t, err)
+	assert.NotNil(t, ob.GetOrderById(bid.ID.String()))
+
+	assert.Empty(t, ob.ExpireOrders(time.Now().UnixNano()))
+	assert.Len(t, ob.ExpireOrders(bid.ExpiresAt), 1)
+	assert.Nil(t, ob.GetOrderById(bid.ID.String()))
+	assert.Equal(t, 0, ob.Bids.Size())
+}
+
+func TestPlaceLimitOrderPostOnly(t *testing.T) {
+	ex := NewExchange()
+	ob := ex.OrderBook[BTC]
+
+	seller := auth.NewUser(nil, decimal.Zero)
+	buyer := auth.NewUser(nil, decimal.FromInt(10_000))
+	ex.AddUser(seller)
+	ex.AddUser(buyer)
+	deposit(t, ex, seller.ID.String(), AssetBTC, 4)
+
+	ob.PlaceLimitOrder(decimal.FromInt(100), NewOrder(decimal.FromInt(3), false, decimal.FromInt(100), seller.ID.String()))
+
+	crossing := NewOrder(decimal.FromInt(1), true, decimal.FromInt(100), buyer.ID.String())
+	crossing.PostOnly = true
+	matches, err := ob.PlaceLimitOrder(decimal.FromInt(100), crossing)
+	assert.ErrorIs(t, err, ErrPostOnlyWouldCross)
+	assert.Empty(t, matches)
+	assert.Equal(t, decimal.FromInt(3), ob.TotalAskVolume())
+	assert.Equal(t, 0, ob.Bids.Size())
+
+	resting := NewOrder(decimal.FromInt(1), true, decimal.FromInt(99), buyer.ID.String())
+	resting.PostOnly = true
+	_, err = ob.PlaceLimitOrder(decimal.FromInt(99), resting)
+	assert.NoError(t, err)
+	assert.Equal(t, decimal.FromInt(99), ob.GetBestBidPrice())
+
+	repriced := NewOrder(decimal.FromInt(1), true, decimal.FromInt(105), buyer.ID.String())
+	repriced.PostOnly = true
+	repriced.PostOnlyReprice = true
+	matches, err = ob.PlaceLimitOrder(decimal.FromInt(105), repriced)
+	assert.NoError(t, err)
+	assert.Empty(t, matches)
+	assert.Equal(t, decimal.RequireFromString("99.99"), repriced.Price)
+	assert.Equal(t, decimal.RequireFromString("99.99"), ob.GetBestBidPrice())
+
+	ask := NewOrder(decimal.FromInt(1), false, decimal.FromInt(90), seller.ID.String())
+	ask.PostOnly = true
+	ask.PostOnlyReprice = true
+	_, err = ob.PlaceLimitOrder(decimal.FromInt(90), ask)
+	assert.NoError(t, err)
+	assert.Equal(t, decimal.FromInt(100), ask.Price)
+	assert.Equal(t, decimal.FromInt(4), ob.TotalAskVolume())
+
+	ioc := NewOrder(decimal.FromInt(1), true, decimal.FromInt(50), buyer.ID.String())
+	ioc.PostOnly = true
+	ioc.TimeInForce = ImmediateOrCancel
+	_, err = ob.PlaceLimitOrder(decimal.FromInt(50), ioc)
+	assert.Error(t, err)
+}
+
+func TestIcebergOrderReplenishesAndLosesPriority(t *testing.T) {
+	ex := NewExchange()
+	ob := ex.OrderBook[BTC]
+
+	seller := auth.NewUser(nil, decimal.Zero)
+	other := auth.NewUser(nil, decimal.Zero)
+	buyer := auth.NewUser(nil, decimal.FromInt(10_000))
+	ex.AddUser(seller)
+	ex.AddUser(other)
+	ex.AddUser(buyer)
+	deposit(t, ex, seller.ID.String(), AssetBTC, 10)
+	deposit(t, ex, other.ID.String(), AssetBTC, 2)
+
+	iceberg := NewOrder(decimal.FromInt(10), false, decimal.FromInt(100), seller.ID.String())
+	iceberg.DisplaySize = decimal.FromInt(3)
+	ob.PlaceLimitOrder(decimal.FromInt(100), iceberg)
+	plain := NewOrder(decimal.FromInt(2), false, decimal.FromInt(100), other.ID.String())
+	ob.PlaceLimitOrder(decimal.FromInt(100), plain)
+
+	// only the display slice is visible
+	assert.Equal(t, decimal.FromInt(3), iceberg.Size)
+	assert.Equal(t, decimal.FromInt(5), ob.TotalAskVolume())
+	assert.Equal(t, decimal.FromInt(5), ob.AsksMap[decimal.FromInt(100)].TotalVolume)
+	assert.Equal(t, decimal.FromInt(12), ob.FillableAskVolume())
+
+	matches, err := ob.PlaceLimitOrder(decimal.FromInt(100), NewOrder(decimal.FromInt(4), true, decimal.FromInt(100), buyer.ID.String()))
+	assert.NoError(t, err)
+
+	// the first slice is taken, the replenished one queues behind the plain ask
+	assert.Len(t, matches, 2)
+	assert.Equal(t, iceberg.ID, matches[0].Ask.ID)
+	assert.Equal(t, decimal.FromInt(3), matches[0].SizeFilled)
+	assert.Equal(t, plain.ID, matches[1].Ask.ID)
+	assert.Equal(t, decimal.FromInt(3), iceberg.Size)
+	assert.Equal(t, decimal.FromInt(4), iceberg.Hidden)
+	assert.Equal(t, decimal.FromInt(1), plain.Size)
+	assert.Equal(t, decimal.FromInt(4), ob.TotalAskVolume())
+	assert.Equal(t, decimal.FromInt(8), ob.FillableAskVolume())
+
+	// a market order can fill against the hidden reserve
+	matches, err = ob.PlaceMarketOrder(NewMarketOrder(decimal.FromInt(8), true, buyer.ID.String()))
+	assert.NoError(t, err)
+	assert.Len(t, matches, 4)
+	assert.True(t, iceberg.IsFilled())
+	assert.Equal(t, 0, ob.Asks.Size())
+	assert.Empty(t, ob.OrdersMap)
+	assert.Equal(t, decimal.Zero, ob.TotalAskVolume())
+	assert.Equal(t, decimal.Zero, ob.FillableAskVolume())
+	assert.Equal(t, decimal.FromInt(1_000), seller.USD)
+}
+
+func TestCancelOrderKeepsVolumesConsistent(t *testing.T) {
+	ex := NewExchange()
+	ob := ex.OrderBook[BTC]
+
+	seller := auth.NewUser(nil, decimal.Zero)
+	ex.AddUser(seller)
+	deposit(t, ex, seller.ID.String(), AssetBTC, 12)
+
+	iceberg := NewOrder(decimal.FromInt(10), false, decimal.FromInt(100), seller.ID.String())
+	iceberg.DisplaySize = decimal.FromInt(3)
+	ob.PlaceLimitOrder(decimal.FromInt(100), iceberg)
+	plain := NewOrder(decimal.FromInt(2), false, decimal.FromInt(100), seller.ID.String())
+	ob.PlaceLimitOrder(decimal.FromInt(100), plain)
+
+	ob.CancelOrderById(iceberg.ID.String())
+	assert.Equal(t, decimal.FromInt(2), ob.TotalAskVolume())
+	assert.Equal(t, decimal.FromInt(2), ob.FillableAskVolume())
+
+	assert.NoError(t, ob.CancelOrderById(plain.ID.String()))
+	assert.Equal(t, decimal.Zero, ob.TotalAskVolume())
+	assert.Equal(t, 0, ob.Asks.Size())
+
+	assert.ErrorIs(t, ob.CancelOrderById(plain.ID.String()), ErrOrderNotFound)
+	assert.ErrorIs(t, ob.CancelOrderById("not-an-id"), ErrOrderNotFound)
+}
+
+func TestSelfTradePreventionModes(t *testing.T) {
+	cases := []struct {
+		mode           SelfTradePrevention
+		matched        decimal.Decimal
+		selfBidRemains bool
+		takerRests     decimal.Decimal
+		bidVolume      decimal.Decimal
+		userUSD        decimal.Decimal
+	}{
+		// the incoming ask stops at the user's own bid
+		{STPCancelNewest, decimal.Zero, true, decimal.Zero, decimal.FromInt(5), decimal.FromInt(9_800)},
+		// the own bid is cancelled (and refunded), the ask trades with the next one and rests
+		{STPCancelOldest, decimal.FromInt(3), false, decimal.FromInt(1), decimal.Zero, decimal.FromInt(10_300)},
+		{STPCancelBoth, decimal.Zero, false, decimal.Zero, decimal.FromInt(3), decimal.FromInt(10_000)},
+		// both lose the overlapping 2, which empties the own bid
+		{STPDecrementAndCancel, decimal.FromInt(2), false, decimal.Zero, decimal.FromInt(1), decimal.FromInt(10_200)},
+	}
+
+	for _, c := range cases {
+		t.Run(string(c.mode), func(t *testing.T) {
+			ex := NewExchange()
+			ob := ex.OrderBook[BTC]
+
+			user := auth.NewUser(nil, decimal.FromInt(10_000))
+			other := auth.NewUser(nil, decimal.FromInt(10_000))
+			ex.AddUser(user)
+			ex.AddUser(other)
+			deposit(t, ex, user.ID.String(), AssetBTC, 4)
+
+			selfBid := NewOrder(decimal.FromInt(2), true, decimal.FromInt(100), user.ID.String())
+			ob.PlaceLimitOrder(decimal.FromInt(100), selfBid)
+			otherBid := NewOrder(decimal.FromInt(3), true, decimal.FromInt(100), other.ID.String())
+			ob.PlaceLimitOrder(decimal.FromInt(100), otherBid)
+
+			ask := NewOrder(decimal.FromInt(4), false, decimal.FromInt(100), user.ID.String())
+			ask.SelfTradePrevention = c.mode
+			matches, err := ob.PlaceLimitOrder(decimal.FromInt(100), ask)
+			assert.NoError(t, err)
+
+			assert.Equal(t, decimal.FromInt(2), ask.SelfTradePrevented)
+			assert.Equal(t, c.matched, filledSize(matches))
+			for _, m := range matches {
+				assert.Equal(t, otherBid.ID, m.Bid.ID)
+			}
+			// prevented size never shows up as a trade
+			assert.Equal(t, len(matches), len(ob.GetTrades()))
+
+			_, resting := ob.OrdersMap[selfBid.ID]
+			assert.Equal(t, c.selfBidRemains, resting)
+			_, resting = ob.OrdersMap[ask.ID]
+			assert.Equal(t, c.takerRests.IsPositive(), resting)
+			assert.Equal(t, c.takerRests, ob.TotalAskVolume())
+			assert.Equal(t, c.bidVolume, ob.TotalBidVolume())
+			assert.Equal(t, c.userUSD, user.USD)
+		})
+	}
+}
+
+func TestSelfTradePreventionUserDefault(t *testing.T) {
+	ex := NewExchange()
+	ob := ex.OrderBook[BTC]
+
+	user := auth.NewUser(nil, decimal.FromInt(10_000))
+	ex.AddUser(user)
+	deposit(t, ex, user.ID.String(), AssetBTC, 2)
+	assert.Error(t, ex.SetSelfTradePrevention(user.ID.String(), "CANCEL_ALL"))
+	assert.NoError(t, ex.SetSelfTradePrevention(user.ID.String(), STPCancelOldest))
+
+	ask := NewOrder(decimal.FromInt(2), false, decimal.FromInt(100), user.ID.String())
+	ob.PlaceLimitOrder(decimal.FromInt(100), ask)
+
+	// the order's own mode wins over the user's default
+	bid := NewOrder(decimal.FromInt(1), true, decimal.FromInt(100), user.ID.String())
+	bid.SelfTradePrevention = STPCancelNewest
+	matches, _ := ob.PlaceLimitOrder(decimal.FromInt(100), bid)
+	assert.Empty(t, matches)
+	assert.Equal(t, decimal.FromInt(2), ob.TotalAskVolume())
+
+	// no self-trade can fill a FOK order
+	fok := NewOrder(decimal.FromInt(1), true, decimal.FromInt(100), user.ID.String())
+	fok.TimeInForce = FillOrKill
+	_, err := ob.PlaceLimitOrder(decimal.FromInt(100), fok)
+	assert.ErrorIs(t, err, ErrFillOrKill)
+
+	// the default cancels the resting ask
+	market := NewMarketOrder(decimal.FromInt(1), true, user.ID.String())
+	matches, err = ob.PlaceMarketOrder(market)
+	assert.NoError(t, err)
+	assert.Empty(t, matches)
+	assert.Equal(t, decimal.FromInt(1), market.SelfTradePrevented)
+	assert.Empty(t, ob.OrdersMap)
+	assert.Equal(t, decimal.Zero, ob.TotalAskVolume())
+	assert.Equal(t, 0, ob.Asks.Size())
+}
+
+func TestAmendOrderReduceKeepsPriority(t *testing.T) {
+	ex := NewExchange()
+	ob := ex.OrderBook[BTC]
+
+	user := auth.NewUser(nil, decimal.FromInt(10_000))
+	other := auth.NewUser(nil, decimal.FromInt(10_000))
+	ex.AddUser(user)
+	ex.AddUser(other)
+	deposit(t, ex, other.ID.String(), AssetBTC, 1)
+
+	first := NewOrder(decimal.FromInt(5), true, decimal.FromInt(100), user.ID.String())
+	first.DisplaySize = decimal.FromInt(2)
+	ob.PlaceLimitOrder(decimal.FromInt(100), first)
+	second := NewOrder(decimal.FromInt(1), true, decimal.FromInt(100), other.ID.String())
+	ob.PlaceLimitOrder(decimal.FromInt(100), second)
+	ts := first.Timestamp
+
+	// the reserve goes first, the escrow for the removed size is given back
+	matches, err := ob.AmendOrder(first.ID.String(), decimal.FromInt(100), decimal.FromInt(3))
+	assert.NoError(t, err)
+	assert.Empty(t, matches)
+	assert.Equal(t, ts, first.Timestamp)
+	assert.Equal(t, decimal.FromInt(2), first.Size)
+	assert.Equal(t, decimal.FromInt(1), first.Hidden)
+	assert.Equal(t, decimal.FromInt(3), ob.TotalBidVolume())
+	assert.Equal(t, decimal.FromInt(4), ob.FillableBidVolume())
+	assert.Equal(t, decimal.FromInt(9_700), user.USD)
+
+	matches, err = ob.AmendOrder(first.ID.String(), decimal.FromInt(100), decimal.FromInt(1))
+	assert.NoError(t, err)
+	assert.Equal(t, decimal.FromInt(1), first.Size)
+	assert.Equal(t, decimal.Zero, first.Hidden)
+	assert.Equal(t, decimal.FromInt(2), ob.BidsMap[decimal.FromInt(100)].TotalVolume)
+	assert.Equal(t, decimal.FromInt(9_900), user.USD)
+
+	// still ahead of the second order
+	matches, _ = ob.PlaceLimitOrder(decimal.FromInt(100), NewOrder(decimal.FromInt(1), false, decimal.FromInt(100), other.ID.String()))
+	assert.Len(t, matches, 1)
+	assert.Equal(t, first.ID, matches[0].Bid.ID)
+}
+
+func TestAmendOrderCancelReplace(t *testing.T) {
+	ex := NewExchange()
+	ob := ex.OrderBook[BTC]
+
+	user := auth.NewUser(nil, decimal.FromInt(1_000))
+	other := auth.NewUser(nil, decimal.FromInt(10_000))
+	ex.AddUser(user)
+	ex.AddUser(other)
+	deposit(t, ex, other.ID.String(), AssetBTC, 2)
+
+	first := NewOrder(decimal.FromInt(2), true, decimal.FromInt(100), user.ID.String())
+	first.PostOnly = true
+	ob.PlaceLimitOrder(decimal.FromInt(100), first)
+	second := NewOrder(decimal.FromInt(2), true, decimal.FromInt(100), other.ID.String())
+	ob.PlaceLimitOrder(decimal.FromInt(100), second)
+	ob.PlaceLimitOrder(decimal.FromInt(105), NewOrder(decimal.FromInt(1), false, decimal.FromInt(105), other.ID.String()))
+
+	// rejected replacements leave the original untouched
+	_, err := ob.AmendOrder(first.ID.String(), decimal.FromInt(100), decimal.FromInt(20))
+	assert.ErrorIs(t, err, ErrInsufficientFunds)
+	_, err = ob.AmendOrder(first.ID.String(), decimal.FromInt(105), decimal.FromInt(2))
+	assert.ErrorIs(t, err, ErrPostOnlyWouldCross)
+	assert.Equal(t, first, ob.OrdersMap[first.ID])
+	assert.Equal(t, decimal.FromInt(800), user.USD)
+	assert.Equal(t, decimal.FromInt(4), ob.TotalBidVolume())
+
+	// a size increase goes to the back of the queue and is escrowed in full
+	matches, err := ob.AmendOrder(first.ID.String(), decimal.FromInt(100), decimal.FromInt(3))
+	assert.NoError(t, err)
+	assert.Empty(t, matches)
+	assert.Equal(t, decimal.FromInt(700), user.USD)
+	assert.Equal(t, decimal.FromInt(5), ob.TotalBidVolume())
+	assert.Equal(t, 1, ob.Bids.Size())
+
+	matches, _ = ob.PlaceLimitOrder(decimal.FromInt(100), NewOrder(decimal.FromInt(1), false, decimal.FromInt(100), other.ID.String()))
+	assert.Equal(t, second.ID, matches[0].Bid.ID)
+
+	// a price change moves it to the new level
+	_, err = ob.AmendOrder(first.ID.String(), decimal.FromInt(104), decimal.FromInt(3))
+	assert.NoError(t, err)
+	assert.Equal(t, decimal.FromInt(104), ob.GetBestBidPrice())
+	assert.Equal(t, decimal.FromInt(688), user.USD)
+	assert.Equal(t, decimal.FromInt(4), ob.TotalBidVolume())
+
+	_, err = ob.AmendOrder(uuid.New().String(), decimal.FromInt(100), decimal.FromInt(1))
+	assert.ErrorIs(t, err, ErrOrderNotFound)
+}
+
+func TestAmendOrderRejectedAskKeepsItsPlace(t *testing.T) {
+	ex := NewExchange()
+	ob := ex.OrderBook[BTC]
+
+	seller := auth.NewUser(nil, decimal.Zero)
+	other := auth.NewUser(nil, decimal.Zero)
+	buyer := auth.NewUser(nil, decimal.FromInt(10_000))
+	ex.AddUser(seller)
+	ex.AddUser(other)
+	ex.AddUser(buyer)
+	deposit(t, ex, seller.ID.String(), AssetBTC, 3)
+	deposit(t, ex, other.ID.String(), AssetBTC, 1)
+
+	ask := NewOrder(decimal.FromInt(2), false, decimal.FromInt(100), seller.ID.String())
+	ob.PlaceLimitOrder(decimal.FromInt(100), ask)
+	ob.PlaceLimitOrder(decimal.FromInt(100), NewOrder(decimal.FromInt(1), false, decimal.FromInt(100), other.ID.String()))
+
+	// the seller only has one more token than the ask locks
+	_, err := ob.AmendOrder(ask.ID.String(), decimal.FromInt(101), decimal.FromInt(4))
+	assert.ErrorIs(t, err, ErrInsufficientFunds)
+	assert.Equal(t, ledger.Balance{Available: decimal.FromInt(1), Locked: decimal.FromInt(2)}, ex.Ledger.Balance(seller.ID.String(), AssetBTC))
+
+	// a replacement rejected after the cancel is put back as it was
+	original := *ask
+	ob.CancelOrder(ask)
+	ob.release(ask, ask.Locked)
+	ob.reinstate(ask, original)
+	assert.Equal(t, decimal.FromInt(2), ask.Locked)
+	assert.Equal(t, ledger.Balance{Available: decimal.FromInt(1), Locked: decimal.FromInt(2)}, ex.Ledger.Balance(seller.ID.String(), AssetBTC))
+	assert.Equal(t, decimal.FromInt(3), ob.TotalAskVolume())
+
+	matches, _ := ob.PlaceLimitOrder(decimal.FromInt(100), NewOrder(decimal.FromInt(1), true, decimal.FromInt(100), buyer.ID.String()))
+	assert.Equal(t, ask.ID, matches[0].Ask.ID)
+	assert.NoError(t, ex.Ledger.Check())
+}
+
+func TestPlaceMarketOrderPriceProtection(t *testing.T) {
+	ex := NewExchange()
+	ob := ex.OrderBook[BTC]
+
+	seller := auth.NewUser(nil, decimal.Zero)
+	buyer := auth.NewUser(nil, decimal.FromInt(10_000))
+	ex.AddUser(seller)
+	ex.AddUser(buyer)
+	deposit(t, ex, seller.ID.String(), AssetBTC, 8)
+
+	ob.PlaceLimitOrder(decimal.FromInt(100), NewOrder(decimal.FromInt(1), false, decimal.FromInt(100), seller.ID.String()))
+	ob.PlaceLimitOrder(decimal.FromInt(105), NewOrder(decimal.FromInt(1), false, decimal.FromInt(105), seller.ID.String()))
+	ob.PlaceLimitOrder(decimal.FromInt(200), NewOrder(decimal.FromInt(5), false, decimal.FromInt(200), seller.ID.String()))
+
+	// 500 bps above the best ask is tighter than the given worst price
+	o := NewMarketOrder(decimal.FromInt(4), true, buyer.ID.String())
+	o.WorstPrice = decimal.FromInt(150)
+	o.MaxSlippageBps = 500
+	matches, err := ob.PlaceMarketOrder(o)
+	assert.NoError(t, err)
+
+	assert.Equal(t, decimal.FromInt(105), o.WorstPrice)
+	assert.Len(t, matches, 2)
+	assert.Equal(t, decimal.FromInt(2), filledSize(matches))
+	// the remainder is cancelled, not rested
+	assert.Equal(t, decimal.FromInt(2), o.Size)
+	assert.Empty(t, ob.BidsMap)
+	assert.Equal(t, decimal.FromInt(200), ob.GetBestAskPrice())
+	assert.Equal(t, decimal.FromInt(9_795), buyer.USD)
+
+	// nothing within the bound
+	o = NewMarketOrder(decimal.FromInt(1), false, seller.ID.String())
+	o.WorstPrice = decimal.FromInt(1)
+	matches, err = ob.PlaceMarketOrder(o)
+	assert.NoError(t, err)
+	assert.Empty(t, matches)
+	assert.Equal(t, decimal.FromInt(1), o.Size)
+
+	// a bound past MaxSlippageBps is rejected rather than overflowing
+	o = NewMarketOrder(decimal.FromInt(1), true, buyer.ID.String())
+	o.MaxSlippageBps = 92233720368
+	_, err = ob.PlaceMarketOrder(o)
+	var riskErr *RiskError
+	if assert.ErrorAs(t, err, &riskErr) {
+		assert.Equal(t, RiskInvalidProtection, riskErr.Reason)
+	}
+}
+
+func TestPlaceMarketOrderNotionalBudget(t *testing.T) {
+	ex := NewExchange()
+	ob := ex.OrderBook[BTC]
+
+	seller := auth.NewUser(nil, decimal.Zero)
+	buyer := auth.NewUser(nil, decimal.FromInt(10_000))
+	ex.AddUser(seller)
+	ex.AddUser(buyer)
+	deposit(t, ex, seller.ID.String(), AssetBTC, 3)
+
+	ob.PlaceLimitOrder(decimal.FromInt(100), NewOrder(decimal.FromInt(1), false, decimal.FromInt(100), seller.ID.String()))
+	ob.PlaceLimitOrder(decimal.FromInt(101), NewOrder(decimal.FromInt(2), false, decimal.FromInt(101), seller.ID.String()))
+
+	// buy $250 worth: 1 at 100, then the whole lots $150 buys at 101
+	o := NewMarketOrder(decimal.Zero, true, buyer.ID.String())
+	o.MaxNotional = decimal.FromInt(250)
+	matches, err := ob.PlaceMarketOrder(o)
+	assert.NoError(t, err)
+
+	assert.Len(t, matches, 2)
+	assert.Equal(t, decimal.RequireFromString("2.4851"), filledSize(matches))
+	assert.Equal(t, decimal.RequireFromString("249.9951"), matches[0].Notional.Add(matches[1].Notional))
+	assert.True(t, o.IsFilled())
+	assert.Equal(t, decimal.RequireFromString("0.5149"), ob.TotalAskVolume())
+
+	// a sized order stops at whichever bound comes first
+	o = NewMarketOrder(decimal.RequireFromString("0.5"), true, buyer.ID.String())
+	o.MaxNotional = decimal.FromInt(10)
+	matches, err = ob.PlaceMarketOrder(o)
+	assert.NoError(t, err)
+	assert.Equal(t, decimal.RequireFromString("0.099"), filledSize(matches))
+	assert.Equal(t, decimal.RequireFromString("0.401"), o.Size)
+}
+
+func TestBudgetSellAgainstDeepBook(t *testing.T) {
+	ex := NewExchange()
+	ob := ex.OrderBook[ETH]
+
+	seller := auth.NewUser(nil, decimal.Zero)
+	buyer := auth.NewUser(nil, decimal.FromInt(1_000_000))
+	ex.AddUser(seller)
+	ex.AddUser(buyer)
+	sellerID := seller.ID.String()
+	deposit(t, ex, sellerID, AssetETH, 5)
+
+	ob.PlaceLimitOrder(decimal.FromInt(1000), NewOrder(decimal.FromInt(100), true, decimal.FromInt(1000), buyer.ID.String()))
+	ob.PlaceLimitOrder(decimal.FromInt(990), NewOrder(decimal.FromInt(100), true, decimal.FromInt(990), buyer.ID.String()))
+
+	// $2000 worth is 2 ETH at the best bid, only that is locked
+	o := NewMarketOrder(decimal.Zero, false, sellerID)
+	o.MaxNotional = decimal.FromInt(2000)
+	matches, err := ob.PlaceMarketOrder(o)
+	assert.NoError(t, err)
+	assert.Equal(t, decimal.FromInt(2), filledSize(matches))
+	assert.Equal(t, ledger.Balance{Available: decimal.FromInt(3)}, ex.Ledger.Balance(sellerID, AssetETH))
+
+	// a budget beyond what the user holds sells all of it
+	o = NewMarketOrder(decimal.Zero, false, sellerID)
+	o.MaxNotional = decimal.FromInt(20_000)
+	matches, err = ob.PlaceMarketOrder(o)
+	assert.NoError(t, err)
+	assert.Equal(t, decimal.FromInt(3), filledSize(matches))
+	assert.Equal(t, ledger.Balance{}, ex.Ledger.Balance(sellerID, AssetETH))
+	assert.Equal(t, decimal.FromInt(5_000), seller.USD)
+	assert.Equal(t, decimal.FromInt(195), ob.TotalBidVolume())
+	assert.NoError(t, ex.Ledger.Check())
+}
+
+func TestLedgerSettlesTrades(t *testing.T) {
+	ex := NewExchange()
+	ob := ex.OrderBook[BTC]
+
+	seller := auth.NewUser(nil, decimal.Zero)
+	buyer := auth.NewUser(nil, decimal.FromInt(10_000))
+	ex.AddUser(seller)
+	ex.AddUser(buyer)
+	sellerID, buyerID := seller.ID.String(), buyer.ID.String()
+	deposit(t, ex, sellerID, AssetBTC, 3)
+
+	ob.PlaceLimitOrder(decimal.FromInt(100), NewOrder(decimal.FromInt(3), false, decimal.FromInt(100), sellerID))
+	assert.Equal(t, ledger.Balance{Locked: decimal.FromInt(3)}, ex.Ledger.Balance(sellerID, AssetBTC))
+
+	// the maker's locked tokens go to the taker, the rest of the bid locks its USD
+	ob.PlaceLimitOrder(decimal.FromInt(101), NewOrder(decimal.FromInt(5), true, decimal.FromInt(101), buyerID))
+	assert.Equal(t, ledger.Balance{Available: decimal.FromInt(300)}, ex.Ledger.Balance(sellerID, AssetUSD))
+	assert.Equal(t, ledger.Balance{}, ex.Ledger.Balance(sellerID, AssetBTC))
+	assert.Equal(t, ledger.Balance{Available: decimal.FromInt(9_498), Locked: decimal.FromInt(202)}, ex.Ledger.Balance(buyerID, AssetUSD))
+	assert.Equal(t, decimal.FromInt(9_498), buyer.USD)
+
+	// the taker's tokens pay for the match, the maker pays out of its lock
+	deposit(t, ex, sellerID, AssetBTC, 1)
+	_, err := ob.PlaceMarketOrder(NewMarketOrder(decimal.FromInt(1), false, sellerID))
+	assert.NoError(t, err)
+	assert.Equal(t, ledger.Balance{Available: decimal.FromInt(401)}, ex.Ledger.Balance(sellerID, AssetUSD))
+	assert.Equal(t, ledger.Balance{Available: decimal.FromInt(9_498), Locked: decimal.FromInt(101)}, ex.Ledger.Balance(buyerID, AssetUSD))
+
+	// bought tokens are paid out, so the exchange only holds USD
+	assert.Equal(t, decimal.FromInt(10_000), ex.Ledger.Held(AssetUSD))
+	assert.Equal(t, decimal.Zero, ex.Ledger.Held(AssetBTC))
+	assert.NoError(t, ex.Ledger.Check())
+}
+
+func TestPlaceOrderInsufficientFunds(t *testing.T) {
+	ex := NewExchange()
+	ob := ex.OrderBook[BTC]
+
+	seller := auth.NewUser(nil, decimal.Zero)
+	buyer := auth.NewUser(nil, decimal.FromInt(500))
+	ex.AddUser(seller)
+	ex.AddUser(buyer)
+	buyerID := buyer.ID.String()
+	deposit(t, ex, seller.ID.String(), AssetBTC, 6)
+
+	ob.PlaceLimitOrder(decimal.FromInt(100), NewOrder(decimal.FromInt(3), false, decimal.FromInt(100), seller.ID.String()))
+
+	// the bid would trade before running out of money, so nothing may move at all
+	bid := NewOrder(decimal.FromInt(6), true, decimal.FromInt(100), buyerID)
+	matches, err := ob.PlaceLimitOrder(decimal.FromInt(100), bid)
+	assert.ErrorIs(t, err, ErrInsufficientFunds)
+	assert.Empty(t, matches)
+	assert.Equal(t, decimal.FromInt(3), ob.TotalAskVolume())
+	assert.Equal(t, 0, ob.Bids.Size())
+	assert.Equal(t, ledger.Balance{Available: decimal.FromInt(500)}, ex.Ledger.Balance(buyerID, AssetUSD))
+
+	// a market bid locks what its size costs on the book
+	matches, err = ob.PlaceMarketOrder(NewMarketOrder(decimal.FromInt(3), true, buyerID))
+	assert.NoError(t, err)
+	assert.Len(t, matches, 1)
+	assert.Equal(t, ledger.Balance{Available: decimal.FromInt(200)}, ex.Ledger.Balance(buyerID, AssetUSD))
+
+	ob.PlaceLimitOrder(decimal.FromInt(100), NewOrder(decimal.FromInt(3), false, decimal.FromInt(100), seller.ID.String()))
+	_, err = ob.PlaceMarketOrder(NewMarketOrder(decimal.FromInt(3), true, buyerID))
+	assert.ErrorIs(t, err, ErrInsufficientFunds)
+	assert.Equal(t, decimal.FromInt(3), ob.TotalAskVolume())
+	assert.NoError(t, ex.Ledger.Check())
+}
+
+func TestLockedFundsReleasedOnFillCancelAndExpiry(t *testing.T) {
+	ex := NewExchange()
+	ob := ex.OrderBook[BTC]
+
+	seller := auth.NewUser(nil, decimal.Zero)
+	buyer := auth.NewUser(nil, decimal.FromInt(1_000))
+	ex.AddUser(seller)
+	ex.AddUser(buyer)
+	buyerID := buyer.ID.String()
+	deposit(t, ex, seller.ID.String(), AssetBTC, 3)
+
+	bid := NewOrder(decimal.FromInt(4), true, decimal.FromInt(100), buyerID)
+	ob.PlaceLimitOrder(decimal.FromInt(100), bid)
+	assert.Equal(t, decimal.FromInt(400), bid.Locked)
+	assert.Equal(t, ledger.Balance{Available: decimal.FromInt(600), Locked: decimal.FromInt(400)}, ex.Ledger.Balance(buyerID, AssetUSD))
+
+	// each fill is paid out of the lock
+	ob.PlaceLimitOrder(decimal.FromInt(100), NewOrder(decimal.FromInt(1), false, decimal.FromInt(100), seller.ID.String()))
+	assert.Equal(t, decimal.FromInt(300), bid.Locked)
+	assert.Equal(t, ledger.Balance{Available: decimal.FromInt(600), Locked: decimal.FromInt(300)}, ex.Ledger.Balance(buyerID, AssetUSD))
+
+	// cancelling gives the rest back
+	ob.CancelOrderById(bid.ID.String())
+	assert.Equal(t, decimal.Zero, bid.Locked)
+	assert.Equal(t, ledger.Balance{Available: decimal.FromInt(900)}, ex.Ledger.Balance(buyerID, AssetUSD))
+	assert.Equal(t, decimal.FromInt(900), buyer.USD)
+
+	// so does expiring, an ask's tokens can be sold or withdrawn again
+	ask := NewOrder(decimal.FromInt(2), false, decimal.FromInt(110), seller.ID.String())
+	ask.TimeInForce = GoodTillDate
+	ask.ExpiresAt = time.Now().Add(time.Minute).UnixNano()
+	ob.PlaceLimitOrder(decimal.FromInt(110), ask)
+	assert.Equal(t, ledger.Balance{Locked: decimal.FromInt(2)}, ex.Ledger.Balance(seller.ID.String(), AssetBTC))
+
+	ob.ExpireOrders(ask.ExpiresAt)
+	assert.Equal(t, ledger.Balance{Available: decimal.FromInt(2)}, ex.Ledger.Balance(seller.ID.String(), AssetBTC))
+	assert.Equal(t, decimal.FromInt(2), ex.Ledger.Held(AssetBTC))
+	assert.NoError(t, ex.Ledger.Check())
+}
@@ -0,0 +1,100 @@
+package core
+
+import (
+	"github.com/EggsyOnCode/velho-exchange/decimal"
+)
+
+// market orders can be protected against walking a thin book: they don't execute
+// past WorstPrice (given directly, or MaxSlippageBps away from the best opposite
+// price when the order arrives) and don't exchange more than MaxNotional in quote.
+// Whatever can't be filled within those bounds is cancelled.
+
+// basis points in 1
+const bpsScale = 10_000
+
+// MaxSlippageBps is the widest slippage bound, a sell's can't go below zero
+const MaxSlippageBps = bpsScale
+
+func (o *Order) IsProtected() bool {
+	return o.WorstPrice.IsPositive() || o.MaxSlippageBps > 0 || o.MaxNotional.IsPositive()
+}
+
+// checkProtection rejects bounds that are negative or wider than MaxSlippageBps
+// with a *RiskError
+func (o *Order) checkProtection() error {
+	if o.WorstPrice.IsNegative() {
+		return riskError(RiskInvalidProtection, decimal.Zero, o.WorstPrice, "worst price can't be negative")
+	}
+	if o.MaxNotional.IsNegative() {
+		return riskError(RiskInvalidProtection, decimal.Zero, o.MaxNotional, "max notional can't be negative")
+	}
+	if o.MaxSlippageBps < 0 || o.MaxSlippageBps > MaxSlippageBps {
+		return riskError(RiskInvalidProtection, decimal.FromInt(MaxSlippageBps), decimal.FromInt(o.MaxSlippageBps), "max slippage must be between 0 and %d bps", MaxSlippageBps)
+	}
+	return nil
+}
+
+// tightens o.WorstPrice to the slippage bound around the current best opposite price
+func (ob *OrderBook) applySlippageBound(o *Order) {
+	if o.MaxSlippageBps <= 0 {
+		return
+	}
+
+	if o.Bid {
+		best := ob.bestLimit(ob.Asks)
+		if best == nil {
+			return
+		}
+		bound, ok := best.Price.MulChecked(decimal.FromInt(bpsScale + o.MaxSlippageBps))
+		if !ok {
+			// past any price there can be
+			return
+		}
+		bound = bound.Div(decimal.FromInt(bpsScale))
+		if o.WorstPrice.IsZero() || bound.Cmp(o.WorstPrice) < 0 {
+			o.WorstPrice = bound
+		}
+		return
+	}
+
+	best := ob.bestLimit(ob.Bids)
+	if best == nil || o.MaxSlippageBps >= bpsScale {
+		return
+	}
+	bound, ok := best.Price.MulChecked(decimal.FromInt(bpsScale - o.MaxSlippageBps))
+	if !ok {
+		return
+	}
+	bound = bound.Div(decimal.FromInt(bpsScale))
+	if bound.Cmp(o.WorstPrice) > 0 {
+		o.WorstPrice = bound
+	}
+}
+
+// whether o may execute against the price level at price
+func (o *Order) withinWorstPrice(price decimal.Decimal) bool {
+	if o.WorstPrice.IsZero() {
+		return true
+	}
+	if o.Bid {
+		return price.Cmp(o.WorstPrice) <= 0
+	}
+	return price.Cmp(o.WorstPrice) >= 0
+}
+
+// caps o.Size to the whole lots the rest of its quote budget buys at price and
+// returns the size held back, false if not even one lot fits
+func (ob *OrderBook) capToBudget(o *Order, spent, price decimal.Decimal) (decimal.Decimal, bool) {
+	affordable := o.MaxNotional.Sub(spent).Div(price).TruncateTo(ob.Spec.LotSize)
+	if !affordable.IsPositive() {
+		return decimal.Zero, false
+	}
+
+	if affordable.Cmp(o.Size) >= 0 {
+		return decimal.Zero, true
+	}
+
+	held := o.Size.Sub(affordable)
+	o.Size = affordable
+	return held, true
+}
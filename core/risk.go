@@ -0,0 +1,254 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/EggsyOnCode/velho-exchange/decimal"
+)
+
+// Pre-trade risk checks run on every order before it reaches the book, and on
+// amendments that move an order's price or raise its size. Besides the market
+// spec's increments and size bounds, a market's RiskLimits can keep limit prices
+// within a band around a reference price and cap the notional of one order and
+// of a user's open orders on the market. A rejected order fails with a
+// *RiskError saying which check it failed.
+
+var ErrRiskCheck = errors.New("order rejected by pre-trade risk checks")
+
+// RiskReason is the check a rejected order failed
+type RiskReason string
+
+const (
+	// size isn't a positive multiple of the lot size
+	RiskInvalidSize  RiskReason = "INVALID_SIZE"
+	RiskSizeBelowMin RiskReason = "SIZE_BELOW_MIN"
+	RiskSizeAboveMax RiskReason = "SIZE_ABOVE_MAX"
+	// a limit or stop price that isn't positive
+	RiskInvalidPrice RiskReason = "INVALID_PRICE"
+	// price isn't a multiple of the tick size
+	RiskPriceOffTick RiskReason = "PRICE_OFF_TICK"
+	// limit price too far from the reference price
+	RiskPriceOutsideBand RiskReason = "PRICE_OUTSIDE_BAND"
+	RiskMaxOrderNotional RiskReason = "MAX_ORDER_NOTIONAL"
+	RiskMaxUserNotional  RiskReason = "MAX_USER_NOTIONAL"
+	// a market order's worst price, slippage or notional bound is out of range
+	RiskInvalidProtection RiskReason = "INVALID_PROTECTION"
+)
+
+// RiskError is an order's rejection by a pre-trade check
+type RiskError struct {
+	Reason  RiskReason
+	Message string
+	// the bound the order broke and what the order came to, zero when the
+	// check has no bound (e.g. a price that isn't positive)
+	Limit decimal.Decimal
+	Value decimal.Decimal
+}
+
+func (e *RiskError) Error() string {
+	return e.Message
+}
+
+func (e *RiskError) Unwrap() error {
+	return ErrRiskCheck
+}
+
+func riskError(reason RiskReason, limit, value decimal.Decimal, format string, args ...any) *RiskError {
+	return &RiskError{Reason: reason, Message: fmt.Sprintf(format, args...), Limit: limit, Value: value}
+}
+
+// PriceReference is what a market's price band is around
+type PriceReference string
+
+const (
+	// the mid of the best bid and ask (default)
+	ReferenceMid PriceReference = "MID"
+	// the last traded price
+	ReferenceLast PriceReference = "LAST"
+)
+
+// widest price band, 100x the reference price
+const maxPriceBandBps = 100 * bpsScale
+
+// RiskLimits are a market's pre-trade checks on top of its spec's increments,
+// zero disables a check
+type RiskLimits struct {
+	// how far, in basis points, a limit price may be from the reference price.
+	// There's no band until the market has a reference price.
+	PriceBandBps int64 `json:"price_band_bps"`
+	// the price the band is around, each reference falls back to the other
+	// while the market doesn't have it
+	PriceReference PriceReference `json:"price_reference,omitempty"`
+	// quote value of one order, market orders are valued at the reference price
+	MaxOrderNotional decimal.Decimal `json:"max_order_notional"`
+	// quote value of a user's open orders on the market, the new one included
+	MaxUserNotional decimal.Decimal `json:"max_user_notional"`
+}
+
+func (r RiskLimits) Validate() error {
+	if r.PriceBandBps < 0 || r.PriceBandBps > maxPriceBandBps {
+		return fmt.Errorf("price band must be between 0 and %d bps", maxPriceBandBps)
+	}
+	if r.PriceReference != "" && r.PriceReference != ReferenceMid && r.PriceReference != ReferenceLast {
+		return fmt.Errorf("unknown price reference %q", r.PriceReference)
+	}
+	if r.MaxOrderNotional.IsNegative() || r.MaxUserNotional.IsNegative() {
+		return fmt.Errorf("notional limits can't be negative")
+	}
+	return nil
+}
+
+// SetRiskLimits replaces the pre-trade risk limits of market, they apply from
+// the next order on
+func (ex *Exchange) SetRiskLimits(market Market, limits RiskLimits) error {
+	return ex.execute(CmdSetRiskLimits, &riskLimitsCommand{Market: market, Limits: limits})
+}
+
+func (ex *Exchange) setRiskLimits(market Market, limits RiskLimits) error {
+	ob, err := ex.Market(market)
+	if err != nil {
+		return err
+	}
+	if err := limits.Validate(); err != nil {
+		return err
+	}
+
+	ob.Spec.Risk = limits
+	return nil
+}
+
+// ReferencePrice is the price the market's band is around, zero if the book is
+// one-sided and nothing traded yet
+func (ob *OrderBook) ReferencePrice() decimal.Decimal {
+	mid := decimal.Zero
+	bid, ask := ob.bestLimit(ob.Bids), ob.bestLimit(ob.Asks)
+	if bid != nil && ask != nil {
+		mid = bid.Price.Add(ask.Price).Div(decimal.FromInt(2))
+	}
+
+	if mid.IsZero() || ob.Spec.Risk.PriceReference == ReferenceLast && ob.CurrentPrice.IsPositive() {
+		return ob.CurrentPrice
+	}
+	return mid
+}
+
+// whether o ends up on the book at its limit price
+func (o *Order) hasLimitPrice() bool {
+	return o.OrderType == LimitOrder || o.OrderType == StopLimitOrder
+}
+
+// checkRisk runs the pre-trade checks on o, except is an order of the user's
+// not to count against their notional (the one an amendment replaces).
+// ex.cmdMu is held.
+func (ex *Exchange) checkRisk(ob *OrderBook, o *Order, except string) error {
+	value, err := ob.checkOrderRisk(o)
+	if err != nil {
+		return err
+	}
+
+	// orders that can't rest don't add to what the user has open
+	limit := ob.Spec.Risk.MaxUserNotional
+	if !limit.IsPositive() || !o.canRest() {
+		return nil
+	}
+	total, exceeded := value, value.Cmp(limit) > 0
+	if orders, ok := ex.orders[o.UserID]; ok {
+		orders.Each(func(id string, v *ExOrder) {
+			if exceeded || id == except || v.Market != ob.TokenId {
+				return
+			}
+			open := ob.GetOrderById(id)
+			if open == nil {
+				return
+			}
+			n, ok := open.openNotional()
+			// summing past the limit could overflow
+			if !ok || n.Cmp(limit.Sub(total)) > 0 {
+				exceeded = true
+				return
+			}
+			total = total.Add(n)
+		})
+	}
+	if exceeded {
+		return riskError(RiskMaxUserNotional, limit, value, "open orders on %s would be worth more than the %s limit per user", ob.TokenId, limit)
+	}
+	return nil
+}
+
+// checks o against the market's spec and limits and returns its notional
+func (ob *OrderBook) checkOrderRisk(o *Order) (decimal.Decimal, error) {
+	spec, limits := ob.Spec, ob.Spec.Risk
+
+	// a market order can be sized by its quote budget
+	sizedByBudget := o.Size.IsZero() && o.MaxNotional.IsPositive() && !o.hasLimitPrice()
+	if !sizedByBudget {
+		if err := spec.checkSize(o.Size); err != nil {
+			return decimal.Zero, err
+		}
+	}
+	if o.IsStop() {
+		if err := spec.checkPrice("stop price", o.StopPrice); err != nil {
+			return decimal.Zero, err
+		}
+	}
+	if o.hasLimitPrice() {
+		if err := spec.checkPrice("price", o.Price); err != nil {
+			return decimal.Zero, err
+		}
+	} else if err := o.checkProtection(); err != nil {
+		return decimal.Zero, err
+	}
+
+	reference := ob.ReferencePrice()
+	// stop orders are checked against the band once they're triggered, if they're amended
+	onBook := o.OrderType == LimitOrder || o.OrderType == StopLimitOrder && o.Triggered
+	if limits.PriceBandBps > 0 && reference.IsPositive() && onBook {
+		upper := reference.Mul(decimal.FromInt(bpsScale + limits.PriceBandBps)).Div(decimal.FromInt(bpsScale))
+		if o.Price.Cmp(upper) > 0 {
+			return decimal.Zero, riskError(RiskPriceOutsideBand, upper, o.Price, "price %s is more than %d bps above the reference price %s", o.Price, limits.PriceBandBps, reference)
+		}
+		if limits.PriceBandBps < bpsScale {
+			lower := reference.Mul(decimal.FromInt(bpsScale - limits.PriceBandBps)).Div(decimal.FromInt(bpsScale))
+			if o.Price.Cmp(lower) < 0 {
+				return decimal.Zero, riskError(RiskPriceOutsideBand, lower, o.Price, "price %s is more than %d bps below the reference price %s", o.Price, limits.PriceBandBps, reference)
+			}
+		}
+	}
+
+	value, ok := o.notional(reference)
+	if !ok {
+		return decimal.Zero, riskError(RiskMaxOrderNotional, limits.MaxOrderNotional, decimal.Zero, "order of %s at %s is worth more than can be traded", o.Size, o.Price)
+	}
+	if limits.MaxOrderNotional.IsPositive() && value.Cmp(limits.MaxOrderNotional) > 0 {
+		return decimal.Zero, riskError(RiskMaxOrderNotional, limits.MaxOrderNotional, value, "order is worth %s, more than the %s limit per order", value, limits.MaxOrderNotional)
+	}
+	return value, nil
+}
+
+// what o is worth in quote: at its limit or stop price, or for market orders at
+// reference and at most their budget. False if it overflows.
+func (o *Order) notional(reference decimal.Decimal) (decimal.Decimal, bool) {
+	switch {
+	case o.hasLimitPrice():
+		return o.Price.MulChecked(o.Size)
+	case o.IsStop():
+		return o.StopPrice.MulChecked(o.Size)
+	}
+
+	value, ok := reference.MulChecked(o.Size)
+	if o.MaxNotional.IsPositive() && (!ok || o.Size.IsZero() || o.MaxNotional.Cmp(value) < 0) {
+		return o.MaxNotional, true
+	}
+	return value, ok
+}
+
+// what a resting or pending order still has open is worth
+func (o *Order) openNotional() (decimal.Decimal, bool) {
+	price := o.Price
+	if o.OrderType == StopMarketOrder {
+		price = o.StopPrice
+	}
+	return price.MulChecked(o.Remaining())
+}
@@ -0,0 +1,111 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/EggsyOnCode/velho-exchange/auth"
+	"github.com/EggsyOnCode/velho-exchange/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRiskChecks(t *testing.T) {
+	ex := NewExchange()
+	limits := RiskLimits{
+		PriceBandBps:     1000,
+		PriceReference:   ReferenceMid,
+		MaxOrderNotional: decimal.FromInt(50_000),
+		MaxUserNotional:  decimal.FromInt(100_000),
+	}
+	require.NoError(t, ex.SetRiskLimits(BTC, limits))
+	assert.Error(t, ex.SetRiskLimits(BTC, RiskLimits{PriceBandBps: -1}))
+	assert.Error(t, ex.SetRiskLimits(BTC, RiskLimits{PriceReference: "VWAP"}))
+	assert.Error(t, ex.SetRiskLimits(BTC, RiskLimits{MaxOrderNotional: decimal.FromInt(-1)}))
+	assert.ErrorIs(t, ex.SetRiskLimits("DOGE", limits), ErrMarketNotFound)
+
+	buyer := auth.NewUser(nil, decimal.FromInt(1_000_000))
+	seller := auth.NewUser(nil, decimal.Zero)
+	ex.AddUser(buyer)
+	ex.AddUser(seller)
+	ex.Ledger.Deposit(seller.ID.String(), AssetBTC, decimal.FromInt(100), "test")
+
+	rejection := func(err error) RiskReason {
+		t.Helper()
+		var riskErr *RiskError
+		require.ErrorAs(t, err, &riskErr)
+		assert.ErrorIs(t, err, ErrRiskCheck)
+		return riskErr.Reason
+	}
+	bid := func(size, price string) (string, error) {
+		o := NewOrder(decimal.RequireFromString(size), true, decimal.RequireFromString(price), buyer.ID.String())
+		_, err := ex.PlaceOrder(BTC, o)
+		return o.ID.String(), err
+	}
+
+	// there's no band until the book has a reference price
+	first, err := bid("1", "90")
+	require.NoError(t, err)
+	_, err = ex.PlaceOrder(BTC, NewOrder(decimal.FromInt(1), false, decimal.FromInt(110), seller.ID.String()))
+	require.NoError(t, err)
+	assert.Equal(t, decimal.FromInt(100), ex.OrderBook[BTC].ReferencePrice())
+
+	_, err = bid("1", "89.99")
+	assert.Equal(t, RiskPriceOutsideBand, rejection(err))
+	_, err = bid("1", "0")
+	assert.Equal(t, RiskInvalidPrice, rejection(err))
+	_, err = bid("1", "95.001")
+	assert.Equal(t, RiskPriceOffTick, rejection(err))
+	_, err = bid("0.00001", "95")
+	assert.Equal(t, RiskInvalidSize, rejection(err))
+
+	_, err = bid("600", "95")
+	assert.Equal(t, RiskMaxOrderNotional, rejection(err))
+	var riskErr *RiskError
+	require.ErrorAs(t, err, &riskErr)
+	assert.Equal(t, decimal.FromInt(50_000), riskErr.Limit)
+	assert.Equal(t, decimal.FromInt(57_000), riskErr.Value)
+
+	// market orders are valued at the reference price
+	_, err = ex.PlaceOrder(BTC, NewMarketOrder(decimal.FromInt(600), true, buyer.ID.String()))
+	assert.Equal(t, RiskMaxOrderNotional, rejection(err))
+
+	// and their bounds have to be in range
+	market := NewMarketOrder(decimal.FromInt(1), true, buyer.ID.String())
+	market.MaxSlippageBps = MaxSlippageBps + 1
+	_, err = ex.PlaceOrder(BTC, market)
+	assert.Equal(t, RiskInvalidProtection, rejection(err))
+	market = NewMarketOrder(decimal.FromInt(1), false, seller.ID.String())
+	market.WorstPrice = decimal.FromInt(-1)
+	_, err = ex.PlaceOrder(BTC, market)
+	assert.Equal(t, RiskInvalidProtection, rejection(err))
+
+	// the user's open orders on the market count against their notional
+	_, err = bid("500", "100")
+	require.NoError(t, err)
+	_, err = bid("500", "100")
+	assert.Equal(t, RiskMaxUserNotional, rejection(err))
+
+	// amendments are checked in place of the order they replace
+	_, err = ex.AmendOrder(BTC, buyer.ID.String(), first, decimal.FromInt(200), decimal.FromInt(1))
+	assert.Equal(t, RiskPriceOutsideBand, rejection(err))
+	_, err = ex.AmendOrder(BTC, buyer.ID.String(), first, decimal.FromInt(95), decimal.FromInt(1))
+	assert.NoError(t, err)
+
+	// a notional too large to compute is rejected rather than overflowing
+	require.NoError(t, ex.SetRiskLimits(BTC, RiskLimits{}))
+	_, err = bid("1000", "1000000000")
+	assert.Equal(t, RiskMaxOrderNotional, rejection(err))
+
+	// the last price is the reference once something traded
+	require.NoError(t, ex.SetRiskLimits(BTC, RiskLimits{PriceBandBps: 1000, PriceReference: ReferenceLast}))
+	_, err = ex.PlaceOrder(BTC, NewOrder(decimal.FromInt(1), false, decimal.FromInt(100), seller.ID.String()))
+	require.NoError(t, err)
+	assert.Equal(t, decimal.FromInt(100), ex.OrderBook[BTC].CurrentPrice)
+	_, err = bid("1", "111")
+	assert.Equal(t, RiskPriceOutsideBand, rejection(err))
+
+	restored := NewExchange()
+	require.NoError(t, restored.Restore(ex.Snapshot()))
+	assert.Equal(t, ReferenceLast, restored.OrderBook[BTC].Spec.Risk.PriceReference)
+	assert.Equal(t, int64(1000), restored.OrderBook[BTC].Spec.Risk.PriceBandBps)
+}
@@ -0,0 +1,121 @@
+package core
+
+import (
+	"fmt"
+
+	"github.com/EggsyOnCode/velho-exchange/decimal"
+	"github.com/sirupsen/logrus"
+)
+
+// SelfTradePrevention decides what happens when an incoming order would match a
+// resting order of the same user, the incoming (taker) order's mode applies
+type SelfTradePrevention string
+
+const (
+	// self trades are allowed (default)
+	STPNone SelfTradePrevention = ""
+	// the incoming order's remainder is cancelled, the resting order stays
+	STPCancelNewest SelfTradePrevention = "CANCEL_NEWEST"
+	// the resting order is cancelled and matching goes on
+	STPCancelOldest SelfTradePrevention = "CANCEL_OLDEST"
+	// both the resting order and the incoming order's remainder are cancelled
+	STPCancelBoth SelfTradePrevention = "CANCEL_BOTH"
+	// both orders are reduced by the size they overlap, whichever is left empty is cancelled
+	STPDecrementAndCancel SelfTradePrevention = "DECREMENT_AND_CANCEL"
+)
+
+func (m SelfTradePrevention) Validate() error {
+	switch m {
+	case STPNone, STPCancelNewest, STPCancelOldest, STPCancelBoth, STPDecrementAndCancel:
+		return nil
+	}
+	return fmt.Errorf("unknown self trade prevention mode %q", m)
+}
+
+// whether the incoming order's remainder is cancelled once it reaches its user's own order
+func (m SelfTradePrevention) CancelsIncoming() bool {
+	return m == STPCancelNewest || m == STPCancelBoth
+}
+
+// SelfTrade is a match that self-trade prevention stopped from happening,
+// it is never recorded as a Trade
+type SelfTrade struct {
+	// the resting order of the same user
+	Resting *Order
+	// size the two orders would have traded
+	Size decimal.Decimal
+	// size taken off the resting order, its custody has to be released
+	Released decimal.Decimal
+	// whether the resting order left the book
+	Removed bool
+}
+
+// the order's own mode, or its user's default when it has none
+func (ob *OrderBook) selfTradePrevention(o *Order) SelfTradePrevention {
+	if o.SelfTradePrevention == STPNone && ob.Exchange != nil {
+		return ob.Exchange.SelfTradePrevention(o.UserID)
+	}
+	return o.SelfTradePrevention
+}
+
+// applies o's self-trade prevention mode against order, a resting order of the same user
+func (l *Limit) preventSelfTrade(o, order *Order, now int64) SelfTrade {
+	st := SelfTrade{
+		Resting: order,
+		Size:    decimal.Min(o.Remaining(), order.Remaining()),
+	}
+	o.SelfTradePrevented = o.SelfTradePrevented.Add(st.Size)
+
+	switch o.SelfTradePrevention {
+	case STPCancelNewest:
+		o.Size = decimal.Zero
+	case STPCancelOldest:
+		st.Released, st.Removed = order.Remaining(), true
+		l.RemoveOrders([]*Order{order})
+	case STPCancelBoth:
+		st.Released, st.Removed = order.Remaining(), true
+		l.RemoveOrders([]*Order{order})
+		o.Size = decimal.Zero
+	case STPDecrementAndCancel:
+		// the visible slice goes first, then an iceberg's reserve
+		visible := decimal.Min(order.Size, st.Size)
+		hidden := st.Size.Sub(visible)
+		order.Size = order.Size.Sub(visible)
+		order.Hidden = order.Hidden.Sub(hidden)
+		l.TotalVolume = l.TotalVolume.Sub(visible)
+		l.HiddenVolume = l.HiddenVolume.Sub(hidden)
+		o.Size = o.Size.Sub(st.Size)
+		st.Released = st.Size
+
+		if order.IsFilled() {
+			st.Removed = true
+			l.Orders.Remove(order.Timestamp)
+		} else if order.Size.IsZero() {
+			l.replenish(order, now)
+		}
+	}
+
+	return st
+}
+
+// takes the orders cancelled or reduced by self-trade prevention off the book and
+// hands the released size back to their owners
+func (ob *OrderBook) settleSelfTrades(selfTrades []SelfTrade) {
+	for _, st := range selfTrades {
+		if st.Removed {
+			delete(ob.OrdersMap, st.Resting.ID)
+		}
+
+		if st.Released.IsPositive() {
+			ob.releaseCustody(st.Resting, st.Released)
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"id":       st.Resting.ID,
+			"userId":   st.Resting.UserID,
+			"size":     st.Size,
+			"released": st.Released,
+			"removed":  st.Removed,
+		}).Info("self trade prevented")
+	}
+}
@@ -0,0 +1,188 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+
+	"github.com/EggsyOnCode/velho-exchange/decimal"
+	"github.com/sirupsen/logrus"
+)
+
+// Every listed market has a sequencer: one goroutine that takes the requests for
+// the market off a channel and handles them one at a time, so it's the only one
+// touching the book's trees and maps. Commands that change a book are applied by
+// its sequencer, which then publishes what they changed to the market data feed
+// (marketdata.go); reads of a book (ReadBook) run on it between them.
+//
+// Matching moves funds between accounts every market shares, and the
+// write-ahead log has to hold commands in the order they were applied, so a
+// sequencer logs and applies a command holding the command lock like every other
+// command does. Account state (users, balances, the order index) is only changed
+// under that lock, which is what reads of it across markets take too.
+
+// ErrRequestPanicked is what a request or command fails with if handling it
+// panicked, the exchange carries on with the next one
+var ErrRequestPanicked = errors.New("request failed unexpectedly")
+
+// how many requests can wait for a market's sequencer before submitting blocks
+const sequencerBacklog = 256
+
+// a command to apply, or a read of the book
+type request struct {
+	typ  CommandType
+	cmd  command
+	read func(ob *OrderBook)
+
+	err  error
+	done chan struct{}
+}
+
+func newRequest() *request {
+	return &request{done: make(chan struct{})}
+}
+
+func (r *request) finish(err error) {
+	r.err = err
+	close(r.done)
+}
+
+type sequencer struct {
+	market   Market
+	requests chan *request
+}
+
+// starts the sequencer of market, ex.marketsMu is held
+func (ex *Exchange) startSequencerLocked(market Market) {
+	if _, ok := ex.sequencers[market]; ok {
+		return
+	}
+	s := &sequencer{market: market, requests: make(chan *request, sequencerBacklog)}
+	ex.sequencers[market] = s
+	go s.run(ex)
+}
+
+func (s *sequencer) run(ex *Exchange) {
+	for req := range s.requests {
+		s.handle(ex, req)
+	}
+}
+
+// handles req, a panic fails it instead of taking the exchange down
+func (s *sequencer) handle(ex *Exchange, req *request) {
+	defer func() {
+		if r := recover(); r != nil {
+			logrus.WithFields(logrus.Fields{
+				"market": s.market,
+				"type":   req.typ,
+				"panic":  r,
+				"stack":  string(debug.Stack()),
+			}).Error("sequencer request panicked")
+			req.finish(fmt.Errorf("%w: %v", ErrRequestPanicked, r))
+		}
+	}()
+
+	if req.cmd != nil {
+		err := ex.logAndApply(req.typ, req.cmd)
+		// subscribers hear of the command before its submitter does
+		if ob, _ := ex.Market(s.market); ob != nil {
+			ob.publishMarketData()
+		}
+		req.finish(err)
+		return
+	}
+
+	// the book is looked up as it's read, a restored exchange has new ones
+	ob, err := ex.Market(s.market)
+	if err == nil {
+		req.read(ob)
+	}
+	req.finish(err)
+}
+
+// hands req to the sequencer of market, it's finished right away if there's none
+func (ex *Exchange) submit(market Market, req *request) *request {
+	ex.marketsMu.RLock()
+	s, ok := ex.sequencers[market]
+	ex.marketsMu.RUnlock()
+
+	if !ok {
+		req.finish(fmt.Errorf("%w: %q", ErrMarketNotFound, market))
+		return req
+	}
+	s.requests <- req
+	return req
+}
+
+// ReadBook runs read on the sequencer of market, between its commands. read
+// mustn't keep what it's handed: the book only holds still while it runs.
+func (ex *Exchange) ReadBook(market Market, read func(ob *OrderBook)) error {
+	req := newRequest()
+	req.read = read
+	req = ex.submit(market, req)
+	<-req.done
+	return req.err
+}
+
+// Future is the response to a request handed to a market's sequencer, it's ready
+// once the sequencer got to the request
+type Future[T any] struct {
+	req    *request
+	result func() T
+}
+
+// Done is closed once the request was handled
+func (f *Future[T]) Done() <-chan struct{} {
+	return f.req.done
+}
+
+// Wait blocks until the request was handled and returns its result
+func (f *Future[T]) Wait() (T, error) {
+	<-f.req.done
+	return f.result(), f.req.err
+}
+
+// WaitContext is Wait that gives up once ctx is done, the request is handled either way
+func (f *Future[T]) WaitContext(ctx context.Context) (T, error) {
+	select {
+	case <-f.req.done:
+		return f.result(), f.req.err
+	case <-ctx.Done():
+		var zero T
+		return zero, ctx.Err()
+	}
+}
+
+// OrderResult is what placing or amending an order came to: the order as the
+// command left it, copied so it can be read while the book moves on, and the
+// fills it got
+type OrderResult struct {
+	Order   Order
+	Matches []Match
+}
+
+// SubmitOrder hands o to the sequencer of market without waiting for it to be
+// placed, see PlaceOrder. o belongs to the book once it's submitted, the result's
+// copy is what's read.
+func (ex *Exchange) SubmitOrder(market Market, o *Order) *Future[OrderResult] {
+	cmd := newPlaceOrderCommand(market, o)
+	return submitCommand(ex, CmdPlaceOrder, cmd, func() OrderResult {
+		return OrderResult{Order: cmd.placed, Matches: cmd.matches}
+	})
+}
+
+// SubmitAmend hands an amendment of userID's order to the sequencer of market
+// without waiting for it, see AmendOrder
+func (ex *Exchange) SubmitAmend(market Market, userID, orderID string, price, size decimal.Decimal) *Future[OrderResult] {
+	cmd := &amendOrderCommand{Market: market, UserID: userID, OrderID: orderID, Price: price, Size: size}
+	return submitCommand(ex, CmdAmendOrder, cmd, func() OrderResult {
+		return OrderResult{Order: cmd.amended, Matches: cmd.matches}
+	})
+}
+
+func submitCommand[T any](ex *Exchange, typ CommandType, cmd marketCommand, result func() T) *Future[T] {
+	req := newRequest()
+	req.typ, req.cmd = typ, cmd
+	return &Future[T]{req: ex.submit(cmd.market(), req), result: result}
+}
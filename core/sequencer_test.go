@@ -0,0 +1,182 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/EggsyOnCode/velho-exchange/auth"
+	"github.com/EggsyOnCode/velho-exchange/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// run with -race: traders on both markets, readers of books and accounts, a new
+// market and snapshots all at once
+func TestSequencersUnderLoad(t *testing.T) {
+	dir := t.TempDir()
+	ex := NewExchange()
+	require.NoError(t, ex.Recover(filepath.Join(dir, "snapshot.json"), filepath.Join(dir, "commands.wal"), WALConfig{Sync: SyncNever}))
+	defer ex.CloseWAL()
+
+	var traders []string
+	for i := 0; i < 4; i++ {
+		user := auth.NewUser(nil, decimal.FromInt(10_000_000))
+		require.NoError(t, ex.AddUser(user))
+		deposit(t, ex, user.ID.String(), AssetETH, 50)
+		deposit(t, ex, user.ID.String(), AssetBTC, 50)
+		traders = append(traders, user.ID.String())
+	}
+
+	var wg sync.WaitGroup
+	feed := NewSubscriber(16)
+	for _, channel := range []FeedChannel{FeedDepth, FeedTrades, FeedTicker} {
+		require.NoError(t, ex.Subscribe(feed, ETH, channel))
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for range feed.Messages() {
+		}
+	}()
+
+	for _, market := range []Market{ETH, BTC} {
+		for i, userID := range traders {
+			wg.Add(1)
+			go func(market Market, userID string, bid bool) {
+				defer wg.Done()
+				for j := 0; j < 50; j++ {
+					o := NewOrder(decimal.FromInt(1), bid, decimal.FromInt(int64(990+j%20)), userID)
+					result, err := ex.SubmitOrder(market, o).Wait()
+					if !assert.NoError(t, err) {
+						return
+					}
+					if result.Order.IsFilled() {
+						continue
+					}
+					switch j % 3 {
+					case 0:
+						// it may have been filled meanwhile too
+						err := ex.CancelOrder(market, o.ID.String())
+						assert.True(t, err == nil || errors.Is(err, ErrOrderNotFound), "cancel: %v", err)
+					case 1:
+						// it may have been filled meanwhile
+						ex.AmendOrder(market, userID, o.ID.String(), result.Order.Price, decimal.RequireFromString("0.5"))
+					}
+				}
+			}(market, userID, i%2 == 0)
+		}
+	}
+
+	readers := []func(){
+		func() {
+			ex.ReadBook(ETH, func(ob *OrderBook) {
+				ob.Bids.Each(func(price decimal.Decimal, l *Limit) { l.Orders.Size() })
+				ob.GetTrades()
+			})
+		},
+		func() { ex.GetOrders(traders[0]) },
+		func() { ex.User(traders[1]) },
+		func() { ex.Ledger.Balances(traders[2]) },
+		func() { ex.UserTrades(traders[3]) },
+		func() { ex.MarketSpec(BTC) },
+		func() { ex.Snapshot() },
+	}
+	for _, read := range readers {
+		wg.Add(1)
+		go func(read func()) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				read()
+			}
+		}(read)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		spec := DefaultMarketSpecs[ETH]
+		spec.Base = "SOL"
+		_, err := ex.CreateMarket("SOL", spec)
+		assert.NoError(t, err)
+		assert.NoError(t, ex.SetMarketStatus("SOL", MarketHalted))
+		assert.NoError(t, ex.SetFeeSchedule(BTC, DefaultFeeSchedule))
+		_, err = ex.WriteSnapshot(filepath.Join(dir, "snapshot.json"))
+		assert.NoError(t, err)
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10; i++ {
+			ex.PublishDepthSnapshots()
+		}
+		feed.Close()
+	}()
+
+	wg.Wait()
+
+	assert.NoError(t, ex.Ledger.Check())
+	// the log holds the commands in the order they were applied
+	assert.NoError(t, ex.VerifySnapshot())
+}
+
+func TestSequencerRejectsUnknownMarket(t *testing.T) {
+	ex := NewExchange()
+
+	_, err := ex.SubmitOrder("DOGE", NewOrder(decimal.FromInt(1), true, decimal.FromInt(1), "user")).Wait()
+	assert.ErrorIs(t, err, ErrMarketNotFound)
+	assert.ErrorIs(t, ex.ReadBook("DOGE", func(ob *OrderBook) {}), ErrMarketNotFound)
+	assert.ErrorIs(t, ex.CancelOrder("DOGE", "id"), ErrMarketNotFound)
+}
+
+func TestFutureWaitContext(t *testing.T) {
+	ex := NewExchange()
+	user := auth.NewUser(nil, decimal.FromInt(1_000))
+	require.NoError(t, ex.AddUser(user))
+
+	// the sequencer is busy until the read returns
+	busy, release := make(chan struct{}), make(chan struct{})
+	go ex.ReadBook(ETH, func(ob *OrderBook) {
+		close(busy)
+		<-release
+	})
+	<-busy
+
+	o := NewOrder(decimal.FromInt(1), true, decimal.FromInt(100), user.ID.String())
+	future := ex.SubmitOrder(ETH, o)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := future.WaitContext(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	// the order is placed all the same
+	close(release)
+	result, err := future.Wait()
+	require.NoError(t, err)
+	assert.Equal(t, o.ID, result.Order.ID)
+	assert.Equal(t, decimal.FromInt(100), result.Order.Price)
+	orders, _ := ex.GetOrders(user.ID.String())
+	assert.Len(t, orders, 1)
+}
+
+type panicCommand struct{}
+
+func (c *panicCommand) market() Market { return ETH }
+
+func (c *panicCommand) apply(ex *Exchange) error { panic("boom") }
+
+func TestSequencerRecoversFromPanics(t *testing.T) {
+	ex := NewExchange()
+
+	assert.ErrorIs(t, ex.execute("PANIC", &panicCommand{}), ErrRequestPanicked)
+	assert.ErrorIs(t, ex.ReadBook(ETH, func(ob *OrderBook) { panic("boom") }), ErrRequestPanicked)
+
+	// the market's sequencer and the command lock are still there for the next requests
+	user := auth.NewUser(nil, decimal.FromInt(1_000))
+	require.NoError(t, ex.AddUser(user))
+	_, err := ex.PlaceOrder(ETH, NewOrder(decimal.FromInt(1), true, decimal.FromInt(100), user.ID.String()))
+	assert.NoError(t, err)
+}
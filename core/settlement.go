@@ -0,0 +1,209 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/EggsyOnCode/velho-exchange/auth"
+	"github.com/EggsyOnCode/velho-exchange/decimal"
+	"github.com/sirupsen/logrus"
+)
+
+type TransferStatus string
+
+const (
+	// queued, or sent and waiting for its transaction to be confirmed
+	TransferPending   TransferStatus = "PENDING"
+	TransferConfirmed TransferStatus = "CONFIRMED"
+	// given up on after too many failed attempts
+	TransferFailed TransferStatus = "FAILED"
+)
+
+// Transfer moves an asset between a user's own wallet and the exchange's custody.
+// The ledger has already recorded it by the time it's queued for settlement.
+type Transfer struct {
+	ID     uint64          `json:"id"`
+	Asset  Asset           `json:"asset"`
+	UserID string          `json:"user_id"`
+	Amount decimal.Decimal `json:"amount"`
+	// into the exchange's custody, out of it to the user otherwise
+	ToExchange bool `json:"to_exchange"`
+	// where a transfer out of custody is sent, the user's wallet when it's empty
+	Address string         `json:"address,omitempty"`
+	Status  TransferStatus `json:"status"`
+	// the transaction carrying the transfer, shared with the rest of its batch
+	TxID     string `json:"tx_id,omitempty"`
+	Attempts int    `json:"attempts"`
+	// why the last attempt failed
+	Error string `json:"error,omitempty"`
+	// unix nanos
+	CreatedAt int64 `json:"created_at"`
+	UpdatedAt int64 `json:"updated_at"`
+	// when a failed attempt is retried, unix nanos
+	RetryAt int64 `json:"retry_at,omitempty"`
+}
+
+// Batch is what a backend sends as one transaction: every queued transfer of an
+// asset between the same user's wallet and the exchange's, in the same direction
+type Batch struct {
+	Asset      Asset
+	User       *auth.User
+	ToExchange bool
+	// the transfers' Address
+	Address string
+	// sum of the transfers' amounts
+	Amount    decimal.Decimal
+	Transfers []uint64
+}
+
+// Settlement carries transfers out on whatever holds an asset, e.g. a chain.
+// Each asset is settled by the backend registered for it (see
+// Exchange.RegisterSettlement), an in-memory one by default.
+type Settlement interface {
+	// Send broadcasts b as a single transaction and returns its id
+	Send(b Batch) (string, error)
+	// Status reports whether transaction txID is still pending, confirmed or failed
+	Status(txID string) (TransferStatus, error)
+}
+
+// MemorySettlement keeps wallets in memory, it's the default backend and needs
+// nothing running. Wallets have no funds to check against, so it accepts every
+// transfer and a wallet's balance is only what it got from the exchange minus
+// what it sent. Transactions are confirmed as soon as they're sent.
+type MemorySettlement struct {
+	mu      sync.Mutex
+	wallets map[string]decimal.Decimal
+	custody decimal.Decimal
+	sent    int
+}
+
+func NewMemorySettlement() *MemorySettlement {
+	return &MemorySettlement{
+		wallets: make(map[string]decimal.Decimal),
+	}
+}
+
+func (s *MemorySettlement) Send(b Batch) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := b.User.ID.String()
+	if b.Address != "" {
+		id = b.Address
+	}
+	if b.ToExchange {
+		s.wallets[id] = s.wallets[id].Sub(b.Amount)
+		s.custody = s.custody.Add(b.Amount)
+	} else {
+		s.wallets[id] = s.wallets[id].Add(b.Amount)
+		s.custody = s.custody.Sub(b.Amount)
+	}
+	s.sent++
+
+	return fmt.Sprintf("memory-%d", s.sent), nil
+}
+
+func (s *MemorySettlement) Status(txID string) (TransferStatus, error) {
+	return TransferConfirmed, nil
+}
+
+// Wallet is what a user's wallet, or any other address withdrawn to, holds
+func (s *MemorySettlement) Wallet(userIDOrAddress string) decimal.Decimal {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.wallets[userIDOrAddress]
+}
+
+// Custody is what the exchange's wallet holds
+func (s *MemorySettlement) Custody() decimal.Decimal {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.custody
+}
+
+// RegisterSettlement makes backend settle every transfer of asset from now on
+func (ex *Exchange) RegisterSettlement(asset Asset, backend Settlement) {
+	ex.settler.register(asset, backend)
+}
+
+// Settlement returns the backend transfers of asset are settled with
+func (ex *Exchange) Settlement(asset Asset) Settlement {
+	return ex.settler.backend(asset)
+}
+
+// SetSettlementConfig changes how transfers are batched and retried
+func (ex *Exchange) SetSettlementConfig(config SettlementConfig) {
+	ex.settler.setConfig(config)
+}
+
+// OpenSettlementJournal makes the settlement queue durable: every change to a
+// transfer is appended to the file at path, and the transfers it already holds
+// are loaded back so the unfinished ones are settled. It has to be opened before
+// anything is traded.
+func (ex *Exchange) OpenSettlementJournal(path string) error {
+	return ex.settler.openJournal(path)
+}
+
+// WaitSettled blocks until no transfer is pending anymore
+func (ex *Exchange) WaitSettled() {
+	ex.settler.wait()
+}
+
+// Transfer returns the transfer with the given ID
+func (ex *Exchange) Transfer(id uint64) (Transfer, bool) {
+	ex.settler.mu.Lock()
+	defer ex.settler.mu.Unlock()
+
+	t, ok := ex.settler.transfers[id]
+	if !ok {
+		return Transfer{}, false
+	}
+	return *t, true
+}
+
+// Transfers returns the transfers of userID, or everyone's when it's empty, oldest first
+func (ex *Exchange) Transfers(userID string) []Transfer {
+	ex.settler.mu.Lock()
+	defer ex.settler.mu.Unlock()
+
+	transfers := make([]Transfer, 0)
+	for _, t := range ex.settler.transfers {
+		if userID == "" || t.UserID == userID {
+			transfers = append(transfers, *t)
+		}
+	}
+	sort.Slice(transfers, func(i, j int) bool { return transfers[i].ID < transfers[j].ID })
+
+	return transfers
+}
+
+// queues amount of asset to be settled between userID's wallet and the exchange's
+func (ex *Exchange) submitTransfer(userID string, asset Asset, amount decimal.Decimal, toExchange bool) error {
+	_, err := ex.queueTransfer(Transfer{
+		Asset:      asset,
+		UserID:     userID,
+		Amount:     amount,
+		ToExchange: toExchange,
+	})
+	return err
+}
+
+func (ex *Exchange) queueTransfer(t Transfer) (Transfer, error) {
+	if _, ok := ex.Users[t.UserID]; !ok {
+		return Transfer{}, fmt.Errorf("user %s not found", t.UserID)
+	}
+
+	t = ex.settler.submit(t)
+
+	logrus.WithFields(logrus.Fields{
+		"id":         t.ID,
+		"asset":      t.Asset,
+		"userId":     t.UserID,
+		"amount":     t.Amount,
+		"toExchange": t.ToExchange,
+		"address":    t.Address,
+	}).Info("transfer queued")
+
+	return t, nil
+}
@@ -0,0 +1,133 @@
+package core
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"errors"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/EggsyOnCode/velho-exchange/internals"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// EthClient is the part of a JSON-RPC client EthSettlement uses, satisfied by
+// *ethclient.Client as well as go-ethereum's simulated backend client
+type EthClient interface {
+	ChainID(ctx context.Context) (*big.Int, error)
+	PendingNonceAt(ctx context.Context, account common.Address) (uint64, error)
+	SuggestGasPrice(ctx context.Context) (*big.Int, error)
+	SendTransaction(ctx context.Context, tx *types.Transaction) error
+	TransactionReceipt(ctx context.Context, txHash common.Hash) (*types.Receipt, error)
+}
+
+const (
+	// gas of a plain value transfer
+	ethTransferGas = 21_000
+	ethCallTimeout = 10 * time.Second
+)
+
+// wei in one unit of decimal.Decimal's smallest step (1e-8 ETH)
+var weiPerUnit = big.NewInt(10_000_000_000)
+
+// EthSettlement transfers ETH between users' addresses and the exchange's.
+// Nonces are kept locally per sending address, they're only read from the node
+// the first time an address sends and after a send failed.
+type EthSettlement struct {
+	client     EthClient
+	privateKey *ecdsa.PrivateKey
+	// users' keys, unlocked to sign what's sent from their addresses
+	keys *Keystore
+
+	mu      sync.Mutex
+	chainID *big.Int
+	nonces  map[common.Address]uint64
+}
+
+// privateKey is the exchange's wallet, where custody is held, keys holds the
+// users' (see Exchange.Keystore)
+func NewEthSettlement(client EthClient, privateKey *ecdsa.PrivateKey, keys *Keystore) *EthSettlement {
+	return &EthSettlement{
+		client:     client,
+		privateKey: privateKey,
+		keys:       keys,
+		nonces:     make(map[common.Address]uint64),
+	}
+}
+
+func (s *EthSettlement) Send(b Batch) (string, error) {
+	fromAddr, to := b.User.Address, internals.GetAddress(s.privateKey)
+	if !b.ToExchange {
+		fromAddr, to = internals.GetAddress(s.privateKey), b.User.Address
+		if b.Address != "" {
+			to = common.HexToAddress(b.Address)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ethCallTimeout)
+	defer cancel()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.chainID == nil {
+		chainID, err := s.client.ChainID(ctx)
+		if err != nil {
+			return "", err
+		}
+		s.chainID = chainID
+	}
+
+	nonce, ok := s.nonces[fromAddr]
+	if !ok {
+		var err error
+		if nonce, err = s.client.PendingNonceAt(ctx, fromAddr); err != nil {
+			return "", err
+		}
+	}
+	gasPrice, err := s.client.SuggestGasPrice(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	wei := new(big.Int).Mul(big.NewInt(int64(b.Amount)), weiPerUnit)
+	tx := types.NewTransaction(nonce, to, wei, ethTransferGas, gasPrice, nil)
+	signer := types.LatestSignerForChainID(s.chainID)
+	if b.ToExchange {
+		tx, err = s.keys.SignTx(fromAddr, tx, signer)
+	} else {
+		tx, err = types.SignTx(tx, signer, s.privateKey)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if err := s.client.SendTransaction(ctx, tx); err != nil {
+		// the local nonce may be stale, it's read from the node again next time
+		delete(s.nonces, fromAddr)
+		return "", err
+	}
+	s.nonces[fromAddr] = nonce + 1
+
+	return tx.Hash().Hex(), nil
+}
+
+func (s *EthSettlement) Status(txID string) (TransferStatus, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), ethCallTimeout)
+	defer cancel()
+
+	receipt, err := s.client.TransactionReceipt(ctx, common.HexToHash(txID))
+	if errors.Is(err, ethereum.NotFound) {
+		return TransferPending, nil
+	} else if err != nil {
+		return "", err
+	}
+
+	if receipt.Status != types.ReceiptStatusSuccessful {
+		return TransferFailed, nil
+	}
+	return TransferConfirmed, nil
+}
@@ -0,0 +1,347 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/EggsyOnCode/velho-exchange/auth"
+	"github.com/EggsyOnCode/velho-exchange/decimal"
+	"github.com/EggsyOnCode/velho-exchange/internals"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// blocks every batch until release is closed, fails them while fail is set
+type blockingSettlement struct {
+	release chan struct{}
+	mu      sync.Mutex
+	fail    error
+	sent    []Batch
+}
+
+func (s *blockingSettlement) Send(b Batch) (string, error) {
+	<-s.release
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fail != nil {
+		return "", s.fail
+	}
+	s.sent = append(s.sent, b)
+	return "tx", nil
+}
+
+func (s *blockingSettlement) Status(txID string) (TransferStatus, error) {
+	return TransferConfirmed, nil
+}
+
+func TestSettlementDefaultsToMemory(t *testing.T) {
+	ex := NewExchange()
+	ob := ex.OrderBook[BTC]
+
+	seller := auth.NewUser(nil, decimal.Zero)
+	buyer := auth.NewUser(nil, decimal.FromInt(1_000))
+	ex.AddUser(seller)
+	ex.AddUser(buyer)
+	deposit(t, ex, seller.ID.String(), AssetBTC, 3)
+
+	ob.PlaceLimitOrder(decimal.FromInt(100), NewOrder(decimal.FromInt(3), false, decimal.FromInt(100), seller.ID.String()))
+	ob.PlaceLimitOrder(decimal.FromInt(100), NewOrder(decimal.FromInt(2), true, decimal.FromInt(100), buyer.ID.String()))
+	ex.WaitSettled()
+
+	// the seller's tokens were deposited, only the buyer's are sent
+	wallets := ex.Settlement(AssetBTC).(*MemorySettlement)
+	assert.Equal(t, decimal.Zero, wallets.Wallet(seller.ID.String()))
+	assert.Equal(t, decimal.FromInt(2), wallets.Wallet(buyer.ID.String()))
+	assert.Equal(t, decimal.FromInt(-2), wallets.Custody())
+	assert.Equal(t, decimal.FromInt(1), ex.Ledger.Held(AssetBTC))
+
+	for _, transfer := range ex.Transfers("") {
+		assert.Equal(t, TransferConfirmed, transfer.Status)
+		assert.NotEmpty(t, transfer.TxID)
+	}
+	assert.Len(t, ex.Transfers(buyer.ID.String()), 1)
+
+	// every asset has its own backend
+	assert.NotSame(t, ex.Settlement(AssetBTC), ex.Settlement(AssetETH))
+}
+
+func TestSettlementDoesNotHoldUpMatching(t *testing.T) {
+	ex := NewExchange()
+	ob := ex.OrderBook[BTC]
+	backend := &blockingSettlement{release: make(chan struct{})}
+	ex.RegisterSettlement(AssetBTC, backend)
+
+	seller := auth.NewUser(nil, decimal.Zero)
+	buyer := auth.NewUser(nil, decimal.FromInt(1_000))
+	ex.AddUser(seller)
+	ex.AddUser(buyer)
+	deposit(t, ex, seller.ID.String(), AssetBTC, 3)
+
+	// the backend is stuck, the book and the ledger still move on
+	ob.PlaceLimitOrder(decimal.FromInt(100), NewOrder(decimal.FromInt(3), false, decimal.FromInt(100), seller.ID.String()))
+	matches, err := ob.PlaceLimitOrder(decimal.FromInt(100), NewOrder(decimal.FromInt(2), true, decimal.FromInt(100), buyer.ID.String()))
+	assert.NoError(t, err)
+	assert.Len(t, matches, 1)
+	assert.Equal(t, decimal.FromInt(200), seller.USD)
+
+	close(backend.release)
+	ex.WaitSettled()
+
+	// the buyer's tokens are paid out once it's back
+	assert.Len(t, backend.sent, 1)
+	assert.False(t, backend.sent[0].ToExchange)
+	assert.Equal(t, buyer.ID, backend.sent[0].User.ID)
+	assert.Equal(t, decimal.FromInt(2), backend.sent[0].Amount)
+}
+
+func TestSettlementBatchesTransfersPerWallet(t *testing.T) {
+	s := newSettler(nil)
+	s.setConfig(SettlementConfig{MaxBatch: 2, MaxAttempts: 1, Backoff: time.Millisecond, MaxBackoff: time.Millisecond, PollInterval: time.Millisecond})
+	backend := &blockingSettlement{release: make(chan struct{})}
+	close(backend.release)
+	s.register(AssetBTC, backend)
+
+	alice := auth.NewUser(nil, decimal.Zero)
+	bob := auth.NewUser(nil, decimal.Zero)
+
+	// nothing is sent until the wallets are known, so everything queues up
+	for _, amount := range []int64{1, 2, 3} {
+		s.submit(Transfer{Asset: AssetBTC, UserID: alice.ID.String(), Amount: decimal.FromInt(amount)})
+	}
+	s.submit(Transfer{Asset: AssetBTC, UserID: alice.ID.String(), Amount: decimal.FromInt(4), ToExchange: true})
+	s.submit(Transfer{Asset: AssetBTC, UserID: bob.ID.String(), Amount: decimal.FromInt(5)})
+
+	s.mu.Lock()
+	s.users[alice.ID.String()] = alice
+	s.users[bob.ID.String()] = bob
+	s.mu.Unlock()
+	s.signal()
+	s.wait()
+
+	require.Len(t, backend.sent, 4)
+	assert.Equal(t, []uint64{1, 2}, backend.sent[0].Transfers)
+	assert.Equal(t, decimal.FromInt(3), backend.sent[0].Amount)
+	// past MaxBatch a new batch is started
+	assert.Equal(t, []uint64{3}, backend.sent[1].Transfers)
+	assert.Equal(t, []uint64{4}, backend.sent[2].Transfers)
+	assert.True(t, backend.sent[2].ToExchange)
+	assert.Equal(t, bob.ID, backend.sent[3].User.ID)
+}
+
+func TestSettlementRetriesUntilFailed(t *testing.T) {
+	ex := NewExchange()
+	ex.SetSettlementConfig(SettlementConfig{MaxBatch: 10, MaxAttempts: 3, Backoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond, PollInterval: time.Millisecond})
+	backend := &blockingSettlement{release: make(chan struct{}), fail: errors.New("node unreachable")}
+	close(backend.release)
+	ex.RegisterSettlement(AssetBTC, backend)
+
+	user := auth.NewUser(nil, decimal.Zero)
+	ex.AddUser(user)
+	require.NoError(t, ex.submitTransfer(user.ID.String(), AssetBTC, decimal.FromInt(1), false))
+	ex.WaitSettled()
+
+	transfer, ok := ex.Transfer(1)
+	require.True(t, ok)
+	assert.Equal(t, TransferFailed, transfer.Status)
+	assert.Equal(t, 3, transfer.Attempts)
+	assert.Equal(t, "node unreachable", transfer.Error)
+	assert.Empty(t, transfer.TxID)
+
+	_, ok = ex.Transfer(2)
+	assert.False(t, ok)
+}
+
+func TestSettlementBackoff(t *testing.T) {
+	config := SettlementConfig{Backoff: time.Second, MaxBackoff: 5 * time.Second}
+
+	assert.Equal(t, time.Second, config.backoff(1))
+	assert.Equal(t, 2*time.Second, config.backoff(2))
+	assert.Equal(t, 4*time.Second, config.backoff(3))
+	assert.Equal(t, 5*time.Second, config.backoff(4))
+	assert.Equal(t, 5*time.Second, config.backoff(10))
+}
+
+func TestSettlementJournalSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "settlement.jsonl")
+	user := auth.NewUser(nil, decimal.Zero)
+
+	// the user's wallet was never registered, so nothing got settled
+	before := newSettler(nil)
+	require.NoError(t, before.openJournal(path))
+	before.submit(Transfer{Asset: AssetBTC, UserID: user.ID.String(), Amount: decimal.FromInt(1)})
+	before.submit(Transfer{Asset: AssetBTC, UserID: user.ID.String(), Amount: decimal.FromInt(2)})
+
+	ex := NewExchange()
+	require.NoError(t, ex.OpenSettlementJournal(path))
+	require.Len(t, ex.Transfers(""), 2)
+
+	ex.AddUser(user)
+	ex.WaitSettled()
+
+	for _, transfer := range ex.Transfers(user.ID.String()) {
+		assert.Equal(t, TransferConfirmed, transfer.Status)
+	}
+	assert.Equal(t, decimal.FromInt(3), ex.Settlement(AssetBTC).(*MemorySettlement).Wallet(user.ID.String()))
+
+	// new transfers carry on from the journal's IDs
+	require.NoError(t, ex.submitTransfer(user.ID.String(), AssetBTC, decimal.FromInt(1), true))
+	ex.WaitSettled()
+	transfer, ok := ex.Transfer(3)
+	require.True(t, ok)
+	assert.True(t, transfer.ToExchange)
+}
+
+// a node that mines every transaction it accepts unless told otherwise
+type fakeEthClient struct {
+	mu       sync.Mutex
+	nonces   map[common.Address]uint64
+	sent     []*types.Transaction
+	reverted map[common.Hash]bool
+	// the next SendTransaction fails with it
+	failSend error
+	// PendingNonceAt calls
+	nonceReads int
+}
+
+func newFakeEthClient() *fakeEthClient {
+	return &fakeEthClient{
+		nonces:   make(map[common.Address]uint64),
+		reverted: make(map[common.Hash]bool),
+	}
+}
+
+func (c *fakeEthClient) ChainID(ctx context.Context) (*big.Int, error) {
+	return big.NewInt(1337), nil
+}
+
+func (c *fakeEthClient) PendingNonceAt(ctx context.Context, account common.Address) (uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nonceReads++
+	return c.nonces[account], nil
+}
+
+func (c *fakeEthClient) SuggestGasPrice(ctx context.Context) (*big.Int, error) {
+	return big.NewInt(1), nil
+}
+
+func (c *fakeEthClient) SendTransaction(ctx context.Context, tx *types.Transaction) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.failSend; err != nil {
+		c.failSend = nil
+		return err
+	}
+
+	from, err := types.Sender(types.LatestSignerForChainID(tx.ChainId()), tx)
+	if err != nil {
+		return err
+	}
+	if tx.Nonce() != c.nonces[from] {
+		return errors.New("nonce too low")
+	}
+	c.nonces[from]++
+	c.sent = append(c.sent, tx)
+
+	return nil
+}
+
+func (c *fakeEthClient) TransactionReceipt(ctx context.Context, txHash common.Hash) (*types.Receipt, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, tx := range c.sent {
+		if tx.Hash() != txHash {
+			continue
+		}
+		if c.reverted[txHash] {
+			return &types.Receipt{Status: types.ReceiptStatusFailed}, nil
+		}
+		return &types.Receipt{Status: types.ReceiptStatusSuccessful}, nil
+	}
+	return nil, ethereum.NotFound
+}
+
+func TestEthSettlementManagesNonces(t *testing.T) {
+	client := newFakeEthClient()
+	exchangeKey := internals.GenerateNewPrivateKey()
+	keys := NewKeystore(unconfiguredKeystore)
+	backend := NewEthSettlement(client, exchangeKey, keys)
+	user := auth.NewUser(nil, decimal.Zero)
+	_, err := keys.Import(user.PrivateKey)
+	require.NoError(t, err)
+
+	payout := Batch{Asset: AssetETH, User: user, Amount: decimal.RequireFromString("1.5")}
+	first, err := backend.Send(payout)
+	require.NoError(t, err)
+	second, err := backend.Send(payout)
+	require.NoError(t, err)
+
+	// the nonce is only read once, then counted locally
+	assert.Equal(t, 1, client.nonceReads)
+	require.Len(t, client.sent, 2)
+	assert.Equal(t, uint64(1), client.sent[1].Nonce())
+	assert.Equal(t, internals.GetAddress(user.PrivateKey), *client.sent[0].To())
+	assert.Equal(t, "1500000000000000000", client.sent[0].Value().String())
+
+	// deposits are sent from the user's own address
+	_, err = backend.Send(Batch{Asset: AssetETH, User: user, Amount: decimal.FromInt(1), ToExchange: true})
+	require.NoError(t, err)
+	assert.Equal(t, internals.GetAddress(exchangeKey), *client.sent[2].To())
+	assert.Equal(t, 2, client.nonceReads)
+
+	// a failed send makes it read the nonce again
+	client.failSend = errors.New("connection reset")
+	_, err = backend.Send(payout)
+	assert.Error(t, err)
+	_, err = backend.Send(payout)
+	require.NoError(t, err)
+	assert.Equal(t, 3, client.nonceReads)
+	assert.Equal(t, uint64(2), client.sent[3].Nonce())
+
+	status, err := backend.Status(first)
+	require.NoError(t, err)
+	assert.Equal(t, TransferConfirmed, status)
+
+	client.reverted[common.HexToHash(second)] = true
+	status, err = backend.Status(second)
+	require.NoError(t, err)
+	assert.Equal(t, TransferFailed, status)
+
+	status, err = backend.Status(common.Hash{}.Hex())
+	require.NoError(t, err)
+	assert.Equal(t, TransferPending, status)
+}
+
+func TestEthSettlementSettlesTrades(t *testing.T) {
+	ex := NewExchange()
+	client := newFakeEthClient()
+	ex.RegisterSettlement(AssetETH, NewEthSettlement(client, ex.PrivateKey, ex.Keystore()))
+	ob := ex.OrderBook[ETH]
+
+	seller := auth.NewUser(nil, decimal.Zero)
+	buyer := auth.NewUser(nil, decimal.FromInt(10_000))
+	ex.AddUser(seller)
+	ex.AddUser(buyer)
+	deposit(t, ex, seller.ID.String(), AssetETH, 2)
+
+	ob.PlaceLimitOrder(decimal.FromInt(1_000), NewOrder(decimal.FromInt(2), false, decimal.FromInt(1_000), seller.ID.String()))
+	_, err := ob.PlaceMarketOrder(NewMarketOrder(decimal.FromInt(2), true, buyer.ID.String()))
+	require.NoError(t, err)
+	ex.WaitSettled()
+
+	// the ask sold deposited tokens, they're sent out of custody to the buyer
+	require.Len(t, client.sent, 1)
+	assert.Equal(t, internals.GetAddress(buyer.PrivateKey), *client.sent[0].To())
+	for _, transfer := range ex.Transfers("") {
+		assert.Equal(t, TransferConfirmed, transfer.Status)
+		assert.Equal(t, 1, transfer.Attempts)
+	}
+}
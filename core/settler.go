@@ -0,0 +1,457 @@
+package core
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/EggsyOnCode/velho-exchange/auth"
+	"github.com/EggsyOnCode/velho-exchange/decimal"
+	"github.com/sirupsen/logrus"
+)
+
+type SettlementConfig struct {
+	// most transfers sent in one transaction
+	MaxBatch int
+	// failed attempts after which a transfer is given up
+	MaxAttempts int
+	// wait before the first retry, doubled for every further one up to MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// how often sent transactions are checked for confirmation
+	PollInterval time.Duration
+}
+
+var DefaultSettlementConfig = SettlementConfig{
+	MaxBatch:     50,
+	MaxAttempts:  5,
+	Backoff:      time.Second,
+	MaxBackoff:   time.Minute,
+	PollInterval: time.Second,
+}
+
+// wait before retrying a transfer that failed attempts times
+func (c SettlementConfig) backoff(attempts int) time.Duration {
+	wait := c.Backoff
+	for i := 1; i < attempts && wait < c.MaxBackoff; i++ {
+		wait *= 2
+	}
+	return min(wait, c.MaxBackoff)
+}
+
+// settler works through the settlement queue on its own goroutine so matching
+// never waits for a chain: queued transfers are batched per wallet and sent with
+// their asset's backend, failed sends are retried with backoff and sent
+// transactions are polled until they're confirmed.
+type settler struct {
+	mu sync.Mutex
+	// broadcast once onUpdate has been called with the transfers that changed
+	settled  *sync.Cond
+	config   SettlementConfig
+	backends map[Asset]Settlement
+	// wallets transfers are settled with, the exchange registers its users here
+	users     map[string]*auth.User
+	transfers map[uint64]*Transfer
+	// pending transfers in the order they were queued
+	pending []uint64
+	nextID  uint64
+	journal *os.File
+	wake    chan struct{}
+	// called with every transfer that was sent, confirmed or failed, outside of mu
+	onUpdate func(Transfer)
+	// transfers onUpdate hasn't been called with yet, and how many it's being called with
+	updates   []Transfer
+	notifying int
+	// while the write-ahead log is replayed transfers get IDs from replayID,
+	// see startReplay
+	replaying bool
+	replayID  uint64
+}
+
+func newSettler(onUpdate func(Transfer)) *settler {
+	s := &settler{
+		onUpdate:  onUpdate,
+		config:    DefaultSettlementConfig,
+		backends:  make(map[Asset]Settlement),
+		users:     make(map[string]*auth.User),
+		transfers: make(map[uint64]*Transfer),
+		wake:      make(chan struct{}, 1),
+	}
+	s.settled = sync.NewCond(&s.mu)
+	go s.run()
+
+	return s
+}
+
+func (s *settler) register(asset Asset, backend Settlement) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.backends[asset] = backend
+}
+
+// the backend registered for asset, a new in-memory one if there's none yet
+func (s *settler) backend(asset Asset) Settlement {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.backendLocked(asset)
+}
+
+func (s *settler) backendLocked(asset Asset) Settlement {
+	backend, ok := s.backends[asset]
+	if !ok {
+		backend = NewMemorySettlement()
+		s.backends[asset] = backend
+	}
+	return backend
+}
+
+func (s *settler) setConfig(config SettlementConfig) {
+	s.mu.Lock()
+	s.config = config
+	s.mu.Unlock()
+	s.signal()
+}
+
+func (s *settler) addUser(user *auth.User) {
+	s.mu.Lock()
+	s.users[user.ID.String()] = user
+	s.mu.Unlock()
+	s.signal()
+}
+
+func (s *settler) submit(t Transfer) Transfer {
+	s.mu.Lock()
+	if s.replaying {
+		s.replayID++
+		if queued, ok := s.transfers[s.replayID]; ok {
+			s.mu.Unlock()
+			return *queued
+		}
+		s.nextID = max(s.nextID, s.replayID-1)
+	}
+	s.nextID++
+	t.ID = s.nextID
+	t.Status = TransferPending
+	t.CreatedAt = time.Now().UnixNano()
+	t.UpdatedAt = t.CreatedAt
+	queued := t
+	s.transfers[t.ID] = &queued
+	s.pending = append(s.pending, t.ID)
+	s.persist(&queued)
+	s.mu.Unlock()
+
+	s.signal()
+	return t
+}
+
+// startReplay makes the transfers replayed commands queue take the IDs they got
+// when they were first queued, after from. The ones the journal holds are the
+// same transfers and aren't queued again, only those that never made it there are.
+func (s *settler) startReplay(from uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.replaying = true
+	s.replayID = from
+}
+
+func (s *settler) endReplay() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.replaying = false
+}
+
+func (s *settler) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *settler) wait() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.pending) > 0 || len(s.updates) > 0 || s.notifying > 0 {
+		s.settled.Wait()
+	}
+}
+
+func (s *settler) run() {
+	for {
+		next := s.step(time.Now())
+
+		timer := time.NewTimer(next)
+		select {
+		case <-s.wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// one pass over the queue: sends every batch that's due and checks every sent
+// transaction. Returns how long to wait for the next pass.
+func (s *settler) step(now time.Time) time.Duration {
+	s.mu.Lock()
+	batches, sent := s.due(now)
+	s.mu.Unlock()
+
+	for _, b := range batches {
+		txID, err := b.backend.Send(b.Batch)
+
+		s.mu.Lock()
+		s.sent(b.Batch, txID, err, now)
+		s.mu.Unlock()
+	}
+
+	for txID, asset := range sent {
+		status, err := s.backend(asset).Status(txID)
+		if err != nil {
+			logrus.WithError(err).WithField("tx", txID).Error("transaction status unknown")
+			continue
+		}
+
+		s.mu.Lock()
+		s.confirmed(txID, status, now)
+		s.mu.Unlock()
+	}
+
+	s.notify()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	next := s.config.PollInterval
+	for _, id := range s.pending {
+		if t := s.transfers[id]; t.TxID == "" && t.RetryAt > now.UnixNano() {
+			next = min(next, time.Duration(t.RetryAt-now.UnixNano()))
+		}
+	}
+	return next
+}
+
+// hands the transfers that changed to onUpdate
+func (s *settler) notify() {
+	s.mu.Lock()
+	updates := s.updates
+	s.updates = nil
+	s.notifying += len(updates)
+	s.mu.Unlock()
+
+	for _, t := range updates {
+		if s.onUpdate != nil {
+			s.onUpdate(t)
+		}
+	}
+
+	s.mu.Lock()
+	s.notifying -= len(updates)
+	s.settled.Broadcast()
+	s.mu.Unlock()
+}
+
+type dueBatch struct {
+	Batch
+	backend Settlement
+}
+
+// groups the pending transfers that are due into batches, oldest first, and
+// collects the transactions waiting to be confirmed
+func (s *settler) due(now time.Time) ([]dueBatch, map[string]Asset) {
+	type key struct {
+		asset      Asset
+		userID     string
+		toExchange bool
+		address    string
+	}
+
+	var batches []dueBatch
+	open := make(map[key]int)
+	sent := make(map[string]Asset)
+
+	for _, id := range s.pending {
+		t := s.transfers[id]
+		if t.TxID != "" {
+			sent[t.TxID] = t.Asset
+			continue
+		}
+		user, ok := s.users[t.UserID]
+		if !ok || t.RetryAt > now.UnixNano() {
+			continue
+		}
+
+		k := key{t.Asset, t.UserID, t.ToExchange, t.Address}
+		i, ok := open[k]
+		if !ok || len(batches[i].Transfers) >= s.config.MaxBatch {
+			i = len(batches)
+			open[k] = i
+			batches = append(batches, dueBatch{
+				Batch: Batch{
+					Asset:      t.Asset,
+					User:       user,
+					ToExchange: t.ToExchange,
+					Address:    t.Address,
+					Amount:     decimal.Zero,
+				},
+				backend: s.backendLocked(t.Asset),
+			})
+		}
+		batches[i].Amount = batches[i].Amount.Add(t.Amount)
+		batches[i].Transfers = append(batches[i].Transfers, id)
+	}
+
+	return batches, sent
+}
+
+// records the outcome of sending b
+func (s *settler) sent(b Batch, txID string, err error, now time.Time) {
+	for _, id := range b.Transfers {
+		t := s.transfers[id]
+		t.Attempts++
+		t.UpdatedAt = now.UnixNano()
+		if err != nil {
+			s.failedAttempt(t, err.Error(), now)
+			continue
+		}
+		t.TxID = txID
+		t.Error = ""
+		s.persist(t)
+		s.updates = append(s.updates, *t)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"asset":      b.Asset,
+		"userId":     b.User.ID,
+		"amount":     b.Amount,
+		"toExchange": b.ToExchange,
+		"transfers":  len(b.Transfers),
+		"tx":         txID,
+		"error":      err,
+	}).Info("settlement batch sent")
+}
+
+// records the status of transaction txID
+func (s *settler) confirmed(txID string, status TransferStatus, now time.Time) {
+	if status == TransferPending {
+		return
+	}
+
+	for _, id := range append([]uint64(nil), s.pending...) {
+		t := s.transfers[id]
+		if t.TxID != txID {
+			continue
+		}
+		t.UpdatedAt = now.UnixNano()
+
+		if status == TransferConfirmed {
+			t.Status = TransferConfirmed
+			s.done(t)
+		} else {
+			// the transaction didn't go through, the transfer is sent again
+			t.TxID = ""
+			s.failedAttempt(t, fmt.Sprintf("transaction %s failed", txID), now)
+		}
+	}
+}
+
+// schedules a retry of t, or gives up on it once it ran out of attempts
+func (s *settler) failedAttempt(t *Transfer, reason string, now time.Time) {
+	t.Error = reason
+	if t.Attempts >= s.config.MaxAttempts {
+		t.Status = TransferFailed
+		s.done(t)
+
+		logrus.WithFields(logrus.Fields{
+			"id":       t.ID,
+			"asset":    t.Asset,
+			"userId":   t.UserID,
+			"amount":   t.Amount,
+			"attempts": t.Attempts,
+			"error":    reason,
+		}).Error("transfer failed")
+		return
+	}
+
+	t.RetryAt = now.Add(s.config.backoff(t.Attempts)).UnixNano()
+	s.persist(t)
+}
+
+// takes t, confirmed or failed, off the queue
+func (s *settler) done(t *Transfer) {
+	for i, id := range s.pending {
+		if id == t.ID {
+			s.pending = append(s.pending[:i], s.pending[i+1:]...)
+			break
+		}
+	}
+	t.RetryAt = 0
+	s.persist(t)
+	s.updates = append(s.updates, *t)
+}
+
+// appends t's current state to the journal, if there's one
+func (s *settler) persist(t *Transfer) {
+	if s.journal == nil {
+		return
+	}
+
+	line, _ := json.Marshal(t)
+	line = append(line, '\n')
+	if _, err := s.journal.Write(line); err != nil {
+		logrus.WithError(err).WithField("id", t.ID).Error("transfer not journaled")
+		return
+	}
+	if err := s.journal.Sync(); err != nil {
+		logrus.WithError(err).WithField("id", t.ID).Error("transfer journal not synced")
+	}
+}
+
+func (s *settler) openJournal(path string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+
+	// the journal holds every state a transfer went through, the last one counts
+	transfers := make(map[uint64]*Transfer)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		var t Transfer
+		if err := json.Unmarshal(scanner.Bytes(), &t); err != nil {
+			f.Close()
+			return fmt.Errorf("settlement journal %s line %d: %w", path, line, err)
+		}
+		transfers[t.ID] = &t
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return err
+	}
+
+	s.mu.Lock()
+	if s.journal != nil {
+		s.journal.Close()
+	}
+	s.journal = f
+	for id, t := range transfers {
+		s.transfers[id] = t
+		s.nextID = max(s.nextID, id)
+	}
+	s.pending = s.pending[:0]
+	for id := uint64(1); id <= s.nextID; id++ {
+		if t, ok := s.transfers[id]; ok && t.Status == TransferPending {
+			s.pending = append(s.pending, id)
+		}
+	}
+	s.mu.Unlock()
+
+	logrus.WithFields(logrus.Fields{
+		"path":      path,
+		"transfers": len(transfers),
+	}).Info("settlement journal opened")
+
+	s.signal()
+	return nil
+}
@@ -0,0 +1,195 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/EggsyOnCode/velho-exchange/decimal"
+	"github.com/sirupsen/logrus"
+)
+
+// The ledger credits a transfer into custody when it's queued, so a transfer
+// from a user's wallet that ends up failing credited tokens the exchange never
+// got. Its user's asks on the asset are cancelled and the credit is reversed out
+// of their available balance. Whatever they already sold or withdrew of it is a
+// shortfall: their account is frozen, no orders and no withdrawals, until
+// deposits of the asset pay it back.
+
+var (
+	ErrAccountFrozen = errors.New("account is frozen until a failed transfer into the exchange is paid back")
+	// the failed transfer was already reversed
+	errTransferReversed = errors.New("transfer already reversed")
+)
+
+// shortfalls are changed by commands only, ex.cmdMu guards them
+type shortfalls struct {
+	// transfers into custody that failed and were reversed
+	reversed map[uint64]bool
+	// what users still owe of an asset for them
+	owed map[string]map[Asset]decimal.Decimal
+}
+
+func newShortfalls() *shortfalls {
+	return &shortfalls{
+		reversed: make(map[uint64]bool),
+		owed:     make(map[string]map[Asset]decimal.Decimal),
+	}
+}
+
+// Shortfalls returns what userID owes for failed transfers into the exchange, by asset
+func (ex *Exchange) Shortfalls(userID string) map[Asset]decimal.Decimal {
+	ex.cmdMu.Lock()
+	defer ex.cmdMu.Unlock()
+
+	owed := make(map[Asset]decimal.Decimal, len(ex.shortfalls.owed[userID]))
+	for asset, amount := range ex.shortfalls.owed[userID] {
+		owed[asset] = amount
+	}
+	return owed
+}
+
+// whether userID owes anything for a failed transfer, ex.cmdMu is held
+func (ex *Exchange) frozen(userID string) bool {
+	return len(ex.shortfalls.owed[userID]) > 0
+}
+
+// takes a failed transfer into custody back: the user's asks on its asset are
+// cancelled so their tokens are available again, then the credit is reversed
+func (ex *Exchange) reversePull(t Transfer) {
+	ex.cmdMu.Lock()
+	reversed := ex.shortfalls.reversed[t.ID]
+	var asks []*ExOrder
+	if !reversed {
+		orders, _ := ex.openOrders(t.UserID)
+		for _, o := range orders {
+			if ob, err := ex.Market(o.Market); err == nil && !o.Bid && ob.Spec.Base == t.Asset {
+				asks = append(asks, o)
+			}
+		}
+	}
+	ex.cmdMu.Unlock()
+	if reversed {
+		return
+	}
+
+	for _, o := range asks {
+		if err := ex.CancelOrder(o.Market, o.ID); err != nil {
+			logrus.WithError(err).WithField("id", o.ID).Error("ask of a failed transfer not cancelled")
+		}
+	}
+	cmd := &reverseTransferCommand{TransferID: t.ID, UserID: t.UserID, Asset: t.Asset, Amount: t.Amount}
+	if err := ex.execute(CmdReverseTransfer, cmd); err != nil && !errors.Is(err, errTransferReversed) {
+		logrus.WithError(err).WithField("transfer", t.ID).Error("failed transfer not reversed")
+	}
+}
+
+// reverses the transfers into custody that failed while the write-ahead log was
+// replayed or before a restart
+func (ex *Exchange) followPulls() {
+	for _, t := range ex.Transfers("") {
+		if t.ToExchange && t.Status == TransferFailed {
+			ex.reversePull(t)
+		}
+	}
+}
+
+func (ex *Exchange) reverseTransfer(c *reverseTransferCommand) error {
+	s := ex.shortfalls
+	if s.reversed[c.TransferID] {
+		return errTransferReversed
+	}
+
+	ref := fmt.Sprintf("transfer %d failed", c.TransferID)
+	taken := decimal.Min(c.Amount, ex.Ledger.Balance(c.UserID, c.Asset).Available)
+	if taken.IsPositive() {
+		if err := ex.Ledger.Withdraw(c.UserID, c.Asset, taken, ref); err != nil {
+			return err
+		}
+	}
+	s.reversed[c.TransferID] = true
+
+	owed := c.Amount.Sub(taken)
+	if owed.IsPositive() {
+		if s.owed[c.UserID] == nil {
+			s.owed[c.UserID] = make(map[Asset]decimal.Decimal)
+		}
+		s.owed[c.UserID][c.Asset] = s.owed[c.UserID][c.Asset].Add(owed)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"transfer": c.TransferID,
+		"userId":   c.UserID,
+		"asset":    c.Asset,
+		"reversed": taken,
+		"owed":     owed,
+	}).Warn("failed transfer into the exchange reversed")
+
+	return nil
+}
+
+// pays what userID owes of asset out of their available balance, after a
+// deposit of it. ex.cmdMu is held.
+func (ex *Exchange) repayShortfall(userID string, asset Asset) error {
+	owed := ex.shortfalls.owed[userID][asset]
+	paid := decimal.Min(owed, ex.Ledger.Balance(userID, asset).Available)
+	if !paid.IsPositive() {
+		return nil
+	}
+	if err := ex.Ledger.Withdraw(userID, asset, paid, "shortfall repaid"); err != nil {
+		return err
+	}
+
+	if left := owed.Sub(paid); left.IsPositive() {
+		ex.shortfalls.owed[userID][asset] = left
+		return nil
+	}
+	delete(ex.shortfalls.owed[userID], asset)
+	if len(ex.shortfalls.owed[userID]) == 0 {
+		delete(ex.shortfalls.owed, userID)
+	}
+	return nil
+}
+
+type ShortfallSnapshot struct {
+	UserID string          `json:"user_id"`
+	Asset  Asset           `json:"asset"`
+	Amount decimal.Decimal `json:"amount"`
+}
+
+func (s *shortfalls) snapshot() ([]uint64, []ShortfallSnapshot) {
+	reversed := make([]uint64, 0, len(s.reversed))
+	for id := range s.reversed {
+		reversed = append(reversed, id)
+	}
+	sort.Slice(reversed, func(i, j int) bool { return reversed[i] < reversed[j] })
+
+	owed := make([]ShortfallSnapshot, 0)
+	for userID, assets := range s.owed {
+		for asset, amount := range assets {
+			owed = append(owed, ShortfallSnapshot{UserID: userID, Asset: asset, Amount: amount})
+		}
+	}
+	sort.Slice(owed, func(i, j int) bool {
+		if owed[i].UserID != owed[j].UserID {
+			return owed[i].UserID < owed[j].UserID
+		}
+		return owed[i].Asset < owed[j].Asset
+	})
+
+	return reversed, owed
+}
+
+func (s *shortfalls) restore(reversed []uint64, owed []ShortfallSnapshot) {
+	s.reversed = make(map[uint64]bool, len(reversed))
+	for _, id := range reversed {
+		s.reversed[id] = true
+	}
+	s.owed = make(map[string]map[Asset]decimal.Decimal)
+	for _, o := range owed {
+		if s.owed[o.UserID] == nil {
+			s.owed[o.UserID] = make(map[Asset]decimal.Decimal)
+		}
+		s.owed[o.UserID][o.Asset] = o.Amount
+	}
+}
@@ -0,0 +1,71 @@
+package core
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/EggsyOnCode/velho-exchange/auth"
+	"github.com/EggsyOnCode/velho-exchange/decimal"
+	"github.com/EggsyOnCode/velho-exchange/ledger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFailedTransferIntoCustodyIsReversed(t *testing.T) {
+	ex := NewExchange()
+	ex.SetSettlementConfig(SettlementConfig{MaxBatch: 10, MaxAttempts: 1, Backoff: time.Millisecond, MaxBackoff: time.Millisecond, PollInterval: time.Millisecond})
+	backend := &blockingSettlement{release: make(chan struct{}), fail: errors.New("insufficient balance")}
+	ex.RegisterSettlement(AssetBTC, backend)
+	ob := ex.OrderBook[BTC]
+
+	seller := auth.NewUser(nil, decimal.Zero)
+	buyer := auth.NewUser(nil, decimal.FromInt(10_000))
+	ex.AddUser(seller)
+	ex.AddUser(buyer)
+	sellerID := seller.ID.String()
+
+	// the ledger credits the pull right away, the seller sells one of it and
+	// rests an ask for another
+	ob.TransferTokens(sellerID, AssetBTC, decimal.FromInt(3), true)
+	ask := NewOrder(decimal.FromInt(2), false, decimal.FromInt(100), sellerID)
+	_, err := ex.PlaceOrder(BTC, ask)
+	require.NoError(t, err)
+	_, err = ex.PlaceOrder(BTC, NewMarketOrder(decimal.FromInt(1), true, buyer.ID.String()))
+	require.NoError(t, err)
+
+	// the transfer fails: the ask is cancelled and what's left of the credit is
+	// taken back, the sold token is owed
+	close(backend.release)
+	ex.WaitSettled()
+	transfer, ok := ex.Transfer(1)
+	require.True(t, ok)
+	assert.Equal(t, TransferFailed, transfer.Status)
+
+	assert.Nil(t, ob.GetOrderById(ask.ID.String()))
+	assert.Equal(t, ledger.Balance{}, ex.Ledger.Balance(sellerID, AssetBTC))
+	assert.Equal(t, map[Asset]decimal.Decimal{AssetBTC: decimal.FromInt(1)}, ex.Shortfalls(sellerID))
+	assert.NoError(t, ex.Ledger.Check())
+
+	// until it's paid back the account can't trade or withdraw
+	_, err = ex.PlaceOrder(BTC, NewOrder(decimal.FromInt(1), true, decimal.FromInt(90), sellerID))
+	assert.ErrorIs(t, err, ErrAccountFrozen)
+	_, err = ex.RequestWithdrawal(sellerID, AssetUSD, decimal.FromInt(1), "")
+	assert.ErrorIs(t, err, ErrAccountFrozen)
+
+	restored := NewExchange()
+	require.NoError(t, restored.Restore(ex.Snapshot()))
+	assert.Equal(t, ex.Shortfalls(sellerID), restored.Shortfalls(sellerID))
+
+	// a transfer is only reversed once
+	ex.reversePull(transfer)
+	assert.Equal(t, decimal.FromInt(1), ex.Shortfalls(sellerID)[AssetBTC])
+
+	// a deposit of the asset pays it back first
+	deposit(t, ex, sellerID, AssetBTC, 2)
+	assert.Empty(t, ex.Shortfalls(sellerID))
+	assert.Equal(t, ledger.Balance{Available: decimal.FromInt(1)}, ex.Ledger.Balance(sellerID, AssetBTC))
+	_, err = ex.PlaceOrder(BTC, NewOrder(decimal.FromInt(1), false, decimal.FromInt(100), sellerID))
+	assert.NoError(t, err)
+	assert.NoError(t, ex.Ledger.Check())
+}
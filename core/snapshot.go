@@ -0,0 +1,667 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/EggsyOnCode/velho-exchange/auth"
+	"github.com/EggsyOnCode/velho-exchange/avl"
+	"github.com/EggsyOnCode/velho-exchange/decimal"
+	"github.com/EggsyOnCode/velho-exchange/ledger"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	g "github.com/zyedidia/generic"
+)
+
+// A snapshot is the state commands left, as of a command of the write-ahead
+// log: the books and their open orders, users, balances, fee settings,
+// deposits, withdrawals and API keys. History isn't kept: the ledger's journal
+// and the trades fee tiers no longer count are compacted away once the snapshot
+// is written, and a book only keeps its latest trades. Recovering restores the
+// latest snapshot and replays only the commands logged after it. Snapshots are
+// JSON, tagged with SnapshotVersion.
+
+// SnapshotVersion is bumped whenever the format changes, older snapshots aren't
+// restored
+const SnapshotVersion = 1
+
+// ErrSnapshotMismatch is returned by VerifySnapshot when a restored state isn't
+// the live one
+var ErrSnapshotMismatch = errors.New("restored state doesn't match the live one")
+
+type Snapshot struct {
+	Version int `json:"version"`
+	// sequence number of the last command applied, replay carries on after it
+	Seq uint64 `json:"seq"`
+	// the engine's clock, see Exchange.now
+	Clock int64 `json:"clock"`
+	// unix nanos
+	TakenAt int64            `json:"taken_at"`
+	Users   []UserSnapshot   `json:"users"`
+	Markets []MarketSnapshot `json:"markets"`
+	// balances, without the journal
+	Ledger ledger.Snapshot `json:"ledger"`
+	// each user's index of the orders they have on a book, see Exchange.GetOrders
+	Orders              map[string][]ExOrder           `json:"orders"`
+	SelfTradePrevention map[string]SelfTradePrevention `json:"self_trade_prevention"`
+	MaxOpenOrders       int                            `json:"max_open_orders"`
+	FeeCurrency         map[string]FeeCurrency         `json:"fee_currency"`
+	// users' trades within FeeVolumeWindow of Clock, what their fee tiers count
+	UserTrades       map[string][]UserTrade     `json:"user_trades"`
+	DepositAddresses map[string]common.Address  `json:"deposit_addresses"`
+	Deposits         []Deposit                  `json:"deposits"`
+	WithdrawalLimits map[Asset]WithdrawalLimits `json:"withdrawal_limits"`
+	Withdrawals      []Withdrawal               `json:"withdrawals"`
+	// ID of the last settlement transfer a command queued, transfers keep
+	// their state in the settlement journal
+	TransferID uint64           `json:"transfer_id"`
+	APIKeys    []APIKeySnapshot `json:"api_keys"`
+	// failed transfers into custody that were reversed and what users owe for
+	// them, see shortfalls.go
+	ReversedTransfers []uint64            `json:"reversed_transfers"`
+	Shortfalls        []ShortfallSnapshot `json:"shortfalls"`
+	// users' and deposit addresses' keys, as the keystore encrypted them
+	Keys []json.RawMessage `json:"keys"`
+}
+
+type UserSnapshot struct {
+	ID      uuid.UUID       `json:"id"`
+	Address common.Address  `json:"address"`
+	USD     decimal.Decimal `json:"usd"`
+}
+
+type MarketSnapshot struct {
+	Market Market     `json:"market"`
+	Spec   MarketSpec `json:"spec"`
+	// best price first
+	Bids []LevelSnapshot `json:"bids"`
+	Asks []LevelSnapshot `json:"asks"`
+	// trigger book, next to trigger first
+	BuyStops  []LevelSnapshot `json:"buy_stops"`
+	SellStops []LevelSnapshot `json:"sell_stops"`
+	// the book's latest trades, oldest first
+	Trades          []Trade         `json:"trades"`
+	CurrentPrice    decimal.Decimal `json:"current_price"`
+	LastTradeTs     int64           `json:"last_trade_ts"`
+	TotalBidVolume  decimal.Decimal `json:"total_bid_volume"`
+	TotalAskVolume  decimal.Decimal `json:"total_ask_volume"`
+	HiddenBidVolume decimal.Decimal `json:"hidden_bid_volume"`
+	HiddenAskVolume decimal.Decimal `json:"hidden_ask_volume"`
+}
+
+type LevelSnapshot struct {
+	Price        decimal.Decimal `json:"price"`
+	TotalVolume  decimal.Decimal `json:"total_volume"`
+	HiddenVolume decimal.Decimal `json:"hidden_volume"`
+	// oldest first
+	Orders []Order `json:"orders"`
+}
+
+// Snapshot returns a copy of the exchange's state as of the last command applied
+func (ex *Exchange) Snapshot() *Snapshot {
+	ex.cmdMu.Lock()
+	defer ex.cmdMu.Unlock()
+	return ex.snapshot()
+}
+
+// Seq returns the sequence number of the last command applied from the log
+func (ex *Exchange) Seq() uint64 {
+	ex.cmdMu.Lock()
+	defer ex.cmdMu.Unlock()
+	return ex.seq
+}
+
+// ex.cmdMu is held
+func (ex *Exchange) snapshot() *Snapshot {
+	s := &Snapshot{
+		Version:             SnapshotVersion,
+		Seq:                 ex.seq,
+		Clock:               ex.clock,
+		TakenAt:             time.Now().UnixNano(),
+		Users:               make([]UserSnapshot, 0, len(ex.Users)),
+		Ledger:              ex.Ledger.Snapshot(),
+		Orders:              make(map[string][]ExOrder),
+		SelfTradePrevention: make(map[string]SelfTradePrevention, len(ex.selfTradePrevention)),
+		MaxOpenOrders:       ex.maxOpenOrders,
+	}
+
+	for _, user := range ex.Users {
+		s.Users = append(s.Users, UserSnapshot{ID: user.ID, Address: user.Address, USD: user.USD})
+	}
+	sort.Slice(s.Users, func(i, j int) bool { return s.Users[i].ID.String() < s.Users[j].ID.String() })
+
+	for _, ob := range ex.Markets() {
+		s.Markets = append(s.Markets, ob.snapshot())
+	}
+
+	// orders that left their book are dropped from the index, like GetOrders does
+	for userID, orders := range ex.orders {
+		orders.Each(func(_ string, v *ExOrder) {
+			ob, err := ex.Market(v.Market)
+			if err != nil {
+				return
+			}
+			if o := ob.GetOrderById(v.ID); o != nil {
+				order := *v
+				order.Triggered = o.Triggered
+				s.Orders[userID] = append(s.Orders[userID], order)
+			}
+		})
+	}
+	for userID, mode := range ex.selfTradePrevention {
+		s.SelfTradePrevention[userID] = mode
+	}
+
+	ex.fees.mu.Lock()
+	s.FeeCurrency = make(map[string]FeeCurrency, len(ex.fees.currency))
+	for userID, currency := range ex.fees.currency {
+		s.FeeCurrency[userID] = currency
+	}
+	s.UserTrades = ex.fees.tradesSince(ex.clock - int64(FeeVolumeWindow))
+	ex.fees.mu.Unlock()
+
+	w := ex.deposits
+	w.mu.Lock()
+	s.DepositAddresses = make(map[string]common.Address, len(w.addresses))
+	for userID, address := range w.addresses {
+		s.DepositAddresses[userID] = address
+	}
+	s.Deposits = make([]Deposit, 0, len(w.deposits))
+	for _, d := range w.deposits {
+		s.Deposits = append(s.Deposits, *d)
+	}
+	w.mu.Unlock()
+	sort.Slice(s.Deposits, func(i, j int) bool { return s.Deposits[i].ID < s.Deposits[j].ID })
+
+	d := ex.withdrawals
+	d.mu.Lock()
+	s.WithdrawalLimits = make(map[Asset]WithdrawalLimits, len(d.limits))
+	for asset, limits := range d.limits {
+		s.WithdrawalLimits[asset] = limits
+	}
+	s.Withdrawals = make([]Withdrawal, 0, len(d.withdrawals))
+	for _, w := range d.withdrawals {
+		s.Withdrawals = append(s.Withdrawals, *w)
+	}
+	d.mu.Unlock()
+	sort.Slice(s.Withdrawals, func(i, j int) bool { return s.Withdrawals[i].ID < s.Withdrawals[j].ID })
+
+	ex.settler.mu.Lock()
+	s.TransferID = ex.settler.nextID
+	ex.settler.mu.Unlock()
+
+	s.APIKeys = ex.apiKeys.snapshot()
+	s.ReversedTransfers, s.Shortfalls = ex.shortfalls.snapshot()
+	s.Keys = ex.keystore.snapshot()
+
+	return s
+}
+
+func (ob *OrderBook) snapshot() MarketSnapshot {
+	m := MarketSnapshot{
+		Market:          ob.TokenId,
+		Spec:            ob.Spec,
+		Bids:            levelSnapshots(ob.Bids),
+		Asks:            levelSnapshots(ob.Asks),
+		BuyStops:        levelSnapshots(ob.buyStops),
+		SellStops:       levelSnapshots(ob.sellStops),
+		Trades:          make([]Trade, 0, ob.Trades.Size()),
+		CurrentPrice:    ob.CurrentPrice,
+		LastTradeTs:     ob.lastTradeTs,
+		TotalBidVolume:  ob.totalBidVolume,
+		TotalAskVolume:  ob.totalAskVolume,
+		HiddenBidVolume: ob.hiddenBidVolume,
+		HiddenAskVolume: ob.hiddenAskVolume,
+	}
+	m.Spec.Fees = append(FeeSchedule(nil), ob.Spec.Fees...)
+	ob.Trades.Each(func(_ int64, t *Trade) {
+		m.Trades = append(m.Trades, *t)
+	})
+	return m
+}
+
+func levelSnapshots(side *avl.Tree[decimal.Decimal, *Limit]) []LevelSnapshot {
+	levels := make([]LevelSnapshot, 0)
+	side.Each(func(_ decimal.Decimal, l *Limit) {
+		level := LevelSnapshot{
+			Price:        l.Price,
+			TotalVolume:  l.TotalVolume,
+			HiddenVolume: l.HiddenVolume,
+			Orders:       make([]Order, 0, l.Orders.Size()),
+		}
+		l.Orders.Each(func(_ int64, o *Order) {
+			order := *o
+			order.Limit = nil
+			level.Orders = append(level.Orders, order)
+		})
+		levels = append(levels, level)
+	})
+	return levels
+}
+
+// Restore replaces the exchange's state with s. It has to be done before the
+// write-ahead log is opened, which then replays the commands logged after s.
+// If it fails the exchange is left half restored and shouldn't be used.
+func (ex *Exchange) Restore(s *Snapshot) error {
+	if s.Version != SnapshotVersion {
+		return fmt.Errorf("snapshot version %d can't be restored, expected %d", s.Version, SnapshotVersion)
+	}
+
+	ex.cmdMu.Lock()
+	defer ex.cmdMu.Unlock()
+
+	if ex.wal != nil {
+		return fmt.Errorf("snapshot can't be restored once the write-ahead log is open")
+	}
+
+	if err := ex.keystore.restore(s.Keys); err != nil {
+		return err
+	}
+
+	ex.Users = make(map[string]*auth.User, len(s.Users))
+	ex.addresses = make(map[common.Address]string, len(s.Users))
+	for _, u := range s.Users {
+		user := &auth.User{ID: u.ID, Address: u.Address, USD: u.USD}
+		ex.Users[u.ID.String()] = user
+		ex.addresses[u.Address] = u.ID.String()
+		ex.settler.addUser(user)
+	}
+	// users' USD follows their restored balances
+	if err := ex.Ledger.Restore(s.Ledger); err != nil {
+		return err
+	}
+
+	books := make(map[Market]*OrderBook, len(s.Markets))
+	for _, m := range s.Markets {
+		books[m.Market] = m.restore(ex)
+	}
+	ex.marketsMu.Lock()
+	ex.OrderBook = books
+	for market := range books {
+		ex.startSequencerLocked(market)
+	}
+	ex.marketsMu.Unlock()
+
+	ex.orders = make(map[string]*avl.Tree[string, *ExOrder], len(s.Orders))
+	for _, orders := range s.Orders {
+		for _, order := range orders {
+			ex.AddOrder(&order)
+		}
+	}
+	ex.selfTradePrevention = make(map[string]SelfTradePrevention, len(s.SelfTradePrevention))
+	for userID, mode := range s.SelfTradePrevention {
+		ex.selfTradePrevention[userID] = mode
+	}
+	ex.maxOpenOrders = s.MaxOpenOrders
+
+	ex.fees.mu.Lock()
+	ex.fees.currency = make(map[string]FeeCurrency, len(s.FeeCurrency))
+	for userID, currency := range s.FeeCurrency {
+		ex.fees.currency[userID] = currency
+	}
+	ex.fees.trades = make(map[string][]UserTrade, len(s.UserTrades))
+	for userID, trades := range s.UserTrades {
+		ex.fees.trades[userID] = append([]UserTrade(nil), trades...)
+	}
+	ex.fees.mu.Unlock()
+
+	w := ex.deposits
+	w.mu.Lock()
+	w.addresses = make(map[string]common.Address, len(s.DepositAddresses))
+	w.owners = make(map[string]string, len(s.DepositAddresses))
+	for userID, address := range s.DepositAddresses {
+		w.addresses[userID] = address
+		w.owners[strings.ToLower(address.Hex())] = userID
+	}
+	w.deposits = make(map[uint64]*Deposit, len(s.Deposits))
+	w.seen = make(map[string]uint64, len(s.Deposits))
+	w.nextID = 0
+	for i := range s.Deposits {
+		deposit := s.Deposits[i]
+		w.deposits[deposit.ID] = &deposit
+		w.seen[depositKey(deposit.Asset, deposit.TxID)] = deposit.ID
+		w.nextID = max(w.nextID, deposit.ID)
+	}
+	w.mu.Unlock()
+
+	d := ex.withdrawals
+	d.mu.Lock()
+	d.limits = make(map[Asset]WithdrawalLimits, len(s.WithdrawalLimits))
+	for asset, limits := range s.WithdrawalLimits {
+		d.limits[asset] = limits
+	}
+	d.withdrawals = make(map[uint64]*Withdrawal, len(s.Withdrawals))
+	d.byTransfer = make(map[uint64]uint64)
+	d.nextID = 0
+	for i := range s.Withdrawals {
+		withdrawal := s.Withdrawals[i]
+		d.withdrawals[withdrawal.ID] = &withdrawal
+		if withdrawal.TransferID != 0 {
+			d.byTransfer[withdrawal.TransferID] = withdrawal.ID
+		}
+		d.nextID = max(d.nextID, withdrawal.ID)
+	}
+	d.mu.Unlock()
+
+	if err := ex.apiKeys.restore(s.APIKeys, ex.keystore); err != nil {
+		return err
+	}
+	ex.shortfalls.restore(s.ReversedTransfers, s.Shortfalls)
+
+	ex.clock = s.Clock
+	ex.seq = s.Seq
+	ex.restoredTransferID = s.TransferID
+
+	logrus.WithFields(logrus.Fields{
+		"seq":     s.Seq,
+		"users":   len(s.Users),
+		"markets": len(s.Markets),
+	}).Info("snapshot restored")
+
+	return nil
+}
+
+func (m *MarketSnapshot) restore(ex *Exchange) *OrderBook {
+	ob := NewOrderBook(m.Market, m.Spec)
+	ob.SetExchange(ex)
+
+	restoreLevels(ob.Bids, ob.BidsMap, ob.OrdersMap, m.Bids)
+	restoreLevels(ob.Asks, ob.AsksMap, ob.OrdersMap, m.Asks)
+	// pending stop orders aren't on a level of the book yet
+	restoreLevels(ob.buyStops, nil, ob.StopOrders, m.BuyStops)
+	restoreLevels(ob.sellStops, nil, ob.StopOrders, m.SellStops)
+
+	for i := range m.Trades {
+		trade := m.Trades[i]
+		ob.Trades.Put(trade.Timestamp, &trade)
+	}
+	ob.CurrentPrice = m.CurrentPrice
+	ob.lastTradeTs = m.LastTradeTs
+	ob.totalBidVolume = m.TotalBidVolume
+	ob.totalAskVolume = m.TotalAskVolume
+	ob.hiddenBidVolume = m.HiddenBidVolume
+	ob.hiddenAskVolume = m.HiddenAskVolume
+
+	return ob
+}
+
+// puts levels back on side, with their orders in orders. The orders of a book
+// level point back to it, levels is nil for the trigger book.
+func restoreLevels(side *avl.Tree[decimal.Decimal, *Limit], levels map[decimal.Decimal]*Limit, orders map[uuid.UUID]*Order, snapshots []LevelSnapshot) {
+	for _, level := range snapshots {
+		l := &Limit{
+			Price:        level.Price,
+			Orders:       avl.New[int64, *Order](g.Less[int64]),
+			TotalVolume:  level.TotalVolume,
+			HiddenVolume: level.HiddenVolume,
+		}
+		for i := range level.Orders {
+			o := level.Orders[i]
+			if levels != nil {
+				o.Limit = l
+			}
+			l.Orders.Put(o.Timestamp, &o)
+			orders[o.ID] = &o
+		}
+
+		side.Put(l.Price, l)
+		if levels != nil {
+			levels[l.Price] = l
+		}
+	}
+}
+
+// WriteSnapshot writes the exchange's state to path, replacing what's there
+// only once it's entirely on disk. The history the snapshot leaves out is then
+// dropped up to it.
+func (ex *Exchange) WriteSnapshot(path string) (*Snapshot, error) {
+	s := ex.Snapshot()
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return nil, err
+	}
+	ex.compact(s)
+
+	return s, nil
+}
+
+// compact drops the ledger's journal up to s and the trades s left out, so the
+// exchange holds what restoring s and replaying the log after it would
+func (ex *Exchange) compact(s *Snapshot) {
+	ex.Ledger.Compact(s.Ledger.LastTx)
+
+	ex.fees.mu.Lock()
+	ex.fees.trades = ex.fees.tradesSince(s.Clock - int64(FeeVolumeWindow))
+	ex.fees.mu.Unlock()
+}
+
+// LoadSnapshot reads the snapshot at path
+func LoadSnapshot(path string) (*Snapshot, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var s Snapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("snapshot %s: %w", path, err)
+	}
+	return &s, nil
+}
+
+// Recover rebuilds the exchange from the snapshot at snapshotPath, if there's
+// one, and the commands of the write-ahead log at walPath logged after it, then
+// logs every command from then on (see OpenWAL). Snapshots are taken to
+// snapshotPath from then on, see StartSnapshotter.
+func (ex *Exchange) Recover(snapshotPath, walPath string, config WALConfig) error {
+	s, err := LoadSnapshot(snapshotPath)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		logrus.WithField("path", snapshotPath).Info("no snapshot, the whole write-ahead log is replayed")
+	case err != nil:
+		return err
+	default:
+		if err := ex.Restore(s); err != nil {
+			return err
+		}
+	}
+
+	ex.snapshotPath = snapshotPath
+	if err := ex.OpenWAL(walPath, config); err != nil {
+		return err
+	}
+	// a wrong passphrase would otherwise only show once settlement signs
+	return ex.keystore.check()
+}
+
+// StartSnapshotter writes a snapshot to the path given to Recover at the given
+// interval, whenever a command was applied since the last one
+func (ex *Exchange) StartSnapshotter(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		var last uint64
+		for range ticker.C {
+			if ex.snapshotPath == "" || ex.Seq() == last {
+				continue
+			}
+
+			s, err := ex.WriteSnapshot(ex.snapshotPath)
+			if err != nil {
+				logrus.WithError(err).WithField("path", ex.snapshotPath).Error("snapshot not written")
+				continue
+			}
+			last = s.Seq
+
+			logrus.WithFields(logrus.Fields{
+				"path": ex.snapshotPath,
+				"seq":  s.Seq,
+			}).Info("snapshot written")
+		}
+	}()
+}
+
+// VerifySnapshot restores the latest snapshot onto a new exchange, replays the
+// write-ahead log onto it up to the last command applied here and compares the
+// result with the live state. The parts that differ are named in an
+// ErrSnapshotMismatch.
+func (ex *Exchange) VerifySnapshot() error {
+	ex.cmdMu.Lock()
+	live := ex.snapshot()
+	walPath := ""
+	if ex.wal != nil {
+		walPath = ex.wal.path
+	}
+	ex.cmdMu.Unlock()
+
+	if ex.snapshotPath == "" || walPath == "" {
+		return fmt.Errorf("the exchange wasn't recovered from a snapshot and write-ahead log")
+	}
+
+	s, err := LoadSnapshot(ex.snapshotPath)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(walPath)
+	if err != nil {
+		return err
+	}
+	commands, _, err := readWAL(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	for i, c := range commands {
+		if c.Seq > live.Seq {
+			commands = commands[:i]
+			break
+		}
+	}
+
+	restored := NewExchange()
+	if err := restored.Restore(s); err != nil {
+		return err
+	}
+	if err := restored.replay(commands); err != nil {
+		return err
+	}
+
+	return live.Compare(restored.Snapshot())
+}
+
+// Compare returns an ErrSnapshotMismatch naming every part of other that isn't
+// as it is in s. What the deposit watcher and settlement change outside of
+// commands (confirmations, transaction IDs, withdrawal progress) is left out.
+func (s *Snapshot) Compare(other *Snapshot) error {
+	ours, theirs := s.sections(), other.sections()
+
+	var differ []string
+	for name, data := range ours {
+		if theirs[name] != data {
+			differ = append(differ, name)
+		}
+	}
+	for name := range theirs {
+		if _, ok := ours[name]; !ok {
+			differ = append(differ, name)
+		}
+	}
+	if len(differ) > 0 {
+		sort.Strings(differ)
+		return fmt.Errorf("%w: %s", ErrSnapshotMismatch, strings.Join(differ, ", "))
+	}
+	return nil
+}
+
+// the JSON of each part of s that commands decide
+func (s *Snapshot) sections() map[string]string {
+	deposits := make([]Deposit, 0, len(s.Deposits))
+	for _, d := range s.Deposits {
+		// pending deposits are only known to the watcher, credited ones are
+		// numbered in the order they were seen
+		if d.Status != DepositCredited {
+			continue
+		}
+		d.ID, d.Confirmations, d.CreatedAt, d.UpdatedAt = 0, 0, 0, 0
+		deposits = append(deposits, d)
+	}
+	sort.Slice(deposits, func(i, j int) bool {
+		return depositKey(deposits[i].Asset, deposits[i].TxID) < depositKey(deposits[j].Asset, deposits[j].TxID)
+	})
+
+	withdrawals := make([]Withdrawal, 0, len(s.Withdrawals))
+	for _, w := range s.Withdrawals {
+		if w.Status == WithdrawalBroadcast || w.Status == WithdrawalConfirmed {
+			w.Status = WithdrawalApproved
+		}
+		w.TxID, w.UpdatedAt = "", 0
+		withdrawals = append(withdrawals, w)
+	}
+
+	// keys are encrypted with a fresh salt every time, only which ones there are is compared
+	keyAddresses := make([]common.Address, 0, len(s.Keys))
+	for _, data := range s.Keys {
+		address, _ := keyAddress(data)
+		keyAddresses = append(keyAddresses, address)
+	}
+
+	parts := map[string]any{
+		"sequence number":       s.Seq,
+		"clock":                 s.Clock,
+		"users":                 s.Users,
+		"balances":              s.Ledger,
+		"order index":           s.Orders,
+		"self-trade prevention": s.SelfTradePrevention,
+		"max open orders":       s.MaxOpenOrders,
+		"fee currencies":        s.FeeCurrency,
+		"user trades":           s.UserTrades,
+		"deposit addresses":     s.DepositAddresses,
+		"deposits":              deposits,
+		"withdrawal limits":     s.WithdrawalLimits,
+		"withdrawals":           withdrawals,
+		"API keys":              s.APIKeys,
+		"reversed transfers":    s.ReversedTransfers,
+		"shortfalls":            s.Shortfalls,
+		"keystore":              keyAddresses,
+	}
+	for _, m := range s.Markets {
+		parts["market "+string(m.Market)] = m
+	}
+
+	sections := make(map[string]string, len(parts))
+	for name, part := range parts {
+		data, _ := json.Marshal(part)
+		sections[name] = string(data)
+	}
+	return sections
+}
@@ -0,0 +1,149 @@
+package core
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/EggsyOnCode/velho-exchange/auth"
+	"github.com/EggsyOnCode/velho-exchange/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecoverFromSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	snapshotPath, walPath := filepath.Join(dir, "snapshot.json"), filepath.Join(dir, "commands.wal")
+	recover := func() *Exchange {
+		ex := NewExchange()
+		require.NoError(t, ex.OpenSettlementJournal(filepath.Join(dir, "settlement.jsonl")))
+		require.NoError(t, ex.Recover(snapshotPath, walPath, DefaultWALConfig))
+		return ex
+	}
+
+	ex := recover()
+	seller := auth.NewUser(nil, decimal.FromInt(1_000))
+	buyer := auth.NewUser(nil, decimal.FromInt(10_000))
+	require.NoError(t, ex.AddUser(seller))
+	require.NoError(t, ex.AddUser(buyer))
+	sellerID, buyerID := seller.ID.String(), buyer.ID.String()
+	deposit(t, ex, sellerID, AssetETH, 5)
+	require.NoError(t, ex.SetFeeSchedule(ETH, DefaultFeeSchedule))
+
+	iceberg := NewOrder(decimal.FromInt(5), false, decimal.FromInt(1_000), sellerID)
+	iceberg.DisplaySize = decimal.FromInt(1)
+	_, err := ex.PlaceOrder(ETH, iceberg)
+	require.NoError(t, err)
+	_, err = ex.PlaceOrder(ETH, NewOrder(decimal.FromInt(2), true, decimal.FromInt(1_000), buyerID))
+	require.NoError(t, err)
+	_, err = ex.PlaceOrder(ETH, NewStopOrder(StopMarketOrder, decimal.FromInt(1), true, decimal.FromInt(1_100), decimal.Zero, buyerID))
+	require.NoError(t, err)
+	_, err = ex.DepositAddress(buyerID)
+	require.NoError(t, err)
+	key, secret, err := ex.CreateAPIKey(buyerID, APIKey{Scopes: []APIScope{ScopeTrade}})
+	require.NoError(t, err)
+
+	s, err := ex.WriteSnapshot(snapshotPath)
+	require.NoError(t, err)
+	assert.Equal(t, ex.Seq(), s.Seq)
+
+	// the log tail after the snapshot
+	_, err = ex.PlaceOrder(ETH, NewOrder(decimal.FromInt(1), true, decimal.FromInt(1_000), buyerID))
+	require.NoError(t, err)
+	resting := NewOrder(decimal.FromInt(1), true, decimal.FromInt(900), buyerID)
+	_, err = ex.PlaceOrder(ETH, resting)
+	require.NoError(t, err)
+	require.NoError(t, ex.VerifySnapshot())
+	ex.WaitSettled()
+	require.NoError(t, ex.CloseWAL())
+
+	restored := recover()
+	assert.Equal(t, ex.Seq(), restored.Seq())
+	assert.NoError(t, ex.Snapshot().Compare(restored.Snapshot()))
+	assert.NoError(t, restored.Ledger.Check())
+	assert.Equal(t, ex.UserTrades(buyerID), restored.UserTrades(buyerID))
+	assert.Equal(t, decimal.FromInt(2), restored.OrderBook[ETH].FillableAskVolume())
+	assert.NotNil(t, restored.OrderBook[ETH].GetOrderById(resting.ID.String()))
+	orders, _ := restored.GetOrders(buyerID)
+	assert.Len(t, orders, 2)
+	restoredKey, restoredSecret, ok := restored.LookupAPIKey(key.ID)
+	require.True(t, ok)
+	assert.Equal(t, key, restoredKey)
+	assert.Equal(t, []byte(secret), restoredSecret)
+
+	// the restored exchange goes on logging after the commands it replayed
+	_, err = restored.PlaceOrder(ETH, NewOrder(decimal.FromInt(1), true, decimal.FromInt(1_000), buyerID))
+	require.NoError(t, err)
+	assert.Equal(t, s.Seq+3, restored.Seq())
+	require.NoError(t, restored.VerifySnapshot())
+	require.NoError(t, restored.CloseWAL())
+}
+
+func TestVerifySnapshotFindsDivergence(t *testing.T) {
+	dir := t.TempDir()
+	ex := NewExchange()
+	require.NoError(t, ex.Recover(filepath.Join(dir, "snapshot.json"), filepath.Join(dir, "commands.wal"), DefaultWALConfig))
+	defer ex.CloseWAL()
+
+	user := auth.NewUser(nil, decimal.FromInt(1_000))
+	require.NoError(t, ex.AddUser(user))
+	_, err := ex.WriteSnapshot(filepath.Join(dir, "snapshot.json"))
+	require.NoError(t, err)
+	require.NoError(t, ex.VerifySnapshot())
+
+	// a change that bypassed the log
+	ex.OrderBook[ETH].PlaceLimitOrder(decimal.FromInt(100), NewOrder(decimal.FromInt(1), true, decimal.FromInt(100), user.ID.String()))
+
+	err = ex.VerifySnapshot()
+	assert.ErrorIs(t, err, ErrSnapshotMismatch)
+	assert.ErrorContains(t, err, "market ETH")
+	assert.ErrorContains(t, err, "balances")
+
+	_, err = LoadSnapshot(filepath.Join(dir, "missing.json"))
+	assert.Error(t, err)
+}
+
+func TestSnapshotLeavesHistoryOut(t *testing.T) {
+	dir := t.TempDir()
+	snapshotPath := filepath.Join(dir, "snapshot.json")
+	ex := NewExchange()
+	require.NoError(t, ex.Recover(snapshotPath, filepath.Join(dir, "commands.wal"), DefaultWALConfig))
+	defer ex.CloseWAL()
+
+	seller := auth.NewUser(nil, decimal.Zero)
+	buyer := auth.NewUser(nil, decimal.FromInt(1_000_000))
+	require.NoError(t, ex.AddUser(seller))
+	require.NoError(t, ex.AddUser(buyer))
+	sellerID, buyerID := seller.ID.String(), buyer.ID.String()
+	deposit(t, ex, sellerID, AssetETH, 2_000)
+
+	_, err := ex.PlaceOrder(ETH, NewOrder(decimal.FromInt(2_000), false, decimal.FromInt(100), sellerID))
+	require.NoError(t, err)
+	for i := 0; i < MaxBookTrades+5; i++ {
+		_, err := ex.PlaceOrder(ETH, NewOrder(decimal.FromInt(1), true, decimal.FromInt(100), buyerID))
+		require.NoError(t, err)
+	}
+	// a book only keeps its latest trades
+	assert.Equal(t, MaxBookTrades, ex.OrderBook[ETH].Trades.Size())
+
+	// a fill the fee tiers no longer count
+	old := UserTrade{Market: ETH, OrderID: "old", Timestamp: ex.Snapshot().Clock - int64(FeeVolumeWindow) - 1}
+	ex.fees.trades[buyerID] = append([]UserTrade{old}, ex.fees.trades[buyerID]...)
+	before := len(ex.Ledger.Journal())
+
+	s, err := ex.WriteSnapshot(snapshotPath)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(before), s.Ledger.LastTx)
+	assert.NotContains(t, s.UserTrades[buyerID], old)
+	assert.Len(t, s.UserTrades[buyerID], MaxBookTrades+5)
+
+	// the history the snapshot left out is dropped up to it
+	assert.Empty(t, ex.Ledger.Journal())
+	assert.NoError(t, ex.Ledger.Check())
+	assert.NotContains(t, ex.UserTrades(buyerID), old)
+
+	_, err = ex.PlaceOrder(ETH, NewOrder(decimal.FromInt(1), true, decimal.FromInt(100), buyerID))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(before)+1, ex.Ledger.Journal()[0].ID)
+	assert.NoError(t, ex.Ledger.Check())
+	require.NoError(t, ex.VerifySnapshot())
+}
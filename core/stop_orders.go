@@ -0,0 +1,152 @@
+package core
+
+import (
+	"errors"
+	"time"
+
+	"github.com/EggsyOnCode/velho-exchange/decimal"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+var ErrInvalidStopOrder = errors.New("stop orders need a positive stop price (and a limit price for STOP_LIMIT)")
+
+// stop orders wait in the order book's trigger book until the last traded price
+// reaches their stop price: buy stops trigger when it rises to or above it, sell
+// stops when it falls to or below it. A triggered STOP_MARKET order is then
+// placed as a market order and a STOP_LIMIT order as a limit order at Price.
+func NewStopOrder(orderType OrderType, size decimal.Decimal, bid bool, stopPrice, price decimal.Decimal, userID string) *Order {
+	return &Order{
+		ID:          uuid.New(),
+		Size:        size,
+		Timestamp:   time.Now().UnixNano(),
+		Bid:         bid,
+		Price:       price,
+		StopPrice:   stopPrice,
+		OrderType:   orderType,
+		UserID:      userID,
+		TimeInForce: GoodTillCancel,
+	}
+}
+
+func (o *Order) IsStop() bool {
+	return o.OrderType == StopMarketOrder || o.OrderType == StopLimitOrder
+}
+
+// PlaceStopOrder adds o to the trigger book, if the last traded price already
+// reached its stop price it is triggered right away. It locks what it will be
+// paid with while it waits (see Order.stopLock), ErrInsufficientFunds if its
+// user can't cover that.
+func (ob *OrderBook) PlaceStopOrder(o *Order) error {
+	if err := ob.CheckOpen(); err != nil {
+		return err
+	}
+	if !o.IsStop() || !o.StopPrice.IsPositive() || (o.OrderType == StopLimitOrder && !o.Price.IsPositive()) {
+		return ErrInvalidStopOrder
+	}
+	if err := ob.reserve(o, o.stopLock()); err != nil {
+		return err
+	}
+
+	side := ob.sellStops
+	if o.Bid {
+		side = ob.buyStops
+	}
+
+	level, ok := side.Get(o.StopPrice)
+	if !ok {
+		level = NewLimit(o.StopPrice)
+		side.Put(o.StopPrice, level)
+	}
+	level.AddOrder(o)
+	ob.StopOrders[o.ID] = o
+
+	logrus.WithFields(logrus.Fields{
+		"id":        o.ID,
+		"stopPrice": o.StopPrice,
+		"price":     o.Price,
+		"size":      o.Size,
+		"type":      o.Type(),
+		"orderType": o.OrderType,
+		"userId":    o.UserID,
+	}).Info("new stop order")
+
+	ob.triggerStops()
+
+	return nil
+}
+
+// removes a pending stop order from the trigger book
+func (ob *OrderBook) removeStopOrder(o *Order) {
+	side := ob.sellStops
+	if o.Bid {
+		side = ob.buyStops
+	}
+
+	if level, ok := side.Get(o.StopPrice); ok {
+		if level.RemoveOrders([]*Order{o}) {
+			side.Remove(o.StopPrice)
+		}
+	}
+	delete(ob.StopOrders, o.ID)
+}
+
+// activates pending stop orders for as long as the last traded price triggers
+// one; orders triggered by the fills of other triggered orders are handled by
+// the outermost call
+func (ob *OrderBook) triggerStops() {
+	if ob.triggering {
+		return
+	}
+	ob.triggering = true
+	defer func() { ob.triggering = false }()
+
+	for {
+		o := ob.nextTriggeredStop()
+		if o == nil {
+			return
+		}
+
+		ob.removeStopOrder(o)
+		// the order locks what it needs as it's placed
+		ob.release(o, o.Locked)
+		o.Triggered = true
+		// a triggered order joins the book with fresh time priority
+		o.Timestamp = ob.now()
+
+		logrus.WithFields(logrus.Fields{
+			"id":           o.ID,
+			"stopPrice":    o.StopPrice,
+			"currentPrice": ob.CurrentPrice,
+			"orderType":    o.OrderType,
+		}).Info("stop order triggered")
+
+		if o.OrderType == StopLimitOrder {
+			if _, err := ob.PlaceLimitOrder(o.Price, o); err != nil {
+				logrus.WithError(err).WithField("id", o.ID).Error("triggered stop limit order rejected")
+			}
+		} else if _, err := ob.PlaceMarketOrder(o); err != nil {
+			logrus.WithError(err).WithField("id", o.ID).Error("triggered stop market order rejected")
+		}
+	}
+}
+
+// returns the oldest order at the first triggered stop level, if any
+func (ob *OrderBook) nextTriggeredStop() *Order {
+	// nothing has traded yet
+	if ob.lastTradeTs == 0 {
+		return nil
+	}
+
+	var level *Limit
+	if l := ob.bestLimit(ob.buyStops); l != nil && l.Price.Cmp(ob.CurrentPrice) <= 0 {
+		level = l
+	} else if l := ob.bestLimit(ob.sellStops); l != nil && l.Price.Cmp(ob.CurrentPrice) >= 0 {
+		level = l
+	}
+
+	if level == nil {
+		return nil
+	}
+	return level.head()
+}
@@ -0,0 +1,134 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/EggsyOnCode/velho-exchange/auth"
+	"github.com/EggsyOnCode/velho-exchange/decimal"
+	"github.com/EggsyOnCode/velho-exchange/ledger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStopMarketOrderTriggersOnLastTrade(t *testing.T) {
+	ex := NewExchange()
+	ob := ex.OrderBook[BTC]
+
+	seller := auth.NewUser(nil, decimal.Zero)
+	buyer := auth.NewUser(nil, decimal.FromInt(10_000))
+	stopper := auth.NewUser(nil, decimal.FromInt(10_000))
+	ex.AddUser(seller)
+	ex.AddUser(buyer)
+	ex.AddUser(stopper)
+	deposit(t, ex, seller.ID.String(), AssetBTC, 7)
+
+	ob.PlaceLimitOrder(decimal.FromInt(100), NewOrder(decimal.FromInt(2), false, decimal.FromInt(100), seller.ID.String()))
+	ob.PlaceLimitOrder(decimal.FromInt(110), NewOrder(decimal.FromInt(5), false, decimal.FromInt(110), seller.ID.String()))
+
+	stop := NewStopOrder(StopMarketOrder, decimal.FromInt(2), true, decimal.FromInt(105), decimal.Zero, stopper.ID.String())
+	assert.NoError(t, ob.PlaceStopOrder(stop))
+	assert.False(t, stop.Triggered)
+	assert.Equal(t, stop, ob.GetOrderById(stop.ID.String()))
+
+	// trades at 100 don't reach the stop price
+	ob.PlaceLimitOrder(decimal.FromInt(100), NewOrder(decimal.FromInt(1), true, decimal.FromInt(100), buyer.ID.String()))
+	assert.False(t, stop.Triggered)
+
+	// the last trade at 110 does
+	ob.PlaceLimitOrder(decimal.FromInt(110), NewOrder(decimal.FromInt(2), true, decimal.FromInt(110), buyer.ID.String()))
+
+	assert.True(t, stop.Triggered)
+	assert.True(t, stop.IsFilled())
+	assert.Empty(t, ob.StopOrders)
+	assert.Equal(t, decimal.FromInt(2), ob.TotalAskVolume())
+	assert.Equal(t, decimal.FromInt(10_000-220), stopper.USD)
+}
+
+func TestStopLimitOrderRestsAfterTriggerAndCanBeCancelled(t *testing.T) {
+	ex := NewExchange()
+	ob := ex.OrderBook[BTC]
+
+	seller := auth.NewUser(nil, decimal.Zero)
+	buyer := auth.NewUser(nil, decimal.FromInt(10_000))
+	ex.AddUser(seller)
+	ex.AddUser(buyer)
+	deposit(t, ex, seller.ID.String(), AssetBTC, 6)
+
+	ob.PlaceLimitOrder(decimal.FromInt(100), NewOrder(decimal.FromInt(1), true, decimal.FromInt(100), buyer.ID.String()))
+	ob.PlaceLimitOrder(decimal.FromInt(90), NewOrder(decimal.FromInt(1), true, decimal.FromInt(90), buyer.ID.String()))
+
+	pending := NewStopOrder(StopLimitOrder, decimal.FromInt(1), false, decimal.FromInt(50), decimal.FromInt(50), seller.ID.String())
+	assert.NoError(t, ob.PlaceStopOrder(pending))
+
+	stop := NewStopOrder(StopLimitOrder, decimal.FromInt(3), false, decimal.FromInt(95), decimal.FromInt(95), seller.ID.String())
+	assert.NoError(t, ob.PlaceStopOrder(stop))
+	ex.AddOrder(&ExOrder{ID: stop.ID.String(), UserID: seller.ID.String(), Market: BTC, OrderType: StopLimitOrder})
+
+	orders, _ := ex.GetOrders(seller.ID.String())
+	assert.Len(t, orders, 1)
+	assert.False(t, orders[0].Triggered)
+
+	// selling into the 100 bid doesn't trigger, selling into the 90 bid does
+	ob.PlaceLimitOrder(decimal.FromInt(100), NewOrder(decimal.FromInt(1), false, decimal.FromInt(100), seller.ID.String()))
+	assert.False(t, stop.Triggered)
+	ob.PlaceLimitOrder(decimal.FromInt(90), NewOrder(decimal.FromInt(1), false, decimal.FromInt(90), seller.ID.String()))
+	assert.True(t, stop.Triggered)
+
+	// nothing bids at 95 anymore, so the stop limit rests on the book
+	assert.Equal(t, decimal.FromInt(95), ob.GetBestAskPrice())
+	orders, _ = ex.GetOrders(seller.ID.String())
+	assert.Len(t, orders, 1)
+	assert.True(t, orders[0].Triggered)
+
+	// pending stops are cancelled straight out of the trigger book
+	assert.Equal(t, ledger.Balance{Locked: decimal.FromInt(4)}, ex.Ledger.Balance(seller.ID.String(), AssetBTC))
+	ob.CancelOrderById(pending.ID.String())
+	assert.Nil(t, ob.GetOrderById(pending.ID.String()))
+	assert.Empty(t, ob.StopOrders)
+	assert.Equal(t, ledger.Balance{Available: decimal.FromInt(1), Locked: decimal.FromInt(3)}, ex.Ledger.Balance(seller.ID.String(), AssetBTC))
+}
+
+func TestStopOrdersLockFundsWhileTheyWait(t *testing.T) {
+	ex := NewExchange()
+	ob := ex.OrderBook[BTC]
+
+	user := auth.NewUser(nil, decimal.FromInt(1_000))
+	ex.AddUser(user)
+	userID := user.ID.String()
+	deposit(t, ex, userID, AssetBTC, 1)
+
+	// a stop market buy locks its size at its stop price, or its worst price
+	// when it has one
+	buy := NewStopOrder(StopMarketOrder, decimal.FromInt(2), true, decimal.FromInt(200), decimal.Zero, userID)
+	assert.NoError(t, ob.PlaceStopOrder(buy))
+	assert.Equal(t, ledger.Balance{Available: decimal.FromInt(600), Locked: decimal.FromInt(400)}, ex.Ledger.Balance(userID, AssetUSD))
+	capped := NewStopOrder(StopMarketOrder, decimal.FromInt(2), true, decimal.FromInt(200), decimal.Zero, userID)
+	capped.WorstPrice = decimal.FromInt(400)
+	assert.ErrorIs(t, ob.PlaceStopOrder(capped), ErrInsufficientFunds)
+	assert.Len(t, ob.StopOrders, 1)
+
+	// a stop sell locks its size until it expires
+	sell := NewStopOrder(StopLimitOrder, decimal.FromInt(1), false, decimal.FromInt(50), decimal.FromInt(50), userID)
+	sell.TimeInForce = GoodTillDate
+	sell.ExpiresAt = time.Now().Add(time.Minute).UnixNano()
+	assert.NoError(t, ob.PlaceStopOrder(sell))
+	assert.ErrorIs(t, ob.PlaceStopOrder(NewStopOrder(StopMarketOrder, decimal.FromInt(1), false, decimal.FromInt(50), decimal.Zero, userID)), ErrInsufficientFunds)
+	assert.Equal(t, ledger.Balance{Locked: decimal.FromInt(1)}, ex.Ledger.Balance(userID, AssetBTC))
+
+	assert.True(t, ob.HasExpired(sell.ExpiresAt))
+	assert.Equal(t, []*Order{sell}, ob.ExpireOrders(sell.ExpiresAt))
+	assert.Equal(t, ledger.Balance{Available: decimal.FromInt(1)}, ex.Ledger.Balance(userID, AssetBTC))
+
+	ob.CancelOrderById(buy.ID.String())
+	assert.Empty(t, ob.StopOrders)
+	assert.Equal(t, ledger.Balance{Available: decimal.FromInt(1_000)}, ex.Ledger.Balance(userID, AssetUSD))
+	assert.NoError(t, ex.Ledger.Check())
+}
+
+func TestPlaceStopOrderValidation(t *testing.T) {
+	ob := NewOrderBook(BTC, DefaultMarketSpecs[BTC])
+
+	assert.ErrorIs(t, ob.PlaceStopOrder(NewStopOrder(StopMarketOrder, decimal.FromInt(1), true, decimal.Zero, decimal.Zero, "user")), ErrInvalidStopOrder)
+	assert.ErrorIs(t, ob.PlaceStopOrder(NewStopOrder(StopLimitOrder, decimal.FromInt(1), true, decimal.FromInt(10), decimal.Zero, "user")), ErrInvalidStopOrder)
+	assert.ErrorIs(t, ob.PlaceStopOrder(NewOrder(decimal.FromInt(1), true, decimal.FromInt(10), "user")), ErrInvalidStopOrder)
+}
@@ -0,0 +1,338 @@
+package core
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// The write-ahead log holds every command that changed the exchange's state, in
+// the order they were applied. A record is framed as
+//
+//	length  uint32, big endian, of the payload
+//	crc     uint32, big endian, CRC-32C of the payload
+//	payload the command as JSON
+//
+// Commands are appended before they're applied, so replaying the log onto a
+// fresh exchange rebuilds the books, balances and trade tape it had. An append
+// that fails is cut off the log again: the command isn't applied, so it mustn't
+// be replayed either.
+
+// SyncPolicy decides when appended commands are flushed to disk
+type SyncPolicy string
+
+const (
+	// every command is synced before it's applied, nothing accepted is lost (default)
+	SyncAlways SyncPolicy = "ALWAYS"
+	// commands are synced every WALConfig.SyncInterval, a crash loses at most
+	// that much of them
+	SyncInterval SyncPolicy = "INTERVAL"
+	// syncing is left to the OS
+	SyncNever SyncPolicy = "NEVER"
+)
+
+type WALConfig struct {
+	Sync         SyncPolicy
+	SyncInterval time.Duration
+}
+
+var DefaultWALConfig = WALConfig{
+	Sync:         SyncAlways,
+	SyncInterval: 100 * time.Millisecond,
+}
+
+// largest payload a record can hold, anything above is taken as corruption
+const maxWALRecord = 16 << 20
+
+const walHeaderSize = 8
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrWALCorrupt is returned when a record in the middle of the log doesn't
+// check out. A torn record at its end is expected after a crash and dropped.
+var ErrWALCorrupt = errors.New("write-ahead log is corrupt")
+
+type CommandType string
+
+// Command is a record of the write-ahead log
+type Command struct {
+	// position in the log, from 1
+	Seq  uint64      `json:"seq"`
+	Type CommandType `json:"type"`
+	// unix nanos it was accepted at, the engine's clock while it's applied
+	Time int64           `json:"time"`
+	Data json.RawMessage `json:"data"`
+}
+
+type WAL struct {
+	mu     sync.Mutex
+	path   string
+	f      *os.File
+	config WALConfig
+	// sequence number of the last record
+	seq uint64
+	// offset the last record ends at
+	size int64
+	// set once a failed append couldn't be cut off, nothing is appended after it
+	failed error
+	// whether records were written since the last sync
+	dirty bool
+	done  chan struct{}
+}
+
+func (c WALConfig) validate() error {
+	switch c.Sync {
+	case SyncAlways, SyncNever:
+		return nil
+	case SyncInterval:
+		if c.SyncInterval <= 0 {
+			return fmt.Errorf("sync interval must be positive")
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown sync policy %q", c.Sync)
+}
+
+// OpenWAL opens the log at path, creating it if needed, and returns the commands
+// it holds. A torn record at the end is cut off so appending carries on after
+// the last good one.
+func OpenWAL(path string, config WALConfig) (*WAL, []Command, error) {
+	if err := config.validate(); err != nil {
+		return nil, nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	commands, end, err := readWAL(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if info.Size() > end {
+		logrus.WithFields(logrus.Fields{
+			"path":    path,
+			"dropped": info.Size() - end,
+		}).Warn("torn record at the end of the write-ahead log dropped")
+
+		if err := f.Truncate(end); err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+	}
+	if _, err := f.Seek(end, io.SeekStart); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	w := &WAL{path: path, f: f, config: config, size: end, done: make(chan struct{})}
+	if len(commands) > 0 {
+		w.seq = commands[len(commands)-1].Seq
+	}
+	if config.Sync == SyncInterval {
+		go w.syncEvery(config.SyncInterval)
+	}
+
+	return w, commands, nil
+}
+
+// reads every record of r, returns them with the offset the last good one ends at
+func readWAL(r io.ReadSeeker) ([]Command, int64, error) {
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, 0, err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+
+	var commands []Command
+	var offset int64
+	header := make([]byte, walHeaderSize)
+	for offset < size {
+		if _, err := io.ReadFull(r, header); err != nil {
+			// a header cut short can only be the last record
+			return commands, offset, nil
+		}
+		length := binary.BigEndian.Uint32(header[:4])
+		sum := binary.BigEndian.Uint32(header[4:])
+		end := offset + walHeaderSize + int64(length)
+		if length > maxWALRecord {
+			return nil, 0, fmt.Errorf("%w: record at offset %d claims %d bytes", ErrWALCorrupt, offset, length)
+		}
+		if end > size {
+			return commands, offset, nil
+		}
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return nil, 0, err
+		}
+		if crc32.Checksum(payload, crc32c) != sum {
+			if end == size {
+				return commands, offset, nil
+			}
+			return nil, 0, fmt.Errorf("%w: checksum mismatch at offset %d", ErrWALCorrupt, offset)
+		}
+
+		var c Command
+		if err := json.Unmarshal(payload, &c); err != nil {
+			return nil, 0, fmt.Errorf("%w: record at offset %d: %v", ErrWALCorrupt, offset, err)
+		}
+		if n := len(commands); n > 0 && c.Seq != commands[n-1].Seq+1 {
+			return nil, 0, fmt.Errorf("%w: record at offset %d has sequence number %d after %d", ErrWALCorrupt, offset, c.Seq, commands[n-1].Seq)
+		}
+
+		commands = append(commands, c)
+		offset = end
+	}
+
+	return commands, offset, nil
+}
+
+// makes sure commands, the log's records, carry on from seq, the last command
+// the exchange applied, and appends after it
+func (w *WAL) resume(seq uint64, commands []Command) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(commands) == 0 {
+		w.seq = max(w.seq, seq)
+		return nil
+	}
+	if first := commands[0].Seq; first > seq+1 {
+		return fmt.Errorf("log starts at command %d, commands %d to %d are missing", first, seq+1, first-1)
+	}
+	if w.seq < seq {
+		return fmt.Errorf("log ends at command %d, before command %d the exchange was restored at", w.seq, seq)
+	}
+	return nil
+}
+
+// Append gives c the next sequence number and writes it, it's on disk when this
+// returns if the log syncs every command. If writing or syncing it fails it's
+// cut off the log again and the sequence number isn't used.
+func (w *WAL) Append(c *Command) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.failed != nil {
+		return w.failed
+	}
+
+	c.Seq = w.seq + 1
+	payload, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	record := make([]byte, walHeaderSize, walHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:], crc32.Checksum(payload, crc32c))
+	record = append(record, payload...)
+
+	if _, err := w.f.Write(record); err != nil {
+		return w.truncateLocked(err)
+	}
+	w.dirty = true
+	if w.config.Sync == SyncAlways {
+		if err := w.syncLocked(); err != nil {
+			return w.truncateLocked(err)
+		}
+	}
+
+	w.seq = c.Seq
+	w.size += int64(len(record))
+	return nil
+}
+
+// cuts what a failed append wrote off the log and returns err, the append's
+// error. If the log can't be cut back it refuses every append from then on.
+func (w *WAL) truncateLocked(err error) error {
+	terr := w.f.Truncate(w.size)
+	if terr == nil {
+		_, terr = w.f.Seek(w.size, io.SeekStart)
+	}
+	if terr != nil {
+		w.failed = fmt.Errorf("write-ahead log failed after record %d: %v, and couldn't be cut back: %v", w.seq, err, terr)
+		logrus.WithError(w.failed).Error("write-ahead log takes no more records")
+		return w.failed
+	}
+	return err
+}
+
+// Seq returns the sequence number of the last record
+func (w *WAL) Seq() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.seq
+}
+
+// Sync flushes what was appended to disk
+func (w *WAL) Sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.syncLocked()
+}
+
+func (w *WAL) syncLocked() error {
+	if !w.dirty {
+		return nil
+	}
+	if err := w.f.Sync(); err != nil {
+		return err
+	}
+	w.dirty = false
+	return nil
+}
+
+func (w *WAL) syncEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := w.Sync(); err != nil {
+				logrus.WithError(err).Error("write-ahead log not synced")
+			}
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// Close syncs and closes the log
+func (w *WAL) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	select {
+	case <-w.done:
+		return nil
+	default:
+		close(w.done)
+	}
+
+	err := w.syncLocked()
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,190 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/EggsyOnCode/velho-exchange/auth"
+	"github.com/EggsyOnCode/velho-exchange/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWALDropsTornRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "commands.wal")
+
+	wal, commands, err := OpenWAL(path, DefaultWALConfig)
+	require.NoError(t, err)
+	assert.Empty(t, commands)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, wal.Append(&Command{Type: CmdCancelOrder, Data: []byte(`{}`)}))
+	}
+	require.NoError(t, wal.Close())
+
+	// a crash halfway through the fourth record
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0, 0, 0, 42, 1, 2})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	wal, commands, err = OpenWAL(path, DefaultWALConfig)
+	require.NoError(t, err)
+	require.Len(t, commands, 3)
+	assert.Equal(t, uint64(3), commands[2].Seq)
+
+	c := Command{Type: CmdCancelOrder, Data: []byte(`{}`)}
+	require.NoError(t, wal.Append(&c))
+	assert.Equal(t, uint64(4), c.Seq)
+	require.NoError(t, wal.Close())
+
+	_, commands, err = OpenWAL(path, DefaultWALConfig)
+	require.NoError(t, err)
+	assert.Len(t, commands, 4)
+}
+
+func TestWALCorruptRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "commands.wal")
+
+	wal, _, err := OpenWAL(path, WALConfig{Sync: SyncNever})
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		require.NoError(t, wal.Append(&Command{Type: CmdCancelOrder, Data: []byte(`{}`)}))
+	}
+	require.NoError(t, wal.Close())
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	data[walHeaderSize+1] ^= 0xff
+	require.NoError(t, os.WriteFile(path, data, 0o600))
+
+	_, _, err = OpenWAL(path, DefaultWALConfig)
+	assert.ErrorIs(t, err, ErrWALCorrupt)
+
+	_, _, err = OpenWAL(path, WALConfig{Sync: SyncInterval})
+	assert.Error(t, err)
+}
+
+func TestWALCutsOffFailedAppend(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "commands.wal")
+
+	wal, _, err := OpenWAL(path, DefaultWALConfig)
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		require.NoError(t, wal.Append(&Command{Type: CmdCancelOrder, Data: []byte(`{}`)}))
+	}
+
+	// the disk goes away: the record isn't written and can't be cut off either
+	f := wal.f
+	wal.f, err = os.Open(path)
+	require.NoError(t, err)
+	assert.Error(t, wal.Append(&Command{Type: CmdCancelOrder, Data: []byte(`{}`)}))
+	assert.Equal(t, uint64(2), wal.Seq())
+	wal.f.Close()
+	wal.f = f
+	assert.Error(t, wal.Append(&Command{Type: CmdCancelOrder, Data: []byte(`{}`)}))
+	require.NoError(t, wal.Close())
+
+	_, commands, err := OpenWAL(path, DefaultWALConfig)
+	require.NoError(t, err)
+	assert.Len(t, commands, 2)
+}
+
+func TestWALReplaysPanickingCommand(t *testing.T) {
+	commandTypes["PANIC"] = func() command { return &panicCommand{} }
+	defer delete(commandTypes, "PANIC")
+
+	path := filepath.Join(t.TempDir(), "commands.wal")
+	ex := NewExchange()
+	require.NoError(t, ex.OpenWAL(path, DefaultWALConfig))
+	assert.ErrorIs(t, ex.execute("PANIC", &panicCommand{}), ErrRequestPanicked)
+	user := auth.NewUser(nil, decimal.FromInt(1_000))
+	require.NoError(t, ex.AddUser(user))
+	require.NoError(t, ex.CloseWAL())
+
+	// it fails again rather than stopping the exchange from booting
+	restored := NewExchange()
+	require.NoError(t, restored.OpenWAL(path, DefaultWALConfig))
+	defer restored.CloseWAL()
+	assert.Contains(t, restored.Users, user.ID.String())
+}
+
+func TestExchangeReplaysWAL(t *testing.T) {
+	dir := t.TempDir()
+	open := func() *Exchange {
+		ex := NewExchange()
+		require.NoError(t, ex.OpenSettlementJournal(filepath.Join(dir, "settlement.jsonl")))
+		require.NoError(t, ex.OpenWAL(filepath.Join(dir, "commands.wal"), DefaultWALConfig))
+		return ex
+	}
+
+	ex := open()
+	seller := auth.NewUser(nil, decimal.FromInt(1_000))
+	buyer := auth.NewUser(nil, decimal.FromInt(5_000))
+	require.NoError(t, ex.AddUser(seller))
+	require.NoError(t, ex.AddUser(buyer))
+	sellerID, buyerID := seller.ID.String(), buyer.ID.String()
+	deposit(t, ex, sellerID, AssetETH, 3)
+
+	_, err := ex.PlaceOrder(ETH, NewOrder(decimal.FromInt(3), false, decimal.FromInt(1_000), sellerID))
+	require.NoError(t, err)
+	matches, err := ex.PlaceOrder(ETH, NewOrder(decimal.FromInt(1), true, decimal.FromInt(1_000), buyerID))
+	require.NoError(t, err)
+	require.Len(t, matches, 1)
+
+	resting := NewOrder(decimal.FromInt(2), true, decimal.FromInt(900), buyerID)
+	_, err = ex.PlaceOrder(ETH, resting)
+	require.NoError(t, err)
+	_, err = ex.AmendOrder(ETH, buyerID, resting.ID.String(), decimal.FromInt(950), decimal.FromInt(1))
+	require.NoError(t, err)
+	cancelled := NewOrder(decimal.FromInt(1), true, decimal.FromInt(800), buyerID)
+	_, err = ex.PlaceOrder(ETH, cancelled)
+	require.NoError(t, err)
+	require.NoError(t, ex.CancelOrder(ETH, cancelled.ID.String()))
+
+	// rejected commands are logged too, and rejected again on replay
+	_, err = ex.PlaceOrder(ETH, NewOrder(decimal.FromInt(100), true, decimal.FromInt(1_000), buyerID))
+	assert.ErrorIs(t, err, ErrInsufficientFunds)
+	// unless they're rejected before they're logged
+	seq := ex.wal.Seq()
+	protected := NewMarketOrder(decimal.FromInt(1), true, buyerID)
+	protected.MaxSlippageBps = MaxSlippageBps + 1
+	_, err = ex.PlaceOrder(ETH, protected)
+	assert.ErrorIs(t, err, ErrRiskCheck)
+	assert.Equal(t, seq, ex.wal.Seq())
+
+	w, err := ex.RequestWithdrawal(buyerID, AssetUSD, decimal.FromInt(100), "")
+	require.NoError(t, err)
+	_, err = ex.ApproveWithdrawal(w.ID)
+	require.NoError(t, err)
+	ex.WaitSettled()
+	require.NoError(t, ex.CloseWAL())
+
+	restored := open()
+	ex.WaitSettled()
+
+	for _, userID := range []string{sellerID, buyerID} {
+		assert.Equal(t, ex.Ledger.Balances(userID), restored.Ledger.Balances(userID))
+		assert.Equal(t, ex.Users[userID].USD, restored.Users[userID].USD)
+		assert.Equal(t, ex.UserTrades(userID), restored.UserTrades(userID))
+	}
+	assert.NoError(t, restored.Ledger.Check())
+
+	ob, rob := ex.OrderBook[ETH], restored.OrderBook[ETH]
+	assert.Equal(t, ob.TotalAskVolume(), rob.TotalAskVolume())
+	assert.Equal(t, ob.TotalBidVolume(), rob.TotalBidVolume())
+	assert.Equal(t, ob.CurrentPrice, rob.CurrentPrice)
+	assert.Equal(t, ob.Trades.Size(), rob.Trades.Size())
+	amended := rob.GetOrderById(resting.ID.String())
+	require.NotNil(t, amended)
+	assert.Equal(t, resting.Price, amended.Price)
+	assert.Equal(t, resting.Timestamp, amended.Timestamp)
+	assert.Nil(t, rob.GetOrderById(cancelled.ID.String()))
+
+	// the transfers were matched with the journal's, not queued again
+	assert.Equal(t, ex.Transfers(""), restored.Transfers(""))
+	rw, ok := restored.Withdrawal(w.ID)
+	require.True(t, ok)
+	assert.Equal(t, WithdrawalConfirmed, rw.Status)
+}
@@ -0,0 +1,407 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/EggsyOnCode/velho-exchange/decimal"
+	"github.com/EggsyOnCode/velho-exchange/ledger"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/sirupsen/logrus"
+)
+
+type WithdrawalStatus string
+
+const (
+	// waiting for an admin, the amount is locked
+	WithdrawalRequested WithdrawalStatus = "REQUESTED"
+	// taken off the user's balance and queued for settlement
+	WithdrawalApproved WithdrawalStatus = "APPROVED"
+	// its transaction was sent
+	WithdrawalBroadcast WithdrawalStatus = "BROADCAST"
+	WithdrawalConfirmed WithdrawalStatus = "CONFIRMED"
+	// turned down by an admin, the amount is unlocked
+	WithdrawalRejected WithdrawalStatus = "REJECTED"
+	// settlement gave up on it, the amount is credited back
+	WithdrawalFailed WithdrawalStatus = "FAILED"
+)
+
+var (
+	ErrWithdrawalNotFound = errors.New("withdrawal not found")
+	ErrWithdrawalLimit    = errors.New("withdrawal limit exceeded")
+	// approving or rejecting a withdrawal that isn't waiting for it
+	ErrWithdrawalState = errors.New("withdrawal is not awaiting approval")
+)
+
+type Withdrawal struct {
+	ID     uint64          `json:"id"`
+	UserID string          `json:"user_id"`
+	Asset  Asset           `json:"asset"`
+	Amount decimal.Decimal `json:"amount"`
+	// where it's sent, the user's wallet when it's empty
+	Address string           `json:"address,omitempty"`
+	Status  WithdrawalStatus `json:"status"`
+	// the settlement transfer carrying it, once it's approved
+	TransferID uint64 `json:"transfer_id,omitempty"`
+	TxID       string `json:"tx_id,omitempty"`
+	// why it was rejected or failed
+	Reason string `json:"reason,omitempty"`
+	// unix nanos
+	CreatedAt int64 `json:"created_at"`
+	UpdatedAt int64 `json:"updated_at"`
+}
+
+// WithdrawalLimits bound what users can withdraw of an asset, zero means no bound
+type WithdrawalLimits struct {
+	// largest single withdrawal
+	MaxAmount decimal.Decimal `json:"max_amount"`
+	// most a user can withdraw in 24 hours, rejected and failed withdrawals don't count
+	DailyLimit decimal.Decimal `json:"daily_limit"`
+	// withdrawals up to this amount are approved right away, larger ones wait
+	// for an admin. Zero means every withdrawal waits.
+	ApprovalThreshold decimal.Decimal `json:"approval_threshold"`
+}
+
+// withdrawalDesk keeps the withdrawals users requested. A withdrawal locks its
+// amount until an admin decides on it: approving takes it off the user's balance
+// and queues it for settlement, rejecting unlocks it.
+type withdrawalDesk struct {
+	mu          sync.Mutex
+	limits      map[Asset]WithdrawalLimits
+	withdrawals map[uint64]*Withdrawal
+	// withdrawal carried by each settlement transfer
+	byTransfer map[uint64]uint64
+	nextID     uint64
+}
+
+func newWithdrawalDesk() *withdrawalDesk {
+	return &withdrawalDesk{
+		limits:      make(map[Asset]WithdrawalLimits),
+		withdrawals: make(map[uint64]*Withdrawal),
+		byTransfer:  make(map[uint64]uint64),
+	}
+}
+
+// SetWithdrawalLimits replaces the limits of asset, requests already made keep their status
+func (ex *Exchange) SetWithdrawalLimits(asset Asset, limits WithdrawalLimits) error {
+	return ex.execute(CmdSetWithdrawalLimits, &withdrawalLimitsCommand{Asset: asset, Limits: limits})
+}
+
+func (ex *Exchange) WithdrawalLimits(asset Asset) WithdrawalLimits {
+	ex.withdrawals.mu.Lock()
+	defer ex.withdrawals.mu.Unlock()
+	return ex.withdrawals.limits[asset]
+}
+
+// RequestWithdrawal locks amount of userID's asset to be sent to address, their
+// own wallet if it's empty. It's approved right away if it's within the asset's
+// approval threshold.
+func (ex *Exchange) RequestWithdrawal(userID string, asset Asset, amount decimal.Decimal, address string) (Withdrawal, error) {
+	cmd := &requestWithdrawalCommand{UserID: userID, Asset: asset, Amount: amount, Address: address}
+	err := ex.execute(CmdRequestWithdrawal, cmd)
+	return cmd.withdrawal, err
+}
+
+func (ex *Exchange) requestWithdrawal(userID string, asset Asset, amount decimal.Decimal, address string) (Withdrawal, error) {
+	if _, ok := ex.Users[userID]; !ok {
+		return Withdrawal{}, fmt.Errorf("user %s not found", userID)
+	}
+	if ex.frozen(userID) {
+		return Withdrawal{}, ErrAccountFrozen
+	}
+	if !amount.IsPositive() {
+		return Withdrawal{}, fmt.Errorf("amount %s must be positive", amount)
+	}
+	if address != "" && !common.IsHexAddress(address) {
+		return Withdrawal{}, fmt.Errorf("invalid address %q", address)
+	}
+
+	d := ex.withdrawals
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Unix(0, ex.now())
+	limits := d.limits[asset]
+	if limits.MaxAmount.IsPositive() && amount.Cmp(limits.MaxAmount) > 0 {
+		return Withdrawal{}, fmt.Errorf("%w: %s is more than %s", ErrWithdrawalLimit, amount, limits.MaxAmount)
+	}
+	if limits.DailyLimit.IsPositive() {
+		withdrawn := d.withdrawnSince(userID, asset, now.Add(-24*time.Hour))
+		if withdrawn.Add(amount).Cmp(limits.DailyLimit) > 0 {
+			return Withdrawal{}, fmt.Errorf("%w: %s already withdrawn of %s today", ErrWithdrawalLimit, withdrawn, limits.DailyLimit)
+		}
+	}
+
+	d.nextID++
+	w := &Withdrawal{
+		ID:        d.nextID,
+		UserID:    userID,
+		Asset:     asset,
+		Amount:    amount,
+		Address:   address,
+		Status:    WithdrawalRequested,
+		CreatedAt: now.UnixNano(),
+		UpdatedAt: now.UnixNano(),
+	}
+	if err := ex.Ledger.Lock(userID, asset, amount, w.ref()); err != nil {
+		d.nextID--
+		return Withdrawal{}, err
+	}
+	d.withdrawals[w.ID] = w
+
+	logrus.WithFields(logrus.Fields{
+		"id":      w.ID,
+		"userId":  userID,
+		"asset":   asset,
+		"amount":  amount,
+		"address": address,
+	}).Info("withdrawal requested")
+
+	if limits.ApprovalThreshold.IsPositive() && amount.Cmp(limits.ApprovalThreshold) <= 0 {
+		if err := ex.approveWithdrawal(w); err != nil {
+			return *w, err
+		}
+	}
+
+	return *w, nil
+}
+
+// ApproveWithdrawal takes a requested withdrawal off its user's balance and
+// queues it for settlement
+func (ex *Exchange) ApproveWithdrawal(id uint64) (Withdrawal, error) {
+	cmd := &approveWithdrawalCommand{ID: id}
+	err := ex.execute(CmdApproveWithdrawal, cmd)
+	return cmd.withdrawal, err
+}
+
+func (ex *Exchange) approveWithdrawalByID(id uint64) (Withdrawal, error) {
+	d := ex.withdrawals
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	w, ok := d.withdrawals[id]
+	if !ok {
+		return Withdrawal{}, ErrWithdrawalNotFound
+	}
+	if w.Status != WithdrawalRequested {
+		return *w, ErrWithdrawalState
+	}
+
+	err := ex.approveWithdrawal(w)
+	return *w, err
+}
+
+// RejectWithdrawal turns a requested withdrawal down and unlocks its amount
+func (ex *Exchange) RejectWithdrawal(id uint64, reason string) (Withdrawal, error) {
+	cmd := &rejectWithdrawalCommand{ID: id, Reason: reason}
+	err := ex.execute(CmdRejectWithdrawal, cmd)
+	return cmd.withdrawal, err
+}
+
+func (ex *Exchange) rejectWithdrawal(id uint64, reason string) (Withdrawal, error) {
+	d := ex.withdrawals
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	w, ok := d.withdrawals[id]
+	if !ok {
+		return Withdrawal{}, ErrWithdrawalNotFound
+	}
+	if w.Status != WithdrawalRequested {
+		return *w, ErrWithdrawalState
+	}
+
+	if err := ex.Ledger.Unlock(w.UserID, w.Asset, w.Amount, w.ref()); err != nil {
+		return *w, err
+	}
+	w.Status = WithdrawalRejected
+	w.Reason = reason
+	w.UpdatedAt = ex.now()
+
+	logrus.WithFields(logrus.Fields{
+		"id":     w.ID,
+		"userId": w.UserID,
+		"reason": reason,
+	}).Info("withdrawal rejected")
+
+	return *w, nil
+}
+
+// Withdrawal returns the withdrawal with the given ID
+func (ex *Exchange) Withdrawal(id uint64) (Withdrawal, bool) {
+	d := ex.withdrawals
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	w, ok := d.withdrawals[id]
+	if !ok {
+		return Withdrawal{}, false
+	}
+	return *w, true
+}
+
+// Withdrawals returns the withdrawals of userID, or everyone's when it's empty,
+// with the given status, or any when it's empty, oldest first
+func (ex *Exchange) Withdrawals(userID string, status WithdrawalStatus) []Withdrawal {
+	d := ex.withdrawals
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	withdrawals := make([]Withdrawal, 0)
+	for _, w := range d.withdrawals {
+		if (userID == "" || w.UserID == userID) && (status == "" || w.Status == status) {
+			withdrawals = append(withdrawals, *w)
+		}
+	}
+	sort.Slice(withdrawals, func(i, j int) bool { return withdrawals[i].ID < withdrawals[j].ID })
+
+	return withdrawals
+}
+
+// the ledger reference of w's transactions
+func (w *Withdrawal) ref() string {
+	return fmt.Sprintf("withdrawal %d", w.ID)
+}
+
+// what userID requested of asset since then and wasn't turned down or failed
+func (d *withdrawalDesk) withdrawnSince(userID string, asset Asset, since time.Time) decimal.Decimal {
+	withdrawn := decimal.Zero
+	for _, w := range d.withdrawals {
+		if w.UserID != userID || w.Asset != asset || w.CreatedAt < since.UnixNano() {
+			continue
+		}
+		if w.Status == WithdrawalRejected || w.Status == WithdrawalFailed {
+			continue
+		}
+		withdrawn = withdrawn.Add(w.Amount)
+	}
+	return withdrawn
+}
+
+// pays w's locked amount out of the ledger and queues it, d.mu is held
+func (ex *Exchange) approveWithdrawal(w *Withdrawal) error {
+	_, err := ex.Ledger.Post(ledger.KindWithdrawal, w.ref(),
+		ledger.Posting{Account: ledger.LockedOf(w.UserID, w.Asset), Amount: w.Amount.Neg()},
+		ledger.Posting{Account: ledger.AvailableOf(ledger.External, w.Asset), Amount: w.Amount},
+	)
+	if err != nil {
+		return err
+	}
+
+	t, err := ex.queueTransfer(Transfer{
+		Asset:   w.Asset,
+		UserID:  w.UserID,
+		Amount:  w.Amount,
+		Address: w.Address,
+	})
+	if err != nil {
+		// the user was checked when it was requested, this can't happen
+		return err
+	}
+
+	w.Status = WithdrawalApproved
+	w.TransferID = t.ID
+	w.UpdatedAt = ex.now()
+	ex.withdrawals.byTransfer[t.ID] = w.ID
+
+	logrus.WithFields(logrus.Fields{
+		"id":       w.ID,
+		"userId":   w.UserID,
+		"transfer": t.ID,
+	}).Info("withdrawal approved")
+
+	return nil
+}
+
+// follows the settlement of the transfers carrying withdrawals, a failed one is
+// credited back to its user. That changes a balance, so it's logged as a command.
+// A failed transfer into custody is reversed, see shortfalls.go.
+func (ex *Exchange) transferUpdated(t Transfer) {
+	if t.ToExchange {
+		if t.Status == TransferFailed {
+			ex.reversePull(t)
+		}
+		return
+	}
+
+	d := ex.withdrawals
+	d.mu.Lock()
+	id, ok := d.byTransfer[t.ID]
+	failed := false
+	if ok {
+		w := d.withdrawals[id]
+		w.TxID = t.TxID
+		w.UpdatedAt = time.Now().UnixNano()
+
+		switch t.Status {
+		case TransferPending:
+			if t.TxID != "" {
+				w.Status = WithdrawalBroadcast
+			}
+		case TransferConfirmed:
+			w.Status = WithdrawalConfirmed
+		case TransferFailed:
+			failed = w.Status == WithdrawalApproved || w.Status == WithdrawalBroadcast
+		}
+	}
+	d.mu.Unlock()
+
+	if !failed {
+		return
+	}
+	if err := ex.execute(CmdFailWithdrawal, &failWithdrawalCommand{ID: id, Reason: t.Error}); err != nil && !errors.Is(err, ErrWithdrawalState) {
+		logrus.WithError(err).WithField("id", id).Error("failed withdrawal not credited back")
+	}
+}
+
+// marks withdrawal id failed and credits its amount back to its user, once
+func (ex *Exchange) failWithdrawal(id uint64, reason string) error {
+	d := ex.withdrawals
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	w, ok := d.withdrawals[id]
+	if !ok {
+		return ErrWithdrawalNotFound
+	}
+	if w.Status != WithdrawalApproved && w.Status != WithdrawalBroadcast {
+		return ErrWithdrawalState
+	}
+
+	if err := ex.Ledger.Deposit(w.UserID, w.Asset, w.Amount, w.ref()); err != nil {
+		return err
+	}
+	w.Status = WithdrawalFailed
+	w.Reason = reason
+	w.UpdatedAt = ex.now()
+
+	logrus.WithFields(logrus.Fields{
+		"id":     w.ID,
+		"userId": w.UserID,
+		"reason": reason,
+	}).Info("withdrawal failed")
+
+	return nil
+}
+
+// catches the withdrawals up with the transfers carrying them, for the updates
+// that came in while the write-ahead log was replayed or before a restart
+func (ex *Exchange) followWithdrawals() {
+	d := ex.withdrawals
+	d.mu.Lock()
+	transfers := make([]uint64, 0, len(d.byTransfer))
+	for id := range d.byTransfer {
+		transfers = append(transfers, id)
+	}
+	d.mu.Unlock()
+	sort.Slice(transfers, func(i, j int) bool { return transfers[i] < transfers[j] })
+
+	for _, id := range transfers {
+		if t, ok := ex.Transfer(id); ok {
+			ex.transferUpdated(t)
+		}
+	}
+}
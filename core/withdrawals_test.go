@@ -0,0 +1,129 @@
+package core
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/EggsyOnCode/velho-exchange/auth"
+	"github.com/EggsyOnCode/velho-exchange/decimal"
+	"github.com/EggsyOnCode/velho-exchange/internals"
+	"github.com/EggsyOnCode/velho-exchange/ledger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithdrawalNeedsApproval(t *testing.T) {
+	ex := NewExchange()
+	user := auth.NewUser(nil, decimal.FromInt(1_000))
+	ex.AddUser(user)
+	userID := user.ID.String()
+	address := internals.GetAddress(internals.GenerateNewPrivateKey()).Hex()
+
+	w, err := ex.RequestWithdrawal(userID, AssetUSD, decimal.FromInt(400), address)
+	require.NoError(t, err)
+	assert.Equal(t, WithdrawalRequested, w.Status)
+	assert.Equal(t, ledger.Balance{Available: decimal.FromInt(600), Locked: decimal.FromInt(400)}, ex.Ledger.Balance(userID, AssetUSD))
+	assert.Equal(t, decimal.FromInt(600), user.USD)
+
+	// the locked amount can't be withdrawn twice
+	_, err = ex.RequestWithdrawal(userID, AssetUSD, decimal.FromInt(700), "")
+	assert.ErrorIs(t, err, ErrInsufficientFunds)
+	_, err = ex.RequestWithdrawal(userID, AssetUSD, decimal.FromInt(1), "not an address")
+	assert.Error(t, err)
+
+	w, err = ex.ApproveWithdrawal(w.ID)
+	require.NoError(t, err)
+	assert.Equal(t, WithdrawalApproved, w.Status)
+	_, err = ex.ApproveWithdrawal(w.ID)
+	assert.ErrorIs(t, err, ErrWithdrawalState)
+
+	ex.WaitSettled()
+	w, ok := ex.Withdrawal(w.ID)
+	require.True(t, ok)
+	assert.Equal(t, WithdrawalConfirmed, w.Status)
+	assert.NotEmpty(t, w.TxID)
+	assert.Equal(t, ledger.Balance{Available: decimal.FromInt(600)}, ex.Ledger.Balance(userID, AssetUSD))
+	assert.Equal(t, decimal.FromInt(400), ex.Settlement(AssetUSD).(*MemorySettlement).Wallet(address))
+	assert.NoError(t, ex.Ledger.Check())
+}
+
+func TestWithdrawalRejected(t *testing.T) {
+	ex := NewExchange()
+	user := auth.NewUser(nil, decimal.FromInt(1_000))
+	ex.AddUser(user)
+
+	w, err := ex.RequestWithdrawal(user.ID.String(), AssetUSD, decimal.FromInt(400), "")
+	require.NoError(t, err)
+
+	w, err = ex.RejectWithdrawal(w.ID, "unusual activity")
+	require.NoError(t, err)
+	assert.Equal(t, WithdrawalRejected, w.Status)
+	assert.Equal(t, "unusual activity", w.Reason)
+	assert.Equal(t, decimal.FromInt(1_000), user.USD)
+
+	_, err = ex.ApproveWithdrawal(w.ID)
+	assert.ErrorIs(t, err, ErrWithdrawalState)
+	_, err = ex.RejectWithdrawal(42, "")
+	assert.ErrorIs(t, err, ErrWithdrawalNotFound)
+	assert.Empty(t, ex.Transfers(user.ID.String()))
+}
+
+func TestWithdrawalLimits(t *testing.T) {
+	ex := NewExchange()
+	ex.SetWithdrawalLimits(AssetUSD, WithdrawalLimits{
+		MaxAmount:         decimal.FromInt(500),
+		DailyLimit:        decimal.FromInt(800),
+		ApprovalThreshold: decimal.FromInt(100),
+	})
+	user := auth.NewUser(nil, decimal.FromInt(10_000))
+	ex.AddUser(user)
+	userID := user.ID.String()
+
+	_, err := ex.RequestWithdrawal(userID, AssetUSD, decimal.FromInt(501), "")
+	assert.ErrorIs(t, err, ErrWithdrawalLimit)
+
+	// small withdrawals don't wait for an admin
+	small, err := ex.RequestWithdrawal(userID, AssetUSD, decimal.FromInt(100), "")
+	require.NoError(t, err)
+	assert.Equal(t, WithdrawalApproved, small.Status)
+
+	large, err := ex.RequestWithdrawal(userID, AssetUSD, decimal.FromInt(500), "")
+	require.NoError(t, err)
+	assert.Equal(t, WithdrawalRequested, large.Status)
+
+	_, err = ex.RequestWithdrawal(userID, AssetUSD, decimal.FromInt(201), "")
+	assert.ErrorIs(t, err, ErrWithdrawalLimit)
+
+	// a rejected withdrawal no longer counts against the daily limit
+	_, err = ex.RejectWithdrawal(large.ID, "")
+	require.NoError(t, err)
+	_, err = ex.RequestWithdrawal(userID, AssetUSD, decimal.FromInt(201), "")
+	assert.NoError(t, err)
+
+	assert.Len(t, ex.Withdrawals(userID, WithdrawalRequested), 1)
+	assert.Len(t, ex.Withdrawals("", ""), 3)
+}
+
+func TestFailedWithdrawalCreditedBack(t *testing.T) {
+	ex := NewExchange()
+	ex.SetSettlementConfig(SettlementConfig{MaxBatch: 10, MaxAttempts: 2, Backoff: time.Millisecond, MaxBackoff: time.Millisecond, PollInterval: time.Millisecond})
+	backend := &blockingSettlement{release: make(chan struct{}), fail: errors.New("insufficient funds for gas")}
+	close(backend.release)
+	ex.RegisterSettlement(AssetUSD, backend)
+
+	user := auth.NewUser(nil, decimal.FromInt(1_000))
+	ex.AddUser(user)
+
+	w, err := ex.RequestWithdrawal(user.ID.String(), AssetUSD, decimal.FromInt(400), "")
+	require.NoError(t, err)
+	_, err = ex.ApproveWithdrawal(w.ID)
+	require.NoError(t, err)
+	ex.WaitSettled()
+
+	w, _ = ex.Withdrawal(w.ID)
+	assert.Equal(t, WithdrawalFailed, w.Status)
+	assert.Equal(t, "insufficient funds for gas", w.Reason)
+	assert.Equal(t, ledger.Balance{Available: decimal.FromInt(1_000)}, ex.Ledger.Balance(user.ID.String(), AssetUSD))
+	assert.NoError(t, ex.Ledger.Check())
+}
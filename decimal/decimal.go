@@ -0,0 +1,285 @@
+package decimal
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"math/bits"
+	"strconv"
+	"strings"
+)
+
+// Decimal is a fixed-point number with Precision decimal places, stored as an
+// integer count of 10^-Precision units. Prices, sizes and balances all use it
+// so that equal values always compare (and hash) equal and sums never drift.
+type Decimal int64
+
+const (
+	// number of decimal places every Decimal carries
+	Precision = 8
+	scale     = 100_000_000
+)
+
+const (
+	Zero Decimal = 0
+	One  Decimal = scale
+)
+
+// FromInt returns the Decimal representing the integer v
+func FromInt(v int64) Decimal {
+	return Decimal(v * scale)
+}
+
+// FromFloat rounds f to the nearest Decimal, it should only be used at the
+// boundaries of the system (e.g. balances read from the chain)
+func FromFloat(f float64) Decimal {
+	return Decimal(math.Round(f * scale))
+}
+
+// NewFromString parses a plain decimal string such as "1000", "-0.5" or "12.34567".
+// Values with more than Precision decimal places are rejected rather than rounded.
+func NewFromString(s string) (Decimal, error) {
+	str := strings.TrimSpace(s)
+	if str == "" {
+		return Zero, fmt.Errorf("decimal: empty string")
+	}
+
+	neg := false
+	switch str[0] {
+	case '-':
+		neg = true
+		str = str[1:]
+	case '+':
+		str = str[1:]
+	}
+
+	intPart, fracPart, hasDot := strings.Cut(str, ".")
+	if intPart == "" && (!hasDot || fracPart == "") {
+		return Zero, fmt.Errorf("decimal: invalid value %q", s)
+	}
+	if len(fracPart) > Precision {
+		return Zero, fmt.Errorf("decimal: %q has more than %d decimal places", s, Precision)
+	}
+
+	var units uint64
+	for _, c := range intPart + fracPart + strings.Repeat("0", Precision-len(fracPart)) {
+		if c < '0' || c > '9' {
+			return Zero, fmt.Errorf("decimal: invalid value %q", s)
+		}
+
+		hi, lo := bits.Mul64(units, 10)
+		lo, carry := bits.Add64(lo, uint64(c-'0'), 0)
+		if hi != 0 || carry != 0 || lo > math.MaxInt64 {
+			return Zero, fmt.Errorf("decimal: %q is out of range", s)
+		}
+		units = lo
+	}
+
+	if neg {
+		return Decimal(-int64(units)), nil
+	}
+	return Decimal(units), nil
+}
+
+// RequireFromString is like NewFromString but panics on invalid input,
+// it is meant for constants and tests
+func RequireFromString(s string) Decimal {
+	d, err := NewFromString(s)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+func (d Decimal) Add(o Decimal) Decimal {
+	return d + o
+}
+
+func (d Decimal) Sub(o Decimal) Decimal {
+	return d - o
+}
+
+func (d Decimal) Neg() Decimal {
+	return -d
+}
+
+// Mul returns d * o truncated towards zero to Precision decimal places.
+// The product is computed on 128 bits so it panics only if the result itself
+// doesn't fit in a Decimal.
+func (d Decimal) Mul(o Decimal) Decimal {
+	p, ok := d.MulChecked(o)
+	if !ok {
+		panic(fmt.Sprintf("decimal: overflow in %s * %s", d, o))
+	}
+	return p
+}
+
+// MulChecked is Mul for untrusted operands, it returns false instead of
+// panicking if the product doesn't fit in a Decimal
+func (d Decimal) MulChecked(o Decimal) (Decimal, bool) {
+	neg := (d < 0) != (o < 0)
+
+	hi, lo := bits.Mul64(abs(d), abs(o))
+	if hi >= scale {
+		return 0, false
+	}
+	q, _ := bits.Div64(hi, lo, scale)
+	if q > math.MaxInt64 {
+		return 0, false
+	}
+
+	return fromUnits(q, neg, d, o, "*"), true
+}
+
+// Div returns d / o truncated towards zero to Precision decimal places
+func (d Decimal) Div(o Decimal) Decimal {
+	if o == 0 {
+		panic("decimal: division by zero")
+	}
+	neg := (d < 0) != (o < 0)
+
+	hi, lo := bits.Mul64(abs(d), scale)
+	if hi >= abs(o) {
+		panic(fmt.Sprintf("decimal: overflow in %s / %s", d, o))
+	}
+	q, _ := bits.Div64(hi, lo, abs(o))
+
+	return fromUnits(q, neg, d, o, "/")
+}
+
+// IsMultipleOf reports whether d is an exact multiple of step (e.g. a tick or lot size)
+func (d Decimal) IsMultipleOf(step Decimal) bool {
+	if step == 0 {
+		return true
+	}
+	return d%step == 0
+}
+
+// TruncateTo rounds d towards zero to a multiple of step (e.g. down to a whole lot)
+func (d Decimal) TruncateTo(step Decimal) Decimal {
+	if step == 0 {
+		return d
+	}
+	return d - d%step
+}
+
+func (d Decimal) Cmp(o Decimal) int {
+	switch {
+	case d < o:
+		return -1
+	case d > o:
+		return 1
+	}
+	return 0
+}
+
+func (d Decimal) Sign() int {
+	return d.Cmp(Zero)
+}
+
+func (d Decimal) IsZero() bool {
+	return d == 0
+}
+
+func (d Decimal) IsPositive() bool {
+	return d > 0
+}
+
+func (d Decimal) IsNegative() bool {
+	return d < 0
+}
+
+func (d Decimal) Abs() Decimal {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+func Min(a, b Decimal) Decimal {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func Max(a, b Decimal) Decimal {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// Float64 returns the nearest float64, it is lossy and only meant for logging
+// and for talking to APIs that want floats
+func (d Decimal) Float64() float64 {
+	return float64(d) / scale
+}
+
+// BigFloat returns the exact value of d as a big.Float
+func (d Decimal) BigFloat() *big.Float {
+	return new(big.Float).Quo(new(big.Float).SetInt64(int64(d)), new(big.Float).SetInt64(scale))
+}
+
+// String returns the shortest plain representation of d, e.g. "1000", "0.01", "-2.5"
+func (d Decimal) String() string {
+	u := abs(d)
+	s := strconv.FormatUint(u/scale, 10)
+
+	if frac := u % scale; frac != 0 {
+		fs := strconv.FormatUint(frac, 10)
+		fs = strings.Repeat("0", Precision-len(fs)) + fs
+		s += "." + strings.TrimRight(fs, "0")
+	}
+
+	if d < 0 {
+		return "-" + s
+	}
+	return s
+}
+
+// decimals are sent over the wire as strings so that no precision is lost in
+// clients that parse JSON numbers as floats
+func (d Decimal) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// both "12.5" and 12.5 are accepted, in either case the literal is parsed exactly
+func (d *Decimal) UnmarshalJSON(b []byte) error {
+	str := string(b)
+	if str == "null" {
+		return nil
+	}
+
+	if strings.HasPrefix(str, `"`) {
+		if err := json.Unmarshal(b, &str); err != nil {
+			return err
+		}
+	}
+
+	v, err := NewFromString(str)
+	if err != nil {
+		return err
+	}
+
+	*d = v
+	return nil
+}
+
+func abs(d Decimal) uint64 {
+	if d < 0 {
+		return uint64(-d)
+	}
+	return uint64(d)
+}
+
+func fromUnits(q uint64, neg bool, a, b Decimal, op string) Decimal {
+	if q > math.MaxInt64 {
+		panic(fmt.Sprintf("decimal: overflow in %s %s %s", a, op, b))
+	}
+	if neg {
+		return Decimal(-int64(q))
+	}
+	return Decimal(q)
+}
@@ -0,0 +1,93 @@
+package decimal
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewFromString(t *testing.T) {
+	cases := map[string]Decimal{
+		"0":          Zero,
+		"1000":       FromInt(1000),
+		"0.01":       Decimal(1_000_000),
+		"-2.5":       Decimal(-250_000_000),
+		"+.5":        Decimal(50_000_000),
+		"0.00000001": Decimal(1),
+		"12.":        FromInt(12),
+	}
+
+	for in, expected := range cases {
+		d, err := NewFromString(in)
+		require.NoError(t, err, in)
+		assert.Equal(t, expected, d, in)
+	}
+
+	for _, in := range []string{"", "-", ".", "1.2.3", "abc", "1e3", "0.000000001", "100000000000000000000"} {
+		_, err := NewFromString(in)
+		assert.Error(t, err, in)
+	}
+}
+
+func TestString(t *testing.T) {
+	assert.Equal(t, "1000", FromInt(1000).String())
+	assert.Equal(t, "0.01", RequireFromString("0.010").String())
+	assert.Equal(t, "-2.5", RequireFromString("-2.5").String())
+	assert.Equal(t, "0.00000001", Decimal(1).String())
+	assert.Equal(t, "0", Zero.String())
+}
+
+func TestArithmeticIsExact(t *testing.T) {
+	// 0.1 + 0.2 is the classic float64 drift
+	assert.Equal(t, RequireFromString("0.3"), RequireFromString("0.1").Add(RequireFromString("0.2")))
+
+	price := RequireFromString("1000.01")
+	size := RequireFromString("0.003")
+	assert.Equal(t, RequireFromString("3.00003"), price.Mul(size))
+	assert.Equal(t, RequireFromString("-3.00003"), price.Neg().Mul(size))
+
+	assert.Equal(t, RequireFromString("333.33333333"), FromInt(1000).Div(FromInt(3)))
+	assert.Equal(t, price, price.Mul(size).Div(size))
+
+	assert.Panics(t, func() { FromInt(1_000_000_000).Mul(FromInt(1_000_000_000)) })
+	_, ok := FromInt(1_000_000_000).MulChecked(FromInt(1_000_000_000))
+	assert.False(t, ok)
+	p, ok := price.MulChecked(size)
+	assert.True(t, ok)
+	assert.Equal(t, RequireFromString("3.00003"), p)
+	assert.Panics(t, func() { One.Div(Zero) })
+}
+
+func TestIsMultipleOf(t *testing.T) {
+	tick := RequireFromString("0.01")
+	assert.True(t, RequireFromString("1000.01").IsMultipleOf(tick))
+	assert.False(t, RequireFromString("1000.015").IsMultipleOf(tick))
+	assert.True(t, RequireFromString("1000.015").IsMultipleOf(Zero))
+}
+
+func TestTruncateTo(t *testing.T) {
+	lot := RequireFromString("0.001")
+	assert.Equal(t, RequireFromString("4.999"), RequireFromString("4.99987654").TruncateTo(lot))
+	assert.Equal(t, RequireFromString("-1.5"), RequireFromString("-1.5009").TruncateTo(lot))
+	assert.Equal(t, RequireFromString("1.23"), RequireFromString("1.23").TruncateTo(Zero))
+}
+
+func TestJSON(t *testing.T) {
+	b, err := json.Marshal(struct {
+		Price Decimal `json:"price"`
+	}{RequireFromString("1000.5")})
+	require.NoError(t, err)
+	assert.Equal(t, `{"price":"1000.5"}`, string(b))
+
+	var v struct {
+		A Decimal `json:"a"`
+		B Decimal `json:"b"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(`{"a":"0.1","b":0.1}`), &v))
+	assert.Equal(t, RequireFromString("0.1"), v.A)
+	assert.Equal(t, RequireFromString("0.1"), v.B)
+
+	assert.Error(t, json.Unmarshal([]byte(`{"a":"0.000000001"}`), &v))
+}
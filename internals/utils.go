@@ -77,16 +77,19 @@ func GetGasPrice() (float64, error) {
 
 // value will be sent in Wei
 func TransferETH(from *ecdsa.PrivateKey, to common.Address, valueInETH float64) error {
-	client, _ := NewEthClient()
+	client, err := NewEthClient()
+	if err != nil {
+		return err
+	}
 	fromAddr := GetAddress(from)
 	nonce, err := client.PendingNonceAt(context.Background(), fromAddr)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	gasLimit := uint64(21000) // in units
 	gasPrice, err := client.SuggestGasPrice(context.Background())
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
 	value := big.NewFloat(valueInETH)
@@ -102,7 +105,6 @@ func TransferETH(from *ecdsa.PrivateKey, to common.Address, valueInETH float64)
 
 	signedTx, err := types.SignTx(tx, types.NewEIP155Signer(chainID), from)
 	if err != nil {
-		log.Fatal(err)
 		return err
 	}
 
@@ -0,0 +1,460 @@
+package ledger
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/EggsyOnCode/velho-exchange/decimal"
+)
+
+var (
+	ErrInsufficientFunds = errors.New("insufficient funds")
+	ErrUnbalanced        = errors.New("transaction doesn't balance")
+)
+
+type (
+	Asset       string
+	AccountKind string
+	TxKind      string
+)
+
+const (
+	// free to trade or withdraw
+	Available AccountKind = "available"
+	// reserved by resting orders
+	Locked AccountKind = "locked"
+)
+
+// system owners, their accounts may go negative
+const (
+	// counterparty of every deposit and withdrawal: its balance is minus
+	// everything the exchange holds
+	External = "@external"
+	// collects trading fees
+	Fees = "@fees"
+)
+
+const (
+	KindDeposit    TxKind = "DEPOSIT"
+	KindWithdrawal TxKind = "WITHDRAWAL"
+	KindLock       TxKind = "LOCK"
+	KindUnlock     TxKind = "UNLOCK"
+	KindFill       TxKind = "FILL"
+	KindFee        TxKind = "FEE"
+)
+
+type Account struct {
+	Owner string      `json:"owner"`
+	Asset Asset       `json:"asset"`
+	Kind  AccountKind `json:"kind"`
+}
+
+func AvailableOf(owner string, asset Asset) Account {
+	return Account{Owner: owner, Asset: asset, Kind: Available}
+}
+
+func LockedOf(owner string, asset Asset) Account {
+	return Account{Owner: owner, Asset: asset, Kind: Locked}
+}
+
+func (a Account) isSystem() bool {
+	return a.Owner == External || a.Owner == Fees
+}
+
+// Posting credits Amount to Account, a negative amount is a debit
+type Posting struct {
+	Account Account         `json:"account"`
+	Amount  decimal.Decimal `json:"amount"`
+}
+
+// Transaction is one entry of the journal, its postings sum to zero for every asset
+type Transaction struct {
+	ID        uint64    `json:"id"`
+	Kind      TxKind    `json:"kind"`
+	Ref       string    `json:"ref"`
+	Timestamp int64     `json:"timestamp"`
+	Postings  []Posting `json:"postings"`
+}
+
+type Balance struct {
+	Available decimal.Decimal `json:"available"`
+	Locked    decimal.Decimal `json:"locked"`
+}
+
+// Ledger holds every balance the exchange keeps for its users. Balances only
+// change through balanced transactions appended to the journal, so the opening
+// balances plus the journal are enough to rebuild them (see Check). Compact
+// folds the journal into the opening balances.
+type Ledger struct {
+	mu       sync.Mutex
+	balances map[Account]decimal.Decimal
+	// balances as of transaction base, which the journal goes on from
+	opening  map[Account]decimal.Decimal
+	base     uint64
+	journal  []Transaction
+	onChange func(owner string, asset Asset, balance Balance)
+	// unix nanos transactions are stamped with
+	now func() int64
+}
+
+func New() *Ledger {
+	return &Ledger{
+		balances: make(map[Account]decimal.Decimal),
+		opening:  make(map[Account]decimal.Decimal),
+		now:      func() int64 { return time.Now().UnixNano() },
+	}
+}
+
+// SetClock makes transactions stamped with now instead of the wall clock, while
+// the ledger is locked
+func (l *Ledger) SetClock(now func() int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.now = now
+}
+
+// OnChange registers fn to be called with the new balance of every owner / asset
+// touched by a transaction, while the ledger is locked
+func (l *Ledger) OnChange(fn func(owner string, asset Asset, balance Balance)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.onChange = fn
+}
+
+// Post appends a transaction made of postings to the journal and applies it.
+// It's rejected as a whole if it doesn't balance for every asset or would leave
+// a user account negative.
+func (l *Ledger) Post(kind TxKind, ref string, postings ...Posting) (Transaction, error) {
+	if err := validate(postings); err != nil {
+		return Transaction{}, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	next := make(map[Account]decimal.Decimal, len(postings))
+	for _, p := range postings {
+		if _, ok := next[p.Account]; !ok {
+			next[p.Account] = l.balances[p.Account]
+		}
+		next[p.Account] = next[p.Account].Add(p.Amount)
+	}
+	for acc, bal := range next {
+		if bal.IsNegative() && !acc.isSystem() {
+			return Transaction{}, fmt.Errorf("%w: %s %s balance of %s would be %s", ErrInsufficientFunds, acc.Asset, acc.Kind, acc.Owner, bal)
+		}
+	}
+
+	tx := Transaction{
+		ID:        l.base + uint64(len(l.journal)) + 1,
+		Kind:      kind,
+		Ref:       ref,
+		Timestamp: l.now(),
+		Postings:  append([]Posting(nil), postings...),
+	}
+	l.journal = append(l.journal, tx)
+
+	for acc, bal := range next {
+		l.balances[acc] = bal
+	}
+	if l.onChange != nil {
+		for _, acc := range touched(postings) {
+			l.onChange(acc.Owner, acc.Asset, l.balance(acc.Owner, acc.Asset))
+		}
+	}
+
+	return tx, nil
+}
+
+// brings amount of asset into the exchange for owner
+func (l *Ledger) Deposit(owner string, asset Asset, amount decimal.Decimal, ref string) error {
+	if !amount.IsPositive() {
+		return fmt.Errorf("amount %s must be positive", amount)
+	}
+	_, err := l.Post(KindDeposit, ref,
+		Posting{AvailableOf(External, asset), amount.Neg()},
+		Posting{AvailableOf(owner, asset), amount},
+	)
+	return err
+}
+
+// takes amount of owner's available asset out of the exchange
+func (l *Ledger) Withdraw(owner string, asset Asset, amount decimal.Decimal, ref string) error {
+	if !amount.IsPositive() {
+		return fmt.Errorf("amount %s must be positive", amount)
+	}
+	_, err := l.Post(KindWithdrawal, ref,
+		Posting{AvailableOf(owner, asset), amount.Neg()},
+		Posting{AvailableOf(External, asset), amount},
+	)
+	return err
+}
+
+// reserves amount of owner's available asset, e.g. for a resting order
+func (l *Ledger) Lock(owner string, asset Asset, amount decimal.Decimal, ref string) error {
+	if !amount.IsPositive() {
+		return fmt.Errorf("amount %s must be positive", amount)
+	}
+	_, err := l.Post(KindLock, ref,
+		Posting{AvailableOf(owner, asset), amount.Neg()},
+		Posting{LockedOf(owner, asset), amount},
+	)
+	return err
+}
+
+// releases amount of owner's locked asset
+func (l *Ledger) Unlock(owner string, asset Asset, amount decimal.Decimal, ref string) error {
+	if !amount.IsPositive() {
+		return fmt.Errorf("amount %s must be positive", amount)
+	}
+	_, err := l.Post(KindUnlock, ref,
+		Posting{LockedOf(owner, asset), amount.Neg()},
+		Posting{AvailableOf(owner, asset), amount},
+	)
+	return err
+}
+
+// charges owner a fee of amount, taken from the given account
+func (l *Ledger) Fee(from Account, amount decimal.Decimal, ref string) error {
+	if !amount.IsPositive() {
+		return fmt.Errorf("amount %s must be positive", amount)
+	}
+	_, err := l.Post(KindFee, ref,
+		Posting{from, amount.Neg()},
+		Posting{AvailableOf(Fees, from.Asset), amount},
+	)
+	return err
+}
+
+func (l *Ledger) Balance(owner string, asset Asset) Balance {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.balance(owner, asset)
+}
+
+// every asset owner has (or had) a balance in
+func (l *Ledger) Balances(owner string) map[Asset]Balance {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	balances := make(map[Asset]Balance)
+	for acc := range l.balances {
+		if acc.Owner == owner {
+			balances[acc.Asset] = l.balance(owner, acc.Asset)
+		}
+	}
+	return balances
+}
+
+// HasAccount reports whether owner ever held any asset
+func (l *Ledger) HasAccount(owner string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for acc := range l.balances {
+		if acc.Owner == owner {
+			return true
+		}
+	}
+	return false
+}
+
+// Held returns the total amount of asset the exchange holds: every user's
+// available and locked balance plus collected fees
+func (l *Ledger) Held(asset Asset) decimal.Decimal {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.balances[AvailableOf(External, asset)].Neg()
+}
+
+// Journal returns a copy of every transaction since the ledger was last
+// compacted, oldest first
+func (l *Ledger) Journal() []Transaction {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]Transaction(nil), l.journal...)
+}
+
+// AccountBalance is the balance of one account in a Snapshot
+type AccountBalance struct {
+	Account Account         `json:"account"`
+	Balance decimal.Decimal `json:"balance"`
+}
+
+// Snapshot is the balance of every account as of a transaction, without the
+// journal they add up from
+type Snapshot struct {
+	Balances []AccountBalance `json:"balances"`
+	// ID of the last transaction, the journal goes on after it
+	LastTx uint64 `json:"last_tx"`
+}
+
+// Snapshot returns a copy of the ledger's state, accounts in a stable order
+func (l *Ledger) Snapshot() Snapshot {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	s := Snapshot{
+		Balances: make([]AccountBalance, 0, len(l.balances)),
+		LastTx:   l.base + uint64(len(l.journal)),
+	}
+	for acc, bal := range l.balances {
+		s.Balances = append(s.Balances, AccountBalance{Account: acc, Balance: bal})
+	}
+	sort.Slice(s.Balances, func(i, j int) bool {
+		a, b := s.Balances[i].Account, s.Balances[j].Account
+		if a.Owner != b.Owner {
+			return a.Owner < b.Owner
+		}
+		if a.Asset != b.Asset {
+			return a.Asset < b.Asset
+		}
+		return a.Kind < b.Kind
+	})
+
+	return s
+}
+
+// Restore replaces the ledger's state with s, which it opens with and an empty
+// journal. The new balance of every owner / asset in it is reported to OnChange.
+func (l *Ledger) Restore(s Snapshot) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.balances = make(map[Account]decimal.Decimal, len(s.Balances))
+	l.opening = make(map[Account]decimal.Decimal, len(s.Balances))
+	postings := make([]Posting, 0, len(s.Balances))
+	for _, b := range s.Balances {
+		l.balances[b.Account] = b.Balance
+		l.opening[b.Account] = b.Balance
+		postings = append(postings, Posting{Account: b.Account})
+	}
+	l.base = s.LastTx
+	l.journal = nil
+
+	if l.onChange != nil {
+		for _, acc := range touched(postings) {
+			l.onChange(acc.Owner, acc.Asset, l.balance(acc.Owner, acc.Asset))
+		}
+	}
+
+	return nil
+}
+
+// Compact folds the transactions up to and including ID through into the
+// opening balances and drops them from the journal
+func (l *Ledger) Compact(through uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	n := 0
+	for n < len(l.journal) && l.journal[n].ID <= through {
+		for _, p := range l.journal[n].Postings {
+			l.opening[p.Account] = l.opening[p.Account].Add(p.Amount)
+		}
+		n++
+	}
+	if n == 0 {
+		return
+	}
+	l.base = l.journal[n-1].ID
+	l.journal = append([]Transaction(nil), l.journal[n:]...)
+}
+
+// Check verifies the ledger's invariants: every transaction balances, replaying
+// the journal onto the opening balances gives back the current balances, no user account is negative and,
+// for every asset, what users and fees hold is exactly what was deposited minus
+// what was withdrawn (i.e. all accounts of an asset sum to zero).
+func (l *Ledger) Check() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	replayed := make(map[Account]decimal.Decimal, len(l.opening))
+	for acc, bal := range l.opening {
+		replayed[acc] = bal
+	}
+	for _, tx := range l.journal {
+		if err := validate(tx.Postings); err != nil {
+			return fmt.Errorf("transaction %d: %w", tx.ID, err)
+		}
+		for _, p := range tx.Postings {
+			replayed[p.Account] = replayed[p.Account].Add(p.Amount)
+		}
+	}
+
+	for acc, bal := range l.balances {
+		if replayed[acc] != bal {
+			return fmt.Errorf("%s %s balance of %s is %s, the journal says %s", acc.Asset, acc.Kind, acc.Owner, bal, replayed[acc])
+		}
+	}
+	for acc, bal := range replayed {
+		if l.balances[acc] != bal {
+			return fmt.Errorf("%s %s balance of %s is %s, the journal says %s", acc.Asset, acc.Kind, acc.Owner, l.balances[acc], bal)
+		}
+	}
+
+	totals := make(map[Asset]decimal.Decimal)
+	for acc, bal := range l.balances {
+		if bal.IsNegative() && !acc.isSystem() {
+			return fmt.Errorf("%s %s balance of %s is negative: %s", acc.Asset, acc.Kind, acc.Owner, bal)
+		}
+		totals[acc.Asset] = totals[acc.Asset].Add(bal)
+	}
+	for asset, total := range totals {
+		if !total.IsZero() {
+			return fmt.Errorf("%s isn't conserved, accounts sum to %s", asset, total)
+		}
+	}
+
+	return nil
+}
+
+func (l *Ledger) balance(owner string, asset Asset) Balance {
+	return Balance{
+		Available: l.balances[AvailableOf(owner, asset)],
+		Locked:    l.balances[LockedOf(owner, asset)],
+	}
+}
+
+func validate(postings []Posting) error {
+	if len(postings) == 0 {
+		return fmt.Errorf("%w: no postings", ErrUnbalanced)
+	}
+
+	sums := make(map[Asset]decimal.Decimal)
+	for _, p := range postings {
+		if p.Account.Owner == "" || p.Account.Asset == "" {
+			return fmt.Errorf("posting to an incomplete account %+v", p.Account)
+		}
+		sums[p.Account.Asset] = sums[p.Account.Asset].Add(p.Amount)
+	}
+	for asset, sum := range sums {
+		if !sum.IsZero() {
+			return fmt.Errorf("%w: %s postings sum to %s", ErrUnbalanced, asset, sum)
+		}
+	}
+	return nil
+}
+
+// distinct owner / asset pairs of postings, in a stable order
+func touched(postings []Posting) []Account {
+	seen := make(map[Account]bool)
+	var accounts []Account
+	for _, p := range postings {
+		acc := Account{Owner: p.Account.Owner, Asset: p.Account.Asset}
+		if !seen[acc] {
+			seen[acc] = true
+			accounts = append(accounts, acc)
+		}
+	}
+	sort.Slice(accounts, func(i, j int) bool {
+		if accounts[i].Owner != accounts[j].Owner {
+			return accounts[i].Owner < accounts[j].Owner
+		}
+		return accounts[i].Asset < accounts[j].Asset
+	})
+	return accounts
+}
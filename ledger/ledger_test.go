@@ -0,0 +1,163 @@
+package ledger
+
+import (
+	"testing"
+
+	"github.com/EggsyOnCode/velho-exchange/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPostRejectsUnbalancedTransactions(t *testing.T) {
+	l := New()
+
+	_, err := l.Post(KindFill, "unbalanced",
+		Posting{AvailableOf("alice", "USD"), decimal.FromInt(10)},
+		Posting{AvailableOf("bob", "USD"), decimal.FromInt(-9)},
+	)
+	assert.ErrorIs(t, err, ErrUnbalanced)
+
+	// each asset has to balance on its own
+	_, err = l.Post(KindFill, "cross asset",
+		Posting{AvailableOf("alice", "USD"), decimal.FromInt(10)},
+		Posting{AvailableOf("bob", "ETH"), decimal.FromInt(-10)},
+	)
+	assert.ErrorIs(t, err, ErrUnbalanced)
+
+	assert.Empty(t, l.Journal())
+}
+
+func TestPostIsAtomic(t *testing.T) {
+	l := New()
+	require.NoError(t, l.Deposit("alice", "USD", decimal.FromInt(100), "deposit"))
+	require.NoError(t, l.Deposit("bob", "ETH", decimal.FromInt(1), "deposit"))
+
+	// bob can't pay, so alice isn't debited either
+	_, err := l.Post(KindFill, "fill",
+		Posting{AvailableOf("alice", "USD"), decimal.FromInt(-100)},
+		Posting{AvailableOf("bob", "USD"), decimal.FromInt(100)},
+		Posting{AvailableOf("bob", "ETH"), decimal.FromInt(-2)},
+		Posting{AvailableOf("alice", "ETH"), decimal.FromInt(2)},
+	)
+	assert.ErrorIs(t, err, ErrInsufficientFunds)
+	assert.Equal(t, Balance{Available: decimal.FromInt(100)}, l.Balance("alice", "USD"))
+	assert.Equal(t, Balance{Available: decimal.FromInt(1)}, l.Balance("bob", "ETH"))
+	assert.Len(t, l.Journal(), 2)
+}
+
+func TestLockUnlockAndWithdraw(t *testing.T) {
+	l := New()
+	require.NoError(t, l.Deposit("alice", "USD", decimal.FromInt(100), "deposit"))
+
+	require.NoError(t, l.Lock("alice", "USD", decimal.FromInt(60), "order"))
+	assert.Equal(t, Balance{Available: decimal.FromInt(40), Locked: decimal.FromInt(60)}, l.Balance("alice", "USD"))
+
+	// locked funds can't be withdrawn or locked twice
+	assert.ErrorIs(t, l.Withdraw("alice", "USD", decimal.FromInt(50), "withdrawal"), ErrInsufficientFunds)
+	assert.ErrorIs(t, l.Lock("alice", "USD", decimal.FromInt(50), "order"), ErrInsufficientFunds)
+
+	require.NoError(t, l.Unlock("alice", "USD", decimal.FromInt(20), "cancel"))
+	require.NoError(t, l.Withdraw("alice", "USD", decimal.FromInt(50), "withdrawal"))
+	assert.Equal(t, Balance{Available: decimal.FromInt(10), Locked: decimal.FromInt(40)}, l.Balance("alice", "USD"))
+	assert.Equal(t, decimal.FromInt(50), l.Held("USD"))
+
+	assert.Error(t, l.Lock("alice", "USD", decimal.Zero, "order"))
+	assert.NoError(t, l.Check())
+}
+
+func TestFeeAndBalances(t *testing.T) {
+	l := New()
+	require.NoError(t, l.Deposit("alice", "USD", decimal.FromInt(100), "deposit"))
+	require.NoError(t, l.Deposit("alice", "ETH", decimal.FromInt(2), "deposit"))
+
+	require.NoError(t, l.Fee(AvailableOf("alice", "USD"), decimal.RequireFromString("0.5"), "fill"))
+	assert.Equal(t, Balance{Available: decimal.RequireFromString("0.5")}, l.Balance(Fees, "USD"))
+
+	assert.Equal(t, map[Asset]Balance{
+		"USD": {Available: decimal.RequireFromString("99.5")},
+		"ETH": {Available: decimal.FromInt(2)},
+	}, l.Balances("alice"))
+	assert.True(t, l.HasAccount("alice"))
+	assert.False(t, l.HasAccount("bob"))
+
+	// fees stay on the exchange
+	assert.Equal(t, decimal.FromInt(100), l.Held("USD"))
+	assert.NoError(t, l.Check())
+}
+
+func TestOnChangeReportsTouchedBalances(t *testing.T) {
+	l := New()
+	changed := make(map[string]Balance)
+	l.OnChange(func(owner string, asset Asset, balance Balance) {
+		changed[owner+"/"+string(asset)] = balance
+	})
+
+	require.NoError(t, l.Deposit("alice", "USD", decimal.FromInt(100), "deposit"))
+	require.NoError(t, l.Lock("alice", "USD", decimal.FromInt(30), "order"))
+
+	assert.Equal(t, Balance{Available: decimal.FromInt(70), Locked: decimal.FromInt(30)}, changed["alice/USD"])
+	assert.Equal(t, Balance{Available: decimal.FromInt(-100)}, changed[External+"/USD"])
+}
+
+func TestCheckDetectsTampering(t *testing.T) {
+	l := New()
+	require.NoError(t, l.Deposit("alice", "USD", decimal.FromInt(100), "deposit"))
+	require.NoError(t, l.Check())
+
+	// a balance changed outside of a transaction
+	l.balances[AvailableOf("alice", "USD")] = decimal.FromInt(150)
+	assert.Error(t, l.Check())
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	l := New()
+	l.SetClock(func() int64 { return 42 })
+	require.NoError(t, l.Deposit("alice", "USD", decimal.FromInt(100), "deposit"))
+	require.NoError(t, l.Lock("alice", "USD", decimal.FromInt(30), "order"))
+	assert.Equal(t, int64(42), l.Journal()[0].Timestamp)
+
+	restored := New()
+	var changed []Balance
+	restored.OnChange(func(owner string, asset Asset, balance Balance) {
+		if owner == "alice" {
+			changed = append(changed, balance)
+		}
+	})
+	require.NoError(t, restored.Restore(l.Snapshot()))
+
+	assert.Equal(t, l.Snapshot(), restored.Snapshot())
+	assert.Equal(t, []Balance{{Available: decimal.FromInt(70), Locked: decimal.FromInt(30)}}, changed)
+	assert.NoError(t, restored.Check())
+	// the snapshot doesn't carry the journal
+	assert.Empty(t, restored.Journal())
+
+	// the journal goes on where it left off
+	require.NoError(t, restored.Unlock("alice", "USD", decimal.FromInt(30), "order"))
+	assert.Equal(t, uint64(3), restored.Journal()[0].ID)
+	assert.NoError(t, restored.Check())
+}
+
+func TestCompact(t *testing.T) {
+	l := New()
+	require.NoError(t, l.Deposit("alice", "USD", decimal.FromInt(100), "deposit"))
+	require.NoError(t, l.Lock("alice", "USD", decimal.FromInt(30), "order"))
+	require.NoError(t, l.Withdraw("alice", "USD", decimal.FromInt(20), "withdrawal"))
+
+	l.Compact(2)
+	require.Len(t, l.Journal(), 1)
+	assert.Equal(t, uint64(3), l.Journal()[0].ID)
+	assert.NoError(t, l.Check())
+
+	l.Compact(3)
+	assert.Empty(t, l.Journal())
+	assert.NoError(t, l.Check())
+	assert.Equal(t, uint64(3), l.Snapshot().LastTx)
+
+	require.NoError(t, l.Unlock("alice", "USD", decimal.FromInt(30), "order"))
+	assert.Equal(t, uint64(4), l.Journal()[0].ID)
+	assert.NoError(t, l.Check())
+
+	// tampering still shows against the opening balances
+	l.balances[AvailableOf("alice", "USD")] = decimal.FromInt(150)
+	assert.Error(t, l.Check())
+}
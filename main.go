@@ -1,26 +1,104 @@
 package main
 
 import (
+	"log"
 	"math/rand/v2"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/EggsyOnCode/velho-exchange/api"
 	"github.com/EggsyOnCode/velho-exchange/client"
 	"github.com/EggsyOnCode/velho-exchange/core"
+	"github.com/EggsyOnCode/velho-exchange/decimal"
+	"github.com/EggsyOnCode/velho-exchange/internals"
 	mm "github.com/EggsyOnCode/velho-exchange/market_maker"
+	"github.com/ethereum/go-ethereum/common"
 )
 
 const (
 	ethPrice = 1000.0
+	// transfers still to be settled survive restarts here
+	settlementJournal = "settlement.jsonl"
+	// every command the exchange accepted, replayed on boot
+	commandLog = "commands.wal"
+	// the exchange's state as of a command of the log, so boot only replays what came after
+	snapshotFile = "snapshot.json"
+	// blocks on top of a deposit before it's credited
+	ethConfirmations = 3
+	// what users' keys are encrypted with
+	keystorePassphraseEnv = "VELHO_KEYSTORE_PASSPHRASE"
+	// comma separated addresses of the keys that can sign /admin requests
+	adminAddressesEnv = "VELHO_ADMIN_ADDRESSES"
 )
 
-func startServer() {
+// starts the exchange and serves its API, the exchange is returned so the demo
+// can fund its users
+func startServer() *core.Exchange {
 	exchange := core.NewExchange()
+	keystoreConfig := core.DefaultKeystoreConfig
+	keystoreConfig.Passphrase = os.Getenv(keystorePassphraseEnv)
+	if keystoreConfig.Passphrase == "" {
+		log.Fatalf("%s isn't set", keystorePassphraseEnv)
+	}
+	if err := exchange.ConfigureKeystore(keystoreConfig); err != nil {
+		log.Fatal(err)
+	}
+	// ETH moves on the dev chain, every other asset is settled in memory
+	ethClient, err := internals.NewEthClient()
+	if err != nil {
+		log.Fatal(err)
+	}
+	exchange.RegisterSettlement(core.AssetETH, core.NewEthSettlement(ethClient, exchange.PrivateKey, exchange.Keystore()))
+	if err := exchange.OpenSettlementJournal(settlementJournal); err != nil {
+		log.Fatal(err)
+	}
+	// without a node the exchange still runs, it just doesn't see deposits
+	if err := exchange.WatchDeposits(core.AssetETH, core.NewEthDeposits(ethClient), ethConfirmations); err != nil {
+		log.Printf("not watching ETH deposits: %v", err)
+	}
+	for _, market := range []core.Market{core.ETH, core.BTC} {
+		exchange.SetFeeSchedule(market, core.DefaultFeeSchedule)
+		exchange.SetRiskLimits(market, core.DefaultRiskLimits)
+	}
+	// books and balances are rebuilt from the snapshot and log, so they're opened
+	// once everything above is configured the way it was when the log was started
+	if err := exchange.Recover(snapshotFile, commandLog, core.DefaultWALConfig); err != nil {
+		log.Fatal(err)
+	}
+	exchange.StartSnapshotter(time.Minute)
+	exchange.StartDepositWatcher(2 * time.Second)
+	exchange.StartExpirer(1 * time.Second)
+	exchange.StartDepthSnapshots(5 * time.Second)
 	server := api.NewServer(exchange)
-	server.Start(":3000")
+	var admins []common.Address
+	for _, address := range strings.Split(os.Getenv(adminAddressesEnv), ",") {
+		if address = strings.TrimSpace(address); address == "" {
+			continue
+		}
+		if !common.IsHexAddress(address) {
+			log.Fatalf("%s: invalid address %q", adminAddressesEnv, address)
+		}
+		admins = append(admins, common.HexToAddress(address))
+	}
+	if len(admins) == 0 {
+		log.Printf("%s isn't set, admin requests are refused", adminAddressesEnv)
+	}
+	server.SetAdmins(admins...)
+	go server.Start(":3000")
+
+	return exchange
+}
+
+// credits what a demo user trades with, once per user and asset: the deposit is
+// identified by both so a restart doesn't credit it again
+func fund(exchange *core.Exchange, userID string, asset core.Asset, amount decimal.Decimal) {
+	if err := exchange.CreditDeposit(userID, asset, amount, "demo-"+string(asset)+"-"+userID); err != nil {
+		log.Printf("funding %s: %v", userID, err)
+	}
 }
 
-func initMMs(c *client.Client) []string {
+func initMMs(c *client.Client, exchange *core.Exchange) []string {
 
 	pvkeys := []string{
 		"2a871d0798f97d79848a013d4936a73bf4cc922c825d33c1cf7073dff6d409c6",
@@ -28,10 +106,11 @@ func initMMs(c *client.Client) []string {
 		"dbda1821b80551c9d65939329250298aa3472ba22feea921c0cf5d620ea67b97",
 	}
 
-	usd := 100_000_000.0
 	users := make([]string, 0)
 	for i := 0; i < len(pvkeys); i++ {
-		userId := c.RegisterUser(pvkeys[i], usd)
+		userId := c.RegisterUser(pvkeys[i])
+		fund(exchange, userId, core.AssetUSD, decimal.FromInt(100_000_000))
+		fund(exchange, userId, core.AssetETH, decimal.FromInt(100_000))
 		users = append(users, userId)
 	}
 
@@ -40,21 +119,21 @@ func initMMs(c *client.Client) []string {
 
 func main() {
 
-	go startServer()
+	exchange := startServer()
 	time.Sleep(1 * time.Second)
 	client := client.NewClient()
-	mmUsers := initMMs(client)
+	mmUsers := initMMs(client, exchange)
 
 	time.Sleep(1 * time.Second)
 
 	cfg := mm.Config{
 		UserID:         mmUsers[0],
-		OrderSize:      100,
+		OrderSize:      decimal.FromInt(100),
 		MarketInterval: 1 * time.Second,
-		SeedOffset:     40,
+		SeedOffset:     decimal.FromInt(40),
 		ExClient:       client,
-		MinSpread:      20,
-		PriceOffset:    10,
+		MinSpread:      decimal.FromInt(20),
+		PriceOffset:    decimal.FromInt(10),
 	}
 
 	mm := mm.NewMarketMaker(cfg)
@@ -62,15 +141,17 @@ func main() {
 
 	time.Sleep(2 * time.Second)
 
-	go marketPlacer(client)
+	go marketPlacer(client, exchange)
 
 	select {}
 }
 
-func marketPlacer(client *client.Client) {
+func marketPlacer(client *client.Client, exchange *core.Exchange) {
 	ticker := time.NewTicker(3 * time.Second)
 	userPk := "5de4111afa1a4b94908f83103eb1f1706367c2e68ca870fc3fb9a804cdab365a"
-	user := client.RegisterUser(userPk, 100_000.0)
+	user := client.RegisterUser(userPk)
+	fund(exchange, user, core.AssetUSD, decimal.FromInt(100_000))
+	fund(exchange, user, core.AssetETH, decimal.FromInt(1_000))
 
 	for {
 		randInt := rand.IntN(10)
@@ -84,8 +165,8 @@ func marketPlacer(client *client.Client) {
 			bid = true
 		}
 		// price doesn't matter in market orders
-		client.PlaceOrder("MARKET", 0, 3, bid, "ETH", user)
-		client.PlaceOrder("MARKET", 0, 4, bid, "ETH", user)
+		client.PlaceOrder("MARKET", decimal.Zero, decimal.FromInt(3), bid, "ETH", user)
+		client.PlaceOrder("MARKET", decimal.Zero, decimal.FromInt(4), bid, "ETH", user)
 
 		<-ticker.C
 	}
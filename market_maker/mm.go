@@ -1,31 +1,39 @@
 package mm
 
 import (
+	"errors"
+	"net/http"
 	"time"
 
+	"github.com/EggsyOnCode/velho-exchange/api/handlers"
 	"github.com/EggsyOnCode/velho-exchange/client"
+	"github.com/EggsyOnCode/velho-exchange/core"
+	"github.com/EggsyOnCode/velho-exchange/decimal"
 	"github.com/sirupsen/logrus"
 )
 
 type Config struct {
 	UserID         string
 	MarketInterval time.Duration
-	OrderSize      int64
+	OrderSize      decimal.Decimal
 	// 2x of price offset
-	MinSpread      int64
-	SeedOffset     float64
-	ExClient       *client.Client
-	PriceOffset    float64
+	MinSpread   decimal.Decimal
+	SeedOffset  decimal.Decimal
+	ExClient    *client.Client
+	PriceOffset decimal.Decimal
 }
 
 type MarketMaker struct {
 	userID         string
 	marketInterval time.Duration
-	orderSize      int64
-	minSpread      int64
-	seedOffset     float64
-	priceOffset    float64
+	orderSize      decimal.Decimal
+	minSpread      decimal.Decimal
+	seedOffset     decimal.Decimal
+	priceOffset    decimal.Decimal
 	exClient       *client.Client
+	// IDs of our current quotes, they're amended in place rather than re-placed
+	bidQuoteID string
+	askQuoteID string
 }
 
 func NewMarketMaker(cfg Config) *MarketMaker {
@@ -44,9 +52,9 @@ func (mm *MarketMaker) Start() {
 
 	logrus.WithFields(logrus.Fields{
 		"userId":         mm.userID,
-		"orderSize":      mm.orderSize,
-		"seedOffset":     mm.seedOffset,
-		"minSpread":      mm.minSpread,
+		"orderSize":      mm.orderSize.String(),
+		"seedOffset":     mm.seedOffset.String(),
+		"minSpread":      mm.minSpread.String(),
 		"marketInterval": mm.marketInterval,
 	}).Info("market maker starting ")
 
@@ -61,19 +69,19 @@ func (mm *MarketMaker) makerLoop() {
 		bestBid := mm.exClient.GetBestBidPrice("ETH")
 		bestAsk := mm.exClient.GetBestAskPrice("ETH")
 
-		if bestBid == 0 && bestAsk == 0 {
+		if bestBid.IsZero() && bestAsk.IsZero() {
 			mm.seedMarket()
 			continue
 		}
 
-		spread := bestAsk - bestBid
-		if spread <= float64(mm.minSpread) {
+		spread := bestAsk.Sub(bestBid)
+		if spread.Cmp(mm.minSpread) <= 0 {
 			continue
 		}
 
 		// market making strategy : Tightening the Spread
-		mm.exClient.PlaceOrder("LIMIT", bestBid+mm.priceOffset, mm.orderSize, true, "ETH", mm.userID)
-		mm.exClient.PlaceOrder("LIMIT", bestAsk-mm.priceOffset, mm.orderSize, false, "ETH", mm.userID)
+		mm.placeQuote(bestBid.Add(mm.priceOffset), true)
+		mm.placeQuote(bestAsk.Sub(mm.priceOffset), false)
 
 		<-ticker.C
 	}
@@ -83,15 +91,74 @@ func (mm *MarketMaker) seedMarket() {
 	price := simulateFetchCurrentEthPrice()
 
 	//bid
-	mm.exClient.PlaceOrder("LIMIT", price-(mm.seedOffset), mm.orderSize, true, "ETH", mm.userID)
+	mm.exClient.PlaceOrder("LIMIT", price.Sub(mm.seedOffset), mm.orderSize, true, "ETH", mm.userID)
 
 	// ask
-	mm.exClient.PlaceOrder("LIMIT", price+(mm.seedOffset), mm.orderSize, false, "ETH", mm.userID)
+	mm.exClient.PlaceOrder("LIMIT", price.Add(mm.seedOffset), mm.orderSize, false, "ETH", mm.userID)
 
 }
 
+// quotes are post only, the maker should never take liquidity by accident
+// (e.g. when the book moved between reading the best prices and quoting),
+// nor trade with its own older quotes.
+// A quote that is still resting is moved with a single amend, so there's no
+// window without a quote; a new one is only placed once the old one is gone.
+func (mm *MarketMaker) placeQuote(price decimal.Decimal, bid bool) {
+	quoteID := &mm.askQuoteID
+	if bid {
+		quoteID = &mm.bidQuoteID
+	}
+
+	var apiErr *client.APIError
+	if *quoteID != "" {
+		err := mm.exClient.AmendOrder(*quoteID, string(core.ETH), price, mm.orderSize, mm.userID)
+		if err == nil {
+			return
+		}
+		if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound {
+			mm.logQuoteError(err, price, bid)
+			return
+		}
+		// filled or cancelled, a new quote takes its place
+		*quoteID = ""
+	}
+
+	id, err := mm.exClient.SubmitOrder(&handlers.PlaceOrderRequest{
+		OrderType: handlers.LimitOrder,
+		Price:     price,
+		Size:      mm.orderSize,
+		Bid:       bid,
+		Market:    core.ETH,
+		PostOnly:  true,
+		// a fresh quote replaces whatever is left of our stale one instead of trading with it
+		SelfTradePrevention: core.STPCancelOldest,
+	}, mm.userID)
+	if err != nil {
+		mm.logQuoteError(err, price, bid)
+		return
+	}
+	*quoteID = id
+}
+
+func (mm *MarketMaker) logQuoteError(err error, price decimal.Decimal, bid bool) {
+	var apiErr *client.APIError
+	if errors.As(err, &apiErr) && apiErr.Code == handlers.ErrCodePostOnlyWouldCross {
+		// the spread closed under us, we'll requote on the next tick
+		logrus.WithFields(logrus.Fields{
+			"price": price,
+			"bid":   bid,
+		}).Info("market maker quote would cross, skipping")
+		return
+	}
+
+	logrus.WithError(err).WithFields(logrus.Fields{
+		"price": price,
+		"bid":   bid,
+	}).Error("market maker quote failed")
+}
+
 // this function is used to simulate fetching the current ETH price
 // from a 3rd party exchagne
-func simulateFetchCurrentEthPrice() float64 {
-	return 1000.0
+func simulateFetchCurrentEthPrice() decimal.Decimal {
+	return decimal.FromInt(1000)
 }